@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+)
+
+// s3PutObjectAPI is the subset of the S3 client used to archive enriched metrics.
+type s3PutObjectAPI interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+func newS3Client(ctx context.Context, region string) (s3PutObjectAPI, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(cfg), nil
+}
+
+// archiveBuffer accumulates enriched metrics of one invocation as JSON lines of flatSample.
+type archiveBuffer struct {
+	buf   bytes.Buffer
+	count int
+}
+
+func (a *archiveBuffer) add(reqs []*metricsservicepb.ExportMetricsServiceRequest) error {
+	enc := json.NewEncoder(&a.buf)
+	for _, fs := range flattenSamples(reqs) {
+		if err := enc.Encode(fs); err != nil {
+			return err
+		}
+		a.count++
+	}
+	return nil
+}
+
+// archiveKey returns the S3 key for an invocation's archive, partitioned by UTC date (dt=YYYY-MM-DD)
+// so the objects can be queried as a Hive-style partitioned table.
+func archiveKey(prefix string, now time.Time, id string) string {
+	now = now.UTC()
+	return path.Join(prefix, "dt="+now.Format("2006-01-02"), fmt.Sprintf("%d-%s.jsonl", now.UnixNano(), id))
+}
+
+// flush writes the buffered samples to bucket/key. Nothing is written when the buffer is empty.
+func (a *archiveBuffer) flush(ctx context.Context, client s3PutObjectAPI, bucket, key string) error {
+	if a.count == 0 {
+		return nil
+	}
+	_, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(a.buf.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// fakeS3Client captures PutObject calls.
+type fakeS3Client struct {
+	inputs []*s3.PutObjectInput
+	bodies [][]byte
+}
+
+func (c *fakeS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	b, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.inputs = append(c.inputs, params)
+	c.bodies = append(c.bodies, b)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestArchiveKey(t *testing.T) {
+	now := time.Date(2026, 3, 7, 23, 30, 0, 0, time.FixedZone("UTC+2", 2*60*60))
+	got := archiveKey("enriched-metrics", now, "req-1")
+	want := "enriched-metrics/dt=2026-03-07/" + "1772919000000000000-req-1.jsonl"
+	if got != want {
+		t.Errorf("archiveKey: got %q, want %q", got, want)
+	}
+}
+
+func TestArchiveBufferFlush(t *testing.T) {
+	attrs := []*commonpb.KeyValue{
+		{Key: "name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "arn:aws:ec2:us-east-1:123456789012:instance/i-1"}}},
+		{Key: "tag_name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "my-instance"}}},
+	}
+	req := &metricsservicepb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Metrics: []*metricspb.Metric{
+					newGauge("aws_ec2_cpuutilization_maximum", 10.0, 2_000_000_000, 0, attrs),
+				},
+			}},
+		}},
+	}
+
+	archive := &archiveBuffer{}
+	if err := archive.add([]*metricsservicepb.ExportMetricsServiceRequest{req}); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if err := archive.add([]*metricsservicepb.ExportMetricsServiceRequest{req}); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+
+	client := &fakeS3Client{}
+	if err := archive.flush(context.Background(), client, "my-bucket", "enriched-metrics/dt=2026-03-07/x.jsonl"); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if len(client.inputs) != 1 {
+		t.Fatalf("expected 1 PutObject call, got %d", len(client.inputs))
+	}
+	if got := *client.inputs[0].Bucket; got != "my-bucket" {
+		t.Errorf("bucket: got %q", got)
+	}
+	if got := *client.inputs[0].Key; got != "enriched-metrics/dt=2026-03-07/x.jsonl" {
+		t.Errorf("key: got %q", got)
+	}
+
+	var lines []flatSample
+	scanner := bufio.NewScanner(bytes.NewReader(client.bodies[0]))
+	for scanner.Scan() {
+		var fs flatSample
+		if err := json.Unmarshal(scanner.Bytes(), &fs); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, fs)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 JSON lines, got %d", len(lines))
+	}
+	fs := lines[0]
+	if fs.Name != "aws_ec2_cpuutilization_maximum" || fs.Value != 10.0 || fs.TimestampMs != 2000 {
+		t.Errorf("unexpected sample: %+v", fs)
+	}
+	if fs.Labels["tag_name"] != "my-instance" || fs.Labels["name"] != "arn:aws:ec2:us-east-1:123456789012:instance/i-1" {
+		t.Errorf("unexpected labels: %v", fs.Labels)
+	}
+}
+
+func TestArchiveBufferFlushEmpty(t *testing.T) {
+	client := &fakeS3Client{}
+	if err := (&archiveBuffer{}).flush(context.Background(), client, "my-bucket", "key"); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if len(client.inputs) != 0 {
+		t.Errorf("expected no PutObject call for an empty archive, got %d", len(client.inputs))
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+)
+
+// endpointWeight is one OTEL_ENDPOINT_WEIGHTS entry.
+type endpointWeight struct {
+	endpoint string
+	weight   int
+}
+
+// parseEndpointWeights parses OTEL_ENDPOINT_WEIGHTS, a JSON object of collector addresses to positive
+// integer weights, e.g. {"collector-a:4317":3,"collector-b:4317":1}. Addresses are normalized like
+// OTEL_EXPORTER_OTLP_ENDPOINT and sorted, so the rotation does not depend on the object order.
+func parseEndpointWeights(env string) ([]endpointWeight, error) {
+	if env == "" {
+		return nil, nil
+	}
+	var m map[string]int
+	if err := json.Unmarshal([]byte(env), &m); err != nil {
+		return nil, err
+	}
+	weights := make([]endpointWeight, 0, len(m))
+	for endpoint, weight := range m {
+		endpoint = otlpEndpoint("", endpoint)
+		if endpoint == "" {
+			return nil, errors.New("empty endpoint")
+		}
+		if weight <= 0 {
+			return nil, fmt.Errorf("endpoint %s: weight must be positive, got %d", endpoint, weight)
+		}
+		weights = append(weights, endpointWeight{endpoint: endpoint, weight: weight})
+	}
+	slices.SortFunc(weights, func(a, b endpointWeight) int { return strings.Compare(a.endpoint, b.endpoint) })
+	return weights, nil
+}
+
+// weightedRoundRobin picks endpoints with nginx's smooth weighted round-robin: over any run of total-weight
+// picks, each endpoint is picked exactly weight times, interleaved rather than in bursts.
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	weights []endpointWeight
+	current []int
+}
+
+func newWeightedRoundRobin(weights []endpointWeight) *weightedRoundRobin {
+	return &weightedRoundRobin{weights: weights, current: make([]int, len(weights))}
+}
+
+// next returns the indexes of the endpoints to try for one batch: the picked endpoint first, then the
+// others in order as fallbacks.
+func (w *weightedRoundRobin) next() []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	best, total := 0, 0
+	for i, e := range w.weights {
+		w.current[i] += e.weight
+		total += e.weight
+		if w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	w.current[best] -= total
+
+	order := make([]int, 0, len(w.weights))
+	for i := range w.weights {
+		order = append(order, (best+i)%len(w.weights))
+	}
+	return order
+}
+
+// weightedClient sends each Export to one endpoint picked by weighted round-robin. When that export fails,
+// the next endpoints are tried in turn, within the same call deadline. Endpoints without a client, because
+// they could not be dialed, are skipped.
+type weightedClient struct {
+	picker  *weightedRoundRobin
+	clients []metricsservicepb.MetricsServiceClient
+}
+
+func (c *weightedClient) Export(ctx context.Context, in *metricsservicepb.ExportMetricsServiceRequest, opts ...grpc.CallOption) (*metricsservicepb.ExportMetricsServiceResponse, error) {
+	var errs []error
+	for _, i := range c.picker.next() {
+		if c.clients[i] == nil {
+			continue
+		}
+		resp, err := c.clients[i].Export(ctx, in, opts...)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", c.picker.weights[i].endpoint, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// The OTEL_ENDPOINT_WEIGHTS and OTEL_ROUTING_RULES connections and the rotation are kept at package level,
+// like the shared connection, so warm invocations reuse them and continue the rotation where the last one
+// stopped.
+var (
+	weightedMu     sync.Mutex
+	weightedConns  = make(map[grpcConnConfig]*grpc.ClientConn)
+	weightedPicker *weightedRoundRobin
+)
+
+// weightedGRPCClient returns a client balancing over weights, each endpoint dialed with cfg. An endpoint
+// that cannot be dialed is logged and left out of this invocation; it fails only when none can be dialed.
+func weightedGRPCClient(logger *slog.Logger, cfg grpcConnConfig, weights []endpointWeight) (metricsservicepb.MetricsServiceClient, error) {
+	weightedMu.Lock()
+	defer weightedMu.Unlock()
+
+	if weightedPicker == nil || !slices.Equal(weightedPicker.weights, weights) {
+		weightedPicker = newWeightedRoundRobin(weights)
+	}
+	client := &weightedClient{picker: weightedPicker, clients: make([]metricsservicepb.MetricsServiceClient, len(weights))}
+	var errs []error
+	for i, w := range weights {
+		conn, err := pooledConn(cfg, w.endpoint)
+		if err != nil {
+			logger.Warn("Failed to connect to weighted OTLP endpoint", "endpoint", w.endpoint, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", w.endpoint, err))
+			continue
+		}
+		client.clients[i] = metricsservicepb.NewMetricsServiceClient(conn)
+	}
+	if len(errs) == len(weights) {
+		return nil, errors.Join(errs...)
+	}
+	return client, nil
+}
+
+// pooledConn returns the pooled connection to endpoint, dialed with cfg on first use. weightedMu must be held.
+func pooledConn(cfg grpcConnConfig, endpoint string) (*grpc.ClientConn, error) {
+	cfg.endpoint = endpoint
+	if conn := weightedConns[cfg]; conn != nil {
+		return conn, nil
+	}
+	conn, err := newGRPCConn(cfg)
+	if err != nil {
+		return nil, err
+	}
+	weightedConns[cfg] = conn
+	return conn, nil
+}
+
+// closeWeightedConns closes the OTEL_ENDPOINT_WEIGHTS and OTEL_ROUTING_RULES connections.
+func closeWeightedConns(logger *slog.Logger) {
+	weightedMu.Lock()
+	defer weightedMu.Unlock()
+	for cfg, conn := range weightedConns {
+		if err := conn.Close(); err != nil {
+			logger.Warn("Failed to close OTLP connection on shutdown", "endpoint", cfg.endpoint, "error", err)
+		}
+		delete(weightedConns, cfg)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+)
+
+// endpointClient counts the exports it receives and fails them when failing is set.
+type endpointClient struct {
+	received int
+	failing  bool
+}
+
+func (c *endpointClient) Export(ctx context.Context, in *metricsservicepb.ExportMetricsServiceRequest, opts ...grpc.CallOption) (*metricsservicepb.ExportMetricsServiceResponse, error) {
+	c.received++
+	if c.failing {
+		return nil, errors.New("unavailable")
+	}
+	return &metricsservicepb.ExportMetricsServiceResponse{}, nil
+}
+
+func TestWeightedClientDistribution(t *testing.T) {
+	weights, err := parseEndpointWeights(`{"http://c:4317":1,"a:4317":5,"b:4317":2}`)
+	if err != nil {
+		t.Fatalf("parseEndpointWeights failed: %v", err)
+	}
+	if weights[0].endpoint != "a:4317" || weights[2].endpoint != "c:4317" {
+		t.Fatalf("expected sorted, normalized endpoints, got %v", weights)
+	}
+
+	clients := []*endpointClient{{}, {}, {}}
+	client := &weightedClient{picker: newWeightedRoundRobin(weights)}
+	for _, c := range clients {
+		client.clients = append(client.clients, c)
+	}
+	const batches = 800
+	for range batches {
+		if _, err := client.Export(context.Background(), &metricsservicepb.ExportMetricsServiceRequest{}); err != nil {
+			t.Fatalf("Export failed: %v", err)
+		}
+	}
+	for i, w := range weights {
+		want := batches * w.weight / 8
+		if got := clients[i].received; got != want {
+			t.Errorf("%s: got %d batches, want %d", w.endpoint, got, want)
+		}
+	}
+}
+
+func TestWeightedClientFailover(t *testing.T) {
+	weights := []endpointWeight{{endpoint: "a:4317", weight: 1}, {endpoint: "b:4317", weight: 1}}
+	down, up := &endpointClient{failing: true}, &endpointClient{}
+	client := &weightedClient{picker: newWeightedRoundRobin(weights), clients: []metricsservicepb.MetricsServiceClient{down, up}}
+	for range 4 {
+		if _, err := client.Export(context.Background(), &metricsservicepb.ExportMetricsServiceRequest{}); err != nil {
+			t.Fatalf("expected the export to fail over, got %v", err)
+		}
+	}
+	if up.received != 4 || down.received != 2 {
+		t.Errorf("expected every batch on b, a tried on its turns only, got a=%d b=%d", down.received, up.received)
+	}
+
+	up.failing = true
+	if _, err := client.Export(context.Background(), &metricsservicepb.ExportMetricsServiceRequest{}); err == nil {
+		t.Error("expected an error when every endpoint fails")
+	}
+
+	for _, env := range []string{`{"":1}`, `{"a:4317":0}`, `["a:4317"]`} {
+		if _, err := parseEndpointWeights(env); err == nil {
+			t.Errorf("%s: expected a parse error", env)
+		}
+	}
+}
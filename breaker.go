@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+)
+
+// defaultCircuitBreakerCooldown is how long an open OTLP export circuit short-circuits exports by default.
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+// errCircuitOpen is returned instead of exporting while the OTLP export circuit is open.
+var errCircuitOpen = errors.New("OTLP export circuit breaker is open")
+
+// circuitBreaker opens after threshold consecutive failed exports and short-circuits exports until cooldown
+// has passed. The next export is then let through as a trial, the others still short-circuited while it
+// runs: success closes the circuit, failure opens it for another cooldown. A threshold of 0 or less
+// disables it.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	// trial is set while the trial export of a half-open circuit runs.
+	trial bool
+	now   func() time.Time
+}
+
+// allow reports whether an export may be attempted.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.threshold <= 0 || b.openUntil.IsZero():
+		return true
+	case b.trial || b.now().Before(b.openUntil):
+		return false
+	default:
+		b.trial = true
+		return true
+	}
+}
+
+// record counts the outcome of an attempted export.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if err == nil {
+		b.failures, b.openUntil = 0, time.Time{}
+		return
+	}
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+	}
+}
+
+// configure applies the invocation's settings, keeping the breaker state.
+func (b *circuitBreaker) configure(threshold int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.threshold, b.cooldown = threshold, cooldown
+}
+
+// splitCircuitOpen separates the errors joined in err that only report the open circuit, as exports skipped,
+// from the others, which are failures.
+func splitCircuitOpen(err error) (skipped, failed error) {
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	var skips, failures []error
+	for _, e := range errs {
+		if onlyCircuitOpen(e) {
+			skips = append(skips, e)
+		} else {
+			failures = append(failures, e)
+		}
+	}
+	return errors.Join(skips...), errors.Join(failures...)
+}
+
+// onlyCircuitOpen reports whether err is errCircuitOpen, possibly wrapped, or joins only such errors.
+func onlyCircuitOpen(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case interface{ Unwrap() []error }:
+		for _, inner := range e.Unwrap() {
+			if !onlyCircuitOpen(inner) {
+				return false
+			}
+		}
+		return true
+	case interface{ Unwrap() error }:
+		return onlyCircuitOpen(e.Unwrap())
+	default:
+		return err == errCircuitOpen
+	}
+}
+
+// exportBreaker is kept at package level so an open circuit carries over to the warm invocations that
+// follow, until its cooldown passes.
+var exportBreaker = &circuitBreaker{now: time.Now}
+
+// breakerClient guards the exports of a client with a circuitBreaker.
+type breakerClient struct {
+	client  metricsservicepb.MetricsServiceClient
+	breaker *circuitBreaker
+}
+
+func (c breakerClient) Export(ctx context.Context, in *metricsservicepb.ExportMetricsServiceRequest, opts ...grpc.CallOption) (*metricsservicepb.ExportMetricsServiceResponse, error) {
+	if !c.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+	resp, err := c.client.Export(ctx, in, opts...)
+	c.breaker.record(err)
+	return resp, err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+)
+
+func TestBreakerClientOpensAndCloses(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	breaker := &circuitBreaker{now: func() time.Time { return now }}
+	breaker.configure(3, time.Minute)
+	collector := &endpointClient{failing: true}
+	client := breakerClient{client: collector, breaker: breaker}
+	export := func() error {
+		return exportRequests(context.Background(), client, []*metricsservicepb.ExportMetricsServiceRequest{{}}, time.Second, 1)
+	}
+
+	for i := range 3 {
+		if err := export(); err == nil || errors.Is(err, errCircuitOpen) {
+			t.Fatalf("attempt %d: expected the collector error, got %v", i, err)
+		}
+	}
+	for range 5 {
+		if err := export(); !errors.Is(err, errCircuitOpen) {
+			t.Fatalf("expected the open circuit to short-circuit the export, got %v", err)
+		}
+	}
+	if collector.received != 3 {
+		t.Errorf("expected no attempts while open, got %d", collector.received)
+	}
+
+	// After the cooldown, a failed trial opens the circuit again at once.
+	now = now.Add(time.Minute)
+	if err := export(); err == nil || errors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected a trial export after the cooldown, got %v", err)
+	}
+	if err := export(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected a failed trial to reopen the circuit, got %v", err)
+	}
+
+	// A successful trial closes it.
+	now = now.Add(time.Minute)
+	collector.failing = false
+	for range 3 {
+		if err := export(); err != nil {
+			t.Fatalf("expected the closed circuit to export, got %v", err)
+		}
+	}
+	if collector.received != 7 {
+		t.Errorf("expected 7 attempts in total, got %d", collector.received)
+	}
+
+	// A failure after closing starts the count over.
+	collector.failing = true
+	if err := export(); errors.Is(err, errCircuitOpen) {
+		t.Errorf("expected one failure not to open the circuit, got %v", err)
+	}
+
+	breaker.configure(0, time.Minute)
+	for range 5 {
+		if err := export(); errors.Is(err, errCircuitOpen) {
+			t.Fatal("expected a disabled breaker to never open")
+		}
+	}
+}
+
+func TestCircuitBreakerSingleTrial(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	breaker := &circuitBreaker{now: func() time.Time { return now }}
+	breaker.configure(1, time.Minute)
+	breaker.record(errors.New("unavailable"))
+	if breaker.allow() {
+		t.Fatal("expected the circuit to be open")
+	}
+
+	now = now.Add(time.Minute)
+	if !breaker.allow() {
+		t.Fatal("expected a trial export after the cooldown")
+	}
+	for range 3 {
+		if breaker.allow() {
+			t.Fatal("expected the exports concurrent with the trial to be short-circuited")
+		}
+	}
+	breaker.record(nil)
+	if !breaker.allow() || !breaker.allow() {
+		t.Error("expected a successful trial to close the circuit")
+	}
+}
+
+func TestSplitCircuitOpen(t *testing.T) {
+	failure := errors.New("unavailable")
+	err := errors.Join(
+		fmt.Errorf("record 0: %w", failure),
+		fmt.Errorf("record 1: %w", errCircuitOpen),
+		fmt.Errorf("record 2: %w", errors.Join(errCircuitOpen, errCircuitOpen)),
+		fmt.Errorf("record 3: %w", errors.Join(errCircuitOpen, failure)),
+	)
+	skipped, failed := splitCircuitOpen(err)
+	if skipped == nil || !strings.Contains(skipped.Error(), "record 1") || !strings.Contains(skipped.Error(), "record 2") {
+		t.Errorf("expected records 1 and 2 to be skipped, got %v", skipped)
+	}
+	if failed == nil || !strings.Contains(failed.Error(), "record 0") || !strings.Contains(failed.Error(), "record 3") || strings.Contains(failed.Error(), "record 1") {
+		t.Errorf("expected records 0 and 3 to be failures, got %v", failed)
+	}
+
+	if skipped, failed := splitCircuitOpen(errCircuitOpen); skipped == nil || failed != nil {
+		t.Errorf("expected a lone open circuit to be skipped, got %v, %v", skipped, failed)
+	}
+}
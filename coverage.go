@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// associationCoverage counts, per namespace, the data points associated with a resource and those falling
+// back to the global labels during one invocation, for COVERAGE_REPORT. A low coverage usually points to
+// missing tagging permissions or untagged resources. A nil *associationCoverage counts nothing.
+type associationCoverage struct {
+	mu          sync.Mutex
+	byNamespace map[string]*coverageCounts
+}
+
+type coverageCounts struct {
+	matched, fallback int
+}
+
+func newAssociationCoverage() *associationCoverage {
+	return &associationCoverage{byNamespace: make(map[string]*coverageCounts)}
+}
+
+// record counts a data point of namespace, associated with a resource or not.
+func (c *associationCoverage) record(namespace string, matched bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := c.byNamespace[namespace]
+	if counts == nil {
+		counts = &coverageCounts{}
+		c.byNamespace[namespace] = counts
+	}
+	if matched {
+		counts.matched++
+	} else {
+		counts.fallback++
+	}
+}
+
+// fractions returns the fraction of data points associated with a resource, per namespace seen.
+func (c *associationCoverage) fractions() map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]float64, len(c.byNamespace))
+	for ns, counts := range c.byNamespace {
+		out[ns] = float64(counts.matched) / float64(counts.matched+counts.fallback)
+	}
+	return out
+}
+
+// logCoverage logs the invocation's association coverage, one line per namespace in name order.
+func logCoverage(logger *slog.Logger, c *associationCoverage) {
+	if c == nil {
+		return
+	}
+	fractions := c.fractions()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ns := range sortedKeys(fractions) {
+		counts := c.byNamespace[ns]
+		logger.Info("Association coverage", "namespace", ns, "matched", counts.matched, "fallback", counts.fallback, "coverage", fractions[ns])
+	}
+}
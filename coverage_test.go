@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/job/maxdimassociator"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+)
+
+func TestEnhanceAssociationCoverage(t *testing.T) {
+	var reqs []*metricsservicepb.ExportMetricsServiceRequest
+	for _, id := range []string{"i-1234567890abcdef0", "i-1234567890abcdef0", "i-1234567890abcdef0", "i-0fedcba0987654321"} {
+		reqs = append(reqs, makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10(id)))
+	}
+	resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {{
+		ARN:       "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0",
+		Namespace: "AWS/EC2",
+		Region:    "us-east-1",
+	}}}
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, coverage: newAssociationCoverage()}
+	err := enhanceRequests(slog.Default(), cfg, reqs, resourceCache, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	got := cfg.coverage.fractions()
+	if len(got) != 1 || got["AWS/EC2"] != 0.75 {
+		t.Errorf("expected 3 of 4 EC2 data points associated, got %v", got)
+	}
+	logCoverage(slog.Default(), cfg.coverage)
+
+	var disabled *associationCoverage
+	disabled.record("AWS/EC2", true)
+	logCoverage(slog.Default(), disabled)
+}
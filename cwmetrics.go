@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// defaultPublishCWMetricsNamespace is the CloudWatch namespace PUBLISH_CW_METRICS publishes to by default.
+const defaultPublishCWMetricsNamespace = "CWOTLPTagEnricher"
+
+// cloudWatchPutMetricDataAPI is the subset of the CloudWatch client used to publish enricher metrics.
+type cloudWatchPutMetricDataAPI interface {
+	PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error)
+}
+
+func newCloudWatchClient(ctx context.Context, region string) (cloudWatchPutMetricDataAPI, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	return cloudwatch.NewFromConfig(cfg), nil
+}
+
+// enrichmentCounts counts the enrichment decisions of one invocation for PUBLISH_CW_METRICS. A nil
+// *enrichmentCounts counts nothing.
+type enrichmentCounts struct {
+	enriched atomic.Int64
+	missed   atomic.Int64
+}
+
+// record counts a data point of a supported namespace, associated with a resource or not.
+func (c *enrichmentCounts) record(matched bool) {
+	switch {
+	case c == nil:
+	case matched:
+		c.enriched.Add(1)
+	default:
+		c.missed.Add(1)
+	}
+}
+
+// publish sends the invocation's RecordsProcessed, MetricsEnriched and AssociationMisses counts to
+// namespace in one PutMetricData call, with a FunctionName dimension when running on Lambda.
+func (c *enrichmentCounts) publish(ctx context.Context, client cloudWatchPutMetricDataAPI, namespace string, records int, now time.Time) error {
+	var dims []cwtypes.Dimension
+	if lambdacontext.FunctionName != "" {
+		dims = []cwtypes.Dimension{{Name: aws.String("FunctionName"), Value: aws.String(lambdacontext.FunctionName)}}
+	}
+	datum := func(name string, value int64) cwtypes.MetricDatum {
+		return cwtypes.MetricDatum{
+			MetricName: aws.String(name),
+			Dimensions: dims,
+			Timestamp:  aws.Time(now),
+			Unit:       cwtypes.StandardUnitCount,
+			Value:      aws.Float64(float64(value)),
+		}
+	}
+	_, err := client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+		Namespace: aws.String(namespace),
+		MetricData: []cwtypes.MetricDatum{
+			datum("RecordsProcessed", int64(records)),
+			datum("MetricsEnriched", c.enriched.Load()),
+			datum("AssociationMisses", c.missed.Load()),
+		},
+	})
+	return err
+}
+
+// publishEnrichmentCounts publishes the invocation's counts to PUBLISH_CW_METRICS_NAMESPACE.
+func publishEnrichmentCounts(ctx context.Context, counts *enrichmentCounts, records int, region string) error {
+	client, err := newCloudWatchClient(ctx, region)
+	if err != nil {
+		return err
+	}
+	return counts.publish(ctx, client, envString("PUBLISH_CW_METRICS_NAMESPACE", defaultPublishCWMetricsNamespace), records, time.Now())
+}
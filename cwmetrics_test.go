@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+)
+
+// fakeCloudWatchClient records the PutMetricData inputs it receives.
+type fakeCloudWatchClient struct {
+	inputs []*cloudwatch.PutMetricDataInput
+}
+
+func (c *fakeCloudWatchClient) PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error) {
+	c.inputs = append(c.inputs, params)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func TestEnrichmentCountsPublish(t *testing.T) {
+	var nilCounts *enrichmentCounts
+	nilCounts.record(true)
+
+	counts := &enrichmentCounts{}
+	for _, matched := range []bool{true, true, false, true} {
+		counts.record(matched)
+	}
+
+	client := &fakeCloudWatchClient{}
+	now := time.Unix(1700000000, 0)
+	if err := counts.publish(context.Background(), client, "Enricher", 2, now); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	if len(client.inputs) != 1 {
+		t.Fatalf("expected one PutMetricData call, got %d", len(client.inputs))
+	}
+	in := client.inputs[0]
+	if aws.ToString(in.Namespace) != "Enricher" {
+		t.Errorf("expected namespace Enricher, got %s", aws.ToString(in.Namespace))
+	}
+	got := make(map[string]float64)
+	for _, d := range in.MetricData {
+		if !aws.ToTime(d.Timestamp).Equal(now) || d.Unit != "Count" {
+			t.Errorf("%s: unexpected timestamp %v or unit %s", aws.ToString(d.MetricName), aws.ToTime(d.Timestamp), d.Unit)
+		}
+		got[aws.ToString(d.MetricName)] = aws.ToFloat64(d.Value)
+	}
+	want := map[string]float64{"RecordsProcessed": 2, "MetricsEnriched": 3, "AssociationMisses": 1}
+	if len(got) != len(want) {
+		t.Fatalf("expected metrics %v, got %v", want, got)
+	}
+	for name, v := range want {
+		if got[name] != v {
+			t.Errorf("%s: got %v, want %v", name, got[name], v)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// defaultDebugDumpMaxBytes caps DEBUG_DUMP_FILE so a forgotten debug setting cannot fill /tmp.
+const defaultDebugDumpMaxBytes = 10 << 20
+
+// errDumpFileFull is returned when appending would grow the dump file past its size cap.
+var errDumpFileFull = errors.New("debug dump file size cap reached")
+
+// dumpRequests appends reqs to the file at path as newline-delimited protojson, one request per line.
+// Nothing is written when the lines would take the file past maxBytes.
+func dumpRequests(path string, reqs []*metricsservicepb.ExportMetricsServiceRequest, maxBytes int64) error {
+	var buf bytes.Buffer
+	for _, req := range reqs {
+		b, err := protojson.Marshal(req)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size()+int64(buf.Len()) > maxBytes {
+		return errDumpFileFull
+	}
+	_, err = f.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDumpRequestsRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.jsonl")
+	reqs := []*metricsservicepb.ExportMetricsServiceRequest{
+		makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1")),
+		makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-2")),
+	}
+	// Two invocations append to the same file.
+	for i := 0; i < 2; i++ {
+		if err := dumpRequests(path, reqs, defaultDebugDumpMaxBytes); err != nil {
+			t.Fatalf("dumpRequests failed: %v", err)
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read dump: %v", err)
+	}
+	var lines int
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		got := &metricsservicepb.ExportMetricsServiceRequest{}
+		if err := protojson.Unmarshal(scanner.Bytes(), got); err != nil {
+			t.Fatalf("line %d is not a valid request: %v", lines, err)
+		}
+		if !proto.Equal(got, reqs[lines%len(reqs)]) {
+			t.Errorf("line %d does not match the dumped request", lines)
+		}
+		lines++
+	}
+	if lines != 4 {
+		t.Errorf("expected 4 dumped requests, got %d", lines)
+	}
+}
+
+func TestDumpRequestsSizeCap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.jsonl")
+	reqs := []*metricsservicepb.ExportMetricsServiceRequest{
+		makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1")),
+	}
+	if err := dumpRequests(path, reqs, 1<<20); err != nil {
+		t.Fatalf("dumpRequests failed: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+
+	if err := dumpRequests(path, reqs, info.Size()+1); !errors.Is(err, errDumpFileFull) {
+		t.Fatalf("expected errDumpFileFull, got %v", err)
+	}
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Errorf("dump file grew past the cap: %d -> %d bytes", info.Size(), after.Size())
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// INPUT_FORMAT values. Unknown values behave like inputFormatOTLP.
+const (
+	// inputFormatOTLP reads size-delimited OTLP requests, as written by CloudWatch Metric Streams.
+	inputFormatOTLP = "otlp"
+	// inputFormatEMF reads CloudWatch Embedded Metric Format JSON documents.
+	inputFormatEMF = "emf"
+)
+
+// recordDecoder returns the function decoding Firehose record data for an INPUT_FORMAT.
+func recordDecoder(inputFormat string) func([]byte) ([]*metricsservicepb.ExportMetricsServiceRequest, error) {
+	if inputFormat == inputFormatEMF {
+		return emfIntoRequests
+	}
+	return rawDataIntoRequests
+}
+
+// emfMetadata is the _aws member of an Embedded Metric Format document. The metric values and dimension
+// values are the other top-level members of the document.
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// emfDirective is one entry of _aws.CloudWatchMetrics.
+type emfDirective struct {
+	Namespace  string     `json:"Namespace"`
+	Dimensions [][]string `json:"Dimensions"`
+	Metrics    []struct {
+		Name string `json:"Name"`
+		Unit string `json:"Unit"`
+	} `json:"Metrics"`
+}
+
+// emfIntoRequests decodes the EMF documents of a record, one JSON object after another and optionally
+// gzip-compressed, into one OTLP request. Each metric of each dimension set becomes a Summary data point
+// shaped like a Metric Streams one, carrying the Namespace, MetricName and Dimensions attributes, so it is
+// enriched like any other metric. Documents without CloudWatchMetrics directives are ignored.
+func emfIntoRequests(input []byte) ([]*metricsservicepb.ExportMetricsServiceRequest, error) {
+	if isGzip(input) {
+		var err error
+		if input, err = gunzipBytes(input); err != nil {
+			return nil, err
+		}
+	}
+	var metrics []*metricspb.Metric
+	dec := json.NewDecoder(bytes.NewReader(input))
+	dec.UseNumber()
+	for {
+		var members map[string]any
+		if err := dec.Decode(&members); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("decoding EMF document: %w", err)
+		}
+		raw, err := json.Marshal(members["_aws"])
+		if err != nil {
+			return nil, err
+		}
+		var meta emfMetadata
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return nil, fmt.Errorf("decoding EMF metadata: %w", err)
+		}
+		m, err := emfMetrics(meta, members)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m...)
+	}
+	if len(metrics) == 0 {
+		return nil, nil
+	}
+	return []*metricsservicepb.ExportMetricsServiceRequest{{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}},
+		}},
+	}}, nil
+}
+
+// emfMetrics converts the directives of one document into Summary metrics. A metric whose value is
+// missing from the document is skipped.
+func emfMetrics(meta emfMetadata, members map[string]any) ([]*metricspb.Metric, error) {
+	ts := uint64(meta.Timestamp) * 1e6
+	strVal := func(s string) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+	}
+
+	var metrics []*metricspb.Metric
+	for _, d := range meta.CloudWatchMetrics {
+		if d.Namespace == "" {
+			return nil, errors.New("EMF directive has no Namespace")
+		}
+		dimensionSets := d.Dimensions
+		if len(dimensionSets) == 0 {
+			dimensionSets = [][]string{nil}
+		}
+		for _, m := range d.Metrics {
+			values, ok, err := emfValues(members[m.Name])
+			if err != nil {
+				return nil, fmt.Errorf("metric %s: %w", m.Name, err)
+			}
+			if !ok {
+				continue
+			}
+			for _, set := range dimensionSets {
+				var dims []*commonpb.KeyValue
+				for _, name := range set {
+					v, ok := members[name]
+					if !ok {
+						return nil, fmt.Errorf("metric %s: dimension %s has no value", m.Name, name)
+					}
+					dims = append(dims, &commonpb.KeyValue{Key: name, Value: strVal(fmt.Sprint(v))})
+				}
+				attrs := []*commonpb.KeyValue{
+					{Key: "Namespace", Value: strVal(d.Namespace)},
+					{Key: "MetricName", Value: strVal(m.Name)},
+					{Key: "Dimensions", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{
+						KvlistValue: &commonpb.KeyValueList{Values: dims},
+					}}},
+				}
+				metrics = append(metrics, &metricspb.Metric{
+					Name: cloudWatchMetricNamePrefix + d.Namespace + "/" + m.Name,
+					Unit: m.Unit,
+					Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{
+						DataPoints: []*metricspb.SummaryDataPoint{emfDataPoint(values, ts, attrs)},
+					}},
+				})
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// emfValues returns the values of an EMF metric member, a number or an array of numbers, and false when
+// the member is missing.
+func emfValues(v any) ([]float64, bool, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, false, nil
+	case json.Number:
+		f, err := v.Float64()
+		return []float64{f}, err == nil, err
+	case []any:
+		values := make([]float64, 0, len(v))
+		for _, e := range v {
+			n, ok := e.(json.Number)
+			if !ok {
+				return nil, false, fmt.Errorf("value %v is not a number", e)
+			}
+			f, err := n.Float64()
+			if err != nil {
+				return nil, false, err
+			}
+			values = append(values, f)
+		}
+		return values, len(values) > 0, nil
+	default:
+		return nil, false, fmt.Errorf("value %v is not a number", v)
+	}
+}
+
+// emfDataPoint summarizes values like a Metric Streams data point: count, sum, and the minimum and maximum
+// as the 0 and 1 quantiles.
+func emfDataPoint(values []float64, ts uint64, attrs []*commonpb.KeyValue) *metricspb.SummaryDataPoint {
+	minimum, maximum, sum := values[0], values[0], 0.0
+	for _, v := range values {
+		minimum, maximum, sum = min(minimum, v), max(maximum, v), sum+v
+	}
+	return &metricspb.SummaryDataPoint{
+		Attributes:   attrs,
+		TimeUnixNano: ts,
+		Count:        uint64(len(values)),
+		Sum:          sum,
+		QuantileValues: []*metricspb.SummaryDataPoint_ValueAtQuantile{
+			{Quantile: 0, Value: minimum},
+			{Quantile: 1, Value: maximum},
+		},
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/job/maxdimassociator"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+const emfTestDocuments = `{"_aws":{"Timestamp":1700000000000,"CloudWatchMetrics":[{"Namespace":"AWS/EC2","Dimensions":[["InstanceId"]],"Metrics":[{"Name":"CPUUtilization","Unit":"Percent"}]}]},"InstanceId":"i-1234567890abcdef0","CPUUtilization":[10,30,20]}
+{"message":"not a metric"}
+`
+
+func TestEMFEnrichedGauges(t *testing.T) {
+	reqs, err := emfIntoRequests([]byte(emfTestDocuments))
+	if err != nil {
+		t.Fatalf("emfIntoRequests failed: %v", err)
+	}
+	resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {{
+		ARN:       "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0",
+		Namespace: "AWS/EC2",
+		Region:    "us-east-1",
+		Tags:      []model.Tag{{Key: "team", Value: "web"}},
+	}}}
+	cfg := enhanceConfig{
+		continueOnResourceFailure: true,
+		labelsSnakeCase:           true,
+		yaceCompatMode:            true,
+		yaceCompatStats:           map[string]bool{"SampleCount": true, "Average": true, "Minimum": true, "Maximum": true},
+	}
+	err = enhanceRequests(slog.Default(), cfg, reqs, resourceCache, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	got := make(map[string]float64)
+	for _, m := range reqs[0].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics() {
+		dp := m.GetGauge().GetDataPoints()[0]
+		labels := keyValueToMap(dp.GetAttributes())
+		if labels["tag_team"] != "web" || labels["dimension_instance_id"] != "i-1234567890abcdef0" {
+			t.Errorf("%s: expected the instance to be associated, got %v", m.GetName(), labels)
+		}
+		if dp.GetTimeUnixNano() != 1700000000000*1e6 {
+			t.Errorf("%s: expected the EMF timestamp, got %d", m.GetName(), dp.GetTimeUnixNano())
+		}
+		got[strings.TrimPrefix(m.GetName(), "aws_ec2_cpuutilization_")] = dp.GetAsDouble()
+	}
+	want := map[string]float64{"sample_count": 3, "average": 20, "minimum": 10, "maximum": 30}
+	if len(got) != len(want) {
+		t.Fatalf("expected gauges %v, got %v", want, got)
+	}
+	for stat, v := range want {
+		if got[stat] != v {
+			t.Errorf("%s: got %v, want %v", stat, got[stat], v)
+		}
+	}
+}
+
+func TestEMFIntoRequestsErrors(t *testing.T) {
+	for name, input := range map[string]string{
+		"invalid JSON":      `{"_aws":`,
+		"missing namespace": `{"_aws":{"CloudWatchMetrics":[{"Metrics":[{"Name":"Latency"}]}]},"Latency":1}`,
+		"missing dimension": `{"_aws":{"CloudWatchMetrics":[{"Namespace":"App","Dimensions":[["Service"]],"Metrics":[{"Name":"Latency"}]}]},"Latency":1}`,
+		"non-numeric value": `{"_aws":{"CloudWatchMetrics":[{"Namespace":"App","Metrics":[{"Name":"Latency"}]}]},"Latency":"fast"}`,
+	} {
+		if _, err := emfIntoRequests([]byte(input)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	reqs, err := emfIntoRequests([]byte(`{"_aws":{"CloudWatchMetrics":[{"Namespace":"App","Metrics":[{"Name":"Latency"}]}]}}`))
+	if err != nil || reqs != nil {
+		t.Errorf("expected a metric without a value to be skipped, got %v, %v", reqs, err)
+	}
+}
+
+func TestRecordDecoder(t *testing.T) {
+	reqs, err := recordDecoder(inputFormatEMF)([]byte(emfTestDocuments))
+	if err != nil || len(reqs) != 1 {
+		t.Fatalf("expected the EMF decoder, got %v, %v", reqs, err)
+	}
+	summary := reqs[0].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0]
+	if summary.GetName() != "amazonaws.com/AWS/EC2/CPUUtilization" || summary.GetUnit() != "Percent" {
+		t.Errorf("expected a Metric Streams style summary, got %s (%s)", summary.GetName(), summary.GetUnit())
+	}
+	if _, ok := summary.GetData().(*metricspb.Metric_Summary); !ok {
+		t.Errorf("expected a Summary, got %T", summary.GetData())
+	}
+
+	if _, err := recordDecoder("")([]byte(emfTestDocuments)); err == nil {
+		t.Error("expected the default OTLP decoder to reject EMF data")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+)
+
+const defaultAsyncExportQueueSize = 16
+
+// asyncExport is one record's worth of enriched requests queued for export.
+type asyncExport struct {
+	recordID string
+	reqs     []*metricsservicepb.ExportMetricsServiceRequest
+}
+
+// asyncExporter exports enriched requests from a bounded queue on a background goroutine, so that
+// network export of one record overlaps with the enrichment of the next. Enqueued requests must not be
+// modified afterwards. drain must be called before the handler returns; stop releases the goroutine on
+// early returns.
+type asyncExporter struct {
+	queue chan asyncExport
+	done  chan struct{}
+
+	// sendMu guards closed and senders, as a shutdown may stop the exporter while the handler is still
+	// enqueueing. It is not held while a sender blocks on a full queue: stop closes stopping to release
+	// blocked senders, waits for them, then closes queue.
+	sendMu    sync.Mutex
+	closed    bool
+	senders   sync.WaitGroup
+	stopping  chan struct{}
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	errs []error
+}
+
+// errExporterStopped is returned by enqueue once the exporter is stopped.
+var errExporterStopped = errors.New("export queue is stopped")
+
+// pendingExporters holds the running exporters, so flushPendingExports can drain them on shutdown.
+var pendingExporters = struct {
+	sync.Mutex
+	set map[*asyncExporter]struct{}
+}{set: make(map[*asyncExporter]struct{})}
+
+// startAsyncExporter starts the background exporter. export is called once per enqueued record, in order.
+func startAsyncExporter(ctx context.Context, queueSize int, export func(context.Context, []*metricsservicepb.ExportMetricsServiceRequest) error) *asyncExporter {
+	if queueSize <= 0 {
+		queueSize = defaultAsyncExportQueueSize
+	}
+	e := &asyncExporter{
+		queue:    make(chan asyncExport, queueSize),
+		done:     make(chan struct{}),
+		stopping: make(chan struct{}),
+	}
+	pendingExporters.Lock()
+	pendingExporters.set[e] = struct{}{}
+	pendingExporters.Unlock()
+	go func() {
+		defer func() {
+			pendingExporters.Lock()
+			delete(pendingExporters.set, e)
+			pendingExporters.Unlock()
+			close(e.done)
+		}()
+		for item := range e.queue {
+			if err := export(ctx, item.reqs); err != nil {
+				e.mu.Lock()
+				e.errs = append(e.errs, fmt.Errorf("record %s: %w", item.recordID, err))
+				e.mu.Unlock()
+			}
+		}
+	}()
+	return e
+}
+
+// enqueue queues reqs for export, blocking while the queue is full until ctx is done or the exporter is
+// stopped.
+func (e *asyncExporter) enqueue(ctx context.Context, recordID string, reqs []*metricsservicepb.ExportMetricsServiceRequest) error {
+	e.sendMu.Lock()
+	if e.closed {
+		e.sendMu.Unlock()
+		return errExporterStopped
+	}
+	e.senders.Add(1)
+	e.sendMu.Unlock()
+	defer e.senders.Done()
+
+	select {
+	case e.queue <- asyncExport{recordID: recordID, reqs: reqs}:
+		return nil
+	case <-e.stopping:
+		return errExporterStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drain waits until every queued request has been exported, or until ctx is done, and returns the
+// export errors joined.
+func (e *asyncExporter) drain(ctx context.Context) error {
+	e.stop()
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return fmt.Errorf("draining export queue: %w", ctx.Err())
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return errors.Join(e.errs...)
+}
+
+// stop closes the queue; the goroutine exits once the queued requests are exported. Senders blocked on a
+// full queue return errExporterStopped. It is safe to call more than once.
+func (e *asyncExporter) stop() {
+	e.sendMu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.stopping)
+	}
+	e.sendMu.Unlock()
+	e.closeOnce.Do(func() {
+		e.senders.Wait()
+		close(e.queue)
+	})
+}
+
+// flushPendingExports drains every running exporter until ctx is done, and returns the export errors joined.
+func flushPendingExports(ctx context.Context) error {
+	pendingExporters.Lock()
+	exporters := make([]*asyncExporter, 0, len(pendingExporters.set))
+	for e := range pendingExporters.set {
+		exporters = append(exporters, e)
+	}
+	pendingExporters.Unlock()
+
+	var errs []error
+	for _, e := range exporters {
+		errs = append(errs, e.drain(ctx))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+)
+
+// makeSchemaRequest returns a request identified by the schema URL of its only ResourceMetrics.
+func makeSchemaRequest(url string) *metricsservicepb.ExportMetricsServiceRequest {
+	return &metricsservicepb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{SchemaUrl: url}},
+	}
+}
+
+func TestAsyncExporterDrainsQueue(t *testing.T) {
+	var mu sync.Mutex
+	var exported []string
+	exp := startAsyncExporter(context.Background(), 2, func(ctx context.Context, reqs []*metricsservicepb.ExportMetricsServiceRequest) error {
+		time.Sleep(10 * time.Millisecond)
+		name := reqs[0].GetResourceMetrics()[0].GetSchemaUrl()
+		mu.Lock()
+		exported = append(exported, name)
+		mu.Unlock()
+		if name == "fail" {
+			return errors.New("export rejected")
+		}
+		return nil
+	})
+
+	names := []string{"a", "fail", "b", "c", "d"}
+	for i, name := range names {
+		err := exp.enqueue(context.Background(), strconv.Itoa(i), []*metricsservicepb.ExportMetricsServiceRequest{makeSchemaRequest(name)})
+		if err != nil {
+			t.Fatalf("enqueue %s failed: %v", name, err)
+		}
+	}
+	err := exp.drain(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "record 1: export rejected") {
+		t.Errorf("expected the export error with its record ID, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(exported, ",") != strings.Join(names, ",") {
+		t.Errorf("expected every queued request to be exported in order before drain returns, got %v", exported)
+	}
+}
+
+func TestAsyncExporterDrainRespectsDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	exp := startAsyncExporter(context.Background(), 1, func(ctx context.Context, reqs []*metricsservicepb.ExportMetricsServiceRequest) error {
+		<-release
+		return nil
+	})
+	if err := exp.enqueue(context.Background(), "0", nil); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := exp.drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected drain to stop at the deadline, got %v", err)
+	}
+}
+
+func TestAsyncExporterStopReleasesBlockedSender(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	exp := startAsyncExporter(context.Background(), 1, func(ctx context.Context, reqs []*metricsservicepb.ExportMetricsServiceRequest) error {
+		<-release
+		return nil
+	})
+	// The first record is taken by the exporter goroutine and the second fills the queue.
+	for _, id := range []string{"0", "1"} {
+		if err := exp.enqueue(context.Background(), id, nil); err != nil {
+			t.Fatalf("enqueue %s failed: %v", id, err)
+		}
+	}
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- exp.enqueue(context.Background(), "2", nil)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		exp.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stop blocked behind a sender waiting on a full queue")
+	}
+	if err := <-blocked; !errors.Is(err, errExporterStopped) {
+		t.Errorf("expected the blocked enqueue to fail with errExporterStopped, got %v", err)
+	}
+}
+
+// countingMetricsServer counts the requests it receives.
+type countingMetricsServer struct {
+	metricsservicepb.UnimplementedMetricsServiceServer
+	mu       sync.Mutex
+	received int
+}
+
+func (s *countingMetricsServer) Export(ctx context.Context, req *metricsservicepb.ExportMetricsServiceRequest) (*metricsservicepb.ExportMetricsServiceResponse, error) {
+	time.Sleep(5 * time.Millisecond)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received++
+	return &metricsservicepb.ExportMetricsServiceResponse{}, nil
+}
+
+func TestLambdaHandlerAsyncExport(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := grpc.NewServer()
+	collector := &countingMetricsServer{}
+	metricsservicepb.RegisterMetricsServiceServer(srv, collector)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	t.Cleanup(func() {
+		sharedConnMu.Lock()
+		defer sharedConnMu.Unlock()
+		if sharedConn != nil {
+			sharedConn.Close()
+		}
+		sharedConn, sharedClient, sharedConnCfg = nil, nil, grpcConnConfig{}
+	})
+
+	orig := newTaggingFactory
+	newTaggingFactory = func(*slog.Logger, string) (taggingClientFactory, error) {
+		return brokenTaggingFactory{}, nil
+	}
+	t.Cleanup(func() { newTaggingFactory = orig })
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", lis.Addr().String())
+	t.Setenv("ASYNC_EXPORT", "true")
+	t.Setenv("ASYNC_EXPORT_QUEUE_SIZE", "1")
+
+	var records []events.KinesisFirehoseEventRecord
+	for _, id := range []string{"rec-1", "rec-2", "rec-3", "rec-4"} {
+		data, err := requestsIntoRawData([]*metricsservicepb.ExportMetricsServiceRequest{makeSchemaRequest(id)})
+		if err != nil {
+			t.Fatalf("requestsIntoRawData failed: %v", err)
+		}
+		records = append(records, events.KinesisFirehoseEventRecord{RecordID: id, Data: data})
+	}
+	if _, err := lambdaHandler(context.Background(), events.KinesisFirehoseEvent{Records: records}); err != nil {
+		t.Fatalf("lambdaHandler failed: %v", err)
+	}
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	if collector.received != len(records) {
+		t.Errorf("expected %d requests exported before the handler returned, got %d", len(records), collector.received)
+	}
+}
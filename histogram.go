@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// histogramBuckets are the buckets of a histogram data point in the explicit layout: counts[i] counts the
+// values up to bounds[i] not counted by a lower bucket, and the last count, past every bound, is +Inf's.
+type histogramBuckets struct {
+	bounds []float64
+	counts []uint64
+}
+
+// exponentialHistogramBuckets returns the buckets of an exponential histogram data point, lowest first:
+// the negative buckets, the zero bucket bounded by the zero threshold, then the positive buckets.
+func exponentialHistogramBuckets(dp *metricspb.ExponentialHistogramDataPoint) histogramBuckets {
+	base := math.Exp2(math.Exp2(-float64(dp.GetScale())))
+	var b histogramBuckets
+	neg := dp.GetNegative()
+	for j := len(neg.GetBucketCounts()) - 1; j >= 0; j-- {
+		b.bounds = append(b.bounds, -math.Pow(base, float64(int(neg.GetOffset())+j)))
+		b.counts = append(b.counts, neg.GetBucketCounts()[j])
+	}
+	b.bounds = append(b.bounds, dp.GetZeroThreshold())
+	b.counts = append(b.counts, dp.GetZeroCount())
+	pos := dp.GetPositive()
+	for i, c := range pos.GetBucketCounts() {
+		b.bounds = append(b.bounds, math.Pow(base, float64(int(pos.GetOffset())+i+1)))
+		b.counts = append(b.counts, c)
+	}
+	b.counts = append(b.counts, 0)
+	return b
+}
+
+// histogramBucketGauges returns the classic Prometheus series of a histogram data point for
+// EMIT_HISTOGRAM_BUCKETS: one *_bucket gauge per bound with its cumulative count and an le label, ending
+// with le="+Inf", then *_sum and *_count, so histogram_quantile() works downstream.
+func histogramBucketGauges(
+	cwm *model.Metric,
+	buckets histogramBuckets,
+	count uint64,
+	sum float64,
+	ts, startTs uint64,
+	attrs []*commonpb.KeyValue,
+	conv summaryConversion,
+) []statisticGauge {
+	name := statisticMetricName(conv.nameStyle, cwm, "")
+	countGauge := func(name string, v uint64, attrs []*commonpb.KeyValue) *metricspb.Metric {
+		m := newGauge(name, float64(v), ts, startTs, attrs)
+		if conv.integerCounts {
+			setIntValues(m, int64(v))
+		}
+		return m
+	}
+	withLe := func(le string) []*commonpb.KeyValue {
+		out := make([]*commonpb.KeyValue, 0, len(attrs)+1)
+		out = append(out, attrs...)
+		return append(out, &commonpb.KeyValue{Key: "le", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: le}}})
+	}
+
+	gauges := make([]statisticGauge, 0, len(buckets.bounds)+3)
+	var cumulative uint64
+	for i, bound := range buckets.bounds {
+		if i < len(buckets.counts) {
+			cumulative += buckets.counts[i]
+		}
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		gauges = append(gauges, statisticGauge{"bucket", countGauge(name+"_bucket", cumulative, withLe(le))})
+	}
+	gauges = append(gauges,
+		statisticGauge{"bucket", countGauge(name+"_bucket", count, withLe("+Inf"))},
+		statisticGauge{"Sum", newGauge(name+"_sum", sum, ts, startTs, attrs)},
+		statisticGauge{"SampleCount", countGauge(name+"_count", count, attrs)},
+	)
+	return gauges
+}
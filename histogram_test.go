@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// bucketValues returns the values of the *_bucket gauges of histogramBucketGauges by le label, and the
+// values of the other gauges by name.
+func bucketValues(gauges []statisticGauge) map[string]float64 {
+	got := make(map[string]float64)
+	for _, sg := range gauges {
+		dp := sg.metric.GetGauge().GetDataPoints()[0]
+		if le, ok := keyValueToMap(dp.GetAttributes())["le"]; ok {
+			got[le] = dp.GetAsDouble()
+		} else {
+			got[sg.metric.GetName()] = dp.GetAsDouble()
+		}
+	}
+	return got
+}
+
+func TestHistogramBucketGauges(t *testing.T) {
+	cwm := &model.Metric{Namespace: "AWS/ApplicationELB", MetricName: "TargetResponseTime"}
+	buckets := histogramBuckets{bounds: []float64{1, 5, 10}, counts: []uint64{2, 3, 4, 1}}
+
+	gauges := histogramBucketGauges(cwm, buckets, 10, 42, 2000, 1000, nil, summaryConversion{})
+	want := map[string]float64{
+		"1": 2, "5": 5, "10": 9, "+Inf": 10,
+		"aws_applicationelb_target_response_time_sum":   42,
+		"aws_applicationelb_target_response_time_count": 10,
+	}
+	got := bucketValues(gauges)
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: got %v, want %v", k, got[k], v)
+		}
+	}
+	for _, sg := range gauges[:4] {
+		if sg.metric.GetName() != "aws_applicationelb_target_response_time_bucket" {
+			t.Errorf("unexpected bucket name %q", sg.metric.GetName())
+		}
+	}
+
+	gauges = histogramBucketGauges(cwm, buckets, 10, 42, 2000, 1000, nil, summaryConversion{integerCounts: true})
+	if dp := gauges[3].metric.GetGauge().GetDataPoints()[0]; dp.GetAsInt() != 10 {
+		t.Errorf("expected an integer +Inf bucket with INTEGER_COUNTS, got %v", dp)
+	}
+}
+
+func TestExponentialHistogramBuckets(t *testing.T) {
+	dp := &metricspb.ExponentialHistogramDataPoint{
+		Count:     4,
+		ZeroCount: 1,
+		Positive:  &metricspb.ExponentialHistogramDataPoint_Buckets{BucketCounts: []uint64{1, 2}},
+	}
+	cwm := &model.Metric{Namespace: "AWS/EC2", MetricName: "CPUUtilization"}
+	got := bucketValues(histogramBucketGauges(cwm, exponentialHistogramBuckets(dp), dp.GetCount(), 0, 0, 0, nil, summaryConversion{}))
+	for le, v := range map[string]float64{"0": 1, "2": 2, "4": 4, "+Inf": 4} {
+		if got[le] != v {
+			t.Errorf("le=%s: got %v, want %v", le, got[le], v)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package prompb holds the Prometheus remote-write 1.0 messages the enricher sends: WriteRequest,
+// TimeSeries, Label and Sample from prometheus/prompb (remote.proto and types.proto), encoded by hand
+// with protowire so the binary does not depend on the whole Prometheus module. Fields the enricher never
+// sets (metadata, exemplars, native histograms) are left out; Unmarshal skips them.
+package prompb
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// WriteRequest is prometheus.WriteRequest.
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+// TimeSeries is prometheus.TimeSeries. Labels must be sorted by name.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// Label is prometheus.Label.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is prometheus.Sample; Timestamp is in milliseconds since the epoch.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// Marshal returns the protobuf wire encoding of m, byte for byte what the upstream gogo-generated code
+// produces: fields in number order and proto3 zero values omitted.
+func (m *WriteRequest) Marshal() ([]byte, error) {
+	var b []byte
+	for _, ts := range m.Timeseries {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts.marshal())
+	}
+	return b, nil
+}
+
+func (m *TimeSeries) marshal() []byte {
+	var b []byte
+	for _, l := range m.Labels {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, l.marshal())
+	}
+	for _, s := range m.Samples {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, s.marshal())
+	}
+	return b
+}
+
+func (m *Label) marshal() []byte {
+	var b []byte
+	if m.Name != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, m.Name)
+	}
+	if m.Value != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, m.Value)
+	}
+	return b
+}
+
+func (m *Sample) marshal() []byte {
+	var b []byte
+	if m.Value != 0 {
+		b = protowire.AppendTag(b, 1, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(m.Value))
+	}
+	if m.Timestamp != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Timestamp))
+	}
+	return b
+}
+
+// Unmarshal decodes the protobuf wire encoding b into m, replacing its contents.
+func (m *WriteRequest) Unmarshal(b []byte) error {
+	*m = WriteRequest{}
+	return walk(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if num == 1 && typ == protowire.BytesType {
+			var ts TimeSeries
+			if err := ts.unmarshal(v); err != nil {
+				return err
+			}
+			m.Timeseries = append(m.Timeseries, ts)
+		}
+		return nil
+	})
+}
+
+func (m *TimeSeries) unmarshal(b []byte) error {
+	return walk(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			var l Label
+			if err := walk(v, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+				if typ == protowire.BytesType {
+					switch num {
+					case 1:
+						l.Name = string(v)
+					case 2:
+						l.Value = string(v)
+					}
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			m.Labels = append(m.Labels, l)
+		case 2:
+			var s Sample
+			if err := walk(v, func(num protowire.Number, typ protowire.Type, _ []byte, n uint64) error {
+				switch {
+				case num == 1 && typ == protowire.Fixed64Type:
+					s.Value = math.Float64frombits(n)
+				case num == 2 && typ == protowire.VarintType:
+					s.Timestamp = int64(n)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			m.Samples = append(m.Samples, s)
+		}
+		return nil
+	})
+}
+
+// walk calls fn for each field of the message encoded in b, with the field's bytes for length-delimited
+// fields and its value for varint and fixed-width ones. Groups are skipped.
+func walk(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return fmt.Errorf("prompb: %w", protowire.ParseError(l))
+		}
+		b = b[l:]
+		var (
+			v []byte
+			n uint64
+		)
+		switch typ {
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			n, l = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var n32 uint32
+			n32, l = protowire.ConsumeFixed32(b)
+			n = uint64(n32)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, b)
+			if l >= 0 {
+				b = b[l:]
+				continue
+			}
+		}
+		if l < 0 {
+			return fmt.Errorf("prompb: %w", protowire.ParseError(l))
+		}
+		b = b[l:]
+		if err := fn(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
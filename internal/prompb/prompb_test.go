@@ -0,0 +1,52 @@
+package prompb
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestWriteRequestWireFormat(t *testing.T) {
+	wr := &WriteRequest{Timeseries: []TimeSeries{{
+		Labels:  []Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "x"}},
+		Samples: []Sample{{Value: 1.5, Timestamp: 1000}, {Value: 0, Timestamp: -1}},
+	}, {}}}
+	// Encoded by github.com/prometheus/prometheus/prompb v0.304.2.
+	want := []byte("\n5\n\x0e\n\b__name__\x12\x02up\n\b\n\x03job\x12\x01x\x12\f\t\x00\x00\x00\x00\x00\x00\xf8?\x10\xe8\a\x12\v\x10\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01\n\x00")
+
+	b, err := wr.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("Marshal mismatch:\n got %q\nwant %q", b, want)
+	}
+
+	var got WriteRequest
+	if err := got.Unmarshal(b); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(&got, wr) {
+		t.Errorf("round trip mismatch: got %+v, want %+v", got, *wr)
+	}
+}
+
+func TestWriteRequestUnmarshalSkipsUnknownFields(t *testing.T) {
+	// A metadata entry (field 3) before a series holding an exemplar (field 3) and a sample.
+	b := []byte("\x1a\x02\x08\x01\n\x0f\x1a\x02\x10\x01\x12\t\t\x00\x00\x00\x00\x00\x00\xf0?")
+	var got WriteRequest
+	if err := got.Unmarshal(b); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	want := WriteRequest{Timeseries: []TimeSeries{{Samples: []Sample{{Value: 1}}}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteRequestUnmarshalTruncated(t *testing.T) {
+	var wr WriteRequest
+	if err := wr.Unmarshal([]byte("\n5\n\x0e")); err == nil {
+		t.Error("expected an error for a truncated message")
+	}
+}
@@ -2,20 +2,38 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log/slog"
+	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/grafana/regexp"
 	"github.com/matttproud/golang_protobuf_extensions/v2/pbutil"
 	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/clients/tagging"
 	clientsv2 "github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/clients/v2"
@@ -23,92 +41,463 @@ import (
 	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/job/maxdimassociator"
 	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
 	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/promutil"
+	logspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
 	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
 	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
 	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	grpcgzip "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 const cacheFile = "cache"
 
+// version identifies the enricher build. Release builds set it with -ldflags "-X main.version=<version>".
+var version = "dev"
+
+// taggingClientFactory is the subset of the YACE client factory used to build the tagging client.
+type taggingClientFactory interface {
+	Refresh()
+	GetTaggingClient(region string, role model.Role, concurrencyLimit int) tagging.Client
+}
+
+// newTaggingFactory creates the YACE client factory for region. Tests replace it.
+var newTaggingFactory = func(logger *slog.Logger, region string) (taggingClientFactory, error) {
+	return clientsv2.NewFactory(logger, model.JobsConfig{
+		DiscoveryJobs: []model.DiscoveryJob{
+			{
+				Regions: []string{region},
+				Roles:   []model.Role{{}},
+			},
+		},
+	}, false)
+}
+
+// buildTaggingClient refreshes factory and returns its tagging client for region. The factory reports
+// no errors itself, so a panic or a nil client is turned into an error.
+func buildTaggingClient(factory taggingClientFactory, region string) (client tagging.Client, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			client, err = nil, fmt.Errorf("failed to build tagging client: %v", r)
+		}
+	}()
+	factory.Refresh()
+	client = factory.GetTaggingClient(region, model.Role{}, 5)
+	if client == nil {
+		return nil, errors.New("tagging client factory returned no client")
+	}
+	return client, nil
+}
+
+// regionalTaggingClient sends each GetResources call to a tagging client for the requested region. The
+// YACE clients are bound to the region they were built for, so clients for regions other than the
+// Lambda's own are built on first use with newClient and kept for the invocation.
+type regionalTaggingClient struct {
+	mu        sync.Mutex
+	clients   map[string]tagging.Client
+	newClient func(region string) (tagging.Client, error)
+}
+
+func newRegionalTaggingClient(logger *slog.Logger, region string, client tagging.Client) *regionalTaggingClient {
+	return &regionalTaggingClient{
+		clients: map[string]tagging.Client{region: client},
+		newClient: func(region string) (tagging.Client, error) {
+			factory, err := newTaggingFactory(logger, region)
+			if err != nil {
+				return nil, err
+			}
+			return buildTaggingClient(factory, region)
+		},
+	}
+}
+
+func (c *regionalTaggingClient) GetResources(ctx context.Context, job model.DiscoveryJob, region string) ([]*model.TaggedResource, error) {
+	c.mu.Lock()
+	client, ok := c.clients[region]
+	if !ok {
+		var err error
+		client, err = c.newClient(region)
+		if err != nil {
+			c.mu.Unlock()
+			return nil, fmt.Errorf("tagging client for region %s: %w", region, err)
+		}
+		c.clients[region] = client
+	}
+	c.mu.Unlock()
+	return client.GetResources(ctx, job, region)
+}
+
+// errTaggingBudgetExhausted is returned by budgetedTaggingClient once its calls are used up.
+var errTaggingBudgetExhausted = errors.New("tagging API call budget exhausted")
+
+// budgetedTaggingClient allows at most limit GetResources calls, bounding the Tagging API cost and
+// latency of one invocation. Later calls fail with errTaggingBudgetExhausted without reaching the API.
+type budgetedTaggingClient struct {
+	client tagging.Client
+	limit  int64
+	calls  atomic.Int64
+}
+
+func (c *budgetedTaggingClient) GetResources(ctx context.Context, job model.DiscoveryJob, region string) ([]*model.TaggedResource, error) {
+	if c.calls.Add(1) > c.limit {
+		return nil, errTaggingBudgetExhausted
+	}
+	return c.client.GetResources(ctx, job, region)
+}
+
+// retryingTaggingClient retries failed GetResources calls up to maxRetries times, waiting backoff before
+// the first retry and doubling it before each next one, so a transient Tagging API error does not leave a
+// namespace unmatched for the whole cache window. Errors retrying cannot fix, an empty namespace or an
+// exhausted call budget, are returned at once, as is the context's error when it is done while waiting.
+type retryingTaggingClient struct {
+	client     tagging.Client
+	maxRetries int
+	backoff    time.Duration
+}
+
+func (c retryingTaggingClient) GetResources(ctx context.Context, job model.DiscoveryJob, region string) ([]*model.TaggedResource, error) {
+	delay := c.backoff
+	for attempt := 0; ; attempt++ {
+		resources, err := c.client.GetResources(ctx, job, region)
+		if err == nil || attempt >= c.maxRetries ||
+			errors.Is(err, tagging.ErrExpectedToFindResources) || errors.Is(err, errTaggingBudgetExhausted) {
+			return resources, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
 func main() {
-	lambda.Start(lambdaHandler)
+	lambda.StartWithOptions(lambdaHandler, lambda.WithEnableSIGTERM(func() {
+		shutdown(newLogger(os.Getenv("LOG_LEVEL")), shutdownFlushTimeout)
+	}))
 }
 
 func lambdaHandler(ctx context.Context, request events.KinesisFirehoseEvent) (interface{}, error) {
+	invocationStart := time.Now()
 	logger := newLogger(os.Getenv("LOG_LEVEL"))
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		// Correlates every log line of the invocation with the platform's START, END and REPORT lines.
+		logger = logger.With("aws_request_id", lc.AwsRequestID)
+	}
+	// The subsystem loggers are built once, so an invalid LOG_LEVEL_<SUBSYSTEM> is warned about once.
+	enrichLogger := subsystemLogger(logger, logSubsystemEnrich)
+	exportLogger := subsystemLogger(logger, logSubsystemExport)
+	cacheLogger := subsystemLogger(logger, logSubsystemCache)
 	region := aws.String(os.Getenv("AWS_REGION"))
 
-	continueOnResourceFailure := envBool("CONTINUE_ON_RESOURCE_FAILURE", true)
 	continueOnExportFailure := envBool("CONTINUE_ON_EXPORT_FAILURE", true)
-	fileCacheEnabled := envBool("FILE_CACHE_ENABLED", true)
-	fileCacheExpiration := envDuration("FILE_CACHE_EXPIRATION", 1*time.Hour, logger)
-	fileCachePath := envString("FILE_CACHE_PATH", "/tmp")
-	staticLabels, err := parseStaticLabels(os.Getenv("STATIC_LABELS"))
+	cfg := enhanceConfig{
+		continueOnResourceFailure:  envBool("CONTINUE_ON_RESOURCE_FAILURE", true),
+		cacheLogger:                cacheLogger,
+		fileCacheEnabled:           envBool("FILE_CACHE_ENABLED", true),
+		fileCacheCompress:          envBool("FILE_CACHE_COMPRESS", false),
+		fileCacheExpiration:        envDuration("FILE_CACHE_EXPIRATION", 1*time.Hour, logger),
+		fileCachePath:              envString("FILE_CACHE_PATH", "/tmp"),
+		defaultLabels:              envBool("DEFAULT_LABELS", false),
+		labelsSnakeCase:            envBool("LABELS_SNAKE_CASE", false),
+		yaceCompatMode:             envBool("YACE_COMPAT_MODE", false),
+		keepOriginalOnSkip:         envBool("KEEP_ORIGINAL_ON_SKIP", false),
+		emitMatchStatus:            envBool("EMIT_MATCH_STATUS", false),
+		emitResourceType:           envBool("EMIT_RESOURCE_TYPE_LABEL", false),
+		emitIngestLag:              envBool("EMIT_INGEST_LAG", false),
+		dropAccountID:              !envBool("EMIT_ACCOUNT_ID_LABEL", true),
+		inferNamespaceFromName:     envBool("INFER_NAMESPACE_FROM_NAME", false),
+		regionFromResource:         envBool("REGION_FROM_RESOURCE", false),
+		enableARNFallback:          envBool("ENABLE_ARN_FALLBACK", false),
+		zeroGaugeStartTime:         envBool("ZERO_START_TIME", false),
+		scopePerStatistic:          envBool("SCOPE_PER_STATISTIC", false),
+		shortNamespace:             envBool("SHORT_NAMESPACE", false),
+		nameFromARN:                os.Getenv("NAME_FROM_ARN"),
+		jobLabel:                   os.Getenv("JOB_LABEL"),
+		strictDimensionMatch:       envBool("STRICT_DIMENSION_MATCH", false),
+		typedDimensions:            envBool("TYPED_DIMENSIONS", false),
+		filterResourcesByDimension: envBool("FILTER_RESOURCES_BY_DIMENSION", false),
+		preserveOriginalAttrs:      envBool("PRESERVE_ORIGINAL_ATTRS", false),
+		sampleCountAsCounter:       envBool("SAMPLECOUNT_AS_COUNTER", false),
+		integerCounts:              envBool("INTEGER_COUNTS", false),
+		dropZeroCount:              envBool("DROP_ZERO_COUNT", false),
+		emitHistogramBuckets:       envBool("EMIT_HISTOGRAM_BUCKETS", false),
+		strictMetricNames:          envBool("STRICT_METRIC_NAMES", false),
+		stableOutput:               envBool("STABLE_OUTPUT", false),
+		failOnNoResources:          envBool("FAIL_ON_NO_RESOURCES", false),
+		accountIDResourceKeys:      parseCommaList(os.Getenv("ACCOUNT_ID_RESOURCE_KEYS"), defaultAccountIDResourceKeys),
+		regionResourceKeys:         parseCommaList(os.Getenv("REGION_RESOURCE_KEYS"), defaultRegionResourceKeys),
+		datapointAccountIDAttrKeys: parseCommaList(os.Getenv("DATAPOINT_ACCOUNT_ID_KEYS"), defaultDatapointAccountIDKeys),
+		datapointRegionAttrKeys:    parseCommaList(os.Getenv("DATAPOINT_REGION_KEYS"), defaultDatapointRegionKeys),
+		skipLogSampler:             newLogSampler(envInt("SKIP_LOG_SAMPLE_RATE", 0, logger)),
+	}
+	var err error
+	cfg.staticLabels, cfg.namespaceStaticLabels, err = parseStaticLabelSets(os.Getenv("STATIC_LABELS"))
 	if err != nil {
 		logger.Error("Failed to parse STATIC_LABELS", "error", err)
 	}
-	defaultLabels := envBool("DEFAULT_LABELS", false)
-	labelsSnakeCase := envBool("LABELS_SNAKE_CASE", false)
-	exportedTags, err := parseExportedTags(os.Getenv("EXPORTED_TAGS_ON_METRICS"))
+	cfg.scopeLabels, err = parseScopeLabels(os.Getenv("SCOPE_LABELS"))
+	if err != nil {
+		logger.Error("Failed to parse SCOPE_LABELS", "error", err)
+	}
+	cfg.statisticAliases, err = parseStatisticAliases(os.Getenv("STATISTIC_ALIASES"))
+	if err != nil {
+		logger.Error("Failed to parse STATISTIC_ALIASES", "error", err)
+	}
+	cfg.semconvDimensionMap, err = parseSemconvDimensionMap(os.Getenv("SEMCONV_DIMENSION_MAP"))
+	if err != nil {
+		logger.Error("Failed to parse SEMCONV_DIMENSION_MAP", "error", err)
+	}
+	cfg.enabledAccounts, err = parseEnabledAccounts(os.Getenv("ENABLED_ACCOUNTS"))
+	if err != nil {
+		logger.Error("Failed to parse ENABLED_ACCOUNTS", "error", err)
+	}
+	cfg.compositeDimensions, err = parseCompositeDimensions(os.Getenv("COMPOSITE_DIMENSIONS"))
+	if err != nil {
+		logger.Error("Failed to parse COMPOSITE_DIMENSIONS", "error", err)
+	}
+	cfg.exportedTags, err = parseExportedTags(os.Getenv("EXPORTED_TAGS_ON_METRICS"))
 	if err != nil {
 		logger.Error("Failed to parse EXPORTED_TAGS_ON_METRICS", "error", err)
 	}
-	outputMode := strings.ToLower(envString("FIREHOSE_OUTPUT_MODE", "pass_through"))
-	yaceCompatMode := envBool("YACE_COMPAT_MODE", false)
-	yaceCompatStats, err := parseYACEStats(os.Getenv("YACE_COMPAT_STATS"))
+	cfg.resourceTagFilters, err = parseResourceTagFilters(os.Getenv("RESOURCE_TAG_FILTERS"))
+	if err != nil {
+		logger.Error("Failed to parse RESOURCE_TAG_FILTERS", "error", err)
+	}
+	if envBool("EMIT_RESOURCE_INFO", false) {
+		cfg.matchedResources = newMatchedResources()
+	}
+	if envBool("PUBLISH_CW_METRICS", false) {
+		cfg.enrichmentCounts = &enrichmentCounts{}
+	}
+	if envBool("COVERAGE_REPORT", false) {
+		cfg.coverage = newAssociationCoverage()
+	}
+	outputMode := strings.ToLower(envString("FIREHOSE_OUTPUT_MODE", outputModePassThrough))
+	decodeRecord := recordDecoder(strings.ToLower(envString("INPUT_FORMAT", inputFormatOTLP)))
+	maxResponseRecordBytes := envInt("MAX_RESPONSE_RECORD_BYTES", defaultMaxResponseRecordBytes, logger)
+	cfg.statisticsFilter, err = parseStatisticsFilter(os.Getenv("STATISTICS_FILTER"))
+	if err != nil {
+		logger.Error("Failed to parse STATISTICS_FILTER", "error", err)
+	}
+	cfg.dimensionValueNormalize, err = parseDimensionValueNormalize(os.Getenv("DIMENSION_VALUE_NORMALIZE"))
+	if err != nil {
+		logger.Warn("Invalid DIMENSION_VALUE_NORMALIZE, leaving dimension values unchanged", "error", err)
+	}
+	cfg.metricNameStyle, err = parseMetricNameStyle(os.Getenv("METRIC_NAME_STYLE"))
+	if err != nil {
+		logger.Warn("Invalid METRIC_NAME_STYLE, using prometheus", "error", err)
+	}
+	cfg.tagValues.maxLength = envInt("MAX_TAG_VALUE_LENGTH", 0, logger)
+	cfg.tagValues.re, cfg.tagValues.replacement, err = parseTagValueRegexReplace(os.Getenv("TAG_VALUE_REGEX_REPLACE"))
+	if err != nil {
+		logger.Error("Failed to parse TAG_VALUE_REGEX_REPLACE", "error", err)
+	}
+	globalNamespaces, err := parseStringList(os.Getenv("GLOBAL_NAMESPACES"))
+	if err != nil {
+		logger.Error("Failed to parse GLOBAL_NAMESPACES", "error", err)
+	}
+	for _, ns := range globalNamespaces {
+		if cfg.globalNamespaces == nil {
+			cfg.globalNamespaces = make(map[string]bool, len(globalNamespaces))
+		}
+		cfg.globalNamespaces[ns] = true
+	}
+	cfg.stripAttrs, err = parseStripAttrs(os.Getenv("STRIP_ATTRS"))
+	if err != nil {
+		logger.Error("Failed to parse STRIP_ATTRS, using defaults", "error", err)
+	}
+	cfg.yaceCompatStats, err = parseYACEStats(os.Getenv("YACE_COMPAT_STATS"))
 	if err != nil {
 		logger.Error("Failed to parse YACE_COMPAT_STATS", "error", err)
 		// Use defaults on error
-		yaceCompatStats, _ = parseYACEStats("")
+		cfg.yaceCompatStats, _ = parseYACEStats("")
+	}
+
+	var dedupe *deduper
+	if envBool("DEDUPE", false) {
+		dedupe = newDeduper()
+	}
+
+	sumTemporality, convertSums, err := parseSumTemporality(os.Getenv("SUM_TEMPORALITY"))
+	if err != nil {
+		logger.Error("Failed to parse SUM_TEMPORALITY, passing Sum metrics through", "error", err)
 	}
 
+	deltaSuppression := envBool("DELTA_SUPPRESSION", false)
+	emitProvenance := envBool("EMIT_PROVENANCE_LABELS", false)
+	emitVersion := envBool("EMIT_ENRICHER_VERSION", false)
+
 	resourcesPerNamespace := make(map[string][]*model.TaggedResource)
 	associatorsPerNamespace := make(map[string]maxdimassociator.Associator)
 	responseRecords := make([]events.KinesisFirehoseResponseRecord, 0, len(request.Records))
 
-	cache, err := clientsv2.NewFactory(logger, model.JobsConfig{
-		DiscoveryJobs: []model.DiscoveryJob{
-			{
-				Regions: []string{*region},
-				Roles:   []model.Role{{}},
-			},
-		},
-	}, false)
+	var taggingClient tagging.Client
+	staticResourceFile := os.Getenv("STATIC_RESOURCE_FILE")
+	if staticResourceFile != "" {
+		// A static inventory replaces the Tagging API entirely.
+		if taggingClient, err = loadStaticResources(staticResourceFile); err != nil {
+			taggingClient = nil
+			logger.Error("Failed to load STATIC_RESOURCE_FILE, passing metrics through without enrichment", "file", staticResourceFile, "error", err)
+		}
+	} else {
+		cache, err := newTaggingFactory(logger, *region)
+		if err == nil {
+			taggingClient, err = buildTaggingClient(cache, *region)
+		}
+		if err != nil {
+			logger.Warn("Tagging client unavailable, passing metrics through without enrichment", "error", err)
+		}
+	}
+	customServices, err := parseCustomNamespaces(os.Getenv("CUSTOM_NAMESPACE_DIMENSIONS"), os.Getenv("CUSTOM_NAMESPACE_RESOURCE_FILTERS"))
 	if err != nil {
-		logger.Error("Failed to create a new cache client", "error", err)
-		return nil, err
+		logger.Error("Failed to parse CUSTOM_NAMESPACE_DIMENSIONS", "error", err)
+	}
+	registerCustomServices(logger, customServices)
+
+	stats := newTaggingStats()
+	var clientTag tagging.Client
+	if taggingClient != nil {
+		client := taggingClient
+		if staticResourceFile == "" {
+			client = newRegionalTaggingClient(logger, *region, taggingClient)
+		}
+		if limit := envInt("MAX_TAGGING_CALLS_PER_INVOCATION", 0, logger); limit > 0 {
+			client = &budgetedTaggingClient{client: client, limit: int64(limit)}
+		}
+		if retries := envInt("TAGGING_MAX_RETRIES", 0, logger); retries > 0 {
+			client = retryingTaggingClient{client: client, maxRetries: retries, backoff: envDuration("TAGGING_RETRY_BACKOFF", 200*time.Millisecond, logger)}
+		}
+		clientTag = timedTaggingClient{client: client, stats: stats}
 	}
-	cache.Refresh()
-	clientTag := cache.GetTaggingClient(*region, model.Role{}, 5)
 
-	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
-	insecureConn := envBool("OTEL_EXPORTER_OTLP_INSECURE", true)
-	exportTimeout := envDuration("OTEL_EXPORTER_OTLP_TIMEOUT", 5*time.Second, logger)
+	prewarm, err := parseStringList(os.Getenv("PREWARM_NAMESPACES"))
+	if err != nil {
+		logger.Error("Failed to parse PREWARM_NAMESPACES", "error", err)
+	}
+	if len(prewarm) > 0 && clientTag != nil {
+		prewarmNamespaces(logger, cfg, prewarm, resourcesPerNamespace, associatorsPerNamespace, region, clientTag)
+	}
+
+	connCfg := grpcConnConfig{
+		endpoint:         otlpEndpoint(os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"), os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")),
+		insecure:         envBool("OTEL_EXPORTER_OTLP_INSECURE", true),
+		tlsServerName:    os.Getenv("OTEL_EXPORTER_OTLP_TLS_SERVER_NAME"),
+		caPEM:            os.Getenv("OTEL_EXPORTER_OTLP_CA_PEM"),
+		clientCertPEM:    os.Getenv("OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE_PEM"),
+		clientKeyPEM:     os.Getenv("OTEL_EXPORTER_OTLP_CLIENT_KEY_PEM"),
+		timeout:          envDuration("OTEL_EXPORTER_OTLP_TIMEOUT", 5*time.Second, logger),
+		keepaliveTime:    envDuration("OTEL_GRPC_KEEPALIVE_TIME", 0, logger),
+		keepaliveTimeout: envDuration("OTEL_GRPC_KEEPALIVE_TIMEOUT", 0, logger),
+		dedupHeader:      envBool("EMIT_DEDUP_HEADER", false),
+		maxSendMsgSize:   envInt("OTEL_GRPC_MAX_SEND_MSG_SIZE", 0, logger),
+		compression:      strings.ToLower(os.Getenv("OTEL_EXPORTER_OTLP_COMPRESSION")),
+	}
+	if c := connCfg.compression; c != "" && c != "none" && c != grpcgzip.Name {
+		logger.Warn("Unsupported OTEL_EXPORTER_OTLP_COMPRESSION, sending uncompressed", "compression", c)
+	}
+	exportTimeout := connCfg.timeout
+	exportConcurrency := envInt("OTEL_EXPORT_CONCURRENCY", 1, logger)
+	var exportOpts []grpc.CallOption
+	if envBool("OTEL_EXPORTER_WAIT_FOR_READY", false) {
+		// Queue calls until the connection is ready, bounded by the export timeout, instead of failing fast.
+		exportOpts = append(exportOpts, grpc.WaitForReady(true))
+	}
+
+	if envBool("SELF_TEST", false) && len(request.Records) == 0 {
+		return runSelfTest(ctx, logger, clientTag, *region, connCfg), nil
+	}
+
+	endpointWeights, err := parseEndpointWeights(os.Getenv("OTEL_ENDPOINT_WEIGHTS"))
+	if err != nil {
+		logger.Error("Failed to parse OTEL_ENDPOINT_WEIGHTS", "error", err)
+	}
+	routingRules, err := parseRoutingRules(os.Getenv("OTEL_ROUTING_RULES"))
+	if err != nil {
+		logger.Error("Failed to parse OTEL_ROUTING_RULES", "error", err)
+	}
+	exportEnabled := connCfg.endpoint != "" || len(endpointWeights) > 0 || len(routingRules) > 0
+
+	var grpcClient metricsservicepb.MetricsServiceClient
+	if len(endpointWeights) > 0 {
+		grpcClient, err = weightedGRPCClient(logger, connCfg, endpointWeights)
+		if err != nil {
+			exportLogger.Error("Failed to create OTLP gRPC connection", "error", err)
+			if !continueOnExportFailure {
+				return nil, err
+			}
+		}
+	} else if connCfg.endpoint != "" {
+		grpcClient, err = sharedGRPCClient(connCfg)
+		if err != nil {
+			exportLogger.Error("Failed to create OTLP gRPC connection", "error", err)
+			if !continueOnExportFailure {
+				return nil, err
+			}
+		}
+	}
 
-	var grpcConn *grpc.ClientConn
-	if endpoint != "" {
-		grpcConn, err = newGRPCConn(endpoint, insecureConn, exportTimeout)
+	remoteWriteURL := os.Getenv("PROM_REMOTE_WRITE_URL")
+	remoteWriteTimeout := envDuration("PROM_REMOTE_WRITE_TIMEOUT", 5*time.Second, logger)
+	remoteWriteClient := http.DefaultClient
+	if remoteWriteURL != "" && envBool("OTEL_EXPORTER_SIGV4", false) {
+		sigv4Region := envString("OTEL_EXPORTER_SIGV4_REGION", aws.ToString(region))
+		remoteWriteClient, err = newSigV4HTTPClient(ctx, envString("OTEL_EXPORTER_SIGV4_SERVICE", "aps"), sigv4Region)
 		if err != nil {
-			logger.Error("Failed to create OTLP gRPC connection", "error", err)
+			logger.Error("Failed to load AWS credentials for SigV4", "error", err)
 			if !continueOnExportFailure {
 				return nil, err
 			}
+			remoteWriteURL = ""
 		}
 	}
-	if grpcConn != nil {
-		defer grpcConn.Close()
+
+	if len(routingRules) > 0 {
+		grpcClient = routedGRPCClient(exportLogger, connCfg, envString("OTEL_ROUTING_ATTRIBUTE", defaultRoutingAttribute), routingRules, grpcClient)
+	}
+
+	if threshold := envInt("OTEL_EXPORT_CIRCUIT_BREAKER_THRESHOLD", 0, logger); grpcClient != nil && threshold > 0 {
+		exportBreaker.configure(threshold, envDuration("OTEL_EXPORT_CIRCUIT_BREAKER_COOLDOWN", defaultCircuitBreakerCooldown, logger))
+		grpcClient = breakerClient{client: grpcClient, breaker: exportBreaker}
 	}
 
-	var grpcClient metricsservicepb.MetricsServiceClient
-	if grpcConn != nil {
-		grpcClient = metricsservicepb.NewMetricsServiceClient(grpcConn)
+	var asyncExp *asyncExporter
+	if grpcClient != nil && envBool("ASYNC_EXPORT", false) {
+		asyncExp = startAsyncExporter(ctx, envInt("ASYNC_EXPORT_QUEUE_SIZE", defaultAsyncExportQueueSize, logger),
+			func(ctx context.Context, reqs []*metricsservicepb.ExportMetricsServiceRequest) error {
+				return exportRequests(ctx, grpcClient, reqs, exportTimeout, exportConcurrency, exportOpts...)
+			})
+		defer asyncExp.stop()
+	}
+
+	dumpFile := os.Getenv("DEBUG_DUMP_FILE")
+	dumpMaxBytes := envInt("DEBUG_DUMP_MAX_BYTES", defaultDebugDumpMaxBytes, logger)
+
+	archiveBucket := os.Getenv("ARCHIVE_S3_BUCKET")
+	var archive *archiveBuffer
+	if archiveBucket != "" {
+		archive = &archiveBuffer{}
 	}
 
 	for _, record := range request.Records {
-		expMetricsReqs, err := rawDataIntoRequests(record.Data)
+		logger := recordLogger(logger, record)
+		exportLogger := recordLogger(exportLogger, record)
+		expMetricsReqs, err := decodeRecord(record.Data)
+		if errors.Is(err, errNotMetrics) {
+			logger.Debug("Passing through record that is not an OTLP metrics request")
+			responseRecords = append(responseRecords, passThroughRecord(record))
+			continue
+		}
 		if err != nil {
 			logger.Error("Failed to decode record data", "error", err)
 			if !continueOnExportFailure {
@@ -118,165 +507,575 @@ func lambdaHandler(ctx context.Context, request events.KinesisFirehoseEvent) (in
 			continue
 		}
 
-		if err := enhanceRequests(
-			logger,
-			fileCachePath,
-			continueOnResourceFailure,
-			expMetricsReqs,
-			resourcesPerNamespace,
-			associatorsPerNamespace,
-			region,
-			clientTag,
-			fileCacheExpiration,
-			fileCacheEnabled,
-			staticLabels,
-			defaultLabels,
-			labelsSnakeCase,
-			exportedTags,
-			yaceCompatMode,
-			yaceCompatStats,
-		); err != nil {
-			logger.Error("Failed to enhance record data", "error", err)
-			if !continueOnResourceFailure {
-				return nil, err
+		// Without a tagging client, the metrics are exported as received.
+		if clientTag != nil {
+			recordCfg := cfg
+			recordCfg.cacheLogger = recordLogger(cacheLogger, record)
+			if emitProvenance {
+				recordCfg.provenance = newRecordProvenance(record, lambdacontext.FunctionName)
+			}
+			if err := enhanceRequests(
+				recordLogger(enrichLogger, record),
+				recordCfg,
+				expMetricsReqs,
+				resourcesPerNamespace,
+				associatorsPerNamespace,
+				region,
+				clientTag,
+			); err != nil {
+				logger.Error("Failed to enhance record data", "error", err)
+				if !cfg.continueOnResourceFailure {
+					return nil, err
+				}
 			}
 		}
 
-		if grpcClient != nil {
-			err = exportRequests(ctx, grpcClient, expMetricsReqs, exportTimeout)
-			if err != nil {
-				logger.Error("Failed to export OTLP metrics", "error", err)
+		if emitVersion {
+			setEnricherVersion(expMetricsReqs, version)
+		}
+
+		if dedupe != nil {
+			if dropped := dedupe.dedupeRequests(expMetricsReqs); dropped > 0 {
+				logger.Debug("Dropped duplicate data points", "count", dropped)
+			}
+		}
+
+		if convertSums {
+			if dropped := sumTemporalityState.convertRequests(expMetricsReqs, sumTemporality); dropped > 0 {
+				logger.Debug("Dropped Sum data points without a previous value", "count", dropped)
+			}
+		}
+
+		if deltaSuppression {
+			if dropped := deltaSuppressionState.suppressRequests(expMetricsReqs); dropped > 0 {
+				logger.Debug("Suppressed unchanged gauge data points", "count", dropped)
+			}
+		}
+
+		if dumpFile != "" {
+			if err := dumpRequests(dumpFile, expMetricsReqs, int64(dumpMaxBytes)); err != nil {
+				logger.Warn("Failed to write enriched metrics to DEBUG_DUMP_FILE", "file", dumpFile, "error", err)
+			}
+		}
+
+		if asyncExp != nil {
+			if err := asyncExp.enqueue(ctx, record.RecordID, expMetricsReqs); err != nil {
+				exportLogger.Error("Failed to queue OTLP metrics for export", "error", err)
+				if !continueOnExportFailure {
+					return nil, err
+				}
+			}
+		} else if exportEnabled {
+			err = exportRequests(ctx, grpcClient, expMetricsReqs, exportTimeout, exportConcurrency, exportOpts...)
+			if errors.Is(err, errNoExporter) || onlyCircuitOpen(err) {
+				// The connection failure was already logged and tolerated, or the collector kept failing and
+				// exports are short-circuited; this record is just not exported.
+				exportLogger.Info("Skipping OTLP export", "reason", err)
+			} else if err != nil {
+				exportLogger.Error("Failed to export OTLP metrics", "error", err)
 				if !continueOnExportFailure {
 					return nil, err
 				}
 			}
 		}
 
-		var responseData []byte
-		if outputMode == "enhanced" {
-			responseData, err = requestsIntoRawData(expMetricsReqs)
+		if remoteWriteURL != "" {
+			err = remoteWrite(ctx, remoteWriteClient, remoteWriteURL, requestsToWriteRequest(expMetricsReqs), remoteWriteTimeout)
 			if err != nil {
-				logger.Error("Failed to encode enhanced metrics", "error", err)
+				exportLogger.Error("Failed to remote-write metrics", "error", err)
 				if !continueOnExportFailure {
 					return nil, err
 				}
-				responseRecords = append(responseRecords, passThroughRecord(record))
-				continue
 			}
-		} else {
-			responseData = record.Data
+		}
+
+		if archive != nil {
+			if err := archive.add(expMetricsReqs); err != nil {
+				logger.Error("Failed to serialize metrics for archive", "error", err)
+				if !continueOnExportFailure {
+					return nil, err
+				}
+			}
+		}
+
+		responseData, err := responseDataForMode(logger, outputMode, record, expMetricsReqs, maxResponseRecordBytes)
+		if err != nil {
+			logger.Error("Failed to encode enhanced metrics", "error", err)
+			if !continueOnExportFailure {
+				return nil, err
+			}
+			responseRecords = append(responseRecords, passThroughRecord(record))
+			continue
 		}
 
 		responseRecords = append(responseRecords, buildResponseRecord(record.RecordID, responseData))
 	}
 
+	if asyncExp != nil {
+		if err := asyncExp.drain(ctx); err != nil {
+			// Batches short-circuited by the open circuit are only skipped; any other error still fails.
+			skipped, failed := splitCircuitOpen(err)
+			if skipped != nil {
+				exportLogger.Info("Skipped OTLP exports", "reason", skipped)
+			}
+			if failed != nil {
+				exportLogger.Error("Failed to export OTLP metrics", "error", failed)
+				if !continueOnExportFailure {
+					return nil, failed
+				}
+			}
+		}
+	}
+
+	if grpcClient != nil && cfg.matchedResources != nil {
+		if infoReq := resourceInfoRequest(logger, cfg, cfg.matchedResources, time.Now()); infoReq != nil {
+			err := exportRequests(ctx, grpcClient, []*metricsservicepb.ExportMetricsServiceRequest{infoReq}, exportTimeout, exportConcurrency, exportOpts...)
+			if err != nil {
+				exportLogger.Error("Failed to export resource info", "error", err)
+			}
+		}
+	}
+
+	logTaggingStats(logger, stats)
+	logCoverage(logger, cfg.coverage)
+	if grpcClient != nil && envBool("EMIT_ENRICHER_STATS", false) {
+		if statsReq := enricherStatsRequest(stats, resourcesPerNamespace, invocationStart, time.Now(), *region); statsReq != nil {
+			err := exportRequests(ctx, grpcClient, []*metricsservicepb.ExportMetricsServiceRequest{statsReq}, exportTimeout, exportConcurrency, exportOpts...)
+			if err != nil {
+				exportLogger.Error("Failed to export enricher stats", "error", err)
+			}
+		}
+	}
+
+	if cfg.enrichmentCounts != nil {
+		if err := publishEnrichmentCounts(ctx, cfg.enrichmentCounts, len(request.Records), *region); err != nil {
+			logger.Error("Failed to publish enricher metrics to CloudWatch", "error", err)
+		}
+	}
+
+	if archive != nil {
+		if err := flushArchive(ctx, archive, archiveBucket, *region); err != nil {
+			logger.Error("Failed to archive metrics to S3", "bucket", archiveBucket, "error", err)
+			if !continueOnExportFailure {
+				return nil, err
+			}
+		}
+	}
+
 	return events.KinesisFirehoseResponse{
 		Records: responseRecords,
 	}, nil
 }
 
+// flushArchive writes the invocation's archived metrics to bucket under ARCHIVE_S3_PREFIX.
+func flushArchive(ctx context.Context, archive *archiveBuffer, bucket, region string) error {
+	if archive.count == 0 {
+		return nil
+	}
+	client, err := newS3Client(ctx, region)
+	if err != nil {
+		return err
+	}
+	id := "local"
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		id = lc.AwsRequestID
+	}
+	key := archiveKey(envString("ARCHIVE_S3_PREFIX", "enriched-metrics"), time.Now(), id)
+	return archive.flush(ctx, client, bucket, key)
+}
+
+// enhanceConfig holds the environment-derived settings that control enrichment.
+type enhanceConfig struct {
+	fileCachePath             string
+	continueOnResourceFailure bool
+	fileCacheExpiration       time.Duration
+	fileCacheEnabled          bool
+	fileCacheCompress         bool
+	staticLabels              map[string]string
+	// namespaceStaticLabels holds static labels that apply only to one namespace, on top of staticLabels.
+	namespaceStaticLabels map[string]map[string]string
+	defaultLabels         bool
+	labelsSnakeCase       bool
+	exportedTags          []string
+	resourceTagFilters    []model.SearchTag
+	yaceCompatMode        bool
+	yaceCompatStats       map[string]bool
+	// keepOriginalOnSkip keeps the original Summary in compat mode when association skips the metric.
+	keepOriginalOnSkip bool
+	emitMatchStatus    bool
+	// emitResourceType adds a resource_type label derived from the matched resource's ARN.
+	emitResourceType bool
+	// provenance, when set, adds the firehose_arrival_ts and enricher_source labels of the record being enriched.
+	provenance *recordProvenance
+	// inferNamespaceFromName takes a missing Namespace or MetricName attribute from the metric name.
+	inferNamespaceFromName bool
+	// dropAccountID omits the account_id label, for single-account deployments where it is constant.
+	dropAccountID bool
+	// enabledAccounts, when set, holds ENABLED_ACCOUNTS: only data points of these accounts are enriched.
+	enabledAccounts map[string]bool
+	// jobLabel, when set, is the value of a job label, as Prometheus scrape configs and YACE set it.
+	jobLabel string
+	// regionFromResource takes the region label from the matched resource's ARN when it has one.
+	regionFromResource bool
+	// semconvDimensionMap holds SEMCONV_DIMENSION_MAP, see applySemconvDimensions.
+	semconvDimensionMap map[string]string
+	// compositeDimensions holds COMPOSITE_DIMENSIONS, see compositeDimensionLabels.
+	compositeDimensions []compositeDimension
+	// statisticAliases holds STATISTIC_ALIASES, applied to statistics before naming.
+	statisticAliases statisticAliases
+	// matchedResources, when set, collects the matched resources for the EMIT_RESOURCE_INFO info metric.
+	matchedResources *matchedResources
+	// enrichmentCounts, when set, counts the association decisions for PUBLISH_CW_METRICS.
+	enrichmentCounts *enrichmentCounts
+	// coverage, when set, counts the association coverage per namespace for COVERAGE_REPORT.
+	coverage *associationCoverage
+	// cacheLogger, when set, logs the resource cache lookups, leveled by LOG_LEVEL_CACHE.
+	cacheLogger *slog.Logger
+	// skipLogSampler, when set, logs 1 in SKIP_LOG_SAMPLE_RATE skipped data points at info level.
+	skipLogSampler *logSampler
+	// globalNamespaces holds GLOBAL_NAMESPACES, namespaces of global services such as AWS/CloudFront whose
+	// resources are only tagged in us-east-1. They are always discovered there and labeled region "global".
+	globalNamespaces map[string]bool
+	// emitIngestLag adds an ingest_lag_seconds label, the age of the data point at enrichment time.
+	emitIngestLag bool
+	// clock is used for file cache expiration and ingest lag; nil means real time.
+	clock Clock
+	// accountIDResourceKeys and regionResourceKeys are the resource attribute keys tried in order
+	// for the account_id and region labels; nil means the OTel semantic convention keys.
+	accountIDResourceKeys []string
+	regionResourceKeys    []string
+	// datapointAccountIDAttrKeys and datapointRegionAttrKeys are data point attribute keys used when the
+	// resource has no account or region; nil means AccountId and Region.
+	datapointAccountIDAttrKeys []string
+	datapointRegionAttrKeys    []string
+	// strictDimensionMatch treats a metric as unmatched when it carries a dimension the service does not know.
+	strictDimensionMatch bool
+	// statisticsFilter, when non-nil, drops Summary data points whose Statistic is not listed.
+	statisticsFilter map[string]bool
+	// nameFromARN selects how the name label is derived from a matched resource, see resourceName.
+	nameFromARN string
+	// shortNamespace strips the AWS/ prefix from the namespace label value only.
+	shortNamespace bool
+	// scopePerStatistic groups the gauges emitted in compat mode into one scope per statistic.
+	scopePerStatistic bool
+	// zeroGaugeStartTime clears StartTimeUnixNano on gauges emitted in compat mode.
+	zeroGaugeStartTime bool
+	// enableARNFallback matches dimension values against cached ARN suffixes when the associator finds nothing.
+	enableARNFallback bool
+	// dimensionValueNormalize is a DIMENSION_VALUE_NORMALIZE mode for dimension_* label values.
+	dimensionValueNormalize string
+	// filterResourcesByDimension associates each metric only with the resource types its dimensions select.
+	filterResourcesByDimension bool
+	// typedDimensions emits integer and decimal dimension values as int and double attributes.
+	typedDimensions bool
+	// tagValues normalizes tag and custom_tag label values.
+	tagValues tagValueNormalizer
+	// metricNameStyle is metricNameStylePrometheus or metricNameStyleCloudWatch; other values act as the former.
+	metricNameStyle string
+	// strictMetricNames restricts enriched metric names to [a-z0-9_], see sanitizeMetricName.
+	strictMetricNames bool
+	// stableOutput sorts the metrics of each scope by name in compat mode, see sortMetricsByName.
+	stableOutput bool
+	// sampleCountAsCounter emits SampleCount as a monotonic counter instead of a gauge in compat mode.
+	sampleCountAsCounter bool
+	// integerCounts stores SampleCount values as integers in compat mode.
+	integerCounts bool
+	// dropZeroCount emits no gauges for Summary data points with a zero Count in compat mode.
+	dropZeroCount bool
+	// emitHistogramBuckets converts histograms to le-labeled *_bucket, *_sum and *_count gauges in compat mode.
+	emitHistogramBuckets bool
+	// failOnNoResources reports namespaces without discovered resources as resource failures.
+	failOnNoResources bool
+	// preserveOriginalAttrs keeps the incoming data point attributes alongside the YACE labels in non-compat mode.
+	preserveOriginalAttrs bool
+	// stripAttrs holds the normalized attribute keys (see stripAttrKey) never carried over by preserveOriginalAttrs.
+	stripAttrs map[string]bool
+	// scopeLabels holds SCOPE_LABELS, static labels per instrumentation scope name. enhanceRequests copies
+	// the entry of each scope into scopeStaticLabels while enriching its metrics.
+	scopeLabels       map[string]map[string]string
+	scopeStaticLabels map[string]string
+}
+
 func enhanceRequests(
 	logger *slog.Logger,
-	fileCachePath string,
-	continueOnResourceFailure bool,
+	cfg enhanceConfig,
 	expMetricsReqs []*metricsservicepb.ExportMetricsServiceRequest,
 	resourceCache map[string][]*model.TaggedResource,
 	associatorCache map[string]maxdimassociator.Associator,
 	region *string,
 	client tagging.Client,
-	fileCacheExpiration time.Duration,
-	fileCacheEnabled bool,
-	staticLabels map[string]string,
-	defaultLabels bool,
-	labelsSnakeCase bool,
-	exportedTags []string,
-	yaceCompatMode bool,
-	yaceCompatStats map[string]bool,
 ) error {
+	store := resourceStore{resources: resourceCache, associators: associatorCache}
 	for _, req := range expMetricsReqs {
 		for _, rm := range req.GetResourceMetrics() {
 			// Extract account_id and region from resource attributes
-			accountID, resourceRegion := extractResourceAttributes(rm)
+			accountID, resourceRegion := extractResourceAttributesWithKeys(rm, cfg.accountIDKeys(), cfg.regionKeys())
 			// Use resource region if available, otherwise fall back to Lambda region
 			effectiveRegion := resourceRegion
 			if effectiveRegion == "" && region != nil {
 				effectiveRegion = *region
 			}
 
-			for smIdx, sm := range rm.GetScopeMetrics() {
+			var byStatistic statisticScopes
+			for _, sm := range rm.GetScopeMetrics() {
+				cfg := cfg
+				cfg.scopeStaticLabels = cfg.scopeLabels[sm.GetScope().GetName()]
+				// enrichDataPoint associates the data point attributes with a resource and returns its CloudWatch
+				// metric and YACE labels. It returns a nil metric when the data point is not enriched, and true
+				// when it is to be kept as received (KEEP_ORIGINAL_ON_SKIP).
+				enrichDataPoint := func(metricName string, attrs []*commonpb.KeyValue, ts uint64) (*model.Metric, []*commonpb.KeyValue, bool, error) {
+					cwm := buildCloudWatchMetricFromKeyValues(attrs)
+					if cfg.semconvDimensionMap != nil {
+						applySemconvDimensions(cwm, attrs, cfg.semconvDimensionMap)
+					}
+					if cfg.inferNamespaceFromName && (cwm.Namespace == "" || cwm.MetricName == "") {
+						if ns, name, ok := cloudWatchNameParts(metricName); ok {
+							cwm.Namespace = cmp.Or(cwm.Namespace, ns)
+							cwm.MetricName = cmp.Or(cwm.MetricName, name)
+						}
+					}
+					if cwm.MetricName == "" || cwm.Namespace == "" {
+						cfg.logSkip(logger, "Metric name or namespace is missing, skipping tags enrichment", "namespace", cwm.Namespace, "metric", cwm.MetricName)
+						return nil, nil, false, nil
+					}
+					svc := config.SupportedServices.GetService(cwm.Namespace)
+					if svc == nil {
+						cfg.logSkip(logger, "Unsupported namespace, skipping tags enrichment", "namespace", cwm.Namespace, "metric", cwm.MetricName)
+						return nil, nil, false, nil
+					}
+					dpAccountID := accountID
+					if dpAccountID == "" {
+						dpAccountID = firstAttrValue(attrs, cfg.datapointAccountIDKeys())
+					}
+					if cfg.enabledAccounts != nil && !cfg.enabledAccounts[dpAccountID] {
+						cfg.logSkip(logger, "Account not enabled, skipping tags enrichment", "account_id", dpAccountID, "namespace", cwm.Namespace, "metric", cwm.MetricName)
+						return nil, nil, false, nil
+					}
+
+					discoveryRegion := cfg.discoveryRegion(cwm.Namespace, effectiveRegion)
+					cacheKey := resourceCacheKey(cwm.Namespace, discoveryRegion, aws.ToString(region))
+					if !store.has(cacheKey) {
+						resources, err := getOrCacheResources(
+							cfg.cacheLog(logger),
+							client,
+							cfg.fileCachePath,
+							cwm.Namespace,
+							aws.String(discoveryRegion),
+							cfg.resourceTagFilters,
+							cfg.fileCacheExpiration,
+							cfg.fileCacheEnabled,
+							cfg.fileCacheCompress,
+							cfg.failOnNoResources,
+							cfg.cacheClock(),
+						)
+						if errors.Is(err, errTaggingBudgetExhausted) {
+							logger.Warn("Tagging API call budget exhausted, treating namespace as unmatched", "namespace", cwm.Namespace, "region", discoveryRegion)
+							resources, err = nil, nil
+						}
+						if err != nil {
+							if cfg.continueOnResourceFailure {
+								logger.Error("Failed to get resources for namespace", "namespace", cwm.Namespace, "error", err)
+								return nil, nil, false, nil
+							}
+							return nil, nil, false, err
+						}
+						store.set(cacheKey, resources)
+					}
+
+					var asc maxdimassociator.Associator
+					if cfg.filterResourcesByDimension {
+						asc = store.dimensionAssociator(logger, cacheKey, svc, cwm)
+					} else {
+						asc = store.associator(logger, cacheKey, svc)
+					}
+
+					r, skip := asc.AssociateMetricToResource(cwm)
+					if r == nil && cfg.enableARNFallback {
+						if fr := arnFallback(cwm, store.resources[cacheKey]); fr != nil {
+							logger.Debug("Associated metric by ARN fallback", "metric", cwm.MetricName, "arn", fr.ARN)
+							r, skip = fr, false
+						}
+					}
+					if r != nil && cfg.strictDimensionMatch {
+						if dim, ok := unknownDimension(cwm, svc); ok {
+							logger.Debug("Metric has a dimension unknown to the service, treating as unmatched", "metric", cwm.MetricName, "dimension", dim, "arn", r.ARN)
+							r, skip = nil, false
+						}
+					}
+					if r != nil && !skip {
+						cfg.matchedResources.add(cwm.Namespace, r)
+					}
+					cfg.enrichmentCounts.record(r != nil && !skip)
+					cfg.coverage.record(cwm.Namespace, r != nil && !skip)
+					if skip && cfg.yaceCompatMode && cfg.keepOriginalOnSkip {
+						return nil, nil, true, nil
+					}
+					// Labels take the account and region of the stream, then of the data point, then of the
+					// matched resource's ARN; the region finally falls back to the Lambda region.
+					dpRegion := resourceRegion
+					if resourceRegion == "" {
+						dpRegion = firstAttrValue(attrs, cfg.datapointRegionKeys())
+					}
+					if r != nil && !skip {
+						arnRegion, arnAccountID := arnRegionAccount(r.ARN)
+						dpAccountID, dpRegion = cmp.Or(dpAccountID, arnAccountID), cmp.Or(dpRegion, arnRegion)
+					}
+					dpRegion = cmp.Or(dpRegion, effectiveRegion)
+					if cfg.globalNamespaces[cwm.Namespace] {
+						dpRegion = globalRegionLabel
+					}
+					yaceLabels := buildYACELabelsKeyValue(logger, cfg, cwm, r, skip, dpRegion, dpAccountID)
+					if cfg.emitIngestLag && ts != 0 {
+						yaceLabels = append(yaceLabels, ingestLagLabel(cfg.cacheClock().Now(), ts))
+					}
+					return cwm, yaceLabels, false, nil
+				}
 				var newMetrics []*metricspb.Metric
+				emitGauges := func(gauges []statisticGauge) {
+					for _, sg := range gauges {
+						if cfg.strictMetricNames {
+							sg.metric.Name = sanitizeMetricName(sg.metric.Name)
+						}
+						if cfg.zeroGaugeStartTime {
+							clearStartTime([]*metricspb.Metric{sg.metric})
+						}
+						if cfg.scopePerStatistic {
+							byStatistic.add(sg)
+						} else {
+							newMetrics = append(newMetrics, sg.metric)
+						}
+					}
+				}
 				for _, metric := range sm.GetMetrics() {
 					switch t := metric.Data.(type) {
 					case *metricspb.Metric_Summary:
+						if cfg.statisticsFilter != nil {
+							t.Summary.DataPoints = filterByStatistic(t.Summary.DataPoints, cfg.statisticsFilter)
+						}
+						var skippedDPs []*metricspb.SummaryDataPoint
 						for _, dp := range t.Summary.GetDataPoints() {
 							attrs := dp.GetAttributes()
-							cwm := buildCloudWatchMetricFromKeyValues(attrs)
-							if cwm.MetricName == "" || cwm.Namespace == "" {
-								logger.Debug("Metric name or namespace is missing, skipping tags enrichment", "namespace", cwm.Namespace, "metric", cwm.MetricName)
+							cwm, yaceLabels, keep, err := enrichDataPoint(metric.GetName(), attrs, dp.GetTimeUnixNano())
+							if err != nil {
+								return err
+							}
+							if keep {
+								skippedDPs = append(skippedDPs, dp)
 								continue
 							}
-							svc := config.SupportedServices.GetService(cwm.Namespace)
-							if svc == nil {
-								logger.Debug("Unsupported namespace, skipping tags enrichment", "namespace", cwm.Namespace, "metric", cwm.MetricName)
+							if cwm == nil {
 								continue
 							}
 
-							if _, ok := resourceCache[cwm.Namespace]; !ok {
-								resources, err := getOrCacheResources(
-									logger,
-									client,
-									fileCachePath,
-									cwm.Namespace,
-									region,
-									fileCacheExpiration,
-									fileCacheEnabled,
-								)
-								if err != nil && err != tagging.ErrExpectedToFindResources {
-									if continueOnResourceFailure {
-										logger.Error("Failed to get resources for namespace", "namespace", cwm.Namespace, "error", err)
-										continue
-									}
-									return err
+							if cfg.yaceCompatMode {
+								// Convert Summary to multiple Gauge metrics for YACE compatibility
+								if dp.GetTimeUnixNano() == 0 {
+									logger.Warn("Summary data point has no TimeUnixNano, emitted gauges may be rejected", "namespace", cwm.Namespace, "metric", cwm.MetricName)
 								}
-								resourceCache[cwm.Namespace] = resources
+								emitGauges(summaryStatisticGauges(cwm, dp, yaceLabels, cfg.yaceCompatStats, cfg.summaryConversion()))
+							} else {
+								// Original behavior: update metric name and attributes in place. The name is built from
+								// the data point attributes, never from metric.Name, so enriching a replayed record
+								// again yields the same output: the YACE labels carry no MetricName, and preserved
+								// originals rebuild the same name and labels.
+								statistic := cfg.statisticAliases.resolve(statisticOf(attrs))
+								metric.Name = statisticMetricName(cfg.metricNameStyle, cwm, statistic)
+								if cfg.strictMetricNames {
+									metric.Name = sanitizeMetricName(metric.Name)
+								}
+								if cfg.preserveOriginalAttrs {
+									yaceLabels = mergeOriginalAttrs(yaceLabels, attrs, cfg.stripKeys())
+								}
+								yaceLabels = statisticAttrs(cfg.metricNameStyle, yaceLabels, statistic)
+								dp.Attributes = yaceLabels
 							}
-
-							asc, ok := associatorCache[cwm.Namespace]
-							if !ok {
-								asc = maxdimassociator.NewAssociator(logger, svc.ToModelDimensionsRegexp(), resourceCache[cwm.Namespace])
-								associatorCache[cwm.Namespace] = asc
+						}
+						if len(skippedDPs) > 0 {
+							newMetrics = append(newMetrics, keepSkippedSummary(metric, skippedDPs))
+						}
+					case *metricspb.Metric_ExponentialHistogram:
+						// Exponential histograms are enriched in place. In compat mode, their count, sum, minimum
+						// and maximum become gauges like the statistics of a Summary; data points that are not
+						// enriched stay in the histogram.
+						var kept []*metricspb.ExponentialHistogramDataPoint
+						for _, dp := range t.ExponentialHistogram.GetDataPoints() {
+							attrs := dp.GetAttributes()
+							cwm, yaceLabels, _, err := enrichDataPoint(metric.GetName(), attrs, dp.GetTimeUnixNano())
+							if err != nil {
+								return err
 							}
-
-							r, skip := asc.AssociateMetricToResource(cwm)
-							yaceLabels := buildYACELabelsKeyValue(logger, cwm, r, skip, staticLabels, defaultLabels, labelsSnakeCase, exportedTags, effectiveRegion, accountID)
-
-							if yaceCompatMode {
-								// Convert Summary to multiple Gauge metrics for YACE compatibility
-								gauges := summaryToGauges(cwm, dp, yaceLabels, yaceCompatStats)
-								newMetrics = append(newMetrics, gauges...)
-							} else {
-								// Original behavior: update metric name and attributes in place
-								statistic := attrValue(attrs, "Statistic")
-								if statistic == "" {
-									statistic = attrValue(attrs, "statistic")
+							switch {
+							case cwm == nil:
+								kept = append(kept, dp)
+							case cfg.yaceCompatMode && cfg.emitHistogramBuckets:
+								emitGauges(histogramBucketGauges(cwm, exponentialHistogramBuckets(dp), dp.GetCount(), dp.GetSum(),
+									dp.GetTimeUnixNano(), dp.GetStartTimeUnixNano(), yaceLabels, cfg.summaryConversion()))
+							case cfg.yaceCompatMode:
+								emitGauges(summaryStatisticGauges(cwm, exponentialHistogramSummaryPoint(dp), yaceLabels, cfg.yaceCompatStats, cfg.summaryConversion()))
+							default:
+								if cfg.preserveOriginalAttrs {
+									yaceLabels = mergeOriginalAttrs(yaceLabels, attrs, cfg.stripKeys())
 								}
-								metric.Name = promutil.BuildMetricName(cwm.Namespace, cwm.MetricName, statistic)
 								dp.Attributes = yaceLabels
 							}
 						}
-					default:
-						logger.Debug("Unsupported metric type", "type", fmt.Sprintf("%T", t))
-						if yaceCompatMode {
-							// Keep non-Summary metrics as-is in YACE compat mode
+						if cfg.yaceCompatMode && len(kept) > 0 {
+							t.ExponentialHistogram.DataPoints = kept
 							newMetrics = append(newMetrics, metric)
 						}
-					}
+					case *metricspb.Metric_Histogram:
+						// Explicit bucket histograms are only converted, to le-labeled bucket series, with
+						// EMIT_HISTOGRAM_BUCKETS in compat mode; otherwise they are kept as received.
+						if !cfg.yaceCompatMode || !cfg.emitHistogramBuckets {
+							logger.Debug("Unsupported metric type", "type", fmt.Sprintf("%T", t))
+							if cfg.yaceCompatMode {
+								newMetrics = append(newMetrics, metric)
+							}
+							continue
+						}
+						var kept []*metricspb.HistogramDataPoint
+						for _, dp := range t.Histogram.GetDataPoints() {
+							cwm, yaceLabels, _, err := enrichDataPoint(metric.GetName(), dp.GetAttributes(), dp.GetTimeUnixNano())
+							if err != nil {
+								return err
+							}
+							if cwm == nil {
+								kept = append(kept, dp)
+								continue
+							}
+							buckets := histogramBuckets{bounds: dp.GetExplicitBounds(), counts: dp.GetBucketCounts()}
+							emitGauges(histogramBucketGauges(cwm, buckets, dp.GetCount(), dp.GetSum(),
+								dp.GetTimeUnixNano(), dp.GetStartTimeUnixNano(), yaceLabels, cfg.summaryConversion()))
+						}
+						if len(kept) > 0 {
+							t.Histogram.DataPoints = kept
+							newMetrics = append(newMetrics, metric)
+						}
+					default:
+						logger.Debug("Unsupported metric type", "type", fmt.Sprintf("%T", t))
+						if cfg.yaceCompatMode {
+							// Keep non-Summary metrics as-is in YACE compat mode
+							newMetrics = append(newMetrics, metric)
+						}
+					}
 				}
 
-				// Replace metrics with converted gauges when in YACE compat mode
-				if yaceCompatMode {
-					rm.ScopeMetrics[smIdx].Metrics = newMetrics
+				// Replace metrics with converted gauges when in YACE compat mode. Only this scope's metrics
+				// are replaced; its Scope and SchemaUrl are kept, so gauges stay under the scope that sent them.
+				if cfg.yaceCompatMode {
+					if cfg.stableOutput {
+						sortMetricsByName(newMetrics)
+					}
+					sm.Metrics = newMetrics
+				} else if cfg.statisticsFilter != nil {
+					sm.Metrics = dropEmptySummaries(sm.Metrics)
+				}
+			}
+			if len(byStatistic.scopes) > 0 {
+				if cfg.stableOutput {
+					byStatistic.sort()
 				}
+				rm.ScopeMetrics = append(dropEmptyScopes(rm.ScopeMetrics), byStatistic.scopes...)
 			}
 		}
 	}
@@ -284,53 +1083,437 @@ func enhanceRequests(
 	return nil
 }
 
+// logSampler samples 1 in rate events by counting them. A nil sampler samples nothing.
+type logSampler struct {
+	rate int64
+	n    atomic.Int64
+}
+
+// newLogSampler returns a sampler for 1 in rate events, or nil when rate is 0 or less.
+func newLogSampler(rate int) *logSampler {
+	if rate <= 0 {
+		return nil
+	}
+	return &logSampler{rate: int64(rate)}
+}
+
+// sample reports whether this event is sampled: the first one and every rate-th after it.
+func (s *logSampler) sample() bool {
+	return s != nil && (s.n.Add(1)-1)%s.rate == 0
+}
+
+// logSkip logs a data point skipped by enhanceRequests at debug level, or at info level when the skip is
+// sampled, so skips stay visible at volume without enabling debug logging.
+func (c enhanceConfig) logSkip(logger *slog.Logger, msg string, args ...any) {
+	if c.skipLogSampler.sample() {
+		logger.Info(msg, append(args, "sample_rate", c.skipLogSampler.rate)...)
+		return
+	}
+	logger.Debug(msg, args...)
+}
+
+// prewarmNamespaces discovers the resources of the given namespaces concurrently and fills the resource and
+// associator caches before any record is processed. Failures are logged and left for enhanceRequests to retry.
+func prewarmNamespaces(
+	logger *slog.Logger,
+	cfg enhanceConfig,
+	namespaces []string,
+	resourceCache map[string][]*model.TaggedResource,
+	associatorCache map[string]maxdimassociator.Associator,
+	region *string,
+	client tagging.Client,
+) {
+	type result struct {
+		namespace string
+		svc       *config.ServiceConfig
+		resources []*model.TaggedResource
+		err       error
+	}
+
+	store := resourceStore{resources: resourceCache, associators: associatorCache}
+	results := make(chan result, len(namespaces))
+	var wg sync.WaitGroup
+	for _, ns := range namespaces {
+		if store.has(resourceCacheKey(ns, cfg.discoveryRegion(ns, aws.ToString(region)), aws.ToString(region))) {
+			continue
+		}
+		svc := config.SupportedServices.GetService(ns)
+		if svc == nil {
+			logger.Warn("Unsupported namespace in PREWARM_NAMESPACES, skipping", "namespace", ns)
+			continue
+		}
+		wg.Add(1)
+		go func(ns string, svc *config.ServiceConfig) {
+			defer wg.Done()
+			resources, err := getOrCacheResources(
+				cfg.cacheLog(logger),
+				client,
+				cfg.fileCachePath,
+				ns,
+				aws.String(cfg.discoveryRegion(ns, aws.ToString(region))),
+				cfg.resourceTagFilters,
+				cfg.fileCacheExpiration,
+				cfg.fileCacheEnabled,
+				cfg.fileCacheCompress,
+				cfg.failOnNoResources,
+				cfg.cacheClock(),
+			)
+			results <- result{namespace: ns, svc: svc, resources: resources, err: err}
+		}(ns, svc)
+	}
+	wg.Wait()
+	close(results)
+
+	for r := range results {
+		if r.err != nil {
+			logger.Error("Failed to prewarm resources for namespace", "namespace", r.namespace, "error", r.err)
+			continue
+		}
+		key := resourceCacheKey(r.namespace, cfg.discoveryRegion(r.namespace, aws.ToString(region)), aws.ToString(region))
+		store.set(key, r.resources)
+		store.associator(logger, key, r.svc)
+		logger.Debug("prewarmed resource cache", "namespace", r.namespace, "count", len(r.resources))
+	}
+}
+
+// resourceName returns the name label value for r according to NAME_FROM_ARN:
+// "last_segment" takes the part of the ARN after the last "/" or ":", "tag:<Key>" uses the value of
+// that resource tag, and "full" or "" keeps the ARN. The ARN is used whenever the strategy yields nothing.
+func resourceName(r *model.TaggedResource, strategy string) string {
+	switch {
+	case strategy == "last_segment":
+		if i := strings.LastIndexAny(r.ARN, "/:"); i >= 0 && i < len(r.ARN)-1 {
+			return r.ARN[i+1:]
+		}
+	case strings.HasPrefix(strategy, "tag:"):
+		key := strings.TrimPrefix(strategy, "tag:")
+		for _, tag := range r.Tags {
+			if tag.Key == key && tag.Value != "" {
+				return tag.Value
+			}
+		}
+	}
+	return r.ARN
+}
+
+// setEnricherVersion sets the enricher_version attribute on the Resource of every ResourceMetrics in reqs,
+// replacing any value set by a previous enrichment.
+func setEnricherVersion(reqs []*metricsservicepb.ExportMetricsServiceRequest, v string) {
+	for _, req := range reqs {
+		for _, rm := range req.GetResourceMetrics() {
+			if rm.Resource == nil {
+				rm.Resource = &resourcepb.Resource{}
+			}
+			attrs := slices.DeleteFunc(rm.Resource.Attributes, func(kv *commonpb.KeyValue) bool {
+				return kv.GetKey() == "enricher_version"
+			})
+			rm.Resource.Attributes = append(attrs, &commonpb.KeyValue{
+				Key:   "enricher_version",
+				Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}},
+			})
+		}
+	}
+}
+
+// recordProvenance identifies where an enriched record came from, for EMIT_PROVENANCE_LABELS.
+type recordProvenance struct {
+	// arrivalTs is the record's Firehose ApproximateArrivalTimestamp in Unix milliseconds.
+	arrivalTs string
+	// source is the name of the Lambda function that enriched the record.
+	source string
+}
+
+func newRecordProvenance(record events.KinesisFirehoseEventRecord, functionName string) *recordProvenance {
+	return &recordProvenance{
+		arrivalTs: strconv.FormatInt(record.ApproximateArrivalTimestamp.UnixMilli(), 10),
+		source:    functionName,
+	}
+}
+
+// ingestLagLabel returns the ingest_lag_seconds label: whole seconds between the data point's
+// TimeUnixNano and now.
+func ingestLagLabel(now time.Time, timeUnixNano uint64) *commonpb.KeyValue {
+	lag := now.Sub(time.Unix(0, int64(timeUnixNano)))
+	return &commonpb.KeyValue{
+		Key:   "ingest_lag_seconds",
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: strconv.FormatInt(int64(lag/time.Second), 10)}},
+	}
+}
+
+// resourceType returns "<service>:<type>" for an ARN, e.g. "ec2:instance" or "lambda:function", or just
+// the service when the resource part has no type, as for S3 buckets or SQS queues. It returns "" when
+// the ARN cannot be parsed.
+func resourceType(resourceARN string) string {
+	parsed, err := arn.Parse(resourceARN)
+	if err != nil {
+		return ""
+	}
+	if i := strings.IndexAny(parsed.Resource, "/:"); i > 0 {
+		return parsed.Service + ":" + parsed.Resource[:i]
+	}
+	return parsed.Service
+}
+
+// arnRegionAccount returns the region and account ID of an ARN. Either is "" when the ARN has none, as for
+// global services such as IAM or S3 buckets, and both are "" when it cannot be parsed.
+func arnRegionAccount(resourceARN string) (region, accountID string) {
+	parsed, err := arn.Parse(resourceARN)
+	if err != nil {
+		return "", ""
+	}
+	return parsed.Region, parsed.AccountID
+}
+
+// unknownDimension returns the first dimension of cwm that appears in none of the service's
+// dimension regexps, and true if there is one.
+func unknownDimension(cwm *model.Metric, svc *config.ServiceConfig) (string, bool) {
+	known := make(map[string]struct{})
+	for _, dr := range svc.ToModelDimensionsRegexp() {
+		for _, name := range dr.DimensionsNames {
+			known[name] = struct{}{}
+		}
+	}
+	for _, d := range cwm.Dimensions {
+		if _, ok := known[d.Name]; !ok {
+			return d.Name, true
+		}
+	}
+	return "", false
+}
+
+// arnFallback returns the single resource whose ARN ends with one of the metric's dimension values,
+// e.g. an instance ID or bucket name, or nil when no resource or more than one resource matches.
+// The value must follow a "/" or ":" in the ARN so that partial identifiers do not match.
+func arnFallback(cwm *model.Metric, resources []*model.TaggedResource) *model.TaggedResource {
+	var match *model.TaggedResource
+	for _, d := range cwm.Dimensions {
+		if !looksLikeIdentifier(d.Value) {
+			continue
+		}
+		for _, r := range resources {
+			if !strings.HasSuffix(r.ARN, "/"+d.Value) && !strings.HasSuffix(r.ARN, ":"+d.Value) {
+				continue
+			}
+			if match != nil && match != r {
+				return nil
+			}
+			match = r
+		}
+	}
+	return match
+}
+
+// looksLikeIdentifier reports whether a dimension value could be a resource identifier rather than
+// a generic value such as a stage or an operation name with spaces.
+func looksLikeIdentifier(v string) bool {
+	return len(v) >= 3 && !strings.ContainsAny(v, " \t")
+}
+
+// statisticScopePrefix prefixes the statistic in the scope names used by SCOPE_PER_STATISTIC.
+const statisticScopePrefix = "cloudwatch/"
+
+// statisticScopes groups converted gauges into one ScopeMetrics per statistic, in the order the
+// statistics are first seen.
+type statisticScopes struct {
+	scopes []*metricspb.ScopeMetrics
+	index  map[string]*metricspb.ScopeMetrics
+}
+
+func (s *statisticScopes) add(sg statisticGauge) {
+	sm, ok := s.index[sg.statistic]
+	if !ok {
+		if s.index == nil {
+			s.index = make(map[string]*metricspb.ScopeMetrics)
+		}
+		sm = &metricspb.ScopeMetrics{Scope: &commonpb.InstrumentationScope{Name: statisticScopePrefix + sg.statistic}}
+		s.index[sg.statistic] = sm
+		s.scopes = append(s.scopes, sm)
+	}
+	sm.Metrics = append(sm.Metrics, sg.metric)
+}
+
+// sort orders the statistic scopes by name, and the metrics of each by name.
+func (s *statisticScopes) sort() {
+	slices.SortFunc(s.scopes, func(a, b *metricspb.ScopeMetrics) int {
+		return strings.Compare(a.GetScope().GetName(), b.GetScope().GetName())
+	})
+	for _, sm := range s.scopes {
+		sortMetricsByName(sm.Metrics)
+	}
+}
+
+// sortMetricsByName orders metrics by name for STABLE_OUTPUT. The sort is stable, so the gauges of one
+// name, one per data point or bucket, keep the order of the input.
+func sortMetricsByName(metrics []*metricspb.Metric) {
+	slices.SortStableFunc(metrics, func(a, b *metricspb.Metric) int {
+		return strings.Compare(a.GetName(), b.GetName())
+	})
+}
+
+// dropEmptyScopes removes the scopes left without metrics once their gauges moved to statistic scopes.
+func dropEmptyScopes(scopes []*metricspb.ScopeMetrics) []*metricspb.ScopeMetrics {
+	kept := scopes[:0]
+	for _, sm := range scopes {
+		if len(sm.GetMetrics()) > 0 {
+			kept = append(kept, sm)
+		}
+	}
+	return kept
+}
+
+// keepSkippedSummary returns the Summary metric restricted to the data points that association skipped.
+// The original metric is returned unchanged when every data point was skipped.
+func keepSkippedSummary(metric *metricspb.Metric, skipped []*metricspb.SummaryDataPoint) *metricspb.Metric {
+	if len(skipped) == len(metric.GetSummary().GetDataPoints()) {
+		return metric
+	}
+	return &metricspb.Metric{
+		Name:        metric.GetName(),
+		Description: metric.GetDescription(),
+		Unit:        metric.GetUnit(),
+		Metadata:    metric.GetMetadata(),
+		Data: &metricspb.Metric_Summary{
+			Summary: &metricspb.Summary{DataPoints: skipped},
+		},
+	}
+}
+
+// firstAttrValue returns the first non-empty value among keys, tried in order.
+func firstAttrValue(attrs []*commonpb.KeyValue, keys []string) string {
+	for _, k := range keys {
+		if v := attrValue(attrs, k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// statisticOf returns the Statistic attribute of a data point, falling back to a lowercase statistic key.
+func statisticOf(attrs []*commonpb.KeyValue) string {
+	if statistic := attrValue(attrs, "Statistic"); statistic != "" {
+		return statistic
+	}
+	return attrValue(attrs, "statistic")
+}
+
+// filterByStatistic keeps the data points whose Statistic attribute is in allowed.
+func filterByStatistic(dps []*metricspb.SummaryDataPoint, allowed map[string]bool) []*metricspb.SummaryDataPoint {
+	kept := dps[:0]
+	for _, dp := range dps {
+		if allowed[statisticOf(dp.GetAttributes())] {
+			kept = append(kept, dp)
+		}
+	}
+	return kept
+}
+
+// dropEmptySummaries removes Summary metrics left without data points.
+func dropEmptySummaries(metrics []*metricspb.Metric) []*metricspb.Metric {
+	kept := metrics[:0]
+	for _, m := range metrics {
+		if s := m.GetSummary(); s != nil && len(s.GetDataPoints()) == 0 {
+			continue
+		}
+		kept = append(kept, m)
+	}
+	return kept
+}
+
 // attrValue returns the string value for key in OTLP 1.0 KeyValue attributes, or "" if not found.
 func attrValue(attrs []*commonpb.KeyValue, key string) string {
 	for _, a := range attrs {
 		if a != nil && a.GetKey() == key {
-			if v := a.GetValue(); v != nil {
-				return v.GetStringValue()
-			}
-			return ""
+			return anyValueToString(a.GetValue())
 		}
 	}
 	return ""
 }
 
-// extractResourceAttributes extracts cloud.account.id and cloud.region from OTLP Resource attributes.
-// CloudWatch Metric Streams includes these in the resource attributes.
+// anyValueToString renders scalar OTLP AnyValues as strings so non-string attributes are not read as "".
+// Bytes are base64-encoded as in the OTLP JSON encoding; arrays and kvlists yield "".
+func anyValueToString(v *commonpb.AnyValue) string {
+	switch t := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return t.StringValue
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(t.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(t.DoubleValue, 'f', -1, 64)
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(t.BoolValue)
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(t.BytesValue)
+	default:
+		return ""
+	}
+}
+
+// Default resource attribute keys for the account ID and region, following OTel semantic conventions.
+var (
+	defaultAccountIDResourceKeys = []string{"cloud.account.id"}
+	defaultRegionResourceKeys    = []string{"cloud.region"}
+)
+
+// Default data point attribute keys for the account ID and region, used when the resource lacks them.
+var (
+	defaultDatapointAccountIDKeys = []string{"AccountId"}
+	defaultDatapointRegionKeys    = []string{"Region"}
+)
+
+// extractResourceAttributes extracts the account ID and region from OTLP Resource attributes using the
+// default keys, cloud.account.id and cloud.region. CloudWatch Metric Streams includes these in the resource
+// attributes.
 func extractResourceAttributes(rm *metricspb.ResourceMetrics) (accountID, resourceRegion string) {
+	return extractResourceAttributesWithKeys(rm, defaultAccountIDResourceKeys, defaultRegionResourceKeys)
+}
+
+// extractResourceAttributesWithKeys returns the first non-empty value among accountKeys and regionKeys,
+// tried in order, from the resource attributes.
+func extractResourceAttributesWithKeys(rm *metricspb.ResourceMetrics, accountKeys, regionKeys []string) (accountID, resourceRegion string) {
 	if rm == nil || rm.GetResource() == nil {
 		return "", ""
 	}
+	values := make(map[string]string, len(rm.GetResource().GetAttributes()))
 	for _, attr := range rm.GetResource().GetAttributes() {
 		if attr == nil {
 			continue
 		}
-		switch attr.GetKey() {
-		case "cloud.account.id":
-			if v := attr.GetValue(); v != nil {
-				accountID = v.GetStringValue()
-			}
-		case "cloud.region":
-			if v := attr.GetValue(); v != nil {
-				resourceRegion = v.GetStringValue()
+		values[attr.GetKey()] = anyValueToString(attr.GetValue())
+	}
+	first := func(keys []string) string {
+		for _, k := range keys {
+			if v := values[k]; v != "" {
+				return v
 			}
 		}
+		return ""
+	}
+	return first(accountKeys), first(regionKeys)
+}
+
+// parseCommaList splits a comma-separated env value, trimming spaces and dropping empty entries.
+// It returns defaultValue when the result is empty.
+func parseCommaList(env string, defaultValue []string) []string {
+	var out []string
+	for _, v := range strings.Split(env, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	if len(out) == 0 {
+		return defaultValue
 	}
-	return accountID, resourceRegion
+	return out
 }
 
 // buildYACELabelsKeyValue builds OTLP 1.0 KeyValue attributes per YACE: region, account_id, name, dimension_*, tag_*, custom_tag_*.
+// When cfg.emitMatchStatus is set, a match_status label records whether a resource was associated.
 func buildYACELabelsKeyValue(
 	logger *slog.Logger,
+	cfg enhanceConfig,
 	cwm *model.Metric,
 	r *model.TaggedResource,
 	skip bool,
-	staticLabels map[string]string,
-	defaultLabels bool,
-	labelsSnakeCase bool,
-	exportedTags []string,
 	region string,
 	accountID string,
 ) []*commonpb.KeyValue {
@@ -340,56 +1523,97 @@ func buildYACELabelsKeyValue(
 	}
 
 	// Add region and account_id labels (YACE context labels)
+	if cfg.regionFromResource && r != nil && !skip {
+		arnRegion, _ := arnRegionAccount(r.ARN)
+		region = cmp.Or(arnRegion, region)
+	}
 	if region != "" {
 		out = append(out, &commonpb.KeyValue{Key: "region", Value: strVal(region)})
 	}
-	if accountID != "" {
+	if accountID != "" && !cfg.dropAccountID {
 		out = append(out, &commonpb.KeyValue{Key: "account_id", Value: strVal(accountID)})
 	}
 
 	// Add namespace label for dashboard compatibility
 	if cwm.Namespace != "" {
-		out = append(out, &commonpb.KeyValue{Key: "namespace", Value: strVal(cwm.Namespace)})
+		namespace := cwm.Namespace
+		if cfg.shortNamespace {
+			namespace = strings.TrimPrefix(namespace, "AWS/")
+		}
+		out = append(out, &commonpb.KeyValue{Key: "namespace", Value: strVal(namespace)})
 	}
 
+	matched := r != nil && !skip
 	nameVal := "global"
-	if r != nil && !skip {
-		nameVal = r.ARN
+	if matched {
+		nameVal = resourceName(r, cfg.nameFromARN)
 	}
 	out = append(out, &commonpb.KeyValue{Key: "name", Value: strVal(nameVal)})
 
+	if cfg.emitMatchStatus {
+		status := "unmatched"
+		if matched {
+			status = "matched"
+		}
+		out = append(out, &commonpb.KeyValue{Key: "match_status", Value: strVal(status)})
+	}
+	if cfg.emitResourceType && matched {
+		if rt := resourceType(r.ARN); rt != "" {
+			out = append(out, &commonpb.KeyValue{Key: "resource_type", Value: strVal(rt)})
+		}
+	}
+	if cfg.jobLabel != "" {
+		out = append(out, &commonpb.KeyValue{Key: "job", Value: strVal(cfg.jobLabel)})
+	}
+	if p := cfg.provenance; p != nil {
+		out = append(out,
+			&commonpb.KeyValue{Key: "firehose_arrival_ts", Value: strVal(p.arrivalTs)},
+			&commonpb.KeyValue{Key: "enricher_source", Value: strVal(p.source)},
+		)
+	}
+
+	collapsed, composites := compositeDimensionLabels(cwm.Dimensions, cfg.compositeDimensions, cfg.dimensionValueNormalize)
 	for _, dim := range cwm.Dimensions {
-		ok, promTag := promutil.PromStringTag(dim.Name, labelsSnakeCase)
+		if collapsed[dim.Name] {
+			continue
+		}
+		ok, promTag := promutil.PromStringTag(dim.Name, cfg.labelsSnakeCase)
 		if !ok {
 			logger.Warn("dimension name is an invalid prometheus label name", "dimension", dim.Name)
 			continue
 		}
-		out = append(out, &commonpb.KeyValue{Key: "dimension_" + promTag, Value: strVal(dim.Value)})
+		value := normalizeDimensionValue(cfg.dimensionValueNormalize, dim.Value)
+		if cfg.typedDimensions {
+			out = append(out, &commonpb.KeyValue{Key: "dimension_" + promTag, Value: typedDimensionValue(value)})
+			continue
+		}
+		out = append(out, &commonpb.KeyValue{Key: "dimension_" + promTag, Value: strVal(value)})
 	}
+	out = append(out, composites...)
 
-	if r != nil && !skip {
+	if matched {
 		tagsToExport := r.Tags
-		if len(exportedTags) > 0 {
-			tagsToExport = r.MetricTags(exportedTags)
+		if len(cfg.exportedTags) > 0 {
+			tagsToExport = metricTags(r, cfg.exportedTags)
 		}
 		for _, tag := range tagsToExport {
-			ok, promTag := promutil.PromStringTag(tag.Key, labelsSnakeCase)
+			ok, promTag := promutil.PromStringTag(tag.Key, cfg.labelsSnakeCase)
 			if !ok {
 				logger.Warn("metric tag name is an invalid prometheus label name", "tag", tag.Key)
 				continue
 			}
-			out = append(out, &commonpb.KeyValue{Key: "tag_" + promTag, Value: strVal(tag.Value)})
+			out = append(out, &commonpb.KeyValue{Key: "tag_" + promTag, Value: strVal(cfg.tagValues.normalize(tag.Value))})
 		}
 	}
 
-	if defaultLabels || (r != nil && !skip) {
-		for k, v := range staticLabels {
-			ok, promTag := promutil.PromStringTag(k, labelsSnakeCase)
+	if cfg.defaultLabels || matched {
+		for k, v := range cfg.staticLabelsFor(cwm.Namespace) {
+			ok, promTag := promutil.PromStringTag(k, cfg.labelsSnakeCase)
 			if !ok {
 				logger.Warn("custom tag name is an invalid prometheus label name", "tag", k)
 				continue
 			}
-			out = append(out, &commonpb.KeyValue{Key: "custom_tag_" + promTag, Value: strVal(v)})
+			out = append(out, &commonpb.KeyValue{Key: "custom_tag_" + promTag, Value: strVal(cfg.tagValues.normalize(v))})
 		}
 	}
 
@@ -399,6 +1623,35 @@ func buildYACELabelsKeyValue(
 // defaultYACEStats is the default set of statistics to export in YACE compatibility mode.
 var defaultYACEStats = []string{"Maximum", "Minimum", "Average", "Sum", "SampleCount"}
 
+// statisticAliases maps statistic names as received or derived, e.g. "avg" or "p50", to the names used
+// in metric names and labels, e.g. "Average" or "Median".
+type statisticAliases map[string]string
+
+// resolve returns the alias of statistic, or statistic itself when it has none.
+func (a statisticAliases) resolve(statistic string) string {
+	if alias, ok := a[statistic]; ok {
+		return alias
+	}
+	return statistic
+}
+
+// parseStatisticAliases parses STATISTIC_ALIASES, a JSON object of statistic names to their aliases.
+func parseStatisticAliases(env string) (statisticAliases, error) {
+	if env == "" {
+		return nil, nil
+	}
+	var aliases statisticAliases
+	if err := json.Unmarshal([]byte(env), &aliases); err != nil {
+		return nil, fmt.Errorf("STATISTIC_ALIASES is not a JSON object of strings: %w", err)
+	}
+	for from, to := range aliases {
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("STATISTIC_ALIASES contains an empty statistic in %q: %q", from, to)
+		}
+	}
+	return aliases, nil
+}
+
 // quantileToStatistic maps a quantile value to a YACE-compatible statistic name.
 func quantileToStatistic(q float64) string {
 	switch q {
@@ -434,48 +1687,224 @@ func newGauge(name string, value float64, timestampNano uint64, startTimeNano ui
 	}
 }
 
+// METRIC_NAME_STYLE values.
+const (
+	// metricNameStylePrometheus builds names like YACE, e.g. aws_ec2_cpuutilization_maximum.
+	metricNameStylePrometheus = "prometheus"
+	// metricNameStyleCloudWatch keeps the CloudWatch names, e.g. AWS:EC2:CPUUtilization, and moves the
+	// statistic to a statistic label.
+	metricNameStyleCloudWatch = "cloudwatch"
+)
+
+// invalidCloudWatchNameChars matches characters not allowed in Prometheus metric names.
+var invalidCloudWatchNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// Runs of characters and underscores replaced by sanitizeMetricName.
+var (
+	strictMetricNameInvalidChars = regexp.MustCompile(`[^a-z0-9_]`)
+	strictMetricNameUnderscores  = regexp.MustCompile(`__+`)
+)
+
+// sanitizeMetricName lowercases name and replaces each character outside [a-z0-9_] with "_", collapsing
+// repeated underscores, for backends that accept nothing else. Names from promutil.BuildMetricName are
+// mostly left as is, while the colons of the CloudWatch style and the dots of statistics like p99.9 are not.
+func sanitizeMetricName(name string) string {
+	name = strictMetricNameInvalidChars.ReplaceAllString(strings.ToLower(name), "_")
+	return strictMetricNameUnderscores.ReplaceAllString(name, "_")
+}
+
+// statisticMetricName returns the metric name for a statistic of cwm in the given style. The CloudWatch
+// style joins the namespace and metric name with colons, which unlike "/" are valid in Prometheus names.
+func statisticMetricName(style string, cwm *model.Metric, statistic string) string {
+	if style != metricNameStyleCloudWatch {
+		return promutil.BuildMetricName(cwm.Namespace, cwm.MetricName, statistic)
+	}
+	name := strings.ReplaceAll(cwm.Namespace, "/", ":") + ":" + cwm.MetricName
+	return invalidCloudWatchNameChars.ReplaceAllString(name, "_")
+}
+
+// statisticAttrs returns attrs with a statistic label in the CloudWatch style, where the statistic is
+// not part of the name. attrs is copied, as it is shared by the metrics of one data point.
+func statisticAttrs(style string, attrs []*commonpb.KeyValue, statistic string) []*commonpb.KeyValue {
+	if style != metricNameStyleCloudWatch || statistic == "" {
+		return attrs
+	}
+	out := make([]*commonpb.KeyValue, 0, len(attrs)+1)
+	out = append(out, attrs...)
+	return append(out, &commonpb.KeyValue{Key: "statistic", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: statistic}}})
+}
+
+// parseMetricNameStyle parses METRIC_NAME_STYLE, falling back to the Prometheus style.
+func parseMetricNameStyle(env string) (string, error) {
+	switch style := strings.ToLower(env); style {
+	case "", metricNameStylePrometheus:
+		return metricNameStylePrometheus, nil
+	case metricNameStyleCloudWatch:
+		return style, nil
+	default:
+		return metricNameStylePrometheus, fmt.Errorf("unknown METRIC_NAME_STYLE %q", env)
+	}
+}
+
+// newCounter creates a new OTLP monotonic delta Sum metric with a single data point. CloudWatch
+// reports each period's count separately, so the value is a delta; SUM_TEMPORALITY can make it cumulative.
+func newCounter(name string, value float64, timestampNano uint64, startTimeNano uint64, attrs []*commonpb.KeyValue) *metricspb.Metric {
+	return &metricspb.Metric{
+		Name: name,
+		Data: &metricspb.Metric_Sum{
+			Sum: &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+				IsMonotonic:            true,
+				DataPoints: []*metricspb.NumberDataPoint{{
+					Attributes:        attrs,
+					StartTimeUnixNano: startTimeNano,
+					TimeUnixNano:      timestampNano,
+					Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+				}},
+			},
+		},
+	}
+}
+
+// setIntValues stores v as AsInt in every number data point of m.
+func setIntValues(m *metricspb.Metric, v int64) {
+	var dps []*metricspb.NumberDataPoint
+	switch t := m.Data.(type) {
+	case *metricspb.Metric_Gauge:
+		dps = t.Gauge.GetDataPoints()
+	case *metricspb.Metric_Sum:
+		dps = t.Sum.GetDataPoints()
+	}
+	for _, dp := range dps {
+		dp.Value = &metricspb.NumberDataPoint_AsInt{AsInt: v}
+	}
+}
+
+// clearStartTime zeroes StartTimeUnixNano on every data point of the given gauges. Start time is
+// optional for gauges, and some backends reject gauges whose start time is set.
+func clearStartTime(gauges []*metricspb.Metric) {
+	for _, g := range gauges {
+		for _, dp := range g.GetGauge().GetDataPoints() {
+			dp.StartTimeUnixNano = 0
+		}
+	}
+}
+
+// summaryConversion holds the compat mode options of summaryToGauges.
+type summaryConversion struct {
+	// sampleCountAsCounter emits SampleCount as a delta counter named *_sample_count_total.
+	sampleCountAsCounter bool
+	// integerCounts stores SampleCount, the only integer statistic of a Summary, as AsInt.
+	integerCounts bool
+	// dropZeroCount emits nothing for a data point with a zero Count, whose Sum and SampleCount are noise.
+	dropZeroCount bool
+	// nameStyle selects the metric naming, see statisticMetricName.
+	nameStyle string
+	// aliases renames statistics before they are used in names and labels.
+	aliases statisticAliases
+}
+
 // summaryToGauges converts a Summary metric to multiple Gauge metrics for YACE compatibility.
 // It extracts SampleCount, Sum, Average, Minimum, Maximum, and percentiles as separate gauges.
+// conv adjusts the names and types of the emitted metrics, see summaryConversion.
 func summaryToGauges(
 	cwm *model.Metric,
 	dp *metricspb.SummaryDataPoint,
 	attrs []*commonpb.KeyValue,
 	enabledStats map[string]bool,
+	conv summaryConversion,
 ) []*metricspb.Metric {
-	var gauges []*metricspb.Metric
+	stats := summaryStatisticGauges(cwm, dp, attrs, enabledStats, conv)
+	gauges := make([]*metricspb.Metric, 0, len(stats))
+	for _, sg := range stats {
+		gauges = append(gauges, sg.metric)
+	}
+	return gauges
+}
+
+// exponentialHistogramSummaryPoint returns the count, sum, minimum and maximum of an exponential histogram
+// data point as a Summary data point, so compat mode converts it like a Metric Streams one. The minimum and
+// maximum are left out when the histogram does not record them.
+func exponentialHistogramSummaryPoint(dp *metricspb.ExponentialHistogramDataPoint) *metricspb.SummaryDataPoint {
+	sdp := &metricspb.SummaryDataPoint{
+		Attributes:        dp.GetAttributes(),
+		StartTimeUnixNano: dp.GetStartTimeUnixNano(),
+		TimeUnixNano:      dp.GetTimeUnixNano(),
+		Count:             dp.GetCount(),
+		Sum:               dp.GetSum(),
+	}
+	if dp.Min != nil {
+		sdp.QuantileValues = append(sdp.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{Quantile: 0, Value: dp.GetMin()})
+	}
+	if dp.Max != nil {
+		sdp.QuantileValues = append(sdp.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{Quantile: 1, Value: dp.GetMax()})
+	}
+	return sdp
+}
+
+// statisticGauge is a metric emitted by summaryToGauges along with the statistic it carries.
+type statisticGauge struct {
+	statistic string
+	metric    *metricspb.Metric
+}
+
+// summaryStatisticGauges implements summaryToGauges, keeping the statistic of each emitted metric.
+func summaryStatisticGauges(
+	cwm *model.Metric,
+	dp *metricspb.SummaryDataPoint,
+	attrs []*commonpb.KeyValue,
+	enabledStats map[string]bool,
+	conv summaryConversion,
+) []statisticGauge {
+	var gauges []statisticGauge
+	nameStyle := conv.nameStyle
 	ts := dp.GetTimeUnixNano()
 	startTs := dp.GetStartTimeUnixNano()
 	count := dp.GetCount()
+	if count == 0 && conv.dropZeroCount {
+		return nil
+	}
 	sum := dp.GetSum()
+	gauge := func(stat string, value float64) {
+		stat = conv.aliases.resolve(stat)
+		gauges = append(gauges, statisticGauge{stat, newGauge(
+			statisticMetricName(nameStyle, cwm, stat),
+			value, ts, startTs, statisticAttrs(nameStyle, attrs, stat))})
+	}
 
 	// SampleCount
 	if enabledStats["SampleCount"] {
-		gauges = append(gauges, newGauge(
-			promutil.BuildMetricName(cwm.Namespace, cwm.MetricName, "SampleCount"),
-			float64(count), ts, startTs, attrs))
+		stat := conv.aliases.resolve("SampleCount")
+		var m *metricspb.Metric
+		if conv.sampleCountAsCounter {
+			m = newCounter(
+				statisticMetricName(nameStyle, cwm, stat)+"_total",
+				float64(count), ts, startTs, statisticAttrs(nameStyle, attrs, stat))
+		} else {
+			m = newGauge(
+				statisticMetricName(nameStyle, cwm, stat),
+				float64(count), ts, startTs, statisticAttrs(nameStyle, attrs, stat))
+		}
+		if conv.integerCounts {
+			setIntValues(m, int64(count))
+		}
+		gauges = append(gauges, statisticGauge{stat, m})
 	}
 
 	// Sum
 	if enabledStats["Sum"] {
-		gauges = append(gauges, newGauge(
-			promutil.BuildMetricName(cwm.Namespace, cwm.MetricName, "Sum"),
-			sum, ts, startTs, attrs))
+		gauge("Sum", sum)
 	}
 
 	// Average (calculated from sum/count)
 	if enabledStats["Average"] && count > 0 {
-		gauges = append(gauges, newGauge(
-			promutil.BuildMetricName(cwm.Namespace, cwm.MetricName, "Average"),
-			sum/float64(count), ts, startTs, attrs))
+		gauge("Average", sum/float64(count))
 	}
 
 	// Quantiles -> Minimum, Maximum, percentiles
 	for _, qv := range dp.GetQuantileValues() {
-		stat := quantileToStatistic(qv.GetQuantile())
-		if enabledStats[stat] {
-			gauges = append(gauges, newGauge(
-				promutil.BuildMetricName(cwm.Namespace, cwm.MetricName, stat),
-				qv.GetValue(), ts, startTs, attrs))
+		if stat := conv.aliases.resolve(quantileToStatistic(qv.GetQuantile())); enabledStats[stat] {
+			gauge(stat, qv.GetValue())
 		}
 	}
 
@@ -503,6 +1932,44 @@ func parseYACEStats(env string) (map[string]bool, error) {
 	return enabled, nil
 }
 
+// parseStringList parses a JSON array of strings, returning nil for an empty env.
+func parseStringList(env string) ([]string, error) {
+	if env == "" {
+		return nil, nil
+	}
+	var list []string
+	if err := json.Unmarshal([]byte(env), &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// metricTags returns the tags of r to export for EXPORTED_TAGS_ON_METRICS. Exact keys behave like
+// model.TaggedResource.MetricTags: they are always exported, empty when r lacks the tag, so every metric
+// of a service carries the same labels. A key ending in "*" instead matches every tag of r with that
+// prefix. A tag matched by several entries is exported once.
+func metricTags(r *model.TaggedResource, exportedTags []string) []model.Tag {
+	tags := make([]model.Tag, 0, len(exportedTags))
+	seen := make(map[string]bool, len(exportedTags))
+	for _, key := range exportedTags {
+		prefix, wildcard := strings.CutSuffix(key, "*")
+		if !wildcard {
+			if !seen[key] {
+				seen[key] = true
+				tags = append(tags, r.MetricTags([]string{key})...)
+			}
+			continue
+		}
+		for _, tag := range r.Tags {
+			if strings.HasPrefix(tag.Key, prefix) && !seen[tag.Key] {
+				seen[tag.Key] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
 func parseExportedTags(env string) ([]string, error) {
 	if env == "" {
 		return nil, nil
@@ -514,20 +1981,277 @@ func parseExportedTags(env string) ([]string, error) {
 	return tags, nil
 }
 
-func getOrCacheResources(
-	logger *slog.Logger,
-	client tagging.Client,
+// tagValueRegexReplace is the TAG_VALUE_REGEX_REPLACE object; Replacement may reference groups as in
+// regexp.Regexp.ReplaceAllString.
+type tagValueRegexReplace struct {
+	Regex       string `json:"regex"`
+	Replacement string `json:"replacement"`
+}
+
+func parseTagValueRegexReplace(env string) (*regexp.Regexp, string, error) {
+	if env == "" {
+		return nil, "", nil
+	}
+	var rr tagValueRegexReplace
+	if err := json.Unmarshal([]byte(env), &rr); err != nil {
+		return nil, "", err
+	}
+	re, err := regexp.Compile(rr.Regex)
+	if err != nil {
+		return nil, "", err
+	}
+	return re, rr.Replacement, nil
+}
+
+// parseDimensionValueNormalize validates DIMENSION_VALUE_NORMALIZE: "trim", "lower", "trim_lower" or "".
+func parseDimensionValueNormalize(env string) (string, error) {
+	switch mode := strings.ToLower(env); mode {
+	case "", "trim", "lower", "trim_lower":
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown DIMENSION_VALUE_NORMALIZE %q", env)
+	}
+}
+
+// normalizeDimensionValue applies a DIMENSION_VALUE_NORMALIZE mode to a dimension label value. It is
+// not used for association, which needs the raw value to match resources.
+func normalizeDimensionValue(mode, v string) string {
+	switch mode {
+	case "trim":
+		return strings.TrimSpace(v)
+	case "lower":
+		return strings.ToLower(v)
+	case "trim_lower":
+		return strings.ToLower(strings.TrimSpace(v))
+	}
+	return v
+}
+
+var (
+	intDimensionValue    = regexp.MustCompile(`^-?(0|[1-9][0-9]*)$`)
+	doubleDimensionValue = regexp.MustCompile(`^-?(0|[1-9][0-9]*)\.[0-9]+$`)
+)
+
+// typedDimensionValue returns v as an int or double AnyValue for TYPED_DIMENSIONS when it is a plain
+// decimal number, and as a string otherwise. Values such as "007", "1e3" or "NaN" stay strings so that
+// their text is not changed by the round trip.
+func typedDimensionValue(v string) *commonpb.AnyValue {
+	if intDimensionValue.MatchString(v) {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: n}}
+		}
+	}
+	if doubleDimensionValue.MatchString(v) {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: f}}
+		}
+	}
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}
+}
+
+// tagValueNormalizer rewrites tag label values with an optional regexp replacement, then truncates
+// values longer than maxLength characters. The zero value leaves values unchanged.
+type tagValueNormalizer struct {
+	re          *regexp.Regexp
+	replacement string
+	maxLength   int
+}
+
+// truncatedSuffixLen is the length of the "…" and 8 hex digit hash appended to truncated values.
+const truncatedSuffixLen = 9
+
+func (n tagValueNormalizer) normalize(v string) string {
+	if n.re != nil {
+		v = n.re.ReplaceAllString(v, n.replacement)
+	}
+	if n.maxLength <= 0 || utf8.RuneCountInString(v) <= n.maxLength {
+		return v
+	}
+	runes := []rune(v)
+	if n.maxLength <= truncatedSuffixLen {
+		return string(runes[:n.maxLength])
+	}
+	// The hash of the full value keeps values sharing a long prefix distinct.
+	sum := sha256.Sum256([]byte(v))
+	return string(runes[:n.maxLength-truncatedSuffixLen]) + "…" + hex.EncodeToString(sum[:4])
+}
+
+// resourceTagFilter is one entry of RESOURCE_TAG_FILTERS; Value is a regular expression as in YACE searchTags.
+type resourceTagFilter struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// parseResourceTagFilters parses RESOURCE_TAG_FILTERS into YACE search tags. The tag keys are sent to the
+// Tagging API as server-side TagFilters and the values are matched client-side.
+func parseResourceTagFilters(env string) ([]model.SearchTag, error) {
+	if env == "" {
+		return nil, nil
+	}
+	var filters []resourceTagFilter
+	if err := json.Unmarshal([]byte(env), &filters); err != nil {
+		return nil, err
+	}
+	searchTags := make([]model.SearchTag, 0, len(filters))
+	for _, f := range filters {
+		if f.Key == "" {
+			return nil, errors.New("RESOURCE_TAG_FILTERS contains an entry without a key")
+		}
+		re, err := regexp.Compile(f.Value)
+		if err != nil {
+			return nil, fmt.Errorf("RESOURCE_TAG_FILTERS value for key %q: %w", f.Key, err)
+		}
+		searchTags = append(searchTags, model.SearchTag{Key: f.Key, Value: re})
+	}
+	return searchTags, nil
+}
+
+// parseCustomNamespaces parses CUSTOM_NAMESPACE_DIMENSIONS, a JSON object mapping namespaces to lists of
+// dimension regexps with named groups (as in YACE's services config), and the optional
+// CUSTOM_NAMESPACE_RESOURCE_FILTERS, mapping the same namespaces to Tagging API resource type filters.
+func parseCustomNamespaces(dimensionsEnv, filtersEnv string) ([]config.ServiceConfig, error) {
+	if dimensionsEnv == "" {
+		return nil, nil
+	}
+	var dimensions map[string][]string
+	if err := json.Unmarshal([]byte(dimensionsEnv), &dimensions); err != nil {
+		return nil, err
+	}
+	var filters map[string][]string
+	if filtersEnv != "" {
+		if err := json.Unmarshal([]byte(filtersEnv), &filters); err != nil {
+			return nil, fmt.Errorf("CUSTOM_NAMESPACE_RESOURCE_FILTERS: %w", err)
+		}
+	}
+
+	namespaces := make([]string, 0, len(dimensions))
+	for ns := range dimensions {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	svcs := make([]config.ServiceConfig, 0, len(namespaces))
+	for _, ns := range namespaces {
+		svc := config.ServiceConfig{Namespace: ns}
+		for _, expr := range dimensions[ns] {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("CUSTOM_NAMESPACE_DIMENSIONS regexp for %s: %w", ns, err)
+			}
+			svc.DimensionRegexps = append(svc.DimensionRegexps, re)
+		}
+		for _, f := range filters[ns] {
+			svc.ResourceFilters = append(svc.ResourceFilters, aws.String(f))
+		}
+		svcs = append(svcs, svc)
+	}
+	return svcs, nil
+}
+
+var customServicesMu sync.Mutex
+
+// registerCustomServices adds svcs to YACE's SupportedServices so both association and the tagging
+// client can resolve them. Namespaces that are already known, bundled or registered earlier, are left as is.
+func registerCustomServices(logger *slog.Logger, svcs []config.ServiceConfig) {
+	customServicesMu.Lock()
+	defer customServicesMu.Unlock()
+	for _, svc := range svcs {
+		if config.SupportedServices.GetService(svc.Namespace) != nil {
+			continue
+		}
+		logger.Debug("Registering custom namespace", "namespace", svc.Namespace, "dimension_regexps", len(svc.DimensionRegexps))
+		config.SupportedServices = append(config.SupportedServices, svc)
+	}
+}
+
+// Clock returns the current time. It lets tests control file cache expiration.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (c enhanceConfig) accountIDKeys() []string {
+	if len(c.accountIDResourceKeys) == 0 {
+		return defaultAccountIDResourceKeys
+	}
+	return c.accountIDResourceKeys
+}
+
+func (c enhanceConfig) summaryConversion() summaryConversion {
+	return summaryConversion{
+		sampleCountAsCounter: c.sampleCountAsCounter,
+		integerCounts:        c.integerCounts,
+		dropZeroCount:        c.dropZeroCount,
+		nameStyle:            c.metricNameStyle,
+		aliases:              c.statisticAliases,
+	}
+}
+
+func (c enhanceConfig) stripKeys() map[string]bool {
+	if c.stripAttrs == nil {
+		strip, _ := parseStripAttrs("")
+		return strip
+	}
+	return c.stripAttrs
+}
+
+func (c enhanceConfig) regionKeys() []string {
+	if len(c.regionResourceKeys) == 0 {
+		return defaultRegionResourceKeys
+	}
+	return c.regionResourceKeys
+}
+
+func (c enhanceConfig) datapointAccountIDKeys() []string {
+	if len(c.datapointAccountIDAttrKeys) == 0 {
+		return defaultDatapointAccountIDKeys
+	}
+	return c.datapointAccountIDAttrKeys
+}
+
+func (c enhanceConfig) datapointRegionKeys() []string {
+	if len(c.datapointRegionAttrKeys) == 0 {
+		return defaultDatapointRegionKeys
+	}
+	return c.datapointRegionAttrKeys
+}
+
+// cacheLog returns cacheLogger, or logger when it is not set.
+func (c enhanceConfig) cacheLog(logger *slog.Logger) *slog.Logger {
+	if c.cacheLogger == nil {
+		return logger
+	}
+	return c.cacheLogger
+}
+
+func (c enhanceConfig) cacheClock() Clock {
+	if c.clock == nil {
+		return realClock{}
+	}
+	return c.clock
+}
+
+func getOrCacheResources(
+	logger *slog.Logger,
+	client tagging.Client,
 	fileCachePath,
 	namespace string,
 	region *string,
+	searchTags []model.SearchTag,
 	cacheExpiration time.Duration,
 	cacheEnabled bool,
+	compress bool,
+	failOnNoResources bool,
+	clock Clock,
 ) ([]*model.TaggedResource, error) {
 	if !cacheEnabled {
-		return retrieveResources(namespace, region, client)
+		return retrieveResources(namespace, region, searchTags, client, failOnNoResources)
 	}
 
-	filePath := fileCachePath + "/" + cacheFile + "-" + strings.ReplaceAll(namespace, "/", "-")
+	filePath := cacheFilePath(fileCachePath, namespace, aws.ToString(region), searchTags)
 	f, err := os.Open(filePath)
 	if err != nil && !os.IsNotExist(err) {
 		return nil, err
@@ -539,12 +2263,12 @@ func getOrCacheResources(
 		if err != nil {
 			return nil, err
 		}
-		isExpired = fs.ModTime().Add(cacheExpiration).Before(time.Now())
+		isExpired = fs.ModTime().Add(cacheExpiration).Before(clock.Now())
 	}
 
 	if os.IsNotExist(err) || isExpired {
 		logger.Debug("refreshing resource cache", "namespace", namespace)
-		resources, err := retrieveResources(namespace, region, client)
+		resources, err := retrieveResources(namespace, region, searchTags, client, failOnNoResources)
 		if err != nil {
 			return nil, err
 		}
@@ -552,82 +2276,619 @@ func getOrCacheResources(
 		if err != nil {
 			return nil, err
 		}
+		if compress {
+			if b, err = gzipBytes(b); err != nil {
+				return nil, err
+			}
+		}
 
 		f, err := os.Create(filePath)
 		if err != nil {
 			return nil, err
 		}
-		defer f.Close()
+		defer f.Close()
+
+		if _, err := f.Write(b); err != nil {
+			return nil, err
+		}
+
+		return resources, nil
+	}
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	// Files are read by content rather than by FILE_CACHE_COMPRESS, so toggling it keeps existing caches usable.
+	if isGzip(b) {
+		if b, err = gunzipBytes(b); err != nil {
+			return nil, err
+		}
+	}
+
+	var resources []*model.TaggedResource
+	if err := json.Unmarshal(b, &resources); err != nil {
+		return nil, err
+	}
+	logger.Debug("loaded resources from cache", "namespace", namespace, "count", len(resources))
+	return resources, nil
+}
+
+// cacheFilePath returns the cache file for a discovery key (namespace, region and tag filters).
+// The readable part is the namespace reduced to filesystem-safe characters; a short hash of the full
+// key keeps namespaces that sanitize to the same name, or differ only by region or filters, apart.
+func cacheFilePath(dir, namespace, region string, searchTags []model.SearchTag) string {
+	key := namespace + "\x00" + region
+	for _, st := range searchTags {
+		key += "\x00" + st.Key + "=" + st.Value.String()
+	}
+	sum := sha256.Sum256([]byte(key))
+
+	safe := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '-'
+	}, namespace)
+	return filepath.Join(dir, cacheFile+"-"+safe+"-"+hex.EncodeToString(sum[:4]))
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(b []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// isGzip reports whether b starts with the gzip magic bytes.
+func isGzip(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+// resourceCacheKey returns the in-memory cache key for the resources of namespace in region. Resources of
+// the Lambda's own region are keyed by namespace alone; other regions, as seen in cross-region metric
+// streams, get a "namespace@region" key so each region is discovered and associated separately.
+func resourceCacheKey(namespace, region, defaultRegion string) string {
+	if region == "" || region == defaultRegion {
+		return namespace
+	}
+	return namespace + "@" + region
+}
+
+const (
+	// globalServiceRegion is where the resources of global services are tagged.
+	globalServiceRegion = "us-east-1"
+	// globalRegionLabel is the region label of metrics in GLOBAL_NAMESPACES.
+	globalRegionLabel = "global"
+)
+
+// discoveryRegion returns the region to discover the resources of namespace in: globalServiceRegion for
+// GLOBAL_NAMESPACES, otherwise region.
+func (c enhanceConfig) discoveryRegion(namespace, region string) string {
+	if c.globalNamespaces[namespace] {
+		return globalServiceRegion
+	}
+	return region
+}
+
+// resourceStore pairs the in-memory resource cache with the associators built from it, both keyed by
+// resourceCacheKey. Setting the resources of a key drops its associator, so the next lookup rebuilds
+// it from the new resources instead of matching against a stale set.
+type resourceStore struct {
+	resources   map[string][]*model.TaggedResource
+	associators map[string]maxdimassociator.Associator
+}
+
+func (s resourceStore) has(key string) bool {
+	_, ok := s.resources[key]
+	return ok
+}
+
+func (s resourceStore) set(key string, resources []*model.TaggedResource) {
+	s.resources[key] = resources
+	delete(s.associators, key)
+	for k := range s.associators {
+		if strings.HasPrefix(k, key+"|") {
+			delete(s.associators, k)
+		}
+	}
+}
+
+// associator returns the associator of key, building it from the cached resources on first use.
+func (s resourceStore) associator(logger *slog.Logger, key string, svc *config.ServiceConfig) maxdimassociator.Associator {
+	asc, ok := s.associators[key]
+	if !ok {
+		asc = maxdimassociator.NewAssociator(logger, svc.ToModelDimensionsRegexp(), s.resources[key])
+		s.associators[key] = asc
+	}
+	return asc
+}
+
+// dimensionAssociator returns an associator of key built only from the resources whose type the dimensions
+// of cwm select, see filterResourcesByDimension. Associators are cached per selected set of dimension regexps.
+func (s resourceStore) dimensionAssociator(logger *slog.Logger, key string, svc *config.ServiceConfig, cwm *model.Metric) maxdimassociator.Associator {
+	regexps := svc.ToModelDimensionsRegexp()
+	selected := selectedDimensionRegexps(regexps, cwm)
+	if len(selected) == 0 {
+		return s.associator(logger, key, svc)
+	}
+	ids := make([]string, len(selected))
+	for i, idx := range selected {
+		ids[i] = strconv.Itoa(idx)
+	}
+	filteredKey := key + "|" + strings.Join(ids, ",")
+	asc, ok := s.associators[filteredKey]
+	if !ok {
+		asc = maxdimassociator.NewAssociator(logger, regexps, filterResourcesByDimension(s.resources[key], regexps, cwm))
+		s.associators[filteredKey] = asc
+	}
+	return asc
+}
+
+// selectedDimensionRegexps returns the indexes of the dimension regexps whose dimensions are all present on cwm.
+func selectedDimensionRegexps(regexps []model.DimensionsRegexp, cwm *model.Metric) []int {
+	var selected []int
+	for i, dr := range regexps {
+		if len(dr.DimensionsNames) == 0 {
+			continue
+		}
+		covered := true
+		for _, name := range dr.DimensionsNames {
+			if !slices.ContainsFunc(cwm.Dimensions, func(d model.Dimension) bool { return d.Name == name }) {
+				covered = false
+				break
+			}
+		}
+		if covered {
+			selected = append(selected, i)
+		}
+	}
+	return selected
+}
+
+// filterResourcesByDimension keeps the resources whose ARN matches one of the dimension regexps fully covered
+// by the dimensions of cwm, e.g. only instance ARNs for an AWS/EC2 metric with an InstanceId dimension. When the
+// dimensions select no regexp, resources is returned unchanged.
+func filterResourcesByDimension(resources []*model.TaggedResource, regexps []model.DimensionsRegexp, cwm *model.Metric) []*model.TaggedResource {
+	selected := selectedDimensionRegexps(regexps, cwm)
+	if len(selected) == 0 {
+		return resources
+	}
+	var kept []*model.TaggedResource
+	for _, r := range resources {
+		for _, idx := range selected {
+			if regexps[idx].Regexp.MatchString(r.ARN) {
+				kept = append(kept, r)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// retrieveResources discovers the resources of namespace. tagging.ErrExpectedToFindResources yields an
+// empty result unless failOnNoResources is set, in which case it is returned so that missing resources,
+// often an IAM permission gap, are reported rather than emitted as name="global".
+func retrieveResources(namespace string, region *string, searchTags []model.SearchTag, client tagging.Client, failOnNoResources bool) ([]*model.TaggedResource, error) {
+	resources, err := client.GetResources(context.Background(), model.DiscoveryJob{
+		Namespace:  namespace,
+		SearchTags: searchTags,
+	}, *region)
+	if errors.Is(err, tagging.ErrExpectedToFindResources) && failOnNoResources {
+		return nil, fmt.Errorf("no resources found for namespace %s in %s: %w", namespace, *region, err)
+	}
+	if err != nil && err != tagging.ErrExpectedToFindResources {
+		return nil, err
+	}
+
+	return resources, nil
+}
+
+// cloudWatchMetricNamePrefix prefixes the metric names of CloudWatch Metric Streams, e.g.
+// amazonaws.com/AWS/EC2/CPUUtilization.
+const cloudWatchMetricNamePrefix = "amazonaws.com/"
+
+// cloudWatchNameParts splits a Metric Streams metric name into its namespace and metric name, for
+// INFER_NAMESPACE_FROM_NAME. The metric name is the last path segment; the namespace is everything
+// between the prefix and it, so custom namespaces containing "/" are kept whole.
+func cloudWatchNameParts(name string) (namespace, metricName string, ok bool) {
+	rest, ok := strings.CutPrefix(name, cloudWatchMetricNamePrefix)
+	if !ok {
+		return "", "", false
+	}
+	i := strings.LastIndex(rest, "/")
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", false
+	}
+	return rest[:i], rest[i+1:], true
+}
+
+// buildCloudWatchMetricFromKeyValues parses OTLP 1.0 data point attributes: Namespace, MetricName,
+// and Dimensions (key "Dimensions" with kvlist_value in AWS CloudWatch 1.0.0 format).
+func buildCloudWatchMetricFromKeyValues(attrs []*commonpb.KeyValue) *model.Metric {
+	cwm := &model.Metric{}
+	exact := make(map[string]bool, 3)
+	for _, a := range attrs {
+		if a == nil {
+			continue
+		}
+		k := a.GetKey()
+		v := a.GetValue()
+		if v == nil {
+			continue
+		}
+		field := canonicalMetricKey(k)
+		if field == "" || (k != field && exact[field]) {
+			continue
+		}
+		if k == field {
+			exact[field] = true
+		}
+		switch field {
+		case "MetricName":
+			cwm.MetricName = anyValueToString(v)
+		case "Namespace":
+			cwm.Namespace = anyValueToString(v)
+		case "Dimensions":
+			cwm.Dimensions = nil
+			if kvlist := v.GetKvlistValue(); kvlist != nil {
+				for _, kv := range kvlist.GetValues() {
+					if kv != nil && kv.GetValue() != nil {
+						cwm.Dimensions = append(cwm.Dimensions, model.Dimension{
+							Name:  kv.GetKey(),
+							Value: anyValueToString(kv.GetValue()),
+						})
+					}
+				}
+			}
+		}
+	}
+	return cwm
+}
+
+// applySemconvDimensions maps the semantic-convention keys of SEMCONV_DIMENSION_MAP, e.g. aws.ec2.instance.id,
+// to CloudWatch dimension names, e.g. InstanceId. Mapped keys are renamed inside the Dimensions attribute, and
+// mapped data point attributes are added as dimensions unless cwm already has one of that name.
+func applySemconvDimensions(cwm *model.Metric, attrs []*commonpb.KeyValue, mapping map[string]string) {
+	has := make(map[string]bool, len(cwm.Dimensions))
+	for i, d := range cwm.Dimensions {
+		if name, ok := mapping[d.Name]; ok {
+			cwm.Dimensions[i].Name = name
+		}
+		has[cwm.Dimensions[i].Name] = true
+	}
+	for _, a := range attrs {
+		name, ok := mapping[a.GetKey()]
+		if !ok || has[name] || a.GetValue() == nil {
+			continue
+		}
+		cwm.Dimensions = append(cwm.Dimensions, model.Dimension{Name: name, Value: anyValueToString(a.GetValue())})
+		has[name] = true
+	}
+}
+
+// parseSemconvDimensionMap parses SEMCONV_DIMENSION_MAP, a JSON object of attribute keys to CloudWatch
+// dimension names.
+func parseSemconvDimensionMap(env string) (map[string]string, error) {
+	if env == "" {
+		return nil, nil
+	}
+	var mapping map[string]string
+	if err := json.Unmarshal([]byte(env), &mapping); err != nil {
+		return nil, fmt.Errorf("SEMCONV_DIMENSION_MAP is not a JSON object of strings: %w", err)
+	}
+	for key, name := range mapping {
+		if key == "" || name == "" {
+			return nil, fmt.Errorf("SEMCONV_DIMENSION_MAP contains an empty key or dimension in %q: %q", key, name)
+		}
+	}
+	return mapping, nil
+}
+
+// parseEnabledAccounts parses ENABLED_ACCOUNTS, a JSON array of AWS account IDs, into a set. It returns nil,
+// enriching every account, when unset.
+func parseEnabledAccounts(env string) (map[string]bool, error) {
+	accounts, err := parseStringList(env)
+	if err != nil {
+		return nil, fmt.Errorf("ENABLED_ACCOUNTS is not a JSON array of strings: %w", err)
+	}
+	if accounts == nil {
+		return nil, nil
+	}
+	enabled := make(map[string]bool, len(accounts))
+	for _, id := range accounts {
+		if id = strings.TrimSpace(id); id == "" {
+			return nil, errors.New("ENABLED_ACCOUNTS contains an empty account ID")
+		}
+		enabled[id] = true
+	}
+	return enabled, nil
+}
+
+// defaultCompositeSeparator joins the values of a composite dimension label. CloudWatch dimension values
+// such as ALB and target group names already contain "/".
+const defaultCompositeSeparator = "|"
+
+// validLabelName matches the Prometheus label names accepted for composite dimension labels.
+var validLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// compositeDimension is one COMPOSITE_DIMENSIONS entry: dimensions that only make sense together, e.g.
+// LoadBalancer and TargetGroup, whose values are joined in order into the label.
+type compositeDimension struct {
+	Dimensions []string `json:"dimensions"`
+	Label      string   `json:"label"`
+	Separator  string   `json:"separator"`
+	// Collapse drops the individual dimension_* labels of the dimensions.
+	Collapse bool `json:"collapse"`
+}
+
+// parseCompositeDimensions parses COMPOSITE_DIMENSIONS, a JSON array of compositeDimension objects, e.g.
+// [{"dimensions":["LoadBalancer","TargetGroup"],"label":"load_balancer_target_group","collapse":true}].
+func parseCompositeDimensions(env string) ([]compositeDimension, error) {
+	if env == "" {
+		return nil, nil
+	}
+	var composites []compositeDimension
+	if err := json.Unmarshal([]byte(env), &composites); err != nil {
+		return nil, fmt.Errorf("COMPOSITE_DIMENSIONS is not a JSON array of objects: %w", err)
+	}
+	for i, c := range composites {
+		if len(c.Dimensions) < 2 {
+			return nil, fmt.Errorf("COMPOSITE_DIMENSIONS entry %d needs at least two dimensions", i)
+		}
+		if !validLabelName.MatchString(c.Label) {
+			return nil, fmt.Errorf("COMPOSITE_DIMENSIONS entry %d has an invalid label name %q", i, c.Label)
+		}
+		if c.Separator == "" {
+			composites[i].Separator = defaultCompositeSeparator
+		}
+	}
+	return composites, nil
+}
+
+// compositeDimensionLabels returns the composite labels of dims, one per entry of composites whose
+// dimensions are all present, with values normalized like dimension_* labels. collapsed holds the
+// dimensions whose individual labels are dropped.
+func compositeDimensionLabels(dims []model.Dimension, composites []compositeDimension, normalize string) (collapsed map[string]bool, labels []*commonpb.KeyValue) {
+	if len(composites) == 0 {
+		return nil, nil
+	}
+	values := make(map[string]string, len(dims))
+	for _, d := range dims {
+		values[d.Name] = d.Value
+	}
+	for _, c := range composites {
+		parts := make([]string, 0, len(c.Dimensions))
+		for _, name := range c.Dimensions {
+			v, ok := values[name]
+			if !ok {
+				break
+			}
+			parts = append(parts, normalizeDimensionValue(normalize, v))
+		}
+		if len(parts) < len(c.Dimensions) {
+			continue
+		}
+		labels = append(labels, &commonpb.KeyValue{
+			Key:   c.Label,
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: strings.Join(parts, c.Separator)}},
+		})
+		if c.Collapse {
+			if collapsed == nil {
+				collapsed = make(map[string]bool)
+			}
+			for _, name := range c.Dimensions {
+				collapsed[name] = true
+			}
+		}
+	}
+	return collapsed, labels
+}
 
-		if _, err := f.Write(b); err != nil {
-			return nil, err
-		}
+// defaultStripAttrs are the attributes consumed by buildCloudWatchMetricFromKeyValues and the metric name.
+var defaultStripAttrs = []string{"Namespace", "MetricName", "Dimensions", "Statistic"}
 
-		return resources, nil
+// parseStripAttrs parses STRIP_ATTRS, a JSON array of attribute keys, falling back to defaultStripAttrs
+// when unset or invalid. Keys are matched like canonicalMetricKey, ignoring case and underscores.
+func parseStripAttrs(env string) (map[string]bool, error) {
+	keys, err := parseStringList(env)
+	if err != nil || len(keys) == 0 {
+		keys = defaultStripAttrs
+	}
+	strip := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		strip[stripAttrKey(k)] = true
 	}
+	return strip, err
+}
 
-	b, err := io.ReadAll(f)
-	if err != nil {
-		return nil, err
+func stripAttrKey(k string) string {
+	return strings.ToLower(strings.ReplaceAll(k, "_", ""))
+}
+
+// mergeOriginalAttrs appends the original attributes to the YACE labels, skipping stripped keys and keys
+// already set by a label.
+func mergeOriginalAttrs(labels, original []*commonpb.KeyValue, strip map[string]bool) []*commonpb.KeyValue {
+	seen := make(map[string]bool, len(labels))
+	for _, l := range labels {
+		seen[l.GetKey()] = true
 	}
-	if err := f.Close(); err != nil {
-		return nil, err
+	merged := labels
+	for _, a := range original {
+		if strip[stripAttrKey(a.GetKey())] || seen[a.GetKey()] {
+			continue
+		}
+		seen[a.GetKey()] = true
+		merged = append(merged, a)
 	}
+	return merged
+}
 
-	var resources []*model.TaggedResource
-	if err := json.Unmarshal(b, &resources); err != nil {
-		return nil, err
+// canonicalMetricKey maps a data point attribute key to MetricName, Namespace or Dimensions, ignoring case
+// and underscores so that streams emitting e.g. "namespace" or "metric_name" are still recognized.
+// It returns "" for any other key. Exact canonical keys take precedence over alternates.
+func canonicalMetricKey(k string) string {
+	switch strings.ToLower(strings.ReplaceAll(k, "_", "")) {
+	case "metricname":
+		return "MetricName"
+	case "namespace":
+		return "Namespace"
+	case "dimensions":
+		return "Dimensions"
 	}
-	logger.Debug("loaded resources from cache", "namespace", namespace, "count", len(resources))
-	return resources, nil
+	return ""
 }
 
-func retrieveResources(namespace string, region *string, client tagging.Client) ([]*model.TaggedResource, error) {
-	resources, err := client.GetResources(context.Background(), model.DiscoveryJob{
-		Namespace: namespace,
-	}, *region)
-	if err != nil && err != tagging.ErrExpectedToFindResources {
-		return nil, err
-	}
+// deduper drops data points that exactly duplicate one already seen in the same Firehose batch.
+type deduper struct {
+	seen map[uint64]struct{}
+}
 
-	return resources, nil
+func newDeduper() *deduper {
+	return &deduper{seen: make(map[uint64]struct{})}
 }
 
-// buildCloudWatchMetricFromKeyValues parses OTLP 1.0 data point attributes: Namespace, MetricName,
-// and Dimensions (key "Dimensions" with kvlist_value in AWS CloudWatch 1.0.0 format).
-func buildCloudWatchMetricFromKeyValues(attrs []*commonpb.KeyValue) *model.Metric {
-	cwm := &model.Metric{}
-	for _, a := range attrs {
-		if a == nil {
-			continue
-		}
-		k := a.GetKey()
-		v := a.GetValue()
-		if v == nil {
-			continue
-		}
-		switch k {
-		case "MetricName":
-			cwm.MetricName = v.GetStringValue()
-		case "Namespace":
-			cwm.Namespace = v.GetStringValue()
-		case "Dimensions":
-			if kvlist := v.GetKvlistValue(); kvlist != nil {
-				for _, kv := range kvlist.GetValues() {
-					if kv != nil && kv.GetValue() != nil {
-						cwm.Dimensions = append(cwm.Dimensions, model.Dimension{
-							Name:  kv.GetKey(),
-							Value: kv.GetValue().GetStringValue(),
-						})
+// dedupeRequests removes duplicate data points in place and returns how many were dropped. Two data points
+// are duplicates when metric name, resource, attributes, timestamps and values are all equal; attribute
+// order is normalized first. Metrics left without data points are removed.
+func (d *deduper) dedupeRequests(reqs []*metricsservicepb.ExportMetricsServiceRequest) int {
+	dropped := 0
+	for _, req := range reqs {
+		for _, rm := range req.GetResourceMetrics() {
+			var resourceKey []byte
+			if res := rm.GetResource(); res != nil {
+				resourceKey, _ = attributeKey(res)
+			}
+			for _, sm := range rm.GetScopeMetrics() {
+				kept := sm.Metrics[:0]
+				for _, metric := range sm.GetMetrics() {
+					n, ok := d.dedupeMetric(resourceKey, metric)
+					dropped += n
+					if ok {
+						kept = append(kept, metric)
 					}
 				}
+				sm.Metrics = kept
 			}
 		}
 	}
-	return cwm
+	return dropped
+}
+
+// dedupeMetric filters the data points of metric and reports how many were dropped and whether any remain.
+func (d *deduper) dedupeMetric(resourceKey []byte, metric *metricspb.Metric) (int, bool) {
+	dropped := 0
+	isNew := func(dp proto.Message) bool {
+		if d.isNew(resourceKey, metric.GetName(), dp) {
+			return true
+		}
+		dropped++
+		return false
+	}
+
+	remaining := 0
+	switch t := metric.Data.(type) {
+	case *metricspb.Metric_Summary:
+		kept := t.Summary.DataPoints[:0]
+		for _, dp := range t.Summary.GetDataPoints() {
+			if isNew(dp) {
+				kept = append(kept, dp)
+			}
+		}
+		t.Summary.DataPoints, remaining = kept, len(kept)
+	case *metricspb.Metric_Gauge:
+		kept := t.Gauge.DataPoints[:0]
+		for _, dp := range t.Gauge.GetDataPoints() {
+			if isNew(dp) {
+				kept = append(kept, dp)
+			}
+		}
+		t.Gauge.DataPoints, remaining = kept, len(kept)
+	case *metricspb.Metric_Sum:
+		kept := t.Sum.DataPoints[:0]
+		for _, dp := range t.Sum.GetDataPoints() {
+			if isNew(dp) {
+				kept = append(kept, dp)
+			}
+		}
+		t.Sum.DataPoints, remaining = kept, len(kept)
+	default:
+		// Other metric types are left untouched.
+		return 0, true
+	}
+	return dropped, remaining > 0
+}
+
+func (d *deduper) isNew(resourceKey []byte, name string, dp proto.Message) bool {
+	b, err := attributeKey(dp)
+	if err != nil {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write(resourceKey)
+	h.Write([]byte{0})
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write(b)
+	key := h.Sum64()
+	if _, ok := d.seen[key]; ok {
+		return false
+	}
+	d.seen[key] = struct{}{}
+	return true
+}
+
+// sortAttributes orders attributes by key so equal attribute sets encode identically.
+func sortAttributes(attrs []*commonpb.KeyValue) {
+	sort.SliceStable(attrs, func(i, j int) bool {
+		return attrs[i].GetKey() < attrs[j].GetKey()
+	})
+}
+
+// attributeKey returns the deterministic encoding of m, a resource or data point, with its attributes
+// sorted by key, so equal attribute sets encode identically. The attributes are sorted on a copy: m keeps
+// the label order it is emitted with.
+func attributeKey(m proto.Message) ([]byte, error) {
+	c := proto.Clone(m)
+	if a, ok := c.(interface{ GetAttributes() []*commonpb.KeyValue }); ok {
+		sortAttributes(a.GetAttributes())
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(c)
 }
 
+// errNotMetrics is returned by rawDataIntoRequests for records holding another OTLP signal, such as traces
+// or logs delivered by a misrouted stream. Such records are passed through untouched.
+var errNotMetrics = errors.New("record data is not an OTLP metrics request")
+
+// rawDataIntoRequests decodes size-delimited OTLP requests, decompressing the record first when it
+// starts with the gzip magic bytes. Protobuf decoding is lenient, so traces or logs often decode as metrics,
+// leaving fields unknown to the metrics messages behind. A request with unknown fields fails with
+// errNotMetrics only when the record also decodes cleanly as traces or logs, like data that only decodes as
+// those; otherwise the unknown fields are taken to be newer than the vendored OTLP protos and kept.
 func rawDataIntoRequests(input []byte) ([]*metricsservicepb.ExportMetricsServiceRequest, error) {
+	if isGzip(input) {
+		var err error
+		if input, err = gunzipBytes(input); err != nil {
+			return nil, err
+		}
+	}
 	var requests []*metricsservicepb.ExportMetricsServiceRequest
 	r := bytes.NewBuffer(input)
 	for {
@@ -637,13 +2898,60 @@ func rawDataIntoRequests(input []byte) ([]*metricsservicepb.ExportMetricsService
 			if errors.Is(err, io.EOF) {
 				break
 			}
+			if isOtherSignal(input) {
+				return nil, errNotMetrics
+			}
 			return nil, err
 		}
+		if hasUnknownFields(rm.ProtoReflect()) && isOtherSignal(input) {
+			return nil, errNotMetrics
+		}
 		requests = append(requests, rm)
 	}
 	return requests, nil
 }
 
+// isOtherSignal reports whether input decodes cleanly as size-delimited OTLP trace or log requests.
+func isOtherSignal(input []byte) bool {
+	decodes := func(newRequest func() proto.Message) bool {
+		r := bytes.NewBuffer(input)
+		for n := 0; ; n++ {
+			req := newRequest()
+			if _, err := pbutil.ReadDelimited(r, req); err != nil {
+				return errors.Is(err, io.EOF) && n > 0
+			}
+			if hasUnknownFields(req.ProtoReflect()) {
+				return false
+			}
+		}
+	}
+	return decodes(func() proto.Message { return &tracepb.ExportTraceServiceRequest{} }) ||
+		decodes(func() proto.Message { return &logspb.ExportLogsServiceRequest{} })
+}
+
+// hasUnknownFields reports whether m or any message nested in it holds fields unknown to its type.
+func hasUnknownFields(m protoreflect.Message) bool {
+	if len(m.GetUnknown()) > 0 {
+		return true
+	}
+	unknown := false
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.Kind() != protoreflect.MessageKind && fd.Kind() != protoreflect.GroupKind:
+		case fd.IsList():
+			for i := 0; i < v.List().Len() && !unknown; i++ {
+				unknown = hasUnknownFields(v.List().Get(i).Message())
+			}
+		case fd.IsMap():
+			// OTLP has no map fields.
+		default:
+			unknown = hasUnknownFields(v.Message())
+		}
+		return !unknown
+	})
+	return unknown
+}
+
 func requestsIntoRawData(reqs []*metricsservicepb.ExportMetricsServiceRequest) ([]byte, error) {
 	var b bytes.Buffer
 	for _, r := range reqs {
@@ -654,40 +2962,254 @@ func requestsIntoRawData(reqs []*metricsservicepb.ExportMetricsServiceRequest) (
 	return b.Bytes(), nil
 }
 
+// errNoExporter is returned by exportRequests when there is no OTLP client to export with, e.g. because the
+// connection could not be created and CONTINUE_ON_EXPORT_FAILURE let the invocation go on.
+var errNoExporter = errors.New("no OTLP exporter configured")
+
+// exportRequests exports reqs over the shared connection, each call bounded by timeout. With a concurrency of
+// 1 or less the requests are sent one at a time and the first error stops the export. Otherwise up to
+// concurrency calls run at once, every request is attempted and the errors are joined. A nil client fails
+// with errNoExporter.
 func exportRequests(
 	ctx context.Context,
 	client metricsservicepb.MetricsServiceClient,
 	reqs []*metricsservicepb.ExportMetricsServiceRequest,
 	timeout time.Duration,
+	concurrency int,
+	opts ...grpc.CallOption,
 ) error {
-	for _, r := range reqs {
+	if client == nil {
+		return errNoExporter
+	}
+	if len(reqs) == 0 {
+		return nil
+	}
+	export := func(r *metricsservicepb.ExportMetricsServiceRequest) error {
 		reqCtx, cancel := context.WithTimeout(ctx, timeout)
-		_, err := client.Export(reqCtx, r)
-		cancel()
+		defer cancel()
+		_, err := client.Export(reqCtx, r, opts...)
+		return err
+	}
+
+	if concurrency <= 1 || len(reqs) <= 1 {
+		for _, r := range reqs {
+			if err := export(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	sem := make(chan struct{}, concurrency)
+	errs := make([]error, len(reqs))
+	var wg sync.WaitGroup
+	for i, r := range reqs {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, r *metricsservicepb.ExportMetricsServiceRequest) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = export(r)
+		}(i, r)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// otlpEndpoint returns the gRPC dial target following the OTel SDK precedence: the metrics-specific
+// endpoint, then the generic one. An http:// or https:// scheme and a trailing slash are stripped, as
+// SDK-style URLs are not valid gRPC targets.
+func otlpEndpoint(metricsEndpoint, endpoint string) string {
+	if metricsEndpoint != "" {
+		endpoint = metricsEndpoint
+	}
+	for _, scheme := range []string{"http://", "https://"} {
+		if rest, ok := strings.CutPrefix(endpoint, scheme); ok {
+			endpoint = rest
+			break
+		}
+	}
+	return strings.TrimSuffix(endpoint, "/")
+}
+
+// grpcConnConfig describes how to dial the OTLP collector.
+type grpcConnConfig struct {
+	endpoint string
+	insecure bool
+	// tlsServerName overrides the name used to verify the collector certificate
+	// when it differs from the endpoint host.
+	tlsServerName string
+	// caPEM, clientCertPEM and clientKeyPEM hold PEM-encoded TLS material taken directly from the
+	// environment, so no file needs to be written. caPEM replaces the system roots when set.
+	caPEM         string
+	clientCertPEM string
+	clientKeyPEM  string
+	timeout       time.Duration
+	// keepaliveTime enables client keepalive pings when non-zero.
+	keepaliveTime    time.Duration
+	keepaliveTimeout time.Duration
+	// dedupHeader adds a content hash of each request as gRPC metadata, see dedupKeyInterceptor.
+	dedupHeader bool
+	// maxSendMsgSize raises (or lowers) gRPC's per-message send limit in bytes when positive.
+	maxSendMsgSize int
+	// compression is OTEL_EXPORTER_OTLP_COMPRESSION; "gzip" compresses every export, other values none.
+	compression string
+}
+
+// keepaliveParams returns the client keepalive parameters, or false when keepalive is disabled.
+// Pings are permitted without active streams because the connection sits idle between warm invocations.
+func (c grpcConnConfig) keepaliveParams() (keepalive.ClientParameters, bool) {
+	if c.keepaliveTime <= 0 {
+		return keepalive.ClientParameters{}, false
+	}
+	return keepalive.ClientParameters{
+		Time:                c.keepaliveTime,
+		Timeout:             c.keepaliveTimeout,
+		PermitWithoutStream: true,
+	}, true
+}
+
+// transportCredentials returns the connection credentials. It fails when the PEM material does not parse.
+func (c grpcConnConfig) transportCredentials() (credentials.TransportCredentials, error) {
+	if c.insecure {
+		return insecure.NewCredentials(), nil
+	}
+	if c.caPEM == "" && c.clientCertPEM == "" && c.clientKeyPEM == "" {
+		return credentials.NewClientTLSFromCert(nil, c.tlsServerName), nil
+	}
+
+	tlsCfg := &tls.Config{ServerName: c.tlsServerName, MinVersion: tls.VersionTLS12}
+	if c.caPEM != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(c.caPEM)) {
+			return nil, errors.New("OTEL_EXPORTER_OTLP_CA_PEM contains no valid certificate")
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if c.clientCertPEM != "" || c.clientKeyPEM != "" {
+		cert, err := tls.X509KeyPair([]byte(c.clientCertPEM), []byte(c.clientKeyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("loading OTLP client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(tlsCfg), nil
+}
+
+// dialOptions returns the dial options of the connection other than its transport credentials.
+func (c grpcConnConfig) dialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{
+		grpc.WithBlock(),
+	}
+	if params, ok := c.keepaliveParams(); ok {
+		opts = append(opts, grpc.WithKeepaliveParams(params))
+	}
+	if c.dedupHeader {
+		opts = append(opts, grpc.WithUnaryInterceptor(dedupKeyInterceptor))
+	}
+	if callOpts := c.callOptions(); len(callOpts) > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(callOpts...))
+	}
+	return opts
+}
+
+// callOptions returns the default call options of the connection.
+func (c grpcConnConfig) callOptions() []grpc.CallOption {
+	var opts []grpc.CallOption
+	if c.maxSendMsgSize > 0 {
+		opts = append(opts, grpc.MaxCallSendMsgSize(c.maxSendMsgSize))
+	}
+	if c.compression == grpcgzip.Name {
+		opts = append(opts, grpc.UseCompressor(grpcgzip.Name))
+	}
+	return opts
+}
+
+// dedupKeyHeader carries a stable content hash of the exported request so that idempotency-aware
+// collectors can drop exports repeated by retries.
+const dedupKeyHeader = "x-otlp-dedup-key"
+
+// requestDedupKey returns the hex SHA-256 of the deterministically marshaled message.
+func requestDedupKey(m proto.Message) (string, error) {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func dedupKeyInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if m, ok := req.(proto.Message); ok {
+		key, err := requestDedupKey(m)
 		if err != nil {
 			return err
 		}
+		ctx = metadata.AppendToOutgoingContext(ctx, dedupKeyHeader, key)
 	}
-	return nil
+	return invoker(ctx, method, req, reply, cc, opts...)
 }
 
-func newGRPCConn(endpoint string, insecureConn bool, timeout time.Duration) (*grpc.ClientConn, error) {
-	dialCtx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+// The OTLP connection is kept at package level so warm invocations reuse it instead of re-dialing.
+var (
+	sharedConnMu  sync.Mutex
+	sharedConn    *grpc.ClientConn
+	sharedConnCfg grpcConnConfig
+	sharedClient  metricsservicepb.MetricsServiceClient
+)
 
-	var creds credentials.TransportCredentials
-	if insecureConn {
-		creds = insecure.NewCredentials()
-	} else {
-		creds = credentials.NewClientTLSFromCert(nil, "")
+// sharedGRPCClient returns the metrics client for cfg, dialing lazily on first use.
+// The previous connection is closed and replaced if cfg differs from the one it was dialed with.
+func sharedGRPCClient(cfg grpcConnConfig) (metricsservicepb.MetricsServiceClient, error) {
+	sharedConnMu.Lock()
+	defer sharedConnMu.Unlock()
+
+	if err := dialSharedConnLocked(cfg); err != nil {
+		return nil, err
 	}
+	return sharedClient, nil
+}
 
-	return grpc.DialContext(
-		dialCtx,
-		endpoint,
-		grpc.WithTransportCredentials(creds),
-		grpc.WithBlock(),
-	)
+// sharedGRPCConn returns the shared connection for cfg, dialing it like sharedGRPCClient.
+func sharedGRPCConn(cfg grpcConnConfig) (*grpc.ClientConn, error) {
+	sharedConnMu.Lock()
+	defer sharedConnMu.Unlock()
+
+	if err := dialSharedConnLocked(cfg); err != nil {
+		return nil, err
+	}
+	return sharedConn, nil
+}
+
+func dialSharedConnLocked(cfg grpcConnConfig) error {
+	if sharedConn != nil && sharedConnCfg == cfg {
+		return nil
+	}
+	if sharedConn != nil {
+		sharedConn.Close()
+		sharedConn, sharedClient = nil, nil
+	}
+
+	conn, err := newGRPCConn(cfg)
+	if err != nil {
+		return err
+	}
+	sharedConn, sharedConnCfg = conn, cfg
+	sharedClient = metricsservicepb.NewMetricsServiceClient(conn)
+	return nil
+}
+
+func newGRPCConn(cfg grpcConnConfig) (*grpc.ClientConn, error) {
+	creds, err := cfg.transportCredentials()
+	if err != nil {
+		return nil, err
+	}
+	dialCtx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+	defer cancel()
+
+	return grpc.DialContext(dialCtx, cfg.endpoint, append(cfg.dialOptions(), grpc.WithTransportCredentials(creds))...)
 }
 
 func buildResponseRecord(recordID string, data []byte) events.KinesisFirehoseResponseRecord {
@@ -700,10 +3222,167 @@ func buildResponseRecord(recordID string, data []byte) events.KinesisFirehoseRes
 	}
 }
 
+// recordLogger returns a child logger that tags every entry with the Firehose record ID, so failures
+// can be correlated with the upstream delivery stream.
+func recordLogger(logger *slog.Logger, record events.KinesisFirehoseEventRecord) *slog.Logger {
+	return logger.With("record_id", record.RecordID)
+}
+
 func passThroughRecord(record events.KinesisFirehoseEventRecord) events.KinesisFirehoseResponseRecord {
 	return buildResponseRecord(record.RecordID, record.Data)
 }
 
+// FIREHOSE_OUTPUT_MODE values. Unknown values behave like outputModePassThrough.
+const (
+	// outputModePassThrough returns the original record; enriched metrics are only exported.
+	outputModePassThrough = "pass_through"
+	// outputModePassThroughAndExport is an explicit alias of outputModePassThrough.
+	outputModePassThroughAndExport = "passthrough_and_export"
+	// outputModeEnhanced returns the enriched OTLP record.
+	outputModeEnhanced = "enhanced"
+	// outputModeExportOnly returns an Ok record with empty data; enriched metrics are only exported.
+	outputModeExportOnly = "export_only"
+)
+
+// responseDataForMode returns the data Firehose receives for a record in the given output mode.
+func responseDataForMode(
+	logger *slog.Logger,
+	outputMode string,
+	record events.KinesisFirehoseEventRecord,
+	reqs []*metricsservicepb.ExportMetricsServiceRequest,
+	maxBytes int,
+) ([]byte, error) {
+	switch outputMode {
+	case outputModeEnhanced:
+		data, err := requestsIntoRawData(reqs)
+		if err != nil {
+			return nil, err
+		}
+		return limitResponseData(logger, record, data, maxBytes), nil
+	case outputModeExportOnly:
+		return []byte{}, nil
+	default:
+		return record.Data, nil
+	}
+}
+
+// defaultMaxResponseRecordBytes is the largest record Firehose accepts from a transformation (1,000 KiB).
+const defaultMaxResponseRecordBytes = 1000 * 1024
+
+// limitResponseData returns the enhanced data for a record, or the original record data when the enhanced
+// data exceeds maxBytes. Records are never split: the metrics are already exported, and splitting would
+// change the number of records Firehose delivers. A maxBytes of zero or less disables the check.
+// The logger is expected to carry the record ID.
+func limitResponseData(logger *slog.Logger, record events.KinesisFirehoseEventRecord, enhanced []byte, maxBytes int) []byte {
+	if maxBytes <= 0 || len(enhanced) <= maxBytes {
+		return enhanced
+	}
+	logger.Warn("Enhanced record exceeds MAX_RESPONSE_RECORD_BYTES, returning original record",
+		"size", len(enhanced), "max", maxBytes)
+	return record.Data
+}
+
+// staticLabelsFor returns the wildcard static labels merged with those configured for namespace and the
+// labels of the scope being enriched. Scope values win over namespace values, which win over wildcard ones.
+func (c enhanceConfig) staticLabelsFor(namespace string) map[string]string {
+	nsLabels := c.namespaceStaticLabels[namespace]
+	if len(nsLabels) == 0 && len(c.scopeStaticLabels) == 0 {
+		return c.staticLabels
+	}
+	merged := make(map[string]string, len(c.staticLabels)+len(nsLabels)+len(c.scopeStaticLabels))
+	for _, labels := range []map[string]string{c.staticLabels, nsLabels, c.scopeStaticLabels} {
+		for k, v := range labels {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// parseScopeLabels parses SCOPE_LABELS, a JSON object mapping instrumentation scope names to label
+// objects, e.g. {"cloudwatch-stream-a":{"source":"a"}}. It returns nil when unset.
+func parseScopeLabels(env string) (map[string]map[string]string, error) {
+	if env == "" {
+		return nil, nil
+	}
+	var scopes map[string]map[string]string
+	if err := json.Unmarshal([]byte(env), &scopes); err != nil {
+		return nil, fmt.Errorf("SCOPE_LABELS is not a JSON object of label objects: %w", err)
+	}
+	for scope, labels := range scopes {
+		for k := range labels {
+			if k == "" {
+				return nil, fmt.Errorf("SCOPE_LABELS contains empty label key for scope %q", scope)
+			}
+		}
+	}
+	return scopes, nil
+}
+
+// parseStaticLabelSets parses STATIC_LABELS, which is either a JSON array of key=value strings applied to
+// every namespace, or a JSON object. In the object form a string value is a label applied to every
+// namespace, e.g. {"env":"prod","team":"platform"}, and an object value maps a namespace (or "*" for all)
+// to its labels, e.g. {"*":{"env":"prod"},"AWS/RDS":{"cost_center":"db"}}; both may be mixed. It returns
+// the wildcard labels and the namespace-specific labels.
+func parseStaticLabelSets(staticLabelsEnv string) (map[string]string, map[string]map[string]string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(staticLabelsEnv), "{") {
+		staticLabels, err := parseStaticLabels(staticLabelsEnv)
+		return staticLabels, nil, err
+	}
+
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(staticLabelsEnv), &entries); err != nil {
+		return make(map[string]string), nil, fmt.Errorf("STATIC_LABELS is not a JSON object: %w", err)
+	}
+	staticLabels := make(map[string]string)
+	sets := make(map[string]map[string]string)
+	for _, key := range sortedKeys(entries) {
+		if key == "" {
+			return make(map[string]string), nil, errors.New("STATIC_LABELS contains empty label key")
+		}
+		var value string
+		if err := json.Unmarshal(entries[key], &value); err == nil {
+			staticLabels[key] = value
+			continue
+		}
+		var labels map[string]string
+		if err := json.Unmarshal(entries[key], &labels); err != nil {
+			return make(map[string]string), nil, fmt.Errorf("STATIC_LABELS entry %q must be a string label value or an object of labels: %w", key, err)
+		}
+		for k := range labels {
+			if k == "" {
+				return make(map[string]string), nil, fmt.Errorf("STATIC_LABELS contains empty label key for %s", key)
+			}
+		}
+		if key == "*" {
+			for k, v := range labels {
+				if _, ok := staticLabels[k]; !ok {
+					staticLabels[k] = v
+				}
+			}
+			continue
+		}
+		sets[key] = labels
+	}
+	if len(sets) == 0 {
+		sets = nil
+	}
+	return staticLabels, sets, nil
+}
+
+// parseStatisticsFilter parses STATISTICS_FILTER, a JSON array of Statistic values. It returns nil,
+// meaning no filtering, when unset or empty.
+func parseStatisticsFilter(env string) (map[string]bool, error) {
+	stats, err := parseStringList(env)
+	if err != nil || len(stats) == 0 {
+		return nil, err
+	}
+	allowed := make(map[string]bool, len(stats))
+	for _, s := range stats {
+		allowed[s] = true
+	}
+	return allowed, nil
+}
+
 func parseStaticLabels(staticLabelsEnv string) (map[string]string, error) {
 	staticLabels := make(map[string]string)
 	if staticLabelsEnv == "" {
@@ -712,15 +3391,15 @@ func parseStaticLabels(staticLabelsEnv string) (map[string]string, error) {
 
 	var rawLabels []string
 	if err := json.Unmarshal([]byte(staticLabelsEnv), &rawLabels); err != nil {
-		return staticLabels, err
+		return staticLabels, fmt.Errorf("STATIC_LABELS is not a JSON array of key=value strings: %w", err)
 	}
 
-	for _, label := range rawLabels {
+	for i, label := range rawLabels {
 		if label == "" {
-			return staticLabels, errors.New("STATIC_LABELS contains empty string")
+			return staticLabels, fmt.Errorf("STATIC_LABELS entry %d is an empty string", i)
 		}
 		if !strings.Contains(label, "=") {
-			return staticLabels, errors.New("STATIC_LABELS contains string that is not a key=value pair")
+			return staticLabels, fmt.Errorf("STATIC_LABELS entry %d (%q) is not a key=value pair", i, label)
 		}
 		key, value := strings.Split(label, "=")[0], strings.SplitN(label, "=", 2)[1]
 		staticLabels[key] = value
@@ -755,13 +3434,77 @@ func envDuration(key string, defaultValue time.Duration, logger *slog.Logger) ti
 	return defaultValue
 }
 
+func envInt(key string, defaultValue int, logger *slog.Logger) int {
+	if value := os.Getenv(key); value != "" {
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		} else {
+			logger.Error("Failed to parse integer value, using default", "key", key, "error", err)
+		}
+	}
+	return defaultValue
+}
+
+// logOutput is where newLogger writes; tests replace it to inspect the logs.
+var logOutput io.Writer = os.Stderr
+
 func newLogger(level string) *slog.Logger {
 	logLevel := slog.LevelInfo
 	if strings.ToLower(level) == "debug" {
 		logLevel = slog.LevelDebug
 	}
-	handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
-		Level: logLevel,
+	// The JSON handler logs every level; levelHandler does the leveling so subsystemLogger can change it.
+	handler := slog.NewJSONHandler(logOutput, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
 	})
-	return slog.New(handler)
+	return slog.New(&levelHandler{level: logLevel, handler: handler})
+}
+
+// Log subsystems whose level LOG_LEVEL_<SUBSYSTEM> sets independently of LOG_LEVEL.
+const (
+	logSubsystemEnrich = "enrich"
+	logSubsystemExport = "export"
+	logSubsystemCache  = "cache"
+)
+
+// levelHandler applies its own minimum level to the records of handler.
+type levelHandler struct {
+	level   slog.Leveler
+	handler slog.Handler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.handler.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithGroup(name)}
+}
+
+// subsystemLogger returns logger leveled by LOG_LEVEL_<SUBSYSTEM> (debug, info, warn or error) when it
+// is set, keeping logger's attributes, and logger itself otherwise.
+func subsystemLogger(logger *slog.Logger, subsystem string) *slog.Logger {
+	key := "LOG_LEVEL_" + strings.ToUpper(subsystem)
+	value := os.Getenv(key)
+	if value == "" {
+		return logger
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		logger.Warn("Invalid log level, using LOG_LEVEL", "key", key, "value", value)
+		return logger
+	}
+	h, ok := logger.Handler().(*levelHandler)
+	if !ok {
+		return logger
+	}
+	return slog.New(&levelHandler{level: level, handler: h.handler})
 }
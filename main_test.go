@@ -1,20 +1,57 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/matttproud/golang_protobuf_extensions/v2/pbutil"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/clients/tagging"
 	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/config"
 	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/job/maxdimassociator"
 	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
 	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/promutil"
+	logspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
 	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
 	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logsv1 "go.opentelemetry.io/proto/otlp/logs/v1"
 	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
 	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestParseStaticLabels(t *testing.T) {
@@ -30,6 +67,76 @@ func TestParseStaticLabels(t *testing.T) {
 	}
 }
 
+func TestStaticLabelsPerNamespace(t *testing.T) {
+	staticLabels, nsLabels, err := parseStaticLabelSets(`{"*":{"env":"prod"},"AWS/RDS":{"cost_center":"db","env":"prod-db"}}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg := enhanceConfig{labelsSnakeCase: true, staticLabels: staticLabels, namespaceStaticLabels: nsLabels}
+	resource := &model.TaggedResource{ARN: "arn:aws:rds:us-east-1:123456789012:db:my-db"}
+
+	rds := keyValueToMap(buildYACELabelsKeyValue(slog.Default(), cfg, &model.Metric{Namespace: "AWS/RDS"}, resource, false, "us-east-1", ""))
+	if rds["custom_tag_cost_center"] != "db" {
+		t.Errorf("AWS/RDS: custom_tag_cost_center got %q, want %q", rds["custom_tag_cost_center"], "db")
+	}
+	if rds["custom_tag_env"] != "prod-db" {
+		t.Errorf("AWS/RDS: namespace label should override wildcard, custom_tag_env got %q", rds["custom_tag_env"])
+	}
+
+	ec2 := keyValueToMap(buildYACELabelsKeyValue(slog.Default(), cfg, &model.Metric{Namespace: "AWS/EC2"}, resource, false, "us-east-1", ""))
+	if _, ok := ec2["custom_tag_cost_center"]; ok {
+		t.Errorf("AWS/EC2: custom_tag_cost_center should only apply to AWS/RDS, got %v", ec2)
+	}
+	if ec2["custom_tag_env"] != "prod" {
+		t.Errorf("AWS/EC2: custom_tag_env got %q, want %q", ec2["custom_tag_env"], "prod")
+	}
+
+	// The array form still applies to every namespace.
+	staticLabels, nsLabels, err = parseStaticLabelSets(`["env=prod"]`)
+	if err != nil || staticLabels["env"] != "prod" || nsLabels != nil {
+		t.Errorf("array form: got %v, %v, %v", staticLabels, nsLabels, err)
+	}
+}
+
+func TestParseStaticLabelsMapForm(t *testing.T) {
+	staticLabels, nsLabels, err := parseStaticLabelSets(`{"env":"prod","team":"platform"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(staticLabels) != 2 || staticLabels["env"] != "prod" || staticLabels["team"] != "platform" || nsLabels != nil {
+		t.Errorf("map form: got %v, %v", staticLabels, nsLabels)
+	}
+
+	// String values apply to every namespace alongside per-namespace objects.
+	staticLabels, nsLabels, err = parseStaticLabelSets(`{"env":"prod","AWS/RDS":{"cost_center":"db"}}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if staticLabels["env"] != "prod" || nsLabels["AWS/RDS"]["cost_center"] != "db" {
+		t.Errorf("mixed form: got %v, %v", staticLabels, nsLabels)
+	}
+}
+
+func TestParseStaticLabelsErrors(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string
+	}{
+		{env: `["env=prod","team"]`, want: `entry 1 ("team") is not a key=value pair`},
+		{env: `["env=prod",""]`, want: "entry 1 is an empty string"},
+		{env: `["env=prod"`, want: "not a JSON array"},
+		{env: `{"env":"prod","team":42}`, want: `entry "team"`},
+		{env: `{"env":"prod"`, want: "not a JSON object"},
+		{env: `{"":"prod"}`, want: "empty label key"},
+	}
+	for _, tt := range tests {
+		_, _, err := parseStaticLabelSets(tt.env)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseStaticLabelSets(%s): got error %v, want it to mention %q", tt.env, err, tt.want)
+		}
+	}
+}
+
 func TestParseExportedTags(t *testing.T) {
 	tags, err := parseExportedTags(`["Name","Environment","Team"]`)
 	if err != nil {
@@ -74,6 +181,70 @@ func TestRequestsRoundTrip(t *testing.T) {
 	}
 }
 
+func TestRawDataIntoRequestsGzip(t *testing.T) {
+	reqs := []*metricsservicepb.ExportMetricsServiceRequest{
+		makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1")),
+		makeExportRequestOTLP10("amazonaws.com/AWS/EC2/NetworkIn", ec2InputAttrsOTLP10("i-2")),
+	}
+	raw, err := requestsIntoRawData(reqs)
+	if err != nil {
+		t.Fatalf("requestsIntoRawData failed: %v", err)
+	}
+	compressed, err := gzipBytes(raw)
+	if err != nil {
+		t.Fatalf("gzipBytes failed: %v", err)
+	}
+
+	out, err := rawDataIntoRequests(compressed)
+	if err != nil {
+		t.Fatalf("rawDataIntoRequests failed on gzip input: %v", err)
+	}
+	if len(out) != len(reqs) {
+		t.Fatalf("expected %d requests, got %d", len(reqs), len(out))
+	}
+	for i := range reqs {
+		if !proto.Equal(out[i], reqs[i]) {
+			t.Errorf("request %d differs after gzip round-trip", i)
+		}
+	}
+
+	if _, err := rawDataIntoRequests(compressed[:len(compressed)/2]); err == nil {
+		t.Error("expected an error for truncated gzip input")
+	}
+}
+
+func TestRawDataIntoRequestsKeepsUnknownFields(t *testing.T) {
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	body, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	// A field from an OTLP version newer than the vendored protos.
+	body = protowire.AppendVarint(protowire.AppendTag(body, 99, protowire.VarintType), 1)
+	raw := protowire.AppendBytes(nil, body)
+
+	reqs, err := rawDataIntoRequests(raw)
+	if err != nil || len(reqs) != 1 {
+		t.Fatalf("expected the metrics request to be decoded, got %v, %v", reqs, err)
+	}
+	resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {{
+		ARN:       "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0",
+		Namespace: "AWS/EC2",
+		Region:    "us-east-1",
+		Tags:      []model.Tag{{Key: "team", Value: "web"}},
+	}}}
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true}
+	err = enhanceRequests(slog.Default(), cfg, reqs, resourceCache, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+	dp := reqs[0].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0]
+	if got := keyValueToMap(dp.GetAttributes())["tag_team"]; got != "web" {
+		t.Errorf("expected the data point to be enriched, got %v", keyValueToMap(dp.GetAttributes()))
+	}
+}
+
 // makeExportRequestOTLP10 builds an OTLP 1.0 ExportMetricsServiceRequest with one Summary data point and the given attributes.
 func makeExportRequestOTLP10(metricName string, attrs []*commonpb.KeyValue) *metricsservicepb.ExportMetricsServiceRequest {
 	return makeExportRequestOTLP10WithResource(metricName, attrs, "", "")
@@ -131,6 +302,146 @@ func ec2InputAttrsOTLP10(instanceID string) []*commonpb.KeyValue {
 	}
 }
 
+func TestEnhanceSampledSkipLogs(t *testing.T) {
+	attrs := []*commonpb.KeyValue{
+		{Key: "Namespace", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "Custom/App"}}},
+		{Key: "MetricName", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "Requests"}}},
+	}
+	const skips, rate = 1000, 10
+	req := makeExportRequestOTLP10("amazonaws.com/Custom/App/Requests", attrs)
+	summary := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary()
+	for len(summary.DataPoints) < skips {
+		summary.DataPoints = append(summary.DataPoints, &metricspb.SummaryDataPoint{Attributes: attrs, Count: 1, Sum: 1})
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, skipLogSampler: newLogSampler(rate)}
+	err := enhanceRequests(logger, cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		map[string][]*model.TaggedResource{}, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+	if got := strings.Count(buf.String(), "Unsupported namespace"); got != skips/rate {
+		t.Errorf("expected %d sampled skip logs for %d skips, got %d", skips/rate, skips, got)
+	}
+
+	// Without a sampler, skips are only logged at debug level.
+	buf.Reset()
+	cfg.skipLogSampler = nil
+	err = enhanceRequests(logger, cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		map[string][]*model.TaggedResource{}, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+	if strings.Contains(buf.String(), "Unsupported namespace") {
+		t.Errorf("expected no info-level skip logs without a sampler, got %s", buf.String())
+	}
+}
+
+func TestLimitResponseDataOversizedFallsBack(t *testing.T) {
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	original, err := requestsIntoRawData([]*metricsservicepb.ExportMetricsServiceRequest{req})
+	if err != nil {
+		t.Fatalf("requestsIntoRawData failed: %v", err)
+	}
+	record := events.KinesisFirehoseEventRecord{RecordID: "rec-1", Data: original}
+
+	// Enrichment adds labels, so the enhanced payload is larger than the incoming record.
+	dp := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0]
+	dp.Attributes = append(dp.Attributes, &commonpb.KeyValue{
+		Key:   "tag_description",
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: strings.Repeat("x", 4096)}},
+	})
+	enhanced, err := requestsIntoRawData([]*metricsservicepb.ExportMetricsServiceRequest{req})
+	if err != nil {
+		t.Fatalf("requestsIntoRawData failed: %v", err)
+	}
+
+	got := limitResponseData(slog.Default(), record, enhanced, len(original)+1024)
+	if !bytes.Equal(got, original) {
+		t.Errorf("oversized enhanced payload (%d bytes) should fall back to the original record", len(enhanced))
+	}
+	if got := limitResponseData(slog.Default(), record, enhanced, len(enhanced)); !bytes.Equal(got, enhanced) {
+		t.Error("enhanced payload within the limit should be returned unchanged")
+	}
+	if got := limitResponseData(slog.Default(), record, enhanced, 0); !bytes.Equal(got, enhanced) {
+		t.Error("a zero limit should disable the check")
+	}
+}
+
+func TestResponseDataForMode(t *testing.T) {
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	record := events.KinesisFirehoseEventRecord{RecordID: "rec-1", Data: []byte("original")}
+	reqs := []*metricsservicepb.ExportMetricsServiceRequest{req}
+	enhanced, err := requestsIntoRawData(reqs)
+	if err != nil {
+		t.Fatalf("requestsIntoRawData failed: %v", err)
+	}
+
+	tests := []struct {
+		mode string
+		want []byte
+	}{
+		{outputModePassThrough, record.Data},
+		{outputModePassThroughAndExport, record.Data},
+		{outputModeEnhanced, enhanced},
+		{outputModeExportOnly, []byte{}},
+		{"unknown", record.Data},
+	}
+	for _, tc := range tests {
+		got, err := responseDataForMode(slog.Default(), tc.mode, record, reqs, 0)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.mode, err)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: got %d bytes %q, want %d bytes", tc.mode, len(got), got, len(tc.want))
+		}
+		resp := buildResponseRecord(record.RecordID, got)
+		if resp.Result != "Ok" {
+			t.Errorf("%s: Result got %q, want Ok", tc.mode, resp.Result)
+		}
+	}
+}
+
+func TestRecordLoggerAddsRecordID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	record := events.KinesisFirehoseEventRecord{RecordID: "49546986683135544286507457936321625675700192471156785154"}
+
+	// A Gauge is not enriched and logs at debug level from inside enhanceRequests.
+	req := &metricsservicepb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Metrics: []*metricspb.Metric{newGauge("up", 1, 1, 0, nil)},
+			}},
+		}},
+	}
+	err := enhanceRequests(recordLogger(logger, record), enhanceConfig{continueOnResourceFailure: true},
+		[]*metricsservicepb.ExportMetricsServiceRequest{req},
+		map[string][]*model.TaggedResource{}, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) == 0 || lines[0] == "" {
+		t.Fatal("expected enhanceRequests to emit logs")
+	}
+	for _, line := range lines {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", line, err)
+		}
+		if entry["record_id"] != record.RecordID {
+			t.Errorf("log entry missing record_id: %s", line)
+		}
+	}
+}
+
 func TestBuildCloudWatchMetricFromKeyValues(t *testing.T) {
 	attrs := []*commonpb.KeyValue{
 		{Key: "MetricName", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "VolumeWriteBytes"}}},
@@ -153,6 +464,143 @@ func TestBuildCloudWatchMetricFromKeyValues(t *testing.T) {
 	}
 }
 
+func TestBuildCloudWatchMetricFromKeyValuesLowercaseKeys(t *testing.T) {
+	str := func(s string) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+	}
+	dims := func(id string) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+			Values: []*commonpb.KeyValue{{Key: "VolumeId", Value: str(id)}},
+		}}}
+	}
+
+	cwm := buildCloudWatchMetricFromKeyValues([]*commonpb.KeyValue{
+		{Key: "metric_name", Value: str("VolumeWriteBytes")},
+		{Key: "namespace", Value: str("AWS/EBS")},
+		{Key: "dimensions", Value: dims("vol-123")},
+	})
+	if cwm.MetricName != "VolumeWriteBytes" || cwm.Namespace != "AWS/EBS" {
+		t.Fatalf("lowercase keys not recognized: %+v", cwm)
+	}
+	if len(cwm.Dimensions) != 1 || cwm.Dimensions[0].Value != "vol-123" {
+		t.Fatalf("expected vol-123 dimension, got %+v", cwm.Dimensions)
+	}
+
+	// Canonical keys win regardless of attribute order.
+	cwm = buildCloudWatchMetricFromKeyValues([]*commonpb.KeyValue{
+		{Key: "namespace", Value: str("aws/ebs")},
+		{Key: "Namespace", Value: str("AWS/EBS")},
+		{Key: "Dimensions", Value: dims("vol-123")},
+		{Key: "dimensions", Value: dims("vol-other")},
+	})
+	if cwm.Namespace != "AWS/EBS" {
+		t.Errorf("Namespace: got %q, want canonical %q", cwm.Namespace, "AWS/EBS")
+	}
+	if len(cwm.Dimensions) != 1 || cwm.Dimensions[0].Value != "vol-123" {
+		t.Errorf("Dimensions: got %+v, want canonical vol-123 only", cwm.Dimensions)
+	}
+}
+
+func TestSemconvDimensions(t *testing.T) {
+	mapping, err := parseSemconvDimensionMap(`{"aws.ec2.instance.id":"InstanceId","aws.ec2.image.id":"ImageId"}`)
+	if err != nil {
+		t.Fatalf("parseSemconvDimensionMap failed: %v", err)
+	}
+	str := func(s string) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+	}
+	attrs := []*commonpb.KeyValue{
+		{Key: "Namespace", Value: str("AWS/EC2")},
+		{Key: "MetricName", Value: str("CPUUtilization")},
+		{Key: "Dimensions", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+			Values: []*commonpb.KeyValue{{Key: "aws.ec2.image.id", Value: str("ami-123")}},
+		}}}},
+		{Key: "aws.ec2.instance.id", Value: str("i-1234567890abcdef0")},
+	}
+	cwm := buildCloudWatchMetricFromKeyValues(attrs)
+	applySemconvDimensions(cwm, attrs, mapping)
+	want := []model.Dimension{{Name: "ImageId", Value: "ami-123"}, {Name: "InstanceId", Value: "i-1234567890abcdef0"}}
+	if !slices.Equal(cwm.Dimensions, want) {
+		t.Fatalf("got dimensions %+v, want %+v", cwm.Dimensions, want)
+	}
+
+	// The reconstructed InstanceId dimension associates the metric with its instance.
+	ec2Resource := &model.TaggedResource{
+		ARN:       "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0",
+		Namespace: "AWS/EC2",
+		Region:    "us-east-1",
+		Tags:      []model.Tag{{Key: "Name", Value: "my-instance"}},
+	}
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", attrs[:2:2])
+	dp := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0]
+	dp.Attributes = append(dp.Attributes, attrs[3])
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, semconvDimensionMap: mapping}
+	err = enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		map[string][]*model.TaggedResource{"AWS/EC2": {ec2Resource}}, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+	got := keyValueToMap(dp.GetAttributes())
+	if got["name"] != ec2Resource.ARN || got["tag_name"] != "my-instance" || got["dimension_instance_id"] != "i-1234567890abcdef0" {
+		t.Errorf("expected the instance to be associated from the semconv key, got %v", got)
+	}
+
+	if _, err := parseSemconvDimensionMap(`{"aws.ec2.instance.id":""}`); err == nil {
+		t.Error("expected an error for an empty dimension name")
+	}
+}
+
+func TestAnyValueToString(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    *commonpb.AnyValue
+		expected string
+	}{
+		{"string", &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "i-123"}}, "i-123"},
+		{"int", &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 8080}}, "8080"},
+		{"negative int", &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: -1}}, "-1"},
+		{"double", &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: 0.25}}, "0.25"},
+		{"whole double", &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: 3}}, "3"},
+		{"bool", &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: true}}, "true"},
+		{"bytes", &commonpb.AnyValue{Value: &commonpb.AnyValue_BytesValue{BytesValue: []byte("abc")}}, "YWJj"},
+		{"kvlist", &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{}}}, ""},
+		{"nil", nil, ""},
+	}
+	for _, tc := range tests {
+		if got := anyValueToString(tc.value); got != tc.expected {
+			t.Errorf("anyValueToString(%s): got %q, want %q", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestBuildCloudWatchMetricFromKeyValuesNonStringDimensions(t *testing.T) {
+	attrs := []*commonpb.KeyValue{
+		{Key: "MetricName", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "RequestCount"}}},
+		{Key: "Namespace", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "AWS/ApplicationELB"}}},
+		{Key: "Dimensions", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+			Values: []*commonpb.KeyValue{
+				{Key: "Port", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 443}}},
+				{Key: "Enabled", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: false}}},
+			},
+		}}}},
+		{Key: "Statistic", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: 99.9}}},
+	}
+	cwm := buildCloudWatchMetricFromKeyValues(attrs)
+	if len(cwm.Dimensions) != 2 {
+		t.Fatalf("expected 2 dimensions, got %+v", cwm.Dimensions)
+	}
+	if cwm.Dimensions[0].Value != "443" {
+		t.Errorf("Port dimension: got %q, want %q", cwm.Dimensions[0].Value, "443")
+	}
+	if cwm.Dimensions[1].Value != "false" {
+		t.Errorf("Enabled dimension: got %q, want %q", cwm.Dimensions[1].Value, "false")
+	}
+	if got := attrValue(attrs, "Statistic"); got != "99.9" {
+		t.Errorf("attrValue(Statistic): got %q, want %q", got, "99.9")
+	}
+}
+
 // mockTaggingClient is used when resourceCache is pre-filled so GetResources is never called.
 type mockTaggingClient struct{}
 
@@ -160,6 +608,22 @@ func (mockTaggingClient) GetResources(ctx context.Context, job model.DiscoveryJo
 	return nil, errors.New("mock: should not be called")
 }
 
+// recordingTaggingClient records the discovery jobs it receives and returns a fixed set of resources.
+type recordingTaggingClient struct {
+	mu        sync.Mutex
+	jobs      []model.DiscoveryJob
+	regions   []string
+	resources []*model.TaggedResource
+}
+
+func (c *recordingTaggingClient) GetResources(ctx context.Context, job model.DiscoveryJob, region string) ([]*model.TaggedResource, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.jobs = append(c.jobs, job)
+	c.regions = append(c.regions, region)
+	return c.resources, nil
+}
+
 // keyValueToMap converts OTLP 1.0 KeyValue attributes (string values only) to a map for assertions.
 func keyValueToMap(attrs []*commonpb.KeyValue) map[string]string {
 	m := make(map[string]string, len(attrs))
@@ -206,13 +670,10 @@ func TestEnhanceEC2CPUUtilization(t *testing.T) {
 	}
 
 	err := enhanceRequests(
-		logger, "/tmp", true,
+		logger, enhanceConfig{fileCachePath: "/tmp", continueOnResourceFailure: true, labelsSnakeCase: true},
 		[]*metricsservicepb.ExportMetricsServiceRequest{req},
 		resourceCache, associatorCache,
 		aws.String("us-east-1"), mockTaggingClient{},
-		0, false, nil, false,
-		true, nil,
-		false, nil, // yaceCompatMode=false
 	)
 	if err != nil {
 		t.Fatalf("enhanceRequests failed: %v", err)
@@ -256,365 +717,3382 @@ func TestEnhanceEC2CPUUtilization(t *testing.T) {
 }
 
 // TestEnhanceEC2WithStaticLabelsAndExportedTags verifies custom_tag_* from STATIC_LABELS and EXPORTED_TAGS_ON_METRICS (only exported tags appear as tag_*).
-func TestEnhanceEC2WithStaticLabelsAndExportedTags(t *testing.T) {
-	ec2Resource := &model.TaggedResource{
-		ARN:       "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0",
+func TestEnhanceARNFallback(t *testing.T) {
+	ec2ARN := "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0"
+	resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {{
+		ARN:       ec2ARN,
 		Namespace: "AWS/EC2",
 		Region:    "us-east-1",
-		Tags: []model.Tag{
-			{Key: "Name", Value: "my-instance"},
-			{Key: "Environment", Value: "prod"},
-		},
+		Tags:      []model.Tag{{Key: "Name", Value: "my-instance"}},
+	}}}
+	// ResourceId is not part of any AWS/EC2 dimension mapping, so the associator cannot match it.
+	attrs := []*commonpb.KeyValue{
+		{Key: "Namespace", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "AWS/EC2"}}},
+		{Key: "MetricName", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "CPUUtilization"}}},
+		{Key: "Dimensions", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+			Values: []*commonpb.KeyValue{
+				{Key: "ResourceId", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "i-1234567890abcdef0"}}},
+			},
+		}}}},
 	}
-	req := makeExportRequestOTLP10WithResource("ignored", ec2InputAttrsOTLP10("i-1234567890abcdef0"), "123456789012", "us-east-1")
-	logger := slog.Default()
-	resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {ec2Resource}}
-	svc := config.SupportedServices.GetService("AWS/EC2")
-	if svc == nil {
-		t.Fatal("AWS/EC2 service not found")
+
+	for _, tc := range []struct {
+		fallback bool
+		wantName string
+		wantTag  string
+	}{
+		{fallback: false, wantName: "global"},
+		{fallback: true, wantName: ec2ARN, wantTag: "my-instance"},
+	} {
+		req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", attrs)
+		cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, enableARNFallback: tc.fallback}
+		err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+			resourceCache, map[string]maxdimassociator.Associator{}, aws.String("us-east-1"), mockTaggingClient{})
+		if err != nil {
+			t.Fatalf("enhanceRequests failed: %v", err)
+		}
+		got := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+		if got["name"] != tc.wantName {
+			t.Errorf("fallback=%v: name: got %q, want %q", tc.fallback, got["name"], tc.wantName)
+		}
+		if got["tag_name"] != tc.wantTag {
+			t.Errorf("fallback=%v: tag_name: got %q, want %q", tc.fallback, got["tag_name"], tc.wantTag)
+		}
 	}
-	associatorCache := map[string]maxdimassociator.Associator{
-		"AWS/EC2": maxdimassociator.NewAssociator(logger, svc.ToModelDimensionsRegexp(), resourceCache["AWS/EC2"]),
+}
+
+func TestARNFallbackAmbiguous(t *testing.T) {
+	resources := []*model.TaggedResource{
+		{ARN: "arn:aws:s3:::logs"},
+		{ARN: "arn:aws:logs:us-east-1:123456789012:log-group:logs"},
 	}
-	staticLabels := map[string]string{"env": "prod"}
-	exportedTags := []string{"Name"}
+	cwm := &model.Metric{Dimensions: []model.Dimension{{Name: "BucketName", Value: "logs"}}}
+	if r := arnFallback(cwm, resources); r != nil {
+		t.Errorf("expected no match when several ARNs end with the value, got %s", r.ARN)
+	}
+	cwm.Dimensions[0].Value = "gs"
+	if r := arnFallback(cwm, []*model.TaggedResource{{ARN: "arn:aws:s3:::gs"}}); r != nil {
+		t.Errorf("expected short values to be ignored, got %s", r.ARN)
+	}
+}
 
-	err := enhanceRequests(
-		logger, "/tmp", true,
+// The YACE associator already retries with mappings covering fewer of the metric's dimensions
+// when the most specific one misses, so metrics with extra dimensions still associate.
+func TestEnhanceAssociatesOnDimensionSubset(t *testing.T) {
+	lbARN := "arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/app/my-lb/50dc6c495c0c9188"
+	resourceCache := map[string][]*model.TaggedResource{"AWS/ApplicationELB": {
+		{ARN: lbARN, Namespace: "AWS/ApplicationELB", Region: "us-east-1"},
+		{ARN: "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/other-tg/0000000000000000", Namespace: "AWS/ApplicationELB", Region: "us-east-1"},
+	}}
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/ApplicationELB/RequestCount", []*commonpb.KeyValue{
+		{Key: "Namespace", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "AWS/ApplicationELB"}}},
+		{Key: "MetricName", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "RequestCount"}}},
+		{Key: "Dimensions", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+			Values: []*commonpb.KeyValue{
+				{Key: "LoadBalancer", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "app/my-lb/50dc6c495c0c9188"}}},
+				{Key: "TargetGroup", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "targetgroup/my-tg/73e2d6bc24d8a067"}}},
+			},
+		}}}},
+	})
+
+	err := enhanceRequests(slog.Default(), enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true},
 		[]*metricsservicepb.ExportMetricsServiceRequest{req},
-		resourceCache, associatorCache,
-		aws.String("us-east-1"), mockTaggingClient{},
-		0, false, staticLabels, false,
-		true, exportedTags,
-		false, nil, // yaceCompatMode=false
-	)
+		resourceCache, map[string]maxdimassociator.Associator{}, aws.String("us-east-1"), mockTaggingClient{})
 	if err != nil {
 		t.Fatalf("enhanceRequests failed: %v", err)
 	}
-
 	got := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
-	if got["tag_name"] != "my-instance" {
-		t.Errorf("tag_name: got %q", got["tag_name"])
+	if got["name"] != lbARN {
+		t.Errorf("name: got %q, want the load balancer matched on the LoadBalancer dimension alone %q", got["name"], lbARN)
 	}
-	if _, ok := got["tag_environment"]; ok {
-		t.Errorf("tag_environment should be absent when EXPORTED_TAGS_ON_METRICS=[\"Name\"]")
+}
+
+func TestEnhanceCustomNamespace(t *testing.T) {
+	orig := config.SupportedServices
+	t.Cleanup(func() { config.SupportedServices = orig })
+
+	svcs, err := parseCustomNamespaces(`{"Custom/Widgets":["widget/(?P<WidgetId>[^/]+)"]}`, `{"Custom/Widgets":["widgets:widget"]}`)
+	if err != nil {
+		t.Fatalf("parseCustomNamespaces failed: %v", err)
 	}
-	if got["custom_tag_env"] != "prod" {
-		t.Errorf("custom_tag_env: got %q", got["custom_tag_env"])
+	if len(svcs) != 1 || len(svcs[0].ResourceFilters) != 1 || *svcs[0].ResourceFilters[0] != "widgets:widget" {
+		t.Fatalf("unexpected custom services: %+v", svcs)
 	}
-	// Verify new labels are present
-	if got["region"] != "us-east-1" {
-		t.Errorf("region: got %q", got["region"])
+	registerCustomServices(slog.Default(), svcs)
+	registerCustomServices(slog.Default(), svcs)
+	if got := len(config.SupportedServices) - len(orig); got != 1 {
+		t.Fatalf("expected the custom namespace to be registered once, got %d new entries", got)
 	}
-	if got["account_id"] != "123456789012" {
-		t.Errorf("account_id: got %q", got["account_id"])
+
+	widgetARN := "arn:aws:widgets:us-east-1:123456789012:widget/w-1"
+	resourceCache := map[string][]*model.TaggedResource{"Custom/Widgets": {{
+		ARN:       widgetARN,
+		Namespace: "Custom/Widgets",
+		Region:    "us-east-1",
+		Tags:      []model.Tag{{Key: "Team", Value: "widgets"}},
+	}}}
+	req := makeExportRequestOTLP10("amazonaws.com/Custom/Widgets/Spins", []*commonpb.KeyValue{
+		{Key: "Namespace", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "Custom/Widgets"}}},
+		{Key: "MetricName", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "Spins"}}},
+		{Key: "Dimensions", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+			Values: []*commonpb.KeyValue{
+				{Key: "WidgetId", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "w-1"}}},
+			},
+		}}}},
+	})
+	err = enhanceRequests(slog.Default(), enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true},
+		[]*metricsservicepb.ExportMetricsServiceRequest{req},
+		resourceCache, map[string]maxdimassociator.Associator{}, aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+	got := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+	if got["name"] != widgetARN {
+		t.Errorf("name: got %q, want %q", got["name"], widgetARN)
+	}
+	if got["tag_team"] != "widgets" {
+		t.Errorf("tag_team: got %q, want %q", got["tag_team"], "widgets")
 	}
 }
 
-func TestExtractResourceAttributes(t *testing.T) {
-	// Test with both account_id and region
-	rm := &metricspb.ResourceMetrics{
-		Resource: &resourcepb.Resource{
-			Attributes: []*commonpb.KeyValue{
-				{Key: "cloud.account.id", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "123456789012"}}},
-				{Key: "cloud.region", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "us-west-2"}}},
-				{Key: "cloud.provider", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "aws"}}},
+func TestEnhanceStrictDimensionMatch(t *testing.T) {
+	ec2ARN := "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0"
+	resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {{ARN: ec2ARN, Namespace: "AWS/EC2", Region: "us-east-1"}}}
+	attrs := []*commonpb.KeyValue{
+		{Key: "Namespace", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "AWS/EC2"}}},
+		{Key: "MetricName", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "CPUUtilization"}}},
+		{Key: "Dimensions", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+			Values: []*commonpb.KeyValue{
+				{Key: "InstanceId", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "i-1234567890abcdef0"}}},
+				{Key: "Bogus", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "x"}}},
 			},
-		},
-	}
-	accountID, region := extractResourceAttributes(rm)
-	if accountID != "123456789012" {
-		t.Errorf("accountID: got %q, want %q", accountID, "123456789012")
-	}
-	if region != "us-west-2" {
-		t.Errorf("region: got %q, want %q", region, "us-west-2")
+		}}}},
 	}
 
-	// Test with nil resource
-	rm2 := &metricspb.ResourceMetrics{}
-	accountID2, region2 := extractResourceAttributes(rm2)
-	if accountID2 != "" || region2 != "" {
-		t.Errorf("expected empty values for nil resource, got accountID=%q, region=%q", accountID2, region2)
+	for _, tc := range []struct {
+		strict   bool
+		wantName string
+	}{
+		{strict: false, wantName: ec2ARN},
+		{strict: true, wantName: "global"},
+	} {
+		req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", attrs)
+		cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, strictDimensionMatch: tc.strict}
+		err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+			resourceCache, map[string]maxdimassociator.Associator{}, aws.String("us-east-1"), mockTaggingClient{})
+		if err != nil {
+			t.Fatalf("enhanceRequests failed: %v", err)
+		}
+		got := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+		if got["name"] != tc.wantName {
+			t.Errorf("STRICT_DIMENSION_MATCH=%v: name got %q, want %q", tc.strict, got["name"], tc.wantName)
+		}
 	}
+}
 
-	// Test with nil ResourceMetrics
-	accountID3, region3 := extractResourceAttributes(nil)
-	if accountID3 != "" || region3 != "" {
-		t.Errorf("expected empty values for nil ResourceMetrics, got accountID=%q, region=%q", accountID3, region3)
+func TestEnhanceShortNamespace(t *testing.T) {
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, shortNamespace: true}
+	err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		map[string][]*model.TaggedResource{"AWS/EC2": nil}, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
 	}
-}
 
-func TestQuantileToStatistic(t *testing.T) {
-	tests := []struct {
-		quantile float64
-		expected string
-	}{
-		{0.0, "Minimum"},
-		{1.0, "Maximum"},
-		{0.5, "p50"},
-		{0.95, "p95"},
-		{0.99, "p99"},
-		{0.999, "p99_9"},
+	metric := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0]
+	got := keyValueToMap(metric.GetSummary().GetDataPoints()[0].GetAttributes())
+	if got["namespace"] != "EC2" {
+		t.Errorf("namespace label: got %q, want %q", got["namespace"], "EC2")
 	}
-	for _, tc := range tests {
-		got := quantileToStatistic(tc.quantile)
-		if got != tc.expected {
-			t.Errorf("quantileToStatistic(%v): got %q, want %q", tc.quantile, got, tc.expected)
-		}
+	if want := promutil.BuildMetricName("AWS/EC2", "CPUUtilization", ""); metric.GetName() != want {
+		t.Errorf("metric name should use the full namespace: got %q, want %q", metric.GetName(), want)
 	}
 }
 
-func TestParseYACEStats(t *testing.T) {
-	// Test default (empty string)
-	stats, err := parseYACEStats("")
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-	if !stats["Maximum"] || !stats["Minimum"] || !stats["Average"] || !stats["Sum"] || !stats["SampleCount"] {
-		t.Errorf("expected all default stats to be enabled, got %v", stats)
+func TestEnhanceRefreshRebuildsAssociator(t *testing.T) {
+	logger := slog.Default()
+	arn := "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0"
+	svc := config.SupportedServices.GetService("AWS/EC2")
+	// The associator was built from a resource set that has since expired from the resource cache.
+	associatorCache := map[string]maxdimassociator.Associator{
+		"AWS/EC2": maxdimassociator.NewAssociator(logger, svc.ToModelDimensionsRegexp(), nil),
 	}
+	resourceCache := map[string][]*model.TaggedResource{}
+	client := &recordingTaggingClient{resources: []*model.TaggedResource{{ARN: arn, Namespace: "AWS/EC2", Region: "us-east-1"}}}
 
-	// Test custom list
-	stats, err = parseYACEStats(`["Maximum","Average"]`)
+	req := makeExportRequestOTLP10("ignored", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, fileCachePath: t.TempDir()}
+	err := enhanceRequests(logger, cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		resourceCache, associatorCache, aws.String("us-east-1"), client)
 	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+		t.Fatalf("enhanceRequests failed: %v", err)
 	}
-	if !stats["Maximum"] || !stats["Average"] {
-		t.Errorf("expected Maximum and Average to be enabled")
+
+	attrs := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+	if attrs["name"] != arn {
+		t.Errorf("name label: got %q, want the refreshed resource %q", attrs["name"], arn)
 	}
-	if stats["Minimum"] || stats["Sum"] || stats["SampleCount"] {
-		t.Errorf("expected Minimum, Sum, SampleCount to be disabled")
+	if len(client.jobs) != 1 {
+		t.Errorf("expected 1 discovery, got %d", len(client.jobs))
 	}
+}
 
-	// Test invalid JSON
-	_, err = parseYACEStats(`invalid`)
-	if err == nil {
-		t.Errorf("expected error for invalid JSON")
+func TestResourceStoreSetDropsAssociator(t *testing.T) {
+	logger := slog.Default()
+	svc := config.SupportedServices.GetService("AWS/EC2")
+	store := resourceStore{
+		resources:   map[string][]*model.TaggedResource{},
+		associators: map[string]maxdimassociator.Associator{},
+	}
+	store.set("AWS/EC2", nil)
+	store.associator(logger, "AWS/EC2", svc)
+	if _, ok := store.associators["AWS/EC2"]; !ok {
+		t.Fatal("expected associator to be cached after first use")
+	}
+	store.set("AWS/EC2", []*model.TaggedResource{{ARN: "arn:aws:ec2:us-east-1:123456789012:instance/i-1"}})
+	if _, ok := store.associators["AWS/EC2"]; ok {
+		t.Error("expected set to drop the stale associator")
+	}
+	if !store.has("AWS/EC2") || len(store.resources["AWS/EC2"]) != 1 {
+		t.Errorf("expected the new resources to be cached, got %v", store.resources["AWS/EC2"])
 	}
 }
 
-// makeExportRequestWithSummaryData builds an OTLP 1.0 ExportMetricsServiceRequest with Summary data including count, sum, and quantiles.
-func makeExportRequestWithSummaryData(metricName string, attrs []*commonpb.KeyValue, count uint64, sum float64, quantiles map[float64]float64) *metricsservicepb.ExportMetricsServiceRequest {
-	return makeExportRequestWithSummaryDataAndResource(metricName, attrs, count, sum, quantiles, "", "")
-}
+func TestFilterResourcesByDimension(t *testing.T) {
+	instance := &model.TaggedResource{ARN: "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0", Namespace: "AWS/EC2"}
+	volume := &model.TaggedResource{ARN: "arn:aws:ec2:us-east-1:123456789012:volume/vol-0123456789abcdef0", Namespace: "AWS/EC2"}
+	image := &model.TaggedResource{ARN: "arn:aws:ec2:us-east-1::image/ami-0123456789abcdef0", Namespace: "AWS/EC2"}
+	resources := []*model.TaggedResource{volume, instance, image}
+	regexps := config.SupportedServices.GetService("AWS/EC2").ToModelDimensionsRegexp()
 
-// makeExportRequestWithSummaryDataAndResource builds an OTLP 1.0 ExportMetricsServiceRequest with Summary data and resource attributes.
-func makeExportRequestWithSummaryDataAndResource(metricName string, attrs []*commonpb.KeyValue, count uint64, sum float64, quantiles map[float64]float64, accountID, region string) *metricsservicepb.ExportMetricsServiceRequest {
-	var qvs []*metricspb.SummaryDataPoint_ValueAtQuantile
-	for q, v := range quantiles {
-		qvs = append(qvs, &metricspb.SummaryDataPoint_ValueAtQuantile{
-			Quantile: q,
-			Value:    v,
-		})
+	cwm := &model.Metric{Namespace: "AWS/EC2", Dimensions: []model.Dimension{{Name: "InstanceId", Value: "i-1234567890abcdef0"}}}
+	if got := filterResourcesByDimension(resources, regexps, cwm); len(got) != 1 || got[0] != instance {
+		t.Errorf("InstanceId metric: expected only the instance ARN, got %v", got)
+	}
+	// Metrics whose dimensions select no resource type are associated against every resource.
+	cwm = &model.Metric{Namespace: "AWS/EC2", Dimensions: []model.Dimension{{Name: "AutoScalingGroupName", Value: "asg"}}}
+	if got := filterResourcesByDimension(resources, regexps, cwm); len(got) != len(resources) {
+		t.Errorf("AutoScalingGroupName metric: expected resources unchanged, got %v", got)
 	}
 
-	var resourceAttrs []*commonpb.KeyValue
-	if accountID != "" {
-		resourceAttrs = append(resourceAttrs, &commonpb.KeyValue{
-			Key:   "cloud.account.id",
-			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: accountID}},
-		})
+	logger := slog.Default()
+	store := resourceStore{
+		resources:   map[string][]*model.TaggedResource{"AWS/EC2": resources},
+		associators: map[string]maxdimassociator.Associator{},
 	}
-	if region != "" {
-		resourceAttrs = append(resourceAttrs, &commonpb.KeyValue{
-			Key:   "cloud.region",
-			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: region}},
-		})
+	req := makeExportRequestOTLP10("ignored", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, filterResourcesByDimension: true}
+	err := enhanceRequests(logger, cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		store.resources, store.associators, aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+	attrs := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+	if attrs["name"] != instance.ARN {
+		t.Errorf("name label: got %q, want %q", attrs["name"], instance.ARN)
+	}
+	if _, ok := store.associators["AWS/EC2|0"]; !ok {
+		t.Errorf("expected a filtered associator to be cached, got keys %v", sortedKeys(store.associators))
+	}
+	store.set("AWS/EC2", nil)
+	if len(store.associators) != 0 {
+		t.Errorf("expected refreshing the resources to drop filtered associators, got keys %v", sortedKeys(store.associators))
 	}
+}
 
-	rm := &metricspb.ResourceMetrics{
-		ScopeMetrics: []*metricspb.ScopeMetrics{{
-			Metrics: []*metricspb.Metric{{
-				Name: metricName,
-				Data: &metricspb.Metric_Summary{
-					Summary: &metricspb.Summary{
-						DataPoints: []*metricspb.SummaryDataPoint{{
-							Attributes:        attrs,
-							Count:             count,
-							Sum:               sum,
-							QuantileValues:    qvs,
-							TimeUnixNano:      1000000000,
-							StartTimeUnixNano: 900000000,
-						}},
-					},
-				},
-			}},
-		}},
+func TestEnhanceInferNamespaceFromName(t *testing.T) {
+	nameOnly := func() *metricsservicepb.ExportMetricsServiceRequest {
+		attrs := ec2InputAttrsOTLP10("i-1234567890abcdef0")[2:] // Dimensions only
+		attrs = append(attrs, &commonpb.KeyValue{Key: "Statistic", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "Maximum"}}})
+		return makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", attrs)
 	}
-	if len(resourceAttrs) > 0 {
-		rm.Resource = &resourcepb.Resource{Attributes: resourceAttrs}
+	for _, infer := range []bool{false, true} {
+		req := nameOnly()
+		cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, inferNamespaceFromName: infer}
+		err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+			map[string][]*model.TaggedResource{"AWS/EC2": nil}, map[string]maxdimassociator.Associator{},
+			aws.String("us-east-1"), mockTaggingClient{})
+		if err != nil {
+			t.Fatalf("enhanceRequests failed: %v", err)
+		}
+
+		metric := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0]
+		got := keyValueToMap(metric.GetSummary().GetDataPoints()[0].GetAttributes())
+		if !infer {
+			if metric.GetName() != "amazonaws.com/AWS/EC2/CPUUtilization" || got["namespace"] != "" {
+				t.Errorf("without INFER_NAMESPACE_FROM_NAME the metric should be left as is, got %q %v", metric.GetName(), got)
+			}
+			continue
+		}
+		if want := promutil.BuildMetricName("AWS/EC2", "CPUUtilization", "Maximum"); metric.GetName() != want {
+			t.Errorf("metric name: got %q, want %q", metric.GetName(), want)
+		}
+		if got["namespace"] != "AWS/EC2" || got["dimension_instance_id"] != "i-1234567890abcdef0" {
+			t.Errorf("expected labels from the inferred namespace, got %v", got)
+		}
 	}
+}
 
-	return &metricsservicepb.ExportMetricsServiceRequest{
-		ResourceMetrics: []*metricspb.ResourceMetrics{rm},
+func TestCloudWatchNameParts(t *testing.T) {
+	tests := []struct {
+		name, namespace, metricName string
+		ok                          bool
+	}{
+		{"amazonaws.com/AWS/EC2/CPUUtilization", "AWS/EC2", "CPUUtilization", true},
+		{"amazonaws.com/MyApp/Checkout/Latency", "MyApp/Checkout", "Latency", true},
+		{"amazonaws.com/CPUUtilization", "", "", false},
+		{"amazonaws.com/AWS/EC2/", "", "", false},
+		{"aws_ec2_cpuutilization_maximum", "", "", false},
+	}
+	for _, tt := range tests {
+		ns, name, ok := cloudWatchNameParts(tt.name)
+		if ns != tt.namespace || name != tt.metricName || ok != tt.ok {
+			t.Errorf("cloudWatchNameParts(%q) = %q, %q, %v; want %q, %q, %v", tt.name, ns, name, ok, tt.namespace, tt.metricName, tt.ok)
+		}
 	}
 }
 
-func TestSummaryToGauges(t *testing.T) {
-	cwm := &model.Metric{
-		Namespace:  "AWS/EC2",
-		MetricName: "CPUUtilization",
+func TestEnhanceScopeLabels(t *testing.T) {
+	scopeLabels, err := parseScopeLabels(`{"scope-a":{"source":"stream-a","env":"staging"}}`)
+	if err != nil {
+		t.Fatalf("parseScopeLabels failed: %v", err)
 	}
-	attrs := []*commonpb.KeyValue{
-		{Key: "name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "test-arn"}}},
+	ec2Resource := &model.TaggedResource{ARN: "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0", Namespace: "AWS/EC2", Region: "us-east-1"}
+	summary := func() *metricspb.Metric {
+		return &metricspb.Metric{
+			Name: "amazonaws.com/AWS/EC2/CPUUtilization",
+			Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{
+				DataPoints: []*metricspb.SummaryDataPoint{{Attributes: ec2InputAttrsOTLP10("i-1234567890abcdef0"), Count: 1, Sum: 1}},
+			}},
+		}
 	}
-	dp := &metricspb.SummaryDataPoint{
-		Count:             10,
-		Sum:               50.0,
-		TimeUnixNano:      1000000000,
-		StartTimeUnixNano: 900000000,
-		QuantileValues: []*metricspb.SummaryDataPoint_ValueAtQuantile{
-			{Quantile: 0.0, Value: 2.0},  // Minimum
-			{Quantile: 0.95, Value: 8.0}, // p95
-			{Quantile: 1.0, Value: 10.0}, // Maximum
+	req := &metricsservicepb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		ScopeMetrics: []*metricspb.ScopeMetrics{
+			{Scope: &commonpb.InstrumentationScope{Name: "scope-a"}, Metrics: []*metricspb.Metric{summary()}},
+			{Scope: &commonpb.InstrumentationScope{Name: "scope-b"}, Metrics: []*metricspb.Metric{summary()}},
 		},
+	}}}
+	cfg := enhanceConfig{
+		continueOnResourceFailure: true,
+		labelsSnakeCase:           true,
+		staticLabels:              map[string]string{"env": "prod"},
+		scopeLabels:               scopeLabels,
 	}
-
-	// Enable all stats
-	enabledStats := map[string]bool{
-		"Maximum": true, "Minimum": true, "Average": true, "Sum": true, "SampleCount": true, "p95": true,
+	err = enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		map[string][]*model.TaggedResource{"AWS/EC2": {ec2Resource}}, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
 	}
 
-	gauges := summaryToGauges(cwm, dp, attrs, enabledStats)
-
-	// Should produce: SampleCount, Sum, Average, Minimum, p95, Maximum
-	expectedNames := map[string]float64{
-		"aws_ec2_cpuutilization_sample_count": 10.0,
-		"aws_ec2_cpuutilization_sum":          50.0,
-		"aws_ec2_cpuutilization_average":      5.0, // 50/10
-		"aws_ec2_cpuutilization_minimum":      2.0,
-		"aws_ec2_cpuutilization_p95":          8.0,
-		"aws_ec2_cpuutilization_maximum":      10.0,
+	labels := func(i int) map[string]string {
+		return keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[i].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
 	}
-
-	if len(gauges) != len(expectedNames) {
-		t.Fatalf("expected %d gauges, got %d", len(expectedNames), len(gauges))
+	if a := labels(0); a["custom_tag_source"] != "stream-a" || a["custom_tag_env"] != "staging" {
+		t.Errorf("scope-a: expected its scope labels to override static labels, got %v", a)
+	}
+	if b := labels(1); b["custom_tag_source"] != "" || b["custom_tag_env"] != "prod" {
+		t.Errorf("scope-b: expected only the static labels, got %v", b)
 	}
 
-	for _, g := range gauges {
-		expectedVal, ok := expectedNames[g.GetName()]
-		if !ok {
-			t.Errorf("unexpected gauge name: %s", g.GetName())
-			continue
-		}
-		gotVal := g.GetGauge().GetDataPoints()[0].GetAsDouble()
-		if gotVal != expectedVal {
-			t.Errorf("gauge %s: got value %v, want %v", g.GetName(), gotVal, expectedVal)
-		}
-		// Check attributes are preserved
-		gotAttrs := keyValueToMap(g.GetGauge().GetDataPoints()[0].GetAttributes())
-		if gotAttrs["name"] != "test-arn" {
-			t.Errorf("gauge %s: expected name=test-arn in attrs, got %v", g.GetName(), gotAttrs)
-		}
+	if _, err := parseScopeLabels(`{"scope-a":["source=a"]}`); err == nil {
+		t.Error("expected an error for a scope without a label object")
 	}
 }
 
-// TestEnhanceEC2YACECompatMode verifies that with YACE_COMPAT_MODE=true, Summary metrics are converted to multiple Gauge metrics.
-func TestEnhanceEC2YACECompatMode(t *testing.T) {
-	ec2ARN := "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0"
+func TestEnhanceExponentialHistogram(t *testing.T) {
 	ec2Resource := &model.TaggedResource{
-		ARN:       ec2ARN,
+		ARN:       "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0",
 		Namespace: "AWS/EC2",
 		Region:    "us-east-1",
-		Tags: []model.Tag{
-			{Key: "Name", Value: "my-instance"},
-		},
+		Tags:      []model.Tag{{Key: "Name", Value: "my-instance"}},
+	}
+	makeRequest := func() *metricsservicepb.ExportMetricsServiceRequest {
+		return &metricsservicepb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: []*metricspb.Metric{{
+				Name: "cpu_utilization",
+				Data: &metricspb.Metric_ExponentialHistogram{ExponentialHistogram: &metricspb.ExponentialHistogram{
+					DataPoints: []*metricspb.ExponentialHistogramDataPoint{{
+						Attributes:   ec2InputAttrsOTLP10("i-1234567890abcdef0"),
+						TimeUnixNano: 1000000000,
+						Count:        4,
+						Sum:          proto.Float64(20),
+						Min:          proto.Float64(2),
+						Max:          proto.Float64(9),
+					}},
+				}},
+			}}}},
+		}}}
+	}
+	enhance := func(cfg enhanceConfig, req *metricsservicepb.ExportMetricsServiceRequest) []*metricspb.Metric {
+		t.Helper()
+		cfg.continueOnResourceFailure, cfg.labelsSnakeCase = true, true
+		err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+			map[string][]*model.TaggedResource{"AWS/EC2": {ec2Resource}}, map[string]maxdimassociator.Associator{},
+			aws.String("us-east-1"), mockTaggingClient{})
+		if err != nil {
+			t.Fatalf("enhanceRequests failed: %v", err)
+		}
+		return req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()
 	}
 
-	// Create request with Summary data including count, sum, quantiles, and resource attributes
-	req := makeExportRequestWithSummaryDataAndResource(
-		"amazonaws.com/AWS/EC2/CPUUtilization",
-		ec2InputAttrsOTLP10("i-1234567890abcdef0"),
-		10,   // count
-		50.0, // sum
-		map[float64]float64{
-			0.0: 2.0,  // Minimum
-			1.0: 10.0, // Maximum
-		},
-		"123456789012", // account_id
-		"us-east-1",    // region
-	)
+	metrics := enhance(enhanceConfig{}, makeRequest())
+	if len(metrics) != 1 || metrics[0].GetExponentialHistogram() == nil {
+		t.Fatalf("expected the exponential histogram to be kept, got %v", metrics)
+	}
+	got := keyValueToMap(metrics[0].GetExponentialHistogram().GetDataPoints()[0].GetAttributes())
+	if got["name"] != ec2Resource.ARN || got["tag_name"] != "my-instance" || got["dimension_instance_id"] != "i-1234567890abcdef0" {
+		t.Errorf("expected the data point attributes to be enriched, got %v", got)
+	}
 
-	logger := slog.Default()
-	resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {ec2Resource}}
-	svc := config.SupportedServices.GetService("AWS/EC2")
-	if svc == nil {
-		t.Fatal("AWS/EC2 service not found in config")
+	cfg := enhanceConfig{yaceCompatMode: true, yaceCompatStats: map[string]bool{"SampleCount": true, "Sum": true, "Minimum": true, "Maximum": true}}
+	values := make(map[string]float64)
+	for _, m := range enhance(cfg, makeRequest()) {
+		dp := m.GetGauge().GetDataPoints()[0]
+		if keyValueToMap(dp.GetAttributes())["tag_name"] != "my-instance" {
+			t.Errorf("%s: expected enriched labels", m.GetName())
+		}
+		values[m.GetName()] = dp.GetAsDouble()
 	}
-	associatorCache := map[string]maxdimassociator.Associator{
-		"AWS/EC2": maxdimassociator.NewAssociator(logger, svc.ToModelDimensionsRegexp(), resourceCache["AWS/EC2"]),
+	want := map[string]float64{
+		"aws_ec2_cpuutilization_sample_count": 4,
+		"aws_ec2_cpuutilization_sum":          20,
+		"aws_ec2_cpuutilization_minimum":      2,
+		"aws_ec2_cpuutilization_maximum":      9,
+	}
+	if len(values) != len(want) {
+		t.Fatalf("expected gauges %v, got %v", want, values)
+	}
+	for name, v := range want {
+		if values[name] != v {
+			t.Errorf("%s: got %v, want %v", name, values[name], v)
+		}
 	}
+}
 
-	// Enable YACE compat mode with all default stats
-	yaceCompatStats, _ := parseYACEStats("")
+func TestEnhanceStatisticsFilter(t *testing.T) {
+	withStatistic := func(stat string) *metricspb.SummaryDataPoint {
+		attrs := append(ec2InputAttrsOTLP10("i-1234567890abcdef0"), &commonpb.KeyValue{
+			Key: "Statistic", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: stat}},
+		})
+		return &metricspb.SummaryDataPoint{Attributes: attrs}
+	}
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", nil)
+	metric := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0]
+	average, maximum := withStatistic("Average"), withStatistic("Maximum")
+	metric.GetSummary().DataPoints = []*metricspb.SummaryDataPoint{
+		average, withStatistic("Minimum"), maximum, withStatistic("Sum"),
+	}
+	filter, err := parseStatisticsFilter(`["Average","Maximum"]`)
+	if err != nil {
+		t.Fatalf("parseStatisticsFilter failed: %v", err)
+	}
 
-	err := enhanceRequests(
-		logger, "/tmp", true,
-		[]*metricsservicepb.ExportMetricsServiceRequest{req},
-		resourceCache, associatorCache,
-		aws.String("us-east-1"), mockTaggingClient{},
-		0, false, nil, false,
-		true, nil,
-		true, yaceCompatStats, // yaceCompatMode=true
-	)
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, statisticsFilter: filter}
+	err = enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		map[string][]*model.TaggedResource{"AWS/EC2": nil}, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
 	if err != nil {
 		t.Fatalf("enhanceRequests failed: %v", err)
 	}
 
-	// Verify metrics were converted from Summary to Gauges
-	metrics := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()
+	dps := metric.GetSummary().GetDataPoints()
+	if len(dps) != 2 || dps[0] != average || dps[1] != maximum {
+		t.Fatalf("expected only the Average and Maximum data points to be kept, got %d data points", len(dps))
+	}
+	for i, dp := range dps {
+		if got := keyValueToMap(dp.GetAttributes()); got["namespace"] != "AWS/EC2" {
+			t.Errorf("data point %d was not enriched: %v", i, got)
+		}
+	}
+}
 
-	// Should have: SampleCount, Sum, Average, Minimum, Maximum
-	expectedNames := []string{
-		"aws_ec2_cpuutilization_sample_count",
-		"aws_ec2_cpuutilization_sum",
-		"aws_ec2_cpuutilization_average",
-		"aws_ec2_cpuutilization_minimum",
-		"aws_ec2_cpuutilization_maximum",
+func TestEnhanceStatisticsFilterDropsEmptyMetric(t *testing.T) {
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	cfg := enhanceConfig{continueOnResourceFailure: true, statisticsFilter: map[string]bool{"Average": true}}
+	err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		map[string][]*model.TaggedResource{"AWS/EC2": nil}, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+	if got := len(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()); got != 0 {
+		t.Errorf("expected metric without allowed statistics to be dropped, got %d metrics", got)
 	}
+}
 
-	if len(metrics) != len(expectedNames) {
-		var gotNames []string
-		for _, m := range metrics {
-			gotNames = append(gotNames, m.GetName())
+func TestEnhancePreserveOriginalAttrsStripsReserved(t *testing.T) {
+	attrs := append(ec2InputAttrsOTLP10("i-1234567890abcdef0"),
+		&commonpb.KeyValue{Key: "Statistic", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "Average"}}},
+		&commonpb.KeyValue{Key: "metric_stream_name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "stream-1"}}},
+		&commonpb.KeyValue{Key: "region", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "eu-west-1"}}},
+	)
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", attrs)
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, preserveOriginalAttrs: true}
+	err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		map[string][]*model.TaggedResource{"AWS/EC2": nil}, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	got := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+	for _, k := range []string{"Namespace", "MetricName", "Dimensions", "Statistic"} {
+		if _, ok := got[k]; ok {
+			t.Errorf("reserved attribute %q leaked into output: %v", k, got)
 		}
-		t.Fatalf("expected %d metrics, got %d: %v", len(expectedNames), len(metrics), gotNames)
 	}
+	if got["metric_stream_name"] != "stream-1" {
+		t.Errorf("expected original attribute to be preserved, got %v", got)
+	}
+	if got["region"] != "us-east-1" {
+		t.Errorf("YACE label should win over the original attribute: got region %q", got["region"])
+	}
+}
 
-	// Check that all expected metrics are present and are Gauge type
-	foundNames := make(map[string]bool)
-	for _, m := range metrics {
-		foundNames[m.GetName()] = true
+func TestParseStripAttrs(t *testing.T) {
+	strip, err := parseStripAttrs(`["Statistic","metric_stream_name"]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strip[stripAttrKey("MetricStreamName")] || !strip[stripAttrKey("statistic")] || strip[stripAttrKey("Namespace")] {
+		t.Errorf("unexpected strip set: %v", strip)
+	}
+	if strip, err := parseStripAttrs("not json"); err == nil || !strip[stripAttrKey("Dimensions")] {
+		t.Errorf("invalid STRIP_ATTRS should fall back to the defaults with an error, got %v, %v", strip, err)
+	}
+}
 
-		// Verify it's a Gauge (not Summary)
-		if m.GetGauge() == nil {
-			t.Errorf("metric %s should be Gauge type", m.GetName())
+func TestEnhanceMultipleScopesPreservesScopeIdentity(t *testing.T) {
+	summary := func(metricName string) *metricspb.Metric {
+		attrs := ec2InputAttrsOTLP10("i-1234567890abcdef0")
+		attrs[1] = &commonpb.KeyValue{Key: "MetricName", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: metricName}}}
+		return &metricspb.Metric{
+			Name: "amazonaws.com/AWS/EC2/" + metricName,
+			Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{
+				DataPoints: []*metricspb.SummaryDataPoint{{Attributes: attrs, Count: 2, Sum: 10, TimeUnixNano: 1}},
+			}},
 		}
+	}
+	scopeA := &commonpb.InstrumentationScope{Name: "scope-a", Version: "1.0.0"}
+	scopeB := &commonpb.InstrumentationScope{Name: "scope-b", Version: "2.0.0"}
+	newReq := func() *metricsservicepb.ExportMetricsServiceRequest {
+		return &metricsservicepb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+			ScopeMetrics: []*metricspb.ScopeMetrics{
+				{Scope: scopeA, SchemaUrl: "https://example.com/a", Metrics: []*metricspb.Metric{summary("CPUUtilization")}},
+				{Scope: scopeB, SchemaUrl: "https://example.com/b", Metrics: []*metricspb.Metric{
+					newGauge("untouched", 1, 1, 0, nil),
+					summary("NetworkIn"),
+				}},
+			},
+		}}}
+	}
 
-		// Check labels are correct including new YACE context labels
-		if len(m.GetGauge().GetDataPoints()) > 0 {
-			attrs := keyValueToMap(m.GetGauge().GetDataPoints()[0].GetAttributes())
-			if attrs["region"] != "us-east-1" {
-				t.Errorf("metric %s: expected region=us-east-1, got %s", m.GetName(), attrs["region"])
+	for _, compat := range []bool{false, true} {
+		req := newReq()
+		cfg := enhanceConfig{
+			continueOnResourceFailure: true,
+			yaceCompatMode:            compat,
+			yaceCompatStats:           map[string]bool{"Sum": true},
+		}
+		err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+			map[string][]*model.TaggedResource{"AWS/EC2": nil}, map[string]maxdimassociator.Associator{},
+			aws.String("us-east-1"), mockTaggingClient{})
+		if err != nil {
+			t.Fatalf("compat=%v: enhanceRequests failed: %v", compat, err)
+		}
+
+		// Compat mode emits one gauge per enabled statistic; non-compat mode renames the Summary in place.
+		enriched := func(metricName string) string {
+			if compat {
+				return promutil.BuildMetricName("AWS/EC2", metricName, "Sum")
 			}
-			if attrs["account_id"] != "123456789012" {
-				t.Errorf("metric %s: expected account_id=123456789012, got %s", m.GetName(), attrs["account_id"])
+			return promutil.BuildMetricName("AWS/EC2", metricName, "")
+		}
+		sms := req.GetResourceMetrics()[0].GetScopeMetrics()
+		if len(sms) != 2 {
+			t.Fatalf("compat=%v: expected 2 scope metrics, got %d", compat, len(sms))
+		}
+		for i, want := range []struct {
+			scope     *commonpb.InstrumentationScope
+			schemaURL string
+			names     []string
+		}{
+			{scopeA, "https://example.com/a", []string{enriched("CPUUtilization")}},
+			{scopeB, "https://example.com/b", []string{"untouched", enriched("NetworkIn")}},
+		} {
+			if !proto.Equal(sms[i].GetScope(), want.scope) || sms[i].GetSchemaUrl() != want.schemaURL {
+				t.Errorf("compat=%v: scope %d identity changed: %v %q", compat, i, sms[i].GetScope(), sms[i].GetSchemaUrl())
 			}
-			if attrs["namespace"] != "AWS/EC2" {
-				t.Errorf("metric %s: expected namespace=AWS/EC2, got %s", m.GetName(), attrs["namespace"])
+			var names []string
+			for _, m := range sms[i].GetMetrics() {
+				names = append(names, m.GetName())
 			}
-			if attrs["name"] != ec2ARN {
-				t.Errorf("metric %s: expected name=%s, got %s", m.GetName(), ec2ARN, attrs["name"])
+			if strings.Join(names, ",") != strings.Join(want.names, ",") {
+				t.Errorf("compat=%v: scope %d metrics: got %v, want %v", compat, i, names, want.names)
 			}
-			if attrs["dimension_instance_id"] != "i-1234567890abcdef0" {
-				t.Errorf("metric %s: expected dimension_instance_id=i-1234567890abcdef0, got %s", m.GetName(), attrs["dimension_instance_id"])
+		}
+	}
+}
+
+func TestEnhanceDiscoversInRecordRegion(t *testing.T) {
+	client := &recordingTaggingClient{resources: []*model.TaggedResource{{
+		ARN:       "arn:aws:ec2:eu-west-1:123456789012:instance/i-1234567890abcdef0",
+		Namespace: "AWS/EC2",
+		Region:    "eu-west-1",
+	}}}
+	req := makeExportRequestOTLP10WithResource("ignored", ec2InputAttrsOTLP10("i-1234567890abcdef0"), "123456789012", "eu-west-1")
+	resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": nil}
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, fileCachePath: t.TempDir()}
+
+	err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		resourceCache, map[string]maxdimassociator.Associator{}, aws.String("us-east-1"), client)
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	if len(client.regions) != 1 || client.regions[0] != "eu-west-1" {
+		t.Fatalf("expected discovery in the record region eu-west-1, got %v", client.regions)
+	}
+	if _, ok := resourceCache["AWS/EC2@eu-west-1"]; !ok {
+		t.Errorf("expected eu-west-1 resources to be cached separately, got keys %v", sortedKeys(resourceCache))
+	}
+	got := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+	if got["name"] != "arn:aws:ec2:eu-west-1:123456789012:instance/i-1234567890abcdef0" || got["region"] != "eu-west-1" {
+		t.Errorf("expected the eu-west-1 resource to be associated, got %v", got)
+	}
+}
+
+func TestEnhanceGlobalNamespaceDiscoversInUSEast1(t *testing.T) {
+	client := &recordingTaggingClient{resources: []*model.TaggedResource{{
+		ARN:       "arn:aws:cloudfront::123456789012:distribution/E1ABCDEF",
+		Namespace: "AWS/CloudFront",
+		Tags:      []model.Tag{{Key: "team", Value: "web"}},
+	}}}
+	attrs := []*commonpb.KeyValue{
+		{Key: "Namespace", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "AWS/CloudFront"}}},
+		{Key: "MetricName", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "Requests"}}},
+		{Key: "Dimensions", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+			Values: []*commonpb.KeyValue{
+				{Key: "DistributionId", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "E1ABCDEF"}}},
+				{Key: "Region", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "Global"}}},
+			},
+		}}}},
+	}
+	req := makeExportRequestOTLP10WithResource("ignored", attrs, "123456789012", "eu-west-1")
+	resourceCache := map[string][]*model.TaggedResource{}
+	cfg := enhanceConfig{
+		continueOnResourceFailure: true,
+		labelsSnakeCase:           true,
+		fileCachePath:             t.TempDir(),
+		globalNamespaces:          map[string]bool{"AWS/CloudFront": true},
+	}
+
+	err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		resourceCache, map[string]maxdimassociator.Associator{}, aws.String("eu-west-1"), client)
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	if len(client.regions) != 1 || client.regions[0] != "us-east-1" {
+		t.Fatalf("expected discovery in us-east-1, got %v", client.regions)
+	}
+	if _, ok := resourceCache["AWS/CloudFront@us-east-1"]; !ok {
+		t.Errorf("expected the resources to be cached under us-east-1, got keys %v", sortedKeys(resourceCache))
+	}
+	got := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+	if got["tag_team"] != "web" || got["region"] != "global" {
+		t.Errorf("expected the distribution to be associated with region global, got %v", got)
+	}
+}
+
+func TestEnhanceAccountRegionFromARN(t *testing.T) {
+	ec2Resource := &model.TaggedResource{
+		ARN:       "arn:aws:ec2:eu-west-1:111122223333:instance/i-1234567890abcdef0",
+		Namespace: "AWS/EC2",
+		Region:    "eu-west-1",
+	}
+	tests := []struct {
+		name            string
+		accountID       string
+		region          string
+		expectedAccount string
+		expectedRegion  string
+	}{
+		{"from ARN", "", "", "111122223333", "eu-west-1"},
+		{"from stream", "123456789012", "us-west-2", "123456789012", "us-west-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := makeExportRequestOTLP10WithResource("ignored", ec2InputAttrsOTLP10("i-1234567890abcdef0"), tt.accountID, tt.region)
+			cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true}
+			// Both regions share one prefilled cache entry, so no discovery happens.
+			resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {ec2Resource}, "AWS/EC2@us-west-2": {ec2Resource}}
+			err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+				resourceCache, map[string]maxdimassociator.Associator{}, aws.String("us-east-1"), mockTaggingClient{})
+			if err != nil {
+				t.Fatalf("enhanceRequests failed: %v", err)
+			}
+			got := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+			if got["account_id"] != tt.expectedAccount || got["region"] != tt.expectedRegion {
+				t.Errorf("got account_id=%q region=%q, want %q %q", got["account_id"], got["region"], tt.expectedAccount, tt.expectedRegion)
 			}
+		})
+	}
+}
+
+func TestEnhanceEnabledAccounts(t *testing.T) {
+	enabled, err := parseEnabledAccounts(`["111122223333"]`)
+	if err != nil {
+		t.Fatalf("parseEnabledAccounts failed: %v", err)
+	}
+	var reqs []*metricsservicepb.ExportMetricsServiceRequest
+	for _, account := range []string{"111122223333", "444455556666", ""} {
+		reqs = append(reqs, makeExportRequestOTLP10WithResource("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1234567890abcdef0"), account, ""))
+	}
+	resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {{
+		ARN:       "arn:aws:ec2:us-east-1:111122223333:instance/i-1234567890abcdef0",
+		Namespace: "AWS/EC2",
+		Region:    "us-east-1",
+	}}}
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, enabledAccounts: enabled}
+	err = enhanceRequests(slog.Default(), cfg, reqs, resourceCache, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	for i, want := range []bool{true, false, false} {
+		metric := reqs[i].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0]
+		got := keyValueToMap(metric.GetSummary().GetDataPoints()[0].GetAttributes())
+		if enriched := got["account_id"] != ""; enriched != want {
+			t.Errorf("request %d: enriched=%v, want %v (%s %v)", i, enriched, want, metric.GetName(), got)
+		}
+		if !want && (metric.GetName() != "amazonaws.com/AWS/EC2/CPUUtilization" || got["Namespace"] != "AWS/EC2") {
+			t.Errorf("request %d: expected the data point to pass through raw, got %s %v", i, metric.GetName(), got)
 		}
 	}
 
-	for _, name := range expectedNames {
-		if !foundNames[name] {
-			t.Errorf("expected metric %s not found", name)
+	if enabled, _ := parseEnabledAccounts(""); enabled != nil {
+		t.Errorf("expected every account to be enabled when unset, got %v", enabled)
+	}
+	for _, env := range []string{`"111122223333"`, `[""]`} {
+		if _, err := parseEnabledAccounts(env); err == nil {
+			t.Errorf("expected an error for %s", env)
+		}
+	}
+}
+
+func TestRegionalTaggingClient(t *testing.T) {
+	home := &recordingTaggingClient{}
+	other := &recordingTaggingClient{}
+	var built []string
+	client := &regionalTaggingClient{
+		clients: map[string]tagging.Client{"us-east-1": home},
+		newClient: func(region string) (tagging.Client, error) {
+			built = append(built, region)
+			if region == "ap-south-1" {
+				return nil, errors.New("no credentials")
+			}
+			return other, nil
+		},
+	}
+
+	for _, region := range []string{"us-east-1", "eu-west-1", "eu-west-1"} {
+		if _, err := client.GetResources(context.Background(), model.DiscoveryJob{Namespace: "AWS/EC2"}, region); err != nil {
+			t.Fatalf("GetResources(%s) failed: %v", region, err)
+		}
+	}
+	if _, err := client.GetResources(context.Background(), model.DiscoveryJob{Namespace: "AWS/EC2"}, "ap-south-1"); err == nil {
+		t.Error("expected an error when the regional client cannot be built")
+	}
+
+	if len(home.regions) != 1 || len(other.regions) != 2 {
+		t.Errorf("calls not routed by region: home=%v other=%v", home.regions, other.regions)
+	}
+	if strings.Join(built, ",") != "eu-west-1,ap-south-1" {
+		t.Errorf("expected one client to be built per new region, got %v", built)
+	}
+}
+
+func TestEnhanceIsIdempotent(t *testing.T) {
+	ec2Resource := &model.TaggedResource{
+		ARN:       "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0",
+		Namespace: "AWS/EC2",
+		Region:    "us-east-1",
+		Tags:      []model.Tag{{Key: "Name", Value: "my-instance"}},
+	}
+	logger := slog.Default()
+	svc := config.SupportedServices.GetService("AWS/EC2")
+
+	for _, cfg := range []enhanceConfig{
+		{continueOnResourceFailure: true, labelsSnakeCase: true},
+		{continueOnResourceFailure: true, labelsSnakeCase: true, yaceCompatMode: true, yaceCompatStats: map[string]bool{"Sum": true}},
+		{continueOnResourceFailure: true, labelsSnakeCase: true, preserveOriginalAttrs: true, stripAttrs: map[string]bool{}},
+		{continueOnResourceFailure: true, labelsSnakeCase: true, metricNameStyle: metricNameStyleCloudWatch, emitMatchStatus: true},
+	} {
+		req := makeExportRequestOTLP10WithResource("ignored", ec2InputAttrsOTLP10("i-1234567890abcdef0"), "123456789012", "us-east-1")
+		resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {ec2Resource}}
+		associatorCache := map[string]maxdimassociator.Associator{
+			"AWS/EC2": maxdimassociator.NewAssociator(logger, svc.ToModelDimensionsRegexp(), resourceCache["AWS/EC2"]),
+		}
+		enhance := func() {
+			t.Helper()
+			err := enhanceRequests(logger, cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+				resourceCache, associatorCache, aws.String("us-east-1"), mockTaggingClient{})
+			if err != nil {
+				t.Fatalf("enhanceRequests failed: %v", err)
+			}
+		}
+
+		enhance()
+		once := proto.Clone(req)
+		enhance()
+		if !proto.Equal(once, req) {
+			t.Errorf("compat=%v preserve=%v style=%q: second enrichment changed the output:\nonce:  %v\ntwice: %v",
+				cfg.yaceCompatMode, cfg.preserveOriginalAttrs, cfg.metricNameStyle, once, req)
+		}
+	}
+}
+
+func TestEnhanceTaggingCallBudget(t *testing.T) {
+	str := func(s string) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+	}
+	attrsFor := func(namespace, metricName, dim, value string) []*commonpb.KeyValue {
+		return []*commonpb.KeyValue{
+			{Key: "Namespace", Value: str(namespace)},
+			{Key: "MetricName", Value: str(metricName)},
+			{Key: "Dimensions", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+				Values: []*commonpb.KeyValue{{Key: dim, Value: str(value)}},
+			}}}},
+		}
+	}
+	reqs := []*metricsservicepb.ExportMetricsServiceRequest{
+		makeExportRequestOTLP10("ec2", attrsFor("AWS/EC2", "CPUUtilization", "InstanceId", "i-1234567890abcdef0")),
+		makeExportRequestOTLP10("lambda", attrsFor("AWS/Lambda", "Invocations", "FunctionName", "my-function")),
+		makeExportRequestOTLP10("sqs", attrsFor("AWS/SQS", "NumberOfMessagesSent", "QueueName", "my-queue")),
+	}
+	inner := &recordingTaggingClient{resources: []*model.TaggedResource{{
+		ARN:       "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0",
+		Namespace: "AWS/EC2",
+		Region:    "us-east-1",
+	}}}
+	client := &budgetedTaggingClient{client: inner, limit: 1}
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, fileCachePath: t.TempDir()}
+
+	err := enhanceRequests(slog.Default(), cfg, reqs, map[string][]*model.TaggedResource{},
+		map[string]maxdimassociator.Associator{}, aws.String("us-east-1"), client)
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	if len(inner.jobs) != 1 || inner.jobs[0].Namespace != "AWS/EC2" {
+		t.Fatalf("expected a single Tagging API call for AWS/EC2, got %v", inner.jobs)
+	}
+	for i, want := range []string{"arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0", "global", "global"} {
+		dp := reqs[i].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0]
+		if got := keyValueToMap(dp.GetAttributes())["name"]; got != want {
+			t.Errorf("request %d: name label got %q, want %q", i, got, want)
+		}
+	}
+}
+
+// flakyTaggingClient fails its first failures calls, then returns resources.
+type flakyTaggingClient struct {
+	failures  int
+	calls     int
+	resources []*model.TaggedResource
+}
+
+func (c *flakyTaggingClient) GetResources(ctx context.Context, job model.DiscoveryJob, region string) ([]*model.TaggedResource, error) {
+	c.calls++
+	if c.calls <= c.failures {
+		return nil, errors.New("ThrottlingException: rate exceeded")
+	}
+	return c.resources, nil
+}
+
+func TestRetryingTaggingClient(t *testing.T) {
+	resources := []*model.TaggedResource{{ARN: "arn:aws:ec2:us-east-1:123456789012:instance/i-1", Namespace: "AWS/EC2"}}
+	job := model.DiscoveryJob{Namespace: "AWS/EC2"}
+
+	inner := &flakyTaggingClient{failures: 2, resources: resources}
+	got, err := retryingTaggingClient{client: inner, maxRetries: 2, backoff: time.Millisecond}.GetResources(context.Background(), job, "us-east-1")
+	if err != nil || len(got) != 1 || inner.calls != 3 {
+		t.Errorf("expected success on the third call, got %v, %v after %d calls", got, err, inner.calls)
+	}
+
+	inner = &flakyTaggingClient{failures: 2, resources: resources}
+	if _, err := (retryingTaggingClient{client: inner, maxRetries: 1, backoff: time.Millisecond}).GetResources(context.Background(), job, "us-east-1"); err == nil || inner.calls != 2 {
+		t.Errorf("expected the error after 1 retry, got %v after %d calls", err, inner.calls)
+	}
+
+	// Waiting for the next attempt stops with the context.
+	inner = &flakyTaggingClient{failures: 1, resources: resources}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := (retryingTaggingClient{client: inner, maxRetries: 1, backoff: time.Minute}).GetResources(ctx, job, "us-east-1"); !errors.Is(err, context.DeadlineExceeded) || inner.calls != 1 {
+		t.Errorf("expected the context error without a retry, got %v after %d calls", err, inner.calls)
+	}
+
+	// An exhausted budget is not retried.
+	budgeted := &budgetedTaggingClient{client: &flakyTaggingClient{}, limit: 0}
+	if _, err := (retryingTaggingClient{client: budgeted, maxRetries: 3, backoff: time.Millisecond}).GetResources(context.Background(), job, "us-east-1"); !errors.Is(err, errTaggingBudgetExhausted) || budgeted.calls.Load() != 1 {
+		t.Errorf("expected the budget error at once, got %v after %d calls", err, budgeted.calls.Load())
+	}
+}
+
+func TestEnhanceDimensionValueNormalize(t *testing.T) {
+	ec2Resource := &model.TaggedResource{
+		ARN:       "arn:aws:ec2:us-east-1:123456789012:instance/i-0ABCdef ",
+		Namespace: "AWS/EC2",
+		Region:    "us-east-1",
+	}
+	logger := slog.Default()
+	for mode, want := range map[string]string{
+		"":           "i-0ABCdef ",
+		"trim":       "i-0ABCdef",
+		"lower":      "i-0abcdef ",
+		"trim_lower": "i-0abcdef",
+	} {
+		resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {ec2Resource}}
+		associatorCache := map[string]maxdimassociator.Associator{
+			"AWS/EC2": maxdimassociator.NewAssociator(logger, config.SupportedServices.GetService("AWS/EC2").ToModelDimensionsRegexp(), resourceCache["AWS/EC2"]),
+		}
+		req := makeExportRequestOTLP10("ignored", ec2InputAttrsOTLP10("i-0ABCdef "))
+		cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, dimensionValueNormalize: mode}
+		err := enhanceRequests(logger, cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+			resourceCache, associatorCache, aws.String("us-east-1"), mockTaggingClient{})
+		if err != nil {
+			t.Fatalf("enhanceRequests failed: %v", err)
+		}
+
+		got := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+		if got["dimension_instance_id"] != want {
+			t.Errorf("mode %q: dimension_instance_id got %q, want %q", mode, got["dimension_instance_id"], want)
+		}
+		if got["name"] != ec2Resource.ARN {
+			t.Errorf("mode %q: association should use the raw value, got name %q", mode, got["name"])
+		}
+	}
+
+	if _, err := parseDimensionValueNormalize("upper"); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
+
+func TestTypedDimensions(t *testing.T) {
+	intVal := func(n int64) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: n}}
+	}
+	doubleVal := func(f float64) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: f}}
+	}
+	strVal := func(s string) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+	}
+	for _, tt := range []struct {
+		value string
+		want  *commonpb.AnyValue
+	}{
+		{"443", intVal(443)},
+		{"-1", intVal(-1)},
+		{"0", intVal(0)},
+		{"0.25", doubleVal(0.25)},
+		{"-12.5", doubleVal(-12.5)},
+		{"i-1234567890abcdef0", strVal("i-1234567890abcdef0")},
+		{"007", strVal("007")},
+		{"1e3", strVal("1e3")},
+		{"NaN", strVal("NaN")},
+		{"99999999999999999999", strVal("99999999999999999999")},
+		{"", strVal("")},
+	} {
+		if got := typedDimensionValue(tt.value); !proto.Equal(got, tt.want) {
+			t.Errorf("typedDimensionValue(%q): got %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	cwm := &model.Metric{Namespace: "AWS/ApplicationELB", Dimensions: []model.Dimension{
+		{Name: "Port", Value: "443"},
+		{Name: "Ratio", Value: "0.5"},
+		{Name: "LoadBalancer", Value: "app/my-lb/50dc6c495c0c9188"},
+	}}
+	for _, typed := range []bool{false, true} {
+		cfg := enhanceConfig{labelsSnakeCase: true, typedDimensions: typed}
+		want := map[string]*commonpb.AnyValue{
+			"dimension_port":          strVal("443"),
+			"dimension_ratio":         strVal("0.5"),
+			"dimension_load_balancer": strVal("app/my-lb/50dc6c495c0c9188"),
+		}
+		if typed {
+			want["dimension_port"], want["dimension_ratio"] = intVal(443), doubleVal(0.5)
+		}
+		found := 0
+		for _, kv := range buildYACELabelsKeyValue(slog.Default(), cfg, cwm, nil, false, "us-east-1", "") {
+			w, ok := want[kv.GetKey()]
+			if !ok {
+				continue
+			}
+			found++
+			if !proto.Equal(kv.GetValue(), w) {
+				t.Errorf("TYPED_DIMENSIONS=%v: %s got %v, want %v", typed, kv.GetKey(), kv.GetValue(), w)
+			}
 		}
+		if found != len(want) {
+			t.Errorf("TYPED_DIMENSIONS=%v: found %d of %d dimension labels", typed, found, len(want))
+		}
+	}
+}
+
+func TestEnhanceFailOnNoResources(t *testing.T) {
+	client := stubTaggingClient{err: tagging.ErrExpectedToFindResources}
+	tests := []struct {
+		name        string
+		failOnNone  bool
+		continueOn  bool
+		wantErr     bool
+		wantEnrich  bool
+		wantNameVal string
+	}{
+		{name: "masked by default", continueOn: true, wantEnrich: true, wantNameVal: "global"},
+		{name: "surfaced and skipped", failOnNone: true, continueOn: true},
+		{name: "surfaced and fatal", failOnNone: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := makeExportRequestOTLP10("ignored", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+			cfg := enhanceConfig{
+				continueOnResourceFailure: tt.continueOn,
+				failOnNoResources:         tt.failOnNone,
+				labelsSnakeCase:           true,
+			}
+			err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+				map[string][]*model.TaggedResource{}, map[string]maxdimassociator.Associator{}, aws.String("us-east-1"), client)
+			if tt.wantErr {
+				if !errors.Is(err, tagging.ErrExpectedToFindResources) {
+					t.Fatalf("expected ErrExpectedToFindResources, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("enhanceRequests failed: %v", err)
+			}
+			got := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+			if tt.wantEnrich && got["name"] != tt.wantNameVal {
+				t.Errorf("name label: got %q, want %q", got["name"], tt.wantNameVal)
+			}
+			if !tt.wantEnrich && got["MetricName"] != "CPUUtilization" {
+				t.Errorf("expected the data point to be left unenriched, got %v", got)
+			}
+		})
+	}
+}
+
+func TestEnhanceEC2WithStaticLabelsAndExportedTags(t *testing.T) {
+	ec2Resource := &model.TaggedResource{
+		ARN:       "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0",
+		Namespace: "AWS/EC2",
+		Region:    "us-east-1",
+		Tags: []model.Tag{
+			{Key: "Name", Value: "my-instance"},
+			{Key: "Environment", Value: "prod"},
+		},
+	}
+	req := makeExportRequestOTLP10WithResource("ignored", ec2InputAttrsOTLP10("i-1234567890abcdef0"), "123456789012", "us-east-1")
+	logger := slog.Default()
+	resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {ec2Resource}}
+	svc := config.SupportedServices.GetService("AWS/EC2")
+	if svc == nil {
+		t.Fatal("AWS/EC2 service not found")
+	}
+	associatorCache := map[string]maxdimassociator.Associator{
+		"AWS/EC2": maxdimassociator.NewAssociator(logger, svc.ToModelDimensionsRegexp(), resourceCache["AWS/EC2"]),
+	}
+	staticLabels := map[string]string{"env": "prod"}
+	exportedTags := []string{"Name"}
+
+	err := enhanceRequests(
+		logger, enhanceConfig{
+			fileCachePath:             "/tmp",
+			continueOnResourceFailure: true,
+			staticLabels:              staticLabels,
+			labelsSnakeCase:           true,
+			exportedTags:              exportedTags,
+		},
+		[]*metricsservicepb.ExportMetricsServiceRequest{req},
+		resourceCache, associatorCache,
+		aws.String("us-east-1"), mockTaggingClient{},
+	)
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	got := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+	if got["tag_name"] != "my-instance" {
+		t.Errorf("tag_name: got %q", got["tag_name"])
+	}
+	if _, ok := got["tag_environment"]; ok {
+		t.Errorf("tag_environment should be absent when EXPORTED_TAGS_ON_METRICS=[\"Name\"]")
+	}
+	if got["custom_tag_env"] != "prod" {
+		t.Errorf("custom_tag_env: got %q", got["custom_tag_env"])
+	}
+	// Verify new labels are present
+	if got["region"] != "us-east-1" {
+		t.Errorf("region: got %q", got["region"])
+	}
+	if got["account_id"] != "123456789012" {
+		t.Errorf("account_id: got %q", got["account_id"])
+	}
+}
+
+func TestExtractResourceAttributes(t *testing.T) {
+	// Test with both account_id and region
+	rm := &metricspb.ResourceMetrics{
+		Resource: &resourcepb.Resource{
+			Attributes: []*commonpb.KeyValue{
+				{Key: "cloud.account.id", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "123456789012"}}},
+				{Key: "cloud.region", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "us-west-2"}}},
+				{Key: "cloud.provider", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "aws"}}},
+			},
+		},
+	}
+	accountID, region := extractResourceAttributes(rm)
+	if accountID != "123456789012" {
+		t.Errorf("accountID: got %q, want %q", accountID, "123456789012")
+	}
+	if region != "us-west-2" {
+		t.Errorf("region: got %q, want %q", region, "us-west-2")
+	}
+
+	// Test with nil resource
+	rm2 := &metricspb.ResourceMetrics{}
+	accountID2, region2 := extractResourceAttributes(rm2)
+	if accountID2 != "" || region2 != "" {
+		t.Errorf("expected empty values for nil resource, got accountID=%q, region=%q", accountID2, region2)
+	}
+
+	// Test with nil ResourceMetrics
+	accountID3, region3 := extractResourceAttributes(nil)
+	if accountID3 != "" || region3 != "" {
+		t.Errorf("expected empty values for nil ResourceMetrics, got accountID=%q, region=%q", accountID3, region3)
+	}
+}
+
+func TestExtractResourceAttributesWithKeys(t *testing.T) {
+	str := func(s string) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+	}
+	rm := &metricspb.ResourceMetrics{
+		Resource: &resourcepb.Resource{
+			Attributes: []*commonpb.KeyValue{
+				{Key: "aws.account.id", Value: str("123456789012")},
+				{Key: "region", Value: str("eu-west-1")},
+				{Key: "cloud.region", Value: str("")},
+			},
+		},
+	}
+
+	// The default keys find nothing under these conventions.
+	if accountID, region := extractResourceAttributes(rm); accountID != "" || region != "" {
+		t.Errorf("default keys: got accountID=%q, region=%q", accountID, region)
+	}
+
+	accountKeys := parseCommaList(" cloud.account.id, aws.account.id ,", defaultAccountIDResourceKeys)
+	regionKeys := parseCommaList("cloud.region,region", defaultRegionResourceKeys)
+	accountID, region := extractResourceAttributesWithKeys(rm, accountKeys, regionKeys)
+	if accountID != "123456789012" {
+		t.Errorf("accountID: got %q, want %q", accountID, "123456789012")
+	}
+	// An empty value for an earlier key falls through to the next one.
+	if region != "eu-west-1" {
+		t.Errorf("region: got %q, want %q", region, "eu-west-1")
+	}
+
+	if got := parseCommaList("", defaultRegionResourceKeys); len(got) != 1 || got[0] != "cloud.region" {
+		t.Errorf("expected defaults for empty env, got %v", got)
+	}
+}
+
+func TestEnhanceDatapointAccountAndRegion(t *testing.T) {
+	attrs := append(ec2InputAttrsOTLP10("i-1234567890abcdef0"),
+		&commonpb.KeyValue{Key: "AccountId", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "210987654321"}}},
+		&commonpb.KeyValue{Key: "Region", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "eu-west-1"}}},
+	)
+	// No OTLP Resource, so account and region are only available on the data point.
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", attrs)
+
+	err := enhanceRequests(slog.Default(), enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true},
+		[]*metricsservicepb.ExportMetricsServiceRequest{req},
+		map[string][]*model.TaggedResource{"AWS/EC2": nil}, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	got := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+	if got["account_id"] != "210987654321" {
+		t.Errorf("account_id: got %q, want %q", got["account_id"], "210987654321")
+	}
+	if got["region"] != "eu-west-1" {
+		t.Errorf("region: got %q, want data point region %q over the Lambda region", got["region"], "eu-west-1")
+	}
+}
+
+func TestQuantileToStatistic(t *testing.T) {
+	tests := []struct {
+		quantile float64
+		expected string
+	}{
+		{0.0, "Minimum"},
+		{1.0, "Maximum"},
+		{0.5, "p50"},
+		{0.95, "p95"},
+		{0.99, "p99"},
+		{0.999, "p99_9"},
+	}
+	for _, tc := range tests {
+		got := quantileToStatistic(tc.quantile)
+		if got != tc.expected {
+			t.Errorf("quantileToStatistic(%v): got %q, want %q", tc.quantile, got, tc.expected)
+		}
+	}
+}
+
+func TestParseYACEStats(t *testing.T) {
+	// Test default (empty string)
+	stats, err := parseYACEStats("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !stats["Maximum"] || !stats["Minimum"] || !stats["Average"] || !stats["Sum"] || !stats["SampleCount"] {
+		t.Errorf("expected all default stats to be enabled, got %v", stats)
+	}
+
+	// Test custom list
+	stats, err = parseYACEStats(`["Maximum","Average"]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !stats["Maximum"] || !stats["Average"] {
+		t.Errorf("expected Maximum and Average to be enabled")
+	}
+	if stats["Minimum"] || stats["Sum"] || stats["SampleCount"] {
+		t.Errorf("expected Minimum, Sum, SampleCount to be disabled")
+	}
+
+	// Test invalid JSON
+	_, err = parseYACEStats(`invalid`)
+	if err == nil {
+		t.Errorf("expected error for invalid JSON")
+	}
+}
+
+// makeExportRequestWithSummaryData builds an OTLP 1.0 ExportMetricsServiceRequest with Summary data including count, sum, and quantiles.
+func makeExportRequestWithSummaryData(metricName string, attrs []*commonpb.KeyValue, count uint64, sum float64, quantiles map[float64]float64) *metricsservicepb.ExportMetricsServiceRequest {
+	return makeExportRequestWithSummaryDataAndResource(metricName, attrs, count, sum, quantiles, "", "")
+}
+
+// makeExportRequestWithSummaryDataAndResource builds an OTLP 1.0 ExportMetricsServiceRequest with Summary data and resource attributes.
+func makeExportRequestWithSummaryDataAndResource(metricName string, attrs []*commonpb.KeyValue, count uint64, sum float64, quantiles map[float64]float64, accountID, region string) *metricsservicepb.ExportMetricsServiceRequest {
+	var qvs []*metricspb.SummaryDataPoint_ValueAtQuantile
+	for q, v := range quantiles {
+		qvs = append(qvs, &metricspb.SummaryDataPoint_ValueAtQuantile{
+			Quantile: q,
+			Value:    v,
+		})
+	}
+
+	var resourceAttrs []*commonpb.KeyValue
+	if accountID != "" {
+		resourceAttrs = append(resourceAttrs, &commonpb.KeyValue{
+			Key:   "cloud.account.id",
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: accountID}},
+		})
+	}
+	if region != "" {
+		resourceAttrs = append(resourceAttrs, &commonpb.KeyValue{
+			Key:   "cloud.region",
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: region}},
+		})
+	}
+
+	rm := &metricspb.ResourceMetrics{
+		ScopeMetrics: []*metricspb.ScopeMetrics{{
+			Metrics: []*metricspb.Metric{{
+				Name: metricName,
+				Data: &metricspb.Metric_Summary{
+					Summary: &metricspb.Summary{
+						DataPoints: []*metricspb.SummaryDataPoint{{
+							Attributes:        attrs,
+							Count:             count,
+							Sum:               sum,
+							QuantileValues:    qvs,
+							TimeUnixNano:      1000000000,
+							StartTimeUnixNano: 900000000,
+						}},
+					},
+				},
+			}},
+		}},
+	}
+	if len(resourceAttrs) > 0 {
+		rm.Resource = &resourcepb.Resource{Attributes: resourceAttrs}
+	}
+
+	return &metricsservicepb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{rm},
+	}
+}
+
+func TestSummaryToGauges(t *testing.T) {
+	cwm := &model.Metric{
+		Namespace:  "AWS/EC2",
+		MetricName: "CPUUtilization",
+	}
+	attrs := []*commonpb.KeyValue{
+		{Key: "name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "test-arn"}}},
+	}
+	dp := &metricspb.SummaryDataPoint{
+		Count:             10,
+		Sum:               50.0,
+		TimeUnixNano:      1000000000,
+		StartTimeUnixNano: 900000000,
+		QuantileValues: []*metricspb.SummaryDataPoint_ValueAtQuantile{
+			{Quantile: 0.0, Value: 2.0},  // Minimum
+			{Quantile: 0.95, Value: 8.0}, // p95
+			{Quantile: 1.0, Value: 10.0}, // Maximum
+		},
+	}
+
+	// Enable all stats
+	enabledStats := map[string]bool{
+		"Maximum": true, "Minimum": true, "Average": true, "Sum": true, "SampleCount": true, "p95": true,
+	}
+
+	gauges := summaryToGauges(cwm, dp, attrs, enabledStats, summaryConversion{})
+
+	// Should produce: SampleCount, Sum, Average, Minimum, p95, Maximum
+	expectedNames := map[string]float64{
+		"aws_ec2_cpuutilization_sample_count": 10.0,
+		"aws_ec2_cpuutilization_sum":          50.0,
+		"aws_ec2_cpuutilization_average":      5.0, // 50/10
+		"aws_ec2_cpuutilization_minimum":      2.0,
+		"aws_ec2_cpuutilization_p95":          8.0,
+		"aws_ec2_cpuutilization_maximum":      10.0,
+	}
+
+	if len(gauges) != len(expectedNames) {
+		t.Fatalf("expected %d gauges, got %d", len(expectedNames), len(gauges))
+	}
+
+	for _, g := range gauges {
+		expectedVal, ok := expectedNames[g.GetName()]
+		if !ok {
+			t.Errorf("unexpected gauge name: %s", g.GetName())
+			continue
+		}
+		gotVal := g.GetGauge().GetDataPoints()[0].GetAsDouble()
+		if gotVal != expectedVal {
+			t.Errorf("gauge %s: got value %v, want %v", g.GetName(), gotVal, expectedVal)
+		}
+		// Check attributes are preserved
+		gotAttrs := keyValueToMap(g.GetGauge().GetDataPoints()[0].GetAttributes())
+		if gotAttrs["name"] != "test-arn" {
+			t.Errorf("gauge %s: expected name=test-arn in attrs, got %v", g.GetName(), gotAttrs)
+		}
+	}
+}
+
+func TestStatisticAliases(t *testing.T) {
+	aliases, err := parseStatisticAliases(`{"avg":"Average","p50":"Median","SampleCount":"Count"}`)
+	if err != nil {
+		t.Fatalf("parseStatisticAliases failed: %v", err)
+	}
+	cwm := &model.Metric{Namespace: "AWS/EC2", MetricName: "CPUUtilization"}
+
+	// Gauge path: quantile and fixed statistics are aliased before naming.
+	dp := &metricspb.SummaryDataPoint{
+		Count: 4,
+		Sum:   20,
+		QuantileValues: []*metricspb.SummaryDataPoint_ValueAtQuantile{
+			{Quantile: 0.5, Value: 5},
+			{Quantile: 0.95, Value: 9},
+		},
+	}
+	stats := map[string]bool{"SampleCount": true, "Median": true, "p95": true}
+	var names []string
+	for _, g := range summaryToGauges(cwm, dp, nil, stats, summaryConversion{aliases: aliases}) {
+		names = append(names, g.GetName())
+	}
+	want := "aws_ec2_cpuutilization_count,aws_ec2_cpuutilization_median,aws_ec2_cpuutilization_p95"
+	if strings.Join(names, ",") != want {
+		t.Errorf("gauge path: got %v, want %s", names, want)
+	}
+
+	// In-place path: the Statistic attribute is aliased before naming.
+	attrs := append(ec2InputAttrsOTLP10("i-1234567890abcdef0"), &commonpb.KeyValue{
+		Key: "Statistic", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "avg"}},
+	})
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", attrs)
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, statisticAliases: aliases}
+	err = enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		map[string][]*model.TaggedResource{"AWS/EC2": nil}, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+	if got := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetName(); got != "aws_ec2_cpuutilization_average" {
+		t.Errorf("in-place path: got %s, want aws_ec2_cpuutilization_average", got)
+	}
+
+	for _, env := range []string{`["avg"]`, `{"avg":""}`} {
+		if _, err := parseStatisticAliases(env); err == nil {
+			t.Errorf("expected an error for %s", env)
+		}
+	}
+}
+
+func TestSanitizeMetricName(t *testing.T) {
+	for in, want := range map[string]string{
+		"aws_ec2_cpuutilization_maximum": "aws_ec2_cpuutilization_maximum",
+		"AWS:EC2:CPUUtilization":         "aws_ec2_cpuutilization",
+		"my-app.request-latency_p99.9":   "my_app_request_latency_p99_9",
+		"custom__name--with..repeats":    "custom_name_with_repeats",
+	} {
+		if got := sanitizeMetricName(in); got != want {
+			t.Errorf("sanitizeMetricName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestEnhanceStrictMetricNames(t *testing.T) {
+	attrs := ec2InputAttrsOTLP10("i-1234567890abcdef0")
+	attrs[1].Value = &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "CPU-Credit.Usage"}}
+
+	for _, compat := range []bool{false, true} {
+		base := enhanceConfig{
+			continueOnResourceFailure: true,
+			labelsSnakeCase:           true,
+			metricNameStyle:           metricNameStyleCloudWatch,
+			yaceCompatMode:            compat,
+			yaceCompatStats:           map[string]bool{"Sum": true},
+		}
+		for _, strict := range []bool{false, true} {
+			cfg := base
+			cfg.strictMetricNames = strict
+			req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPU-Credit.Usage", attrs)
+			err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+				map[string][]*model.TaggedResource{"AWS/EC2": nil}, map[string]maxdimassociator.Associator{},
+				aws.String("us-east-1"), mockTaggingClient{})
+			if err != nil {
+				t.Fatalf("enhanceRequests failed: %v", err)
+			}
+			want := "AWS:EC2:CPU_Credit_Usage"
+			if strict {
+				want = "aws_ec2_cpu_credit_usage"
+			}
+			if got := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetName(); got != want {
+				t.Errorf("compat=%v strict=%v: got %s, want %s", compat, strict, got, want)
+			}
+		}
+	}
+}
+
+func TestEnhanceStableOutput(t *testing.T) {
+	for _, perStatistic := range []bool{false, true} {
+		network := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/NetworkIn", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+		network.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].GetSummary().DataPoints[0].GetAttributes()[1].Value =
+			&commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "NetworkIn"}}
+		cpu := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+		sm := network.ResourceMetrics[0].ScopeMetrics[0]
+		sm.Metrics = append(sm.Metrics, cpu.ResourceMetrics[0].ScopeMetrics[0].Metrics...)
+		for _, m := range sm.Metrics {
+			dp := m.GetSummary().GetDataPoints()[0]
+			dp.Count, dp.Sum = 2, 10
+			dp.QuantileValues = []*metricspb.SummaryDataPoint_ValueAtQuantile{{Quantile: 0, Value: 4}, {Quantile: 1, Value: 6}}
+		}
+		cfg := enhanceConfig{
+			continueOnResourceFailure: true,
+			labelsSnakeCase:           true,
+			yaceCompatMode:            true,
+			yaceCompatStats:           map[string]bool{"Sum": true, "Maximum": true, "Minimum": true},
+			scopePerStatistic:         perStatistic,
+			stableOutput:              true,
+		}
+		err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{network},
+			map[string][]*model.TaggedResource{"AWS/EC2": nil}, map[string]maxdimassociator.Associator{},
+			aws.String("us-east-1"), mockTaggingClient{})
+		if err != nil {
+			t.Fatalf("enhanceRequests failed: %v", err)
+		}
+
+		var scopes, names []string
+		for _, sm := range network.GetResourceMetrics()[0].GetScopeMetrics() {
+			scopes = append(scopes, sm.GetScope().GetName())
+			for _, m := range sm.GetMetrics() {
+				names = append(names, m.GetName())
+			}
+		}
+		want := []string{
+			"aws_ec2_cpuutilization_maximum", "aws_ec2_cpuutilization_minimum", "aws_ec2_cpuutilization_sum",
+			"aws_ec2_network_in_maximum", "aws_ec2_network_in_minimum", "aws_ec2_network_in_sum",
+		}
+		if perStatistic {
+			want = []string{
+				"aws_ec2_cpuutilization_maximum", "aws_ec2_network_in_maximum",
+				"aws_ec2_cpuutilization_minimum", "aws_ec2_network_in_minimum",
+				"aws_ec2_cpuutilization_sum", "aws_ec2_network_in_sum",
+			}
+			if !slices.IsSorted(scopes) {
+				t.Errorf("expected statistic scopes in name order, got %q", scopes)
+			}
+		}
+		if !slices.Equal(names, want) {
+			t.Errorf("perStatistic=%v: expected %q, got %q", perStatistic, want, names)
+		}
+	}
+}
+
+func TestSummaryToGaugesMetricNameStyle(t *testing.T) {
+	cwm := &model.Metric{Namespace: "AWS/ApplicationELB", MetricName: "HTTPCode_Target_5XX_Count"}
+	dp := &metricspb.SummaryDataPoint{
+		Count: 4, Sum: 8,
+		QuantileValues: []*metricspb.SummaryDataPoint_ValueAtQuantile{{Quantile: 1.0, Value: 3}},
+	}
+	attrs := []*commonpb.KeyValue{
+		{Key: "name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "test-arn"}}},
+	}
+	stats := map[string]bool{"Sum": true, "Maximum": true}
+
+	tests := []struct {
+		style      string
+		wantNames  []string
+		wantLabels []string
+	}{
+		{
+			style: metricNameStylePrometheus,
+			wantNames: []string{
+				promutil.BuildMetricName(cwm.Namespace, cwm.MetricName, "Sum"),
+				promutil.BuildMetricName(cwm.Namespace, cwm.MetricName, "Maximum"),
+			},
+			wantLabels: []string{"", ""},
+		},
+		{
+			style:      metricNameStyleCloudWatch,
+			wantNames:  []string{"AWS:ApplicationELB:HTTPCode_Target_5XX_Count", "AWS:ApplicationELB:HTTPCode_Target_5XX_Count"},
+			wantLabels: []string{"Sum", "Maximum"},
+		},
+	}
+	for _, tt := range tests {
+		gauges := summaryToGauges(cwm, dp, attrs, stats, summaryConversion{nameStyle: tt.style})
+		if len(gauges) != len(tt.wantNames) {
+			t.Fatalf("%s: expected %d gauges, got %d", tt.style, len(tt.wantNames), len(gauges))
+		}
+		for i, g := range gauges {
+			got := keyValueToMap(g.GetGauge().GetDataPoints()[0].GetAttributes())
+			if g.GetName() != tt.wantNames[i] || got["statistic"] != tt.wantLabels[i] {
+				t.Errorf("%s: gauge %d: got %q statistic=%q, want %q statistic=%q", tt.style, i, g.GetName(), got["statistic"], tt.wantNames[i], tt.wantLabels[i])
+			}
+			if got["name"] != "test-arn" {
+				t.Errorf("%s: gauge %d lost its labels: %v", tt.style, i, got)
+			}
+		}
+	}
+	if len(attrs) != 1 {
+		t.Errorf("shared attributes must not be modified, got %d", len(attrs))
+	}
+}
+
+func TestEnhanceMetricNameStyleCloudWatch(t *testing.T) {
+	attrs := append(ec2InputAttrsOTLP10("i-1234567890abcdef0"), &commonpb.KeyValue{
+		Key: "Statistic", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "Average"}},
+	})
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", attrs)
+	style, err := parseMetricNameStyle("CloudWatch")
+	if err != nil {
+		t.Fatalf("parseMetricNameStyle failed: %v", err)
+	}
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, metricNameStyle: style}
+	err = enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		map[string][]*model.TaggedResource{"AWS/EC2": nil}, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	metric := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0]
+	if metric.GetName() != "AWS:EC2:CPUUtilization" {
+		t.Errorf("metric name: got %q", metric.GetName())
+	}
+	if got := keyValueToMap(metric.GetSummary().GetDataPoints()[0].GetAttributes()); got["statistic"] != "Average" {
+		t.Errorf("expected statistic label, got %v", got)
+	}
+
+	if style, err := parseMetricNameStyle("yace"); err == nil || style != metricNameStylePrometheus {
+		t.Errorf("unknown style should fall back to prometheus with an error, got %q, %v", style, err)
+	}
+}
+
+func TestSummaryToGaugesIntegerCounts(t *testing.T) {
+	cwm := &model.Metric{Namespace: "AWS/EC2", MetricName: "CPUUtilization"}
+	dp := &metricspb.SummaryDataPoint{Count: 7, Sum: 10.5}
+	stats := map[string]bool{"SampleCount": true, "Sum": true}
+
+	for _, asCounter := range []bool{false, true} {
+		metrics := summaryToGauges(cwm, dp, nil, stats, summaryConversion{integerCounts: true, sampleCountAsCounter: asCounter})
+		if len(metrics) != 2 {
+			t.Fatalf("counter=%v: expected 2 metrics, got %d", asCounter, len(metrics))
+		}
+		countDPs := metrics[0].GetGauge().GetDataPoints()
+		if asCounter {
+			countDPs = metrics[0].GetSum().GetDataPoints()
+		}
+		if v, ok := countDPs[0].GetValue().(*metricspb.NumberDataPoint_AsInt); !ok || v.AsInt != 7 {
+			t.Errorf("counter=%v: expected SampleCount as AsInt 7, got %#v", asCounter, countDPs[0].GetValue())
+		}
+		if _, ok := metrics[1].GetGauge().GetDataPoints()[0].GetValue().(*metricspb.NumberDataPoint_AsDouble); !ok {
+			t.Errorf("counter=%v: Sum should stay AsDouble", asCounter)
+		}
+	}
+
+	metrics := summaryToGauges(cwm, dp, nil, stats, summaryConversion{})
+	if _, ok := metrics[0].GetGauge().GetDataPoints()[0].GetValue().(*metricspb.NumberDataPoint_AsDouble); !ok {
+		t.Errorf("SampleCount should be AsDouble by default")
+	}
+}
+
+func TestSummaryToGaugesDropZeroCount(t *testing.T) {
+	cwm := &model.Metric{Namespace: "AWS/EC2", MetricName: "CPUUtilization"}
+	dp := &metricspb.SummaryDataPoint{
+		QuantileValues: []*metricspb.SummaryDataPoint_ValueAtQuantile{{Quantile: 0, Value: 0}, {Quantile: 1, Value: 0}},
+	}
+	stats := map[string]bool{"SampleCount": true, "Sum": true, "Average": true, "Minimum": true, "Maximum": true}
+
+	if metrics := summaryToGauges(cwm, dp, nil, stats, summaryConversion{}); len(metrics) != 4 {
+		t.Errorf("expected every statistic but Average by default, got %d metrics", len(metrics))
+	}
+	if metrics := summaryToGauges(cwm, dp, nil, stats, summaryConversion{dropZeroCount: true}); len(metrics) != 0 {
+		t.Errorf("expected a zero-count data point to be dropped, got %d metrics", len(metrics))
+	}
+	dp.Count, dp.Sum = 2, 3
+	if metrics := summaryToGauges(cwm, dp, nil, stats, summaryConversion{dropZeroCount: true}); len(metrics) != 5 {
+		t.Errorf("expected a non-zero count data point to be kept, got %d metrics", len(metrics))
+	}
+}
+
+func TestSummaryToGaugesSampleCountAsCounter(t *testing.T) {
+	cwm := &model.Metric{Namespace: "AWS/EC2", MetricName: "CPUUtilization"}
+	dp := &metricspb.SummaryDataPoint{Count: 10, Sum: 50.0, TimeUnixNano: 1000000000, StartTimeUnixNano: 900000000}
+
+	metrics := summaryToGauges(cwm, dp, nil, map[string]bool{"SampleCount": true, "Sum": true}, summaryConversion{sampleCountAsCounter: true})
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(metrics))
+	}
+	counter := metrics[0]
+	if counter.GetName() != "aws_ec2_cpuutilization_sample_count_total" {
+		t.Errorf("counter name: got %q", counter.GetName())
+	}
+	sum := counter.GetSum()
+	if sum == nil {
+		t.Fatalf("expected SampleCount to be a Sum, got %T", counter.GetData())
+	}
+	if !sum.GetIsMonotonic() || sum.GetAggregationTemporality() != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA {
+		t.Errorf("expected a monotonic delta Sum, got monotonic=%v temporality=%v", sum.GetIsMonotonic(), sum.GetAggregationTemporality())
+	}
+	if got := sum.GetDataPoints()[0]; got.GetAsDouble() != 10 || got.GetStartTimeUnixNano() != 900000000 {
+		t.Errorf("unexpected counter data point: %v", got)
+	}
+	if metrics[1].GetName() != "aws_ec2_cpuutilization_sum" || metrics[1].GetGauge() == nil {
+		t.Errorf("other statistics should stay gauges, got %q %T", metrics[1].GetName(), metrics[1].GetData())
+	}
+}
+
+// TestEnhanceEC2YACECompatMode verifies that with YACE_COMPAT_MODE=true, Summary metrics are converted to multiple Gauge metrics.
+func TestEnhanceEC2YACECompatMode(t *testing.T) {
+	ec2ARN := "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0"
+	ec2Resource := &model.TaggedResource{
+		ARN:       ec2ARN,
+		Namespace: "AWS/EC2",
+		Region:    "us-east-1",
+		Tags: []model.Tag{
+			{Key: "Name", Value: "my-instance"},
+		},
+	}
+
+	// Create request with Summary data including count, sum, quantiles, and resource attributes
+	req := makeExportRequestWithSummaryDataAndResource(
+		"amazonaws.com/AWS/EC2/CPUUtilization",
+		ec2InputAttrsOTLP10("i-1234567890abcdef0"),
+		10,   // count
+		50.0, // sum
+		map[float64]float64{
+			0.0: 2.0,  // Minimum
+			1.0: 10.0, // Maximum
+		},
+		"123456789012", // account_id
+		"us-east-1",    // region
+	)
+
+	logger := slog.Default()
+	resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {ec2Resource}}
+	svc := config.SupportedServices.GetService("AWS/EC2")
+	if svc == nil {
+		t.Fatal("AWS/EC2 service not found in config")
+	}
+	associatorCache := map[string]maxdimassociator.Associator{
+		"AWS/EC2": maxdimassociator.NewAssociator(logger, svc.ToModelDimensionsRegexp(), resourceCache["AWS/EC2"]),
+	}
+
+	// Enable YACE compat mode with all default stats
+	yaceCompatStats, _ := parseYACEStats("")
+
+	err := enhanceRequests(
+		logger, enhanceConfig{
+			fileCachePath:             "/tmp",
+			continueOnResourceFailure: true,
+			labelsSnakeCase:           true,
+			yaceCompatMode:            true,
+			yaceCompatStats:           yaceCompatStats,
+		},
+		[]*metricsservicepb.ExportMetricsServiceRequest{req},
+		resourceCache, associatorCache,
+		aws.String("us-east-1"), mockTaggingClient{},
+	)
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	// Verify metrics were converted from Summary to Gauges
+	metrics := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()
+
+	// Should have: SampleCount, Sum, Average, Minimum, Maximum
+	expectedNames := []string{
+		"aws_ec2_cpuutilization_sample_count",
+		"aws_ec2_cpuutilization_sum",
+		"aws_ec2_cpuutilization_average",
+		"aws_ec2_cpuutilization_minimum",
+		"aws_ec2_cpuutilization_maximum",
+	}
+
+	if len(metrics) != len(expectedNames) {
+		var gotNames []string
+		for _, m := range metrics {
+			gotNames = append(gotNames, m.GetName())
+		}
+		t.Fatalf("expected %d metrics, got %d: %v", len(expectedNames), len(metrics), gotNames)
+	}
+
+	// Check that all expected metrics are present and are Gauge type
+	foundNames := make(map[string]bool)
+	for _, m := range metrics {
+		foundNames[m.GetName()] = true
+
+		// Verify it's a Gauge (not Summary)
+		if m.GetGauge() == nil {
+			t.Errorf("metric %s should be Gauge type", m.GetName())
+		}
+
+		// Check labels are correct including new YACE context labels
+		if len(m.GetGauge().GetDataPoints()) > 0 {
+			attrs := keyValueToMap(m.GetGauge().GetDataPoints()[0].GetAttributes())
+			if attrs["region"] != "us-east-1" {
+				t.Errorf("metric %s: expected region=us-east-1, got %s", m.GetName(), attrs["region"])
+			}
+			if attrs["account_id"] != "123456789012" {
+				t.Errorf("metric %s: expected account_id=123456789012, got %s", m.GetName(), attrs["account_id"])
+			}
+			if attrs["namespace"] != "AWS/EC2" {
+				t.Errorf("metric %s: expected namespace=AWS/EC2, got %s", m.GetName(), attrs["namespace"])
+			}
+			if attrs["name"] != ec2ARN {
+				t.Errorf("metric %s: expected name=%s, got %s", m.GetName(), ec2ARN, attrs["name"])
+			}
+			if attrs["dimension_instance_id"] != "i-1234567890abcdef0" {
+				t.Errorf("metric %s: expected dimension_instance_id=i-1234567890abcdef0, got %s", m.GetName(), attrs["dimension_instance_id"])
+			}
+		}
+	}
+
+	for _, name := range expectedNames {
+		if !foundNames[name] {
+			t.Errorf("expected metric %s not found", name)
+		}
+	}
+}
+
+// TestEnhanceYACECompatModeKeepOriginalOnSkip verifies that with KEEP_ORIGINAL_ON_SKIP=true, a Summary whose
+// association is skipped is kept untouched instead of being converted to gauges labeled "global".
+func TestEnhanceKeepsResourceMetricsPerAccount(t *testing.T) {
+	// One request carrying the metrics of two accounts and regions, as a merged batch would.
+	req := makeExportRequestOTLP10WithResource("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1"), "111122223333", "us-east-1")
+	other := makeExportRequestOTLP10WithResource("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-2"), "444455556666", "eu-west-1")
+	req.ResourceMetrics = append(req.ResourceMetrics, other.ResourceMetrics...)
+	resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": nil, "AWS/EC2@eu-west-1": nil}
+
+	for _, perStatistic := range []bool{false, true} {
+		req := proto.Clone(req).(*metricsservicepb.ExportMetricsServiceRequest)
+		cfg := enhanceConfig{
+			continueOnResourceFailure: true,
+			labelsSnakeCase:           true,
+			yaceCompatMode:            true,
+			yaceCompatStats:           map[string]bool{"SampleCount": true, "Sum": true},
+			scopePerStatistic:         perStatistic,
+		}
+		err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+			resourceCache, map[string]maxdimassociator.Associator{}, aws.String("us-east-1"), mockTaggingClient{})
+		if err != nil {
+			t.Fatalf("enhanceRequests failed: %v", err)
+		}
+
+		if len(req.GetResourceMetrics()) != 2 {
+			t.Fatalf("scopePerStatistic=%v: expected 2 ResourceMetrics, got %d", perStatistic, len(req.GetResourceMetrics()))
+		}
+		for i, want := range []struct{ account, region, instance string }{
+			{"111122223333", "us-east-1", "i-1"},
+			{"444455556666", "eu-west-1", "i-2"},
+		} {
+			rm := req.GetResourceMetrics()[i]
+			res := keyValueToMap(rm.GetResource().GetAttributes())
+			if res["cloud.account.id"] != want.account || res["cloud.region"] != want.region {
+				t.Errorf("scopePerStatistic=%v: ResourceMetrics %d has resource %v, want %s %s", perStatistic, i, res, want.account, want.region)
+			}
+			var gauges int
+			for _, sm := range rm.GetScopeMetrics() {
+				for _, m := range sm.GetMetrics() {
+					gauges++
+					labels := keyValueToMap(m.GetGauge().GetDataPoints()[0].GetAttributes())
+					if labels["account_id"] != want.account || labels["region"] != want.region || labels["dimension_instance_id"] != want.instance {
+						t.Errorf("scopePerStatistic=%v: %s in ResourceMetrics %d has labels %v", perStatistic, m.GetName(), i, labels)
+					}
+				}
+			}
+			if gauges != 2 {
+				t.Errorf("scopePerStatistic=%v: expected 2 gauges in ResourceMetrics %d, got %d", perStatistic, i, gauges)
+			}
+		}
+	}
+}
+
+func TestEnhanceScopePerStatistic(t *testing.T) {
+	summary := func(metricName string) *metricspb.Metric {
+		attrs := ec2InputAttrsOTLP10("i-1234567890abcdef0")
+		attrs[1] = &commonpb.KeyValue{Key: "MetricName", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: metricName}}}
+		return &metricspb.Metric{
+			Name: "amazonaws.com/AWS/EC2/" + metricName,
+			Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{
+				DataPoints: []*metricspb.SummaryDataPoint{{Attributes: attrs, Count: 2, Sum: 10, TimeUnixNano: 1}},
+			}},
+		}
+	}
+	req := &metricsservicepb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		ScopeMetrics: []*metricspb.ScopeMetrics{
+			{Scope: &commonpb.InstrumentationScope{Name: "scope-a"}, Metrics: []*metricspb.Metric{summary("CPUUtilization")}},
+			{Scope: &commonpb.InstrumentationScope{Name: "scope-b"}, Metrics: []*metricspb.Metric{
+				newGauge("untouched", 1, 1, 0, nil),
+				summary("NetworkIn"),
+			}},
+		},
+	}}}
+	cfg := enhanceConfig{
+		continueOnResourceFailure: true,
+		yaceCompatMode:            true,
+		yaceCompatStats:           map[string]bool{"SampleCount": true, "Sum": true},
+		scopePerStatistic:         true,
+	}
+	err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		map[string][]*model.TaggedResource{"AWS/EC2": nil}, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	// scope-a only held a Summary and is dropped; scope-b keeps its passthrough gauge.
+	want := []struct {
+		scope string
+		names []string
+	}{
+		{"scope-b", []string{"untouched"}},
+		{"cloudwatch/SampleCount", []string{
+			promutil.BuildMetricName("AWS/EC2", "CPUUtilization", "SampleCount"),
+			promutil.BuildMetricName("AWS/EC2", "NetworkIn", "SampleCount"),
+		}},
+		{"cloudwatch/Sum", []string{
+			promutil.BuildMetricName("AWS/EC2", "CPUUtilization", "Sum"),
+			promutil.BuildMetricName("AWS/EC2", "NetworkIn", "Sum"),
+		}},
+	}
+	sms := req.GetResourceMetrics()[0].GetScopeMetrics()
+	if len(sms) != len(want) {
+		t.Fatalf("expected %d scope metrics, got %d", len(want), len(sms))
+	}
+	for i, w := range want {
+		var names []string
+		for _, m := range sms[i].GetMetrics() {
+			names = append(names, m.GetName())
+		}
+		if sms[i].GetScope().GetName() != w.scope || strings.Join(names, ",") != strings.Join(w.names, ",") {
+			t.Errorf("scope %d: got %q %v, want %q %v", i, sms[i].GetScope().GetName(), names, w.scope, w.names)
+		}
+	}
+}
+
+func TestEnhanceYACECompatModeStartTime(t *testing.T) {
+	stats, _ := parseYACEStats(`["Maximum","Sum"]`)
+	for _, tc := range []struct {
+		zeroStartTime bool
+		want          uint64
+	}{
+		{zeroStartTime: false, want: 900000000},
+		{zeroStartTime: true, want: 0},
+	} {
+		req := makeExportRequestWithSummaryData("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1"), 10, 50.0, map[float64]float64{1.0: 10.0})
+		cfg := enhanceConfig{
+			continueOnResourceFailure: true,
+			labelsSnakeCase:           true,
+			yaceCompatMode:            true,
+			yaceCompatStats:           stats,
+			zeroGaugeStartTime:        tc.zeroStartTime,
+		}
+		err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+			map[string][]*model.TaggedResource{"AWS/EC2": nil}, map[string]maxdimassociator.Associator{},
+			aws.String("us-east-1"), mockTaggingClient{})
+		if err != nil {
+			t.Fatalf("enhanceRequests failed: %v", err)
+		}
+
+		metrics := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()
+		if len(metrics) != 2 {
+			t.Fatalf("expected 2 gauges, got %d", len(metrics))
+		}
+		for _, m := range metrics {
+			dp := m.GetGauge().GetDataPoints()[0]
+			if dp.GetStartTimeUnixNano() != tc.want {
+				t.Errorf("ZERO_START_TIME=%v: %s StartTimeUnixNano got %d, want %d", tc.zeroStartTime, m.GetName(), dp.GetStartTimeUnixNano(), tc.want)
+			}
+			if dp.GetTimeUnixNano() != 1000000000 {
+				t.Errorf("ZERO_START_TIME=%v: %s TimeUnixNano should be kept, got %d", tc.zeroStartTime, m.GetName(), dp.GetTimeUnixNano())
+			}
+		}
+	}
+}
+
+func TestEnhanceYACECompatModeKeepOriginalOnSkip(t *testing.T) {
+	ec2Resource := &model.TaggedResource{
+		ARN:       "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0",
+		Namespace: "AWS/EC2",
+		Region:    "us-east-1",
+	}
+	// The data point references an instance that is not in the resource cache, so association skips it.
+	req := makeExportRequestWithSummaryData(
+		"amazonaws.com/AWS/EC2/CPUUtilization",
+		ec2InputAttrsOTLP10("i-0000000000000000"),
+		10, 50.0,
+		map[float64]float64{0.0: 2.0, 1.0: 10.0},
+	)
+	original := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0]
+
+	logger := slog.Default()
+	resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {ec2Resource}}
+	svc := config.SupportedServices.GetService("AWS/EC2")
+	if svc == nil {
+		t.Fatal("AWS/EC2 service not found in config")
+	}
+	associatorCache := map[string]maxdimassociator.Associator{
+		"AWS/EC2": maxdimassociator.NewAssociator(logger, svc.ToModelDimensionsRegexp(), resourceCache["AWS/EC2"]),
+	}
+	yaceCompatStats, _ := parseYACEStats("")
+
+	err := enhanceRequests(
+		logger, enhanceConfig{
+			fileCachePath:             "/tmp",
+			continueOnResourceFailure: true,
+			labelsSnakeCase:           true,
+			yaceCompatMode:            true,
+			yaceCompatStats:           yaceCompatStats,
+			keepOriginalOnSkip:        true,
+		},
+		[]*metricsservicepb.ExportMetricsServiceRequest{req},
+		resourceCache, associatorCache,
+		aws.String("us-east-1"), mockTaggingClient{},
+	)
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	metrics := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()
+	if len(metrics) != 1 {
+		t.Fatalf("expected the original metric only, got %d metrics", len(metrics))
+	}
+	if metrics[0] != original {
+		t.Fatalf("expected the original metric to be kept unchanged")
+	}
+	if metrics[0].GetSummary() == nil {
+		t.Fatalf("expected metric to remain a Summary, got %T", metrics[0].GetData())
+	}
+	if metrics[0].GetName() != "amazonaws.com/AWS/EC2/CPUUtilization" {
+		t.Errorf("metric name changed: got %q", metrics[0].GetName())
+	}
+	got := keyValueToMap(metrics[0].GetSummary().GetDataPoints()[0].GetAttributes())
+	if _, ok := got["name"]; ok {
+		t.Errorf("original attributes should not be replaced with YACE labels, got %v", got)
+	}
+}
+
+func TestOTLPEndpoint(t *testing.T) {
+	tests := []struct {
+		name            string
+		metricsEndpoint string
+		endpoint        string
+		want            string
+	}{
+		{name: "generic", endpoint: "collector:4317", want: "collector:4317"},
+		{name: "metrics-specific wins", metricsEndpoint: "metrics-collector:4317", endpoint: "collector:4317", want: "metrics-collector:4317"},
+		{name: "http scheme", endpoint: "http://collector:4317", want: "collector:4317"},
+		{name: "https scheme and slash", metricsEndpoint: "https://collector.example.com:4317/", want: "collector.example.com:4317"},
+		{name: "unset", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := otlpEndpoint(tt.metricsEndpoint, tt.endpoint); got != tt.want {
+				t.Errorf("otlpEndpoint(%q, %q) = %q, want %q", tt.metricsEndpoint, tt.endpoint, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPCConnConfigKeepalive(t *testing.T) {
+	disabled := grpcConnConfig{endpoint: "localhost:4317", insecure: true}
+	if _, ok := disabled.keepaliveParams(); ok {
+		t.Fatal("expected keepalive to be disabled when OTEL_GRPC_KEEPALIVE_TIME is unset")
+	}
+
+	enabled := disabled
+	enabled.keepaliveTime = 30 * time.Second
+	enabled.keepaliveTimeout = 10 * time.Second
+	params, ok := enabled.keepaliveParams()
+	if !ok {
+		t.Fatal("expected keepalive to be enabled")
+	}
+	if params.Time != 30*time.Second || params.Timeout != 10*time.Second || !params.PermitWithoutStream {
+		t.Errorf("unexpected keepalive parameters: %+v", params)
+	}
+	if got, want := len(enabled.dialOptions()), len(disabled.dialOptions())+1; got != want {
+		t.Errorf("expected keepalive dial option to be added: got %d options, want %d", got, want)
+	}
+}
+
+// startTestGRPCServer starts a gRPC server on a loopback port and returns its address.
+func startTestGRPCServer(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := grpc.NewServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+// recordingMetricsClient records the call options of each Export call.
+type recordingMetricsClient struct {
+	opts [][]grpc.CallOption
+}
+
+func (c *recordingMetricsClient) Export(ctx context.Context, in *metricsservicepb.ExportMetricsServiceRequest, opts ...grpc.CallOption) (*metricsservicepb.ExportMetricsServiceResponse, error) {
+	c.opts = append(c.opts, opts)
+	return &metricsservicepb.ExportMetricsServiceResponse{}, nil
+}
+
+// concurrentMetricsClient tracks how many Export calls run at once and fails requests with a schema URL.
+type concurrentMetricsClient struct {
+	inFlight, maxInFlight, calls atomic.Int64
+	noDeadline                   atomic.Bool
+}
+
+func (c *concurrentMetricsClient) Export(ctx context.Context, in *metricsservicepb.ExportMetricsServiceRequest, opts ...grpc.CallOption) (*metricsservicepb.ExportMetricsServiceResponse, error) {
+	c.calls.Add(1)
+	n := c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
+	for {
+		m := c.maxInFlight.Load()
+		if n <= m || c.maxInFlight.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		c.noDeadline.Store(true)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if url := in.GetResourceMetrics()[0].GetSchemaUrl(); url != "" {
+		return nil, errors.New("rejected " + url)
+	}
+	return &metricsservicepb.ExportMetricsServiceResponse{}, nil
+}
+
+func TestExportRequestsConcurrency(t *testing.T) {
+	var reqs []*metricsservicepb.ExportMetricsServiceRequest
+	for _, url := range []string{"", "a", "", "", "b", ""} {
+		reqs = append(reqs, &metricsservicepb.ExportMetricsServiceRequest{
+			ResourceMetrics: []*metricspb.ResourceMetrics{{SchemaUrl: url}},
+		})
+	}
+
+	client := &concurrentMetricsClient{}
+	err := exportRequests(context.Background(), client, reqs, time.Second, 2)
+	if err == nil || !strings.Contains(err.Error(), "rejected a") || !strings.Contains(err.Error(), "rejected b") {
+		t.Errorf("expected both export errors to be joined, got %v", err)
+	}
+	if got := client.calls.Load(); got != int64(len(reqs)) {
+		t.Errorf("expected every request to be attempted, got %d calls", got)
+	}
+	if got := client.maxInFlight.Load(); got != 2 {
+		t.Errorf("expected at most 2 concurrent exports, reached %d", got)
+	}
+	if client.noDeadline.Load() {
+		t.Error("expected every export call to carry the per-call timeout")
+	}
+
+	// Sequential export stops at the first error.
+	client = &concurrentMetricsClient{}
+	err = exportRequests(context.Background(), client, reqs, time.Second, 1)
+	if err == nil || err.Error() != "rejected a" {
+		t.Errorf("expected the first error, got %v", err)
+	}
+	if got := client.calls.Load(); got != 2 || client.maxInFlight.Load() != 1 {
+		t.Errorf("expected 2 sequential calls, got %d calls with %d in flight", got, client.maxInFlight.Load())
+	}
+}
+
+func TestExportRequestsNoClient(t *testing.T) {
+	reqs := []*metricsservicepb.ExportMetricsServiceRequest{{}}
+	if err := exportRequests(context.Background(), nil, reqs, time.Second, 1); !errors.Is(err, errNoExporter) {
+		t.Errorf("expected errNoExporter for a nil client, got %v", err)
+	}
+	if err := exportRequests(context.Background(), nil, reqs, time.Second, 4); !errors.Is(err, errNoExporter) {
+		t.Errorf("expected errNoExporter for a nil client with concurrency, got %v", err)
+	}
+	if err := exportRequests(context.Background(), nil, nil, time.Second, 1); !errors.Is(err, errNoExporter) {
+		t.Errorf("expected errNoExporter for a nil client without requests, got %v", err)
+	}
+
+	client := &recordingMetricsClient{}
+	if err := exportRequests(context.Background(), client, nil, time.Second, 4); err != nil {
+		t.Errorf("expected no error without requests, got %v", err)
+	}
+	if len(client.opts) != 0 {
+		t.Errorf("expected no Export calls without requests, got %d", len(client.opts))
+	}
+}
+
+func TestExportRequestsWaitForReady(t *testing.T) {
+	reqs := []*metricsservicepb.ExportMetricsServiceRequest{{}, {}}
+	waitForReady := func(opts []grpc.CallOption) bool {
+		for _, o := range opts {
+			if ff, ok := o.(grpc.FailFastCallOption); ok && !ff.FailFast {
+				return true
+			}
+		}
+		return false
+	}
+
+	client := &recordingMetricsClient{}
+	if err := exportRequests(context.Background(), client, reqs, time.Second, 1); err != nil {
+		t.Fatalf("exportRequests failed: %v", err)
+	}
+	if waitForReady(client.opts[0]) {
+		t.Error("wait-for-ready should not be set by default")
+	}
+
+	client = &recordingMetricsClient{}
+	if err := exportRequests(context.Background(), client, reqs, time.Second, 1, grpc.WaitForReady(true)); err != nil {
+		t.Fatalf("exportRequests failed: %v", err)
+	}
+	if len(client.opts) != 2 {
+		t.Fatalf("expected 2 Export calls, got %d", len(client.opts))
+	}
+	for i, opts := range client.opts {
+		if !waitForReady(opts) {
+			t.Errorf("call %d: expected WaitForReady(true) call option, got %v", i, opts)
+		}
+	}
+}
+
+func TestDedupKeyInterceptor(t *testing.T) {
+	headerFor := func(req *metricsservicepb.ExportMetricsServiceRequest) string {
+		var got []string
+		invoker := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			md, _ := metadata.FromOutgoingContext(ctx)
+			got = md.Get(dedupKeyHeader)
+			return nil
+		}
+		if err := dedupKeyInterceptor(context.Background(), "/Export", req, nil, nil, invoker); err != nil {
+			t.Fatalf("interceptor failed: %v", err)
+		}
+		if len(got) != 1 || got[0] == "" {
+			t.Fatalf("expected one %s header, got %v", dedupKeyHeader, got)
+		}
+		return got[0]
+	}
+
+	a := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1"))
+	b := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1"))
+	c := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-2"))
+	if headerFor(a) != headerFor(b) {
+		t.Error("identical requests should carry the same dedup key")
+	}
+	if headerFor(a) == headerFor(c) {
+		t.Error("different requests should carry different dedup keys")
+	}
+
+	withHeader := grpcConnConfig{endpoint: "localhost:4317", insecure: true, dedupHeader: true}
+	if got, want := len(withHeader.dialOptions()), len(grpcConnConfig{endpoint: "localhost:4317", insecure: true}.dialOptions())+1; got != want {
+		t.Errorf("expected interceptor dial option to be added: got %d options, want %d", got, want)
+	}
+}
+
+func TestGRPCConnConfigMaxSendMsgSize(t *testing.T) {
+	base := grpcConnConfig{endpoint: "localhost:4317", insecure: true}
+	if len(base.callOptions()) != 0 {
+		t.Errorf("expected no call options by default, got %v", base.callOptions())
+	}
+
+	cfg := base
+	cfg.maxSendMsgSize = 16 << 20
+	opts := cfg.callOptions()
+	if len(opts) != 1 {
+		t.Fatalf("expected 1 call option, got %d", len(opts))
+	}
+	if opt, ok := opts[0].(grpc.MaxSendMsgSizeCallOption); !ok || opt.MaxSendMsgSize != 16<<20 {
+		t.Errorf("expected MaxCallSendMsgSize(%d), got %#v", 16<<20, opts[0])
+	}
+	if got, want := len(cfg.dialOptions()), len(base.dialOptions())+1; got != want {
+		t.Errorf("expected default call options dial option to be added: got %d options, want %d", got, want)
+	}
+
+	// The limit is enforced by the client before the request is sent.
+	cfg = grpcConnConfig{endpoint: startTestGRPCServer(t), insecure: true, timeout: 2 * time.Second, maxSendMsgSize: 64}
+	conn, err := newGRPCConn(cfg)
+	if err != nil {
+		t.Fatalf("newGRPCConn failed: %v", err)
+	}
+	defer conn.Close()
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	_, err = metricsservicepb.NewMetricsServiceClient(conn).Export(context.Background(), req)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted for a request over the send limit, got %v", err)
+	}
+}
+
+func TestGRPCConnConfigCompression(t *testing.T) {
+	cfg := grpcConnConfig{endpoint: "localhost:4317", insecure: true, compression: "gzip"}
+	opts := cfg.callOptions()
+	if len(opts) != 1 {
+		t.Fatalf("expected 1 call option, got %d", len(opts))
+	}
+	if opt, ok := opts[0].(grpc.CompressorCallOption); !ok || opt.CompressorType != "gzip" {
+		t.Errorf("expected UseCompressor(gzip), got %#v", opts[0])
+	}
+	cfg.compression = "zstd"
+	if len(cfg.callOptions()) != 0 {
+		t.Errorf("expected no compressor for an unsupported compression, got %v", cfg.callOptions())
+	}
+
+	// The collector decodes both compressed and uncompressed exports.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := grpc.NewServer()
+	collector := &countingMetricsServer{}
+	metricsservicepb.RegisterMetricsServiceServer(srv, collector)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	for _, compression := range []string{"", "gzip"} {
+		cfg := grpcConnConfig{endpoint: lis.Addr().String(), insecure: true, timeout: 2 * time.Second, compression: compression}
+		conn, err := newGRPCConn(cfg)
+		if err != nil {
+			t.Fatalf("newGRPCConn failed: %v", err)
+		}
+		_, err = metricsservicepb.NewMetricsServiceClient(conn).Export(context.Background(), req)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("compression %q: export failed: %v", compression, err)
+		}
+	}
+	if collector.received != 2 {
+		t.Errorf("expected the collector to decode both exports, got %d", collector.received)
+	}
+}
+
+func TestGRPCConnConfigTLSServerName(t *testing.T) {
+	cfg := grpcConnConfig{endpoint: "10.0.0.5:4317", tlsServerName: "collector.internal.example.com"}
+	creds, err := cfg.transportCredentials()
+	if err != nil {
+		t.Fatalf("transportCredentials failed: %v", err)
+	}
+	info := creds.Info()
+	if info.SecurityProtocol != "tls" {
+		t.Fatalf("expected TLS credentials, got %q", info.SecurityProtocol)
+	}
+	if info.ServerName != "collector.internal.example.com" {
+		t.Errorf("ServerName: got %q, want %q", info.ServerName, "collector.internal.example.com")
+	}
+
+	cfg.insecure = true
+	creds, _ = cfg.transportCredentials()
+	if got := creds.Info().SecurityProtocol; got != "insecure" {
+		t.Errorf("expected insecure credentials when OTEL_EXPORTER_OTLP_INSECURE is set, got %q", got)
+	}
+}
+
+// selfSignedPEM returns a PEM certificate valid for localhost and its PEM private key.
+func selfSignedPEM(t *testing.T) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey failed: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestGRPCConnConfigPEM(t *testing.T) {
+	certPEM, keyPEM := selfSignedPEM(t)
+	serverCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair failed: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(certPEM)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})))
+	metricsservicepb.RegisterMetricsServiceServer(srv, &countingMetricsServer{})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	// The collector certificate is only trusted through the CA PEM, and it requires the client certificate.
+	cfg := grpcConnConfig{
+		endpoint:      lis.Addr().String(),
+		tlsServerName: "localhost",
+		caPEM:         string(certPEM),
+		clientCertPEM: string(certPEM),
+		clientKeyPEM:  string(keyPEM),
+		timeout:       2 * time.Second,
+	}
+	conn, err := newGRPCConn(cfg)
+	if err != nil {
+		t.Fatalf("newGRPCConn failed: %v", err)
+	}
+	defer conn.Close()
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	if _, err := metricsservicepb.NewMetricsServiceClient(conn).Export(context.Background(), req); err != nil {
+		t.Errorf("expected an export over mutual TLS from PEM strings, got %v", err)
+	}
+
+	for name, bad := range map[string]grpcConnConfig{
+		"invalid CA":       {caPEM: "not a certificate"},
+		"key without cert": {clientKeyPEM: string(keyPEM)},
+	} {
+		if _, err := bad.transportCredentials(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSharedGRPCClientReusedAcrossInvocations(t *testing.T) {
+	t.Cleanup(func() {
+		sharedConnMu.Lock()
+		defer sharedConnMu.Unlock()
+		if sharedConn != nil {
+			sharedConn.Close()
+		}
+		sharedConn, sharedClient, sharedConnCfg = nil, nil, grpcConnConfig{}
+	})
+
+	cfg := grpcConnConfig{endpoint: startTestGRPCServer(t), insecure: true, timeout: 5 * time.Second}
+	first, err := sharedGRPCClient(cfg)
+	if err != nil {
+		t.Fatalf("first invocation failed: %v", err)
+	}
+	second, err := sharedGRPCClient(cfg)
+	if err != nil {
+		t.Fatalf("second invocation failed: %v", err)
+	}
+	if first != second {
+		t.Error("expected the same client to be reused across invocations")
+	}
+
+	changed := cfg
+	changed.endpoint = startTestGRPCServer(t)
+	third, err := sharedGRPCClient(changed)
+	if err != nil {
+		t.Fatalf("invocation with changed endpoint failed: %v", err)
+	}
+	if third == first {
+		t.Error("expected a new client after the endpoint changed")
+	}
+}
+
+func TestBuildYACELabelsDropAccountID(t *testing.T) {
+	cwm := &model.Metric{Namespace: "AWS/EC2", MetricName: "CPUUtilization"}
+	for _, drop := range []bool{false, true} {
+		cfg := enhanceConfig{labelsSnakeCase: true, dropAccountID: drop}
+		got := keyValueToMap(buildYACELabelsKeyValue(slog.Default(), cfg, cwm, nil, false, "us-east-1", "123456789012"))
+		if _, ok := got["account_id"]; ok == drop {
+			t.Errorf("dropAccountID=%v: account_id present = %v", drop, ok)
+		}
+		if got["region"] != "us-east-1" || got["namespace"] != "AWS/EC2" {
+			t.Errorf("dropAccountID=%v: other context labels should be kept, got %v", drop, got)
+		}
+	}
+}
+
+func TestBuildYACELabelsRegionFromResource(t *testing.T) {
+	cwm := &model.Metric{Namespace: "AWS/EC2", MetricName: "CPUUtilization"}
+	resource := &model.TaggedResource{ARN: "arn:aws:ec2:eu-west-1:123456789012:instance/i-1234567890abcdef0"}
+	global := &model.TaggedResource{ARN: "arn:aws:s3:::my-bucket"}
+
+	tests := []struct {
+		name               string
+		regionFromResource bool
+		resource           *model.TaggedResource
+		skip               bool
+		expected           string
+	}{
+		{"disabled", false, resource, false, "us-east-1"},
+		{"ARN region", true, resource, false, "eu-west-1"},
+		{"ARN without region", true, global, false, "us-east-1"},
+		{"unmatched", true, nil, true, "us-east-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := enhanceConfig{labelsSnakeCase: true, regionFromResource: tt.regionFromResource}
+			got := keyValueToMap(buildYACELabelsKeyValue(slog.Default(), cfg, cwm, tt.resource, tt.skip, "us-east-1", "123456789012"))
+			if got["region"] != tt.expected {
+				t.Errorf("region = %q, want %q", got["region"], tt.expected)
+			}
+		})
+	}
+}
+
+func TestBuildYACELabelsJobLabel(t *testing.T) {
+	cwm := &model.Metric{Namespace: "AWS/EC2", MetricName: "CPUUtilization"}
+	for _, job := range []string{"", "cloudwatch-exporter"} {
+		cfg := enhanceConfig{labelsSnakeCase: true, jobLabel: job}
+		got, ok := keyValueToMap(buildYACELabelsKeyValue(slog.Default(), cfg, cwm, nil, true, "us-east-1", "123456789012"))["job"]
+		if ok != (job != "") || got != job {
+			t.Errorf("JOB_LABEL=%q: got job label %q (present %v)", job, got, ok)
+		}
+	}
+}
+
+func TestBuildYACELabelsCompositeDimensions(t *testing.T) {
+	cwm := &model.Metric{
+		Namespace:  "AWS/ApplicationELB",
+		MetricName: "RequestCount",
+		Dimensions: []model.Dimension{
+			{Name: "LoadBalancer", Value: "app/my-lb/50dc6c495c0c9188"},
+			{Name: "TargetGroup", Value: "targetgroup/my-tg/73e2d6bc24d8a067"},
+		},
+	}
+
+	for _, collapse := range []bool{false, true} {
+		env := fmt.Sprintf(`[{"dimensions":["LoadBalancer","TargetGroup"],"label":"lb_target_group","collapse":%t},`+
+			`{"dimensions":["LoadBalancer","AvailabilityZone"],"label":"lb_az"}]`, collapse)
+		composites, err := parseCompositeDimensions(env)
+		if err != nil {
+			t.Fatalf("parseCompositeDimensions failed: %v", err)
+		}
+		cfg := enhanceConfig{labelsSnakeCase: true, compositeDimensions: composites}
+		got := keyValueToMap(buildYACELabelsKeyValue(slog.Default(), cfg, cwm, nil, true, "us-east-1", "123456789012"))
+		if want := "app/my-lb/50dc6c495c0c9188|targetgroup/my-tg/73e2d6bc24d8a067"; got["lb_target_group"] != want {
+			t.Errorf("collapse=%v: lb_target_group = %q, want %q", collapse, got["lb_target_group"], want)
+		}
+		if _, ok := got["lb_az"]; ok {
+			t.Errorf("collapse=%v: expected no composite label for a missing dimension", collapse)
+		}
+		_, individual := got["dimension_load_balancer"]
+		if _, tg := got["dimension_target_group"]; individual != tg || individual == collapse {
+			t.Errorf("collapse=%v: unexpected individual dimension labels in %v", collapse, got)
+		}
+	}
+
+	for _, env := range []string{`{"label":"x"}`, `[{"dimensions":["A"],"label":"x"}]`, `[{"dimensions":["A","B"],"label":"bad-label"}]`} {
+		if _, err := parseCompositeDimensions(env); err == nil {
+			t.Errorf("expected an error for %s", env)
+		}
+	}
+}
+
+func TestBuildYACELabelsMatchStatus(t *testing.T) {
+	logger := slog.Default()
+	cwm := &model.Metric{
+		Namespace:  "AWS/EC2",
+		MetricName: "CPUUtilization",
+		Dimensions: []model.Dimension{{Name: "InstanceId", Value: "i-1234567890abcdef0"}},
+	}
+	resource := &model.TaggedResource{ARN: "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0"}
+	cfg := enhanceConfig{labelsSnakeCase: true, emitMatchStatus: true}
+
+	tests := []struct {
+		name     string
+		resource *model.TaggedResource
+		skip     bool
+		expected string
+	}{
+		{"matched", resource, false, "matched"},
+		{"skipped", nil, true, "unmatched"},
+		{"no resource", nil, false, "unmatched"},
+		{"resource but skip", resource, true, "unmatched"},
+	}
+	for _, tc := range tests {
+		got := keyValueToMap(buildYACELabelsKeyValue(logger, cfg, cwm, tc.resource, tc.skip, "us-east-1", ""))
+		if got["match_status"] != tc.expected {
+			t.Errorf("%s: match_status got %q, want %q", tc.name, got["match_status"], tc.expected)
+		}
+	}
+
+	cfg.emitMatchStatus = false
+	got := keyValueToMap(buildYACELabelsKeyValue(logger, cfg, cwm, resource, false, "us-east-1", ""))
+	if _, ok := got["match_status"]; ok {
+		t.Errorf("match_status should be absent when EMIT_MATCH_STATUS is disabled, got %v", got)
+	}
+}
+
+func TestParseResourceTagFilters(t *testing.T) {
+	filters, err := parseResourceTagFilters(`[{"key":"Environment","value":"prod|staging"},{"key":"Team"}]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(filters) != 2 || filters[0].Key != "Environment" || filters[1].Key != "Team" {
+		t.Fatalf("unexpected filters: %+v", filters)
+	}
+	if !filters[0].Value.MatchString("staging") || filters[0].Value.MatchString("dev") {
+		t.Errorf("Environment filter regexp %q does not match as expected", filters[0].Value)
+	}
+	if !filters[1].Value.MatchString("anything") {
+		t.Errorf("empty value should match any tag value")
+	}
+
+	if filters, err := parseResourceTagFilters(""); err != nil || filters != nil {
+		t.Errorf("expected nil filters for empty env, got %v, %v", filters, err)
+	}
+	if _, err := parseResourceTagFilters(`[{"value":"prod"}]`); err == nil {
+		t.Error("expected error for filter without key")
+	}
+	if _, err := parseResourceTagFilters(`[{"key":"Environment","value":"("}]`); err == nil {
+		t.Error("expected error for invalid regexp")
+	}
+}
+
+func TestGetOrCacheResourcesForwardsTagFilters(t *testing.T) {
+	filters, err := parseResourceTagFilters(`[{"key":"Environment","value":"prod"}]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := &recordingTaggingClient{}
+	if _, err := getOrCacheResources(slog.Default(), client, t.TempDir(), "AWS/EC2", aws.String("us-east-1"), filters, 0, false, false, false, realClock{}); err != nil {
+		t.Fatalf("getOrCacheResources failed: %v", err)
+	}
+	if len(client.jobs) != 1 {
+		t.Fatalf("expected 1 GetResources call, got %d", len(client.jobs))
+	}
+	job := client.jobs[0]
+	if job.Namespace != "AWS/EC2" {
+		t.Errorf("namespace: got %q, want %q", job.Namespace, "AWS/EC2")
+	}
+	if len(job.SearchTags) != 1 || job.SearchTags[0].Key != "Environment" || job.SearchTags[0].Value.String() != "prod" {
+		t.Errorf("expected Environment=prod search tag to be forwarded, got %+v", job.SearchTags)
+	}
+}
+
+func TestDedupeRequests(t *testing.T) {
+	summary := func(attrs []*commonpb.KeyValue, count uint64) *metricsservicepb.ExportMetricsServiceRequest {
+		return makeExportRequestWithSummaryDataAndResource("aws_ec2_cpuutilization", attrs, count, 50.0,
+			map[float64]float64{1.0: 10.0}, "123456789012", "us-east-1")
+	}
+	strKV := func(k, v string) *commonpb.KeyValue {
+		return &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}}
+	}
+
+	// The second record repeats the first data point with attributes in a different order; the third differs in value.
+	first := []*metricsservicepb.ExportMetricsServiceRequest{
+		summary([]*commonpb.KeyValue{strKV("name", "i-1"), strKV("custom_tag_env", "prod")}, 10),
+	}
+	second := []*metricsservicepb.ExportMetricsServiceRequest{
+		summary([]*commonpb.KeyValue{strKV("custom_tag_env", "prod"), strKV("name", "i-1")}, 10),
+		summary([]*commonpb.KeyValue{strKV("name", "i-1"), strKV("custom_tag_env", "prod")}, 11),
+	}
+
+	// Resource attributes in a different order still belong to the same resource.
+	res := second[1].GetResourceMetrics()[0].GetResource()
+	slices.Reverse(res.Attributes)
+
+	d := newDeduper()
+	if dropped := d.dedupeRequests(first); dropped != 0 {
+		t.Fatalf("first record: expected no duplicates, dropped %d", dropped)
+	}
+	if dropped := d.dedupeRequests(second); dropped != 1 {
+		t.Fatalf("second record: expected 1 duplicate, dropped %d", dropped)
+	}
+
+	if got := len(second[0].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()); got != 0 {
+		t.Errorf("expected duplicate metric to be removed, %d metrics remain", got)
+	}
+	if got := len(second[1].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()); got != 1 {
+		t.Errorf("expected distinct metric to be kept, got %d metrics", got)
+	}
+
+	// Dedupe only filters: the kept data points and resources keep their attribute order.
+	keys := func(attrs []*commonpb.KeyValue) []string {
+		var out []string
+		for _, a := range attrs {
+			out = append(out, a.GetKey())
+		}
+		return out
+	}
+	dp := second[1].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0]
+	if got := keys(dp.GetAttributes()); !slices.Equal(got, []string{"name", "custom_tag_env"}) {
+		t.Errorf("expected the data point attribute order to be preserved, got %v", got)
+	}
+	if got := keys(res.GetAttributes()); !slices.Equal(got, []string{"cloud.region", "cloud.account.id"}) {
+		t.Errorf("expected the resource attribute order to be preserved, got %v", got)
+	}
+
+	// Same data point from a different account is not a duplicate.
+	other := []*metricsservicepb.ExportMetricsServiceRequest{
+		makeExportRequestWithSummaryDataAndResource("aws_ec2_cpuutilization",
+			[]*commonpb.KeyValue{strKV("name", "i-1"), strKV("custom_tag_env", "prod")}, 10, 50.0,
+			map[float64]float64{1.0: 10.0}, "210987654321", "us-east-1"),
+	}
+	if dropped := d.dedupeRequests(other); dropped != 0 {
+		t.Errorf("different resource should not be deduplicated, dropped %d", dropped)
+	}
+}
+
+func TestCacheFilePathCollisionSafe(t *testing.T) {
+	dir := "/tmp"
+	a := cacheFilePath(dir, "AWS/EC2", "us-east-1", nil)
+	b := cacheFilePath(dir, "AWS-EC2", "us-east-1", nil)
+	if a == b {
+		t.Fatalf("namespaces that sanitize to the same name must map to distinct files, both got %q", a)
+	}
+	if a != cacheFilePath(dir, "AWS/EC2", "us-east-1", nil) {
+		t.Error("cache file path must be stable for the same key")
+	}
+	if a == cacheFilePath(dir, "AWS/EC2", "eu-west-1", nil) {
+		t.Error("different regions must map to distinct files")
+	}
+	filters, _ := parseResourceTagFilters(`[{"key":"Environment","value":"prod"}]`)
+	if a == cacheFilePath(dir, "AWS/EC2", "us-east-1", filters) {
+		t.Error("different tag filters must map to distinct files")
+	}
+
+	odd := cacheFilePath(dir, "Custom/My App:metrics*", "us-east-1", nil)
+	name := strings.TrimPrefix(odd, dir+"/")
+	if strings.ContainsAny(name, "/: *") {
+		t.Errorf("cache file name contains unsafe characters: %q", name)
+	}
+	if !strings.HasPrefix(name, "cache-Custom-My-App-metrics--") {
+		t.Errorf("unexpected sanitized name: %q", name)
+	}
+}
+
+func TestPrewarmNamespaces(t *testing.T) {
+	ec2ARN := "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0"
+	client := &recordingTaggingClient{resources: []*model.TaggedResource{{
+		ARN:       ec2ARN,
+		Namespace: "AWS/EC2",
+		Region:    "us-east-1",
+	}}}
+	logger := slog.Default()
+	cfg := enhanceConfig{fileCachePath: t.TempDir(), continueOnResourceFailure: true, labelsSnakeCase: true}
+	resourceCache := make(map[string][]*model.TaggedResource)
+	associatorCache := make(map[string]maxdimassociator.Associator)
+
+	prewarmNamespaces(logger, cfg, []string{"AWS/EC2", "AWS/RDS", "Custom/Unknown"}, resourceCache, associatorCache, aws.String("us-east-1"), client)
+
+	if len(client.jobs) != 2 {
+		t.Errorf("expected 2 discovery calls for supported namespaces, got %d", len(client.jobs))
+	}
+	for _, ns := range []string{"AWS/EC2", "AWS/RDS"} {
+		if _, ok := resourceCache[ns]; !ok {
+			t.Errorf("resource cache not prewarmed for %s", ns)
+		}
+		if _, ok := associatorCache[ns]; !ok {
+			t.Errorf("associator cache not prewarmed for %s", ns)
+		}
+	}
+	if _, ok := resourceCache["Custom/Unknown"]; ok {
+		t.Error("unsupported namespace should not be prewarmed")
+	}
+
+	// Record processing must use the prewarmed caches without further discovery calls.
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	if err := enhanceRequests(logger, cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		resourceCache, associatorCache, aws.String("us-east-1"), mockTaggingClient{}); err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+	got := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+	if got["name"] != ec2ARN {
+		t.Errorf("name: got %q, want %q", got["name"], ec2ARN)
+	}
+}
+
+// fakeClock is a Clock whose time only moves when set.
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestGetOrCacheResourcesExpiration(t *testing.T) {
+	dir := t.TempDir()
+	region := aws.String("us-east-1")
+	client := &recordingTaggingClient{resources: []*model.TaggedResource{{ARN: "arn:aws:ec2:us-east-1:123456789012:instance/i-1"}}}
+	expiration := time.Hour
+	written := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: written}
+	path := cacheFilePath(dir, "AWS/EC2", "us-east-1", nil)
+
+	// The first call populates the cache file; its mtime is pinned so expiry is measured from a known point.
+	if _, err := getOrCacheResources(slog.Default(), client, dir, "AWS/EC2", region, nil, expiration, true, false, false, clock); err != nil {
+		t.Fatalf("getOrCacheResources failed: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		now         time.Time
+		wantRefresh bool
+	}{
+		{"fresh", written.Add(expiration - time.Second), false},
+		{"at expiration", written.Add(expiration), false},
+		{"expired", written.Add(expiration + time.Nanosecond), true},
+	}
+	for _, tc := range tests {
+		if err := os.Chtimes(path, written, written); err != nil {
+			t.Fatalf("Chtimes failed: %v", err)
+		}
+		clock.now = tc.now
+		before := len(client.jobs)
+		resources, err := getOrCacheResources(slog.Default(), client, dir, "AWS/EC2", region, nil, expiration, true, false, false, clock)
+		if err != nil {
+			t.Fatalf("%s: getOrCacheResources failed: %v", tc.name, err)
+		}
+		if len(resources) != 1 {
+			t.Errorf("%s: expected 1 resource, got %d", tc.name, len(resources))
+		}
+		if refreshed := len(client.jobs) > before; refreshed != tc.wantRefresh {
+			t.Errorf("%s: refreshed = %v, want %v", tc.name, refreshed, tc.wantRefresh)
+		}
+	}
+}
+
+func TestGetOrCacheResourcesCompressed(t *testing.T) {
+	dir := t.TempDir()
+	region := aws.String("us-east-1")
+	client := &recordingTaggingClient{resources: []*model.TaggedResource{{
+		ARN:  "arn:aws:ec2:us-east-1:123456789012:instance/i-1",
+		Tags: []model.Tag{{Key: "Name", Value: "my-instance"}},
+	}}}
+
+	if _, err := getOrCacheResources(slog.Default(), client, dir, "AWS/EC2", region, nil, time.Hour, true, true, false, realClock{}); err != nil {
+		t.Fatalf("getOrCacheResources failed: %v", err)
+	}
+	b, err := os.ReadFile(cacheFilePath(dir, "AWS/EC2", "us-east-1", nil))
+	if err != nil {
+		t.Fatalf("reading cache file: %v", err)
+	}
+	if !isGzip(b) {
+		t.Fatal("expected cache file to be gzip-compressed")
+	}
+
+	// Reads detect compression from the content, whatever FILE_CACHE_COMPRESS is set to.
+	for _, compress := range []bool{true, false} {
+		resources, err := getOrCacheResources(slog.Default(), client, dir, "AWS/EC2", region, nil, time.Hour, true, compress, false, realClock{})
+		if err != nil {
+			t.Fatalf("compress=%v: getOrCacheResources failed: %v", compress, err)
+		}
+		if len(resources) != 1 || resources[0].ARN != client.resources[0].ARN || resources[0].Tags[0].Value != "my-instance" {
+			t.Errorf("compress=%v: unexpected resources after round-trip: %+v", compress, resources)
+		}
+	}
+	if len(client.jobs) != 1 {
+		t.Errorf("expected cached reads without further discovery, got %d calls", len(client.jobs))
+	}
+
+	// Plain JSON caches written without compression are still read when compression is enabled.
+	plainDir := t.TempDir()
+	if _, err := getOrCacheResources(slog.Default(), client, plainDir, "AWS/EC2", region, nil, time.Hour, true, false, false, realClock{}); err != nil {
+		t.Fatalf("getOrCacheResources failed: %v", err)
+	}
+	resources, err := getOrCacheResources(slog.Default(), client, plainDir, "AWS/EC2", region, nil, time.Hour, true, true, false, realClock{})
+	if err != nil || len(resources) != 1 {
+		t.Errorf("plain JSON cache: got %v, %v", resources, err)
+	}
+}
+
+func TestTagValueNormalizer(t *testing.T) {
+	re, repl, err := parseTagValueRegexReplace(`{"regex":"\\s+","replacement":"_"}`)
+	if err != nil {
+		t.Fatalf("parseTagValueRegexReplace failed: %v", err)
+	}
+	long := strings.Repeat("a", 30)
+	tests := []struct {
+		name string
+		n    tagValueNormalizer
+		in   string
+		want string
+	}{
+		{"unchanged", tagValueNormalizer{}, "my instance", "my instance"},
+		{"regex", tagValueNormalizer{re: re, replacement: repl}, "my  web\tserver", "my_web_server"},
+		{"short enough", tagValueNormalizer{maxLength: 30}, long, long},
+		{"truncated with hash", tagValueNormalizer{maxLength: 20}, long, strings.Repeat("a", 11) + "…" + valueHash8(long)},
+		{"truncated counts characters", tagValueNormalizer{maxLength: 12}, strings.Repeat("é", 13), "ééé…" + valueHash8(strings.Repeat("é", 13))},
+		{"tiny limit", tagValueNormalizer{maxLength: 5}, long, "aaaaa"},
+		{"regex before truncation", tagValueNormalizer{re: re, replacement: repl, maxLength: 5}, "a b c", "a_b_c"},
+	}
+	for _, tt := range tests {
+		if got := tt.n.normalize(tt.in); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if _, _, err := parseTagValueRegexReplace(`{"regex":"(","replacement":""}`); err == nil {
+		t.Error("expected an error for an invalid regex")
+	}
+}
+
+func valueHash8(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:4])
+}
+
+func TestEnhanceTruncatesTagValues(t *testing.T) {
+	ec2Resource := &model.TaggedResource{
+		ARN:       "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0",
+		Namespace: "AWS/EC2",
+		Region:    "us-east-1",
+		Tags:      []model.Tag{{Key: "Description", Value: strings.Repeat("x", 100)}},
+	}
+	req := makeExportRequestOTLP10WithResource("ignored", ec2InputAttrsOTLP10("i-1234567890abcdef0"), "123456789012", "us-east-1")
+	logger := slog.Default()
+	resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {ec2Resource}}
+	associatorCache := map[string]maxdimassociator.Associator{
+		"AWS/EC2": maxdimassociator.NewAssociator(logger, config.SupportedServices.GetService("AWS/EC2").ToModelDimensionsRegexp(), resourceCache["AWS/EC2"]),
+	}
+	cfg := enhanceConfig{
+		continueOnResourceFailure: true,
+		labelsSnakeCase:           true,
+		staticLabels:              map[string]string{"owner": strings.Repeat("y", 100)},
+		tagValues:                 tagValueNormalizer{maxLength: 32},
+	}
+	err := enhanceRequests(logger, cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+		resourceCache, associatorCache, aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	got := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+	for _, k := range []string{"tag_description", "custom_tag_owner"} {
+		if n := utf8.RuneCountInString(got[k]); n != 32 || !strings.Contains(got[k], "…") {
+			t.Errorf("%s: expected a 32 character truncated value, got %q (%d)", k, got[k], n)
+		}
+	}
+	if got["name"] != ec2Resource.ARN {
+		t.Errorf("name label must not be truncated, got %q", got["name"])
+	}
+}
+
+func TestResourceType(t *testing.T) {
+	tests := map[string]string{
+		"arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0":                       "ec2:instance",
+		"arn:aws:lambda:us-east-1:123456789012:function:my-function":                            "lambda:function",
+		"arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/app/my-lb/50dc6c495c": "elasticloadbalancing:loadbalancer",
+		"arn:aws:s3:::my-bucket":                      "s3",
+		"arn:aws:sqs:us-east-1:123456789012:my-queue": "sqs",
+		"not-an-arn": "",
+	}
+	for in, want := range tests {
+		if got := resourceType(in); got != want {
+			t.Errorf("resourceType(%q): got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestEnhanceEmitResourceTypeLabel(t *testing.T) {
+	ec2Resource := &model.TaggedResource{
+		ARN:       "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0",
+		Namespace: "AWS/EC2",
+		Region:    "us-east-1",
+	}
+	logger := slog.Default()
+	resourceCache := map[string][]*model.TaggedResource{"AWS/EC2": {ec2Resource}}
+	associatorCache := map[string]maxdimassociator.Associator{
+		"AWS/EC2": maxdimassociator.NewAssociator(logger, config.SupportedServices.GetService("AWS/EC2").ToModelDimensionsRegexp(), resourceCache["AWS/EC2"]),
+	}
+	matched := makeExportRequestOTLP10("ignored", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	unmatched := makeExportRequestOTLP10("ignored", ec2InputAttrsOTLP10("i-unknown"))
+
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, emitResourceType: true}
+	err := enhanceRequests(logger, cfg, []*metricsservicepb.ExportMetricsServiceRequest{matched, unmatched},
+		resourceCache, associatorCache, aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	labels := func(req *metricsservicepb.ExportMetricsServiceRequest) map[string]string {
+		return keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+	}
+	if got := labels(matched)["resource_type"]; got != "ec2:instance" {
+		t.Errorf("resource_type: got %q, want %q", got, "ec2:instance")
+	}
+	if got, ok := labels(unmatched)["resource_type"]; ok {
+		t.Errorf("unmatched metrics should not get resource_type, got %q", got)
+	}
+}
+
+func TestEnhanceEmitIngestLag(t *testing.T) {
+	ts := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	req := makeExportRequestOTLP10("ignored", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	dp := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0]
+	dp.TimeUnixNano = uint64(ts.UnixNano())
+	noTime := makeExportRequestOTLP10("ignored", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	noTime.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].TimeUnixNano = 0
+
+	cfg := enhanceConfig{
+		continueOnResourceFailure: true,
+		labelsSnakeCase:           true,
+		emitIngestLag:             true,
+		clock:                     &fakeClock{now: ts.Add(95*time.Second + 400*time.Millisecond)},
+	}
+	err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req, noTime},
+		map[string][]*model.TaggedResource{"AWS/EC2": nil}, map[string]maxdimassociator.Associator{},
+		aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	if got := keyValueToMap(dp.GetAttributes())["ingest_lag_seconds"]; got != "95" {
+		t.Errorf("ingest_lag_seconds: got %q, want %q", got, "95")
+	}
+	noTimeAttrs := keyValueToMap(noTime.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+	if got, ok := noTimeAttrs["ingest_lag_seconds"]; ok {
+		t.Errorf("data points without TimeUnixNano should not get ingest_lag_seconds, got %q", got)
+	}
+}
+
+func TestEnhanceEmitProvenanceLabels(t *testing.T) {
+	arrival := time.Date(2026, 1, 2, 3, 4, 5, 678000000, time.UTC)
+	record := events.KinesisFirehoseEventRecord{
+		RecordID:                    "record-1",
+		ApproximateArrivalTimestamp: events.MilliSecondsEpochTime{Time: arrival},
+	}
+	for _, enabled := range []bool{false, true} {
+		req := makeExportRequestOTLP10("ignored", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+		cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true}
+		if enabled {
+			cfg.provenance = newRecordProvenance(record, "cw-otlp-enricher")
+		}
+		err := enhanceRequests(slog.Default(), cfg, []*metricsservicepb.ExportMetricsServiceRequest{req},
+			map[string][]*model.TaggedResource{"AWS/EC2": nil}, map[string]maxdimassociator.Associator{},
+			aws.String("us-east-1"), mockTaggingClient{})
+		if err != nil {
+			t.Fatalf("enhanceRequests failed: %v", err)
+		}
+
+		got := keyValueToMap(req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+		if !enabled {
+			if _, ok := got["firehose_arrival_ts"]; ok {
+				t.Errorf("provenance labels should be off by default, got %v", got)
+			}
+			continue
+		}
+		if got["firehose_arrival_ts"] != "1767323045678" {
+			t.Errorf("firehose_arrival_ts: got %q, want %q", got["firehose_arrival_ts"], "1767323045678")
+		}
+		if got["enricher_source"] != "cw-otlp-enricher" {
+			t.Errorf("enricher_source: got %q, want %q", got["enricher_source"], "cw-otlp-enricher")
+		}
+	}
+}
+
+func TestMetricTagsPrefixPatterns(t *testing.T) {
+	r := &model.TaggedResource{Tags: []model.Tag{
+		{Key: "Name", Value: "web-1"},
+		{Key: "kubernetes.io/cluster", Value: "prod"},
+		{Key: "kubernetes.io/role", Value: "node"},
+		{Key: "Team", Value: "infra"},
+	}}
+	tests := []struct {
+		name     string
+		exported []string
+		want     []model.Tag
+	}{
+		{
+			name:     "prefix",
+			exported: []string{"kubernetes.io/*"},
+			want:     []model.Tag{{Key: "kubernetes.io/cluster", Value: "prod"}, {Key: "kubernetes.io/role", Value: "node"}},
+		},
+		{
+			name:     "exact keys keep empty values",
+			exported: []string{"Name", "Environment"},
+			want:     []model.Tag{{Key: "Name", Value: "web-1"}, {Key: "Environment", Value: ""}},
+		},
+		{
+			name:     "mixed without duplicates",
+			exported: []string{"kubernetes.io/role", "kubernetes.io/*", "T*"},
+			want: []model.Tag{
+				{Key: "kubernetes.io/role", Value: "node"},
+				{Key: "kubernetes.io/cluster", Value: "prod"},
+				{Key: "Team", Value: "infra"},
+			},
+		},
+		{
+			name:     "no match",
+			exported: []string{"aws:*"},
+			want:     []model.Tag{},
+		},
+		{
+			name:     "star matches all",
+			exported: []string{"*"},
+			want:     r.Tags,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := metricTags(r, tt.exported); !slices.Equal(got, tt.want) {
+				t.Errorf("metricTags(%v): got %v, want %v", tt.exported, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResourceName(t *testing.T) {
+	r := &model.TaggedResource{
+		ARN:  "arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/app/my-lb/50dc6c495c0c9188",
+		Tags: []model.Tag{{Key: "Name", Value: "frontend-lb"}, {Key: "Team", Value: ""}},
+	}
+	tests := []struct {
+		strategy string
+		want     string
+	}{
+		{"", r.ARN},
+		{"full", r.ARN},
+		{"last_segment", "50dc6c495c0c9188"},
+		{"tag:Name", "frontend-lb"},
+		{"tag:Team", r.ARN},
+		{"tag:Missing", r.ARN},
+	}
+	for _, tc := range tests {
+		if got := resourceName(r, tc.strategy); got != tc.want {
+			t.Errorf("NAME_FROM_ARN=%q: got %q, want %q", tc.strategy, got, tc.want)
+		}
+	}
+
+	bucket := &model.TaggedResource{ARN: "arn:aws:s3:::my-bucket"}
+	if got := resourceName(bucket, "last_segment"); got != "my-bucket" {
+		t.Errorf("last_segment for S3 ARN: got %q, want %q", got, "my-bucket")
+	}
+
+	cfg := enhanceConfig{labelsSnakeCase: true, nameFromARN: "tag:Name"}
+	got := keyValueToMap(buildYACELabelsKeyValue(slog.Default(), cfg, &model.Metric{Namespace: "AWS/ApplicationELB"}, r, false, "us-east-1", ""))
+	if got["name"] != "frontend-lb" {
+		t.Errorf("name label: got %q, want %q", got["name"], "frontend-lb")
+	}
+}
+
+// brokenTaggingFactory panics when asked for a tagging client, like the YACE factory does for a region
+// it holds no clients for.
+type brokenTaggingFactory struct{}
+
+func (brokenTaggingFactory) Refresh() {}
+
+func (brokenTaggingFactory) GetTaggingClient(string, model.Role, int) tagging.Client {
+	panic("no clients for region")
+}
+
+// fixedTaggingFactory returns client for every region.
+type fixedTaggingFactory struct{ client tagging.Client }
+
+func (fixedTaggingFactory) Refresh() {}
+
+func (f fixedTaggingFactory) GetTaggingClient(string, model.Role, int) tagging.Client {
+	return f.client
+}
+
+func TestLambdaHandlerWithoutTaggingClient(t *testing.T) {
+	orig := newTaggingFactory
+	newTaggingFactory = func(*slog.Logger, string) (taggingClientFactory, error) {
+		return brokenTaggingFactory{}, nil
+	}
+	t.Cleanup(func() { newTaggingFactory = orig })
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("FIREHOSE_OUTPUT_MODE", outputModeEnhanced)
+
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	data, err := requestsIntoRawData([]*metricsservicepb.ExportMetricsServiceRequest{req})
+	if err != nil {
+		t.Fatalf("requestsIntoRawData failed: %v", err)
+	}
+	out, err := lambdaHandler(context.Background(), events.KinesisFirehoseEvent{
+		Records: []events.KinesisFirehoseEventRecord{{RecordID: "rec-1", Data: data}},
+	})
+	if err != nil {
+		t.Fatalf("lambdaHandler failed: %v", err)
+	}
+
+	resp := out.(events.KinesisFirehoseResponse)
+	if len(resp.Records) != 1 || resp.Records[0].RecordID != "rec-1" || resp.Records[0].Result != events.KinesisFirehoseTransformedStateOk {
+		t.Fatalf("unexpected response records: %+v", resp.Records)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(resp.Records[0].Data))
+	if err != nil {
+		t.Fatalf("response data is not base64: %v", err)
+	}
+	got, err := rawDataIntoRequests(decoded)
+	if err != nil {
+		t.Fatalf("rawDataIntoRequests failed: %v", err)
+	}
+	if len(got) != 1 || !proto.Equal(got[0], req) {
+		t.Errorf("expected the metrics to be returned unenriched")
+	}
+}
+
+func TestSubsystemLoggerLevel(t *testing.T) {
+	origOutput := logOutput
+	var logs bytes.Buffer
+	logOutput = &logs
+	t.Cleanup(func() { logOutput = origOutput })
+	t.Setenv("LOG_LEVEL_ENRICH", "debug")
+	t.Setenv("LOG_LEVEL_EXPORT", "error")
+	t.Setenv("LOG_LEVEL_CACHE", "verbose")
+
+	logger := newLogger("info").With("aws_request_id", "req-1")
+	logger.Debug("base debug")
+	subsystemLogger(logger, logSubsystemEnrich).Debug("enrich debug")
+	export := subsystemLogger(logger, logSubsystemExport)
+	export.Warn("export warn")
+	export.Error("export error")
+	subsystemLogger(logger, logSubsystemCache).Debug("cache debug")
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %s", line)
+		}
+		if entry["aws_request_id"] != "req-1" {
+			t.Errorf("expected subsystem loggers to keep the logger attributes, got %s", line)
+		}
+		got = append(got, entry["msg"].(string))
+	}
+	// An invalid level is warned about and falls back to LOG_LEVEL.
+	want := []string{"enrich debug", "export error", "Invalid log level, using LOG_LEVEL"}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestLambdaHandlerWarnsInvalidSubsystemLevelOnce(t *testing.T) {
+	orig, origOutput := newTaggingFactory, logOutput
+	newTaggingFactory = func(*slog.Logger, string) (taggingClientFactory, error) {
+		return fixedTaggingFactory{client: &recordingTaggingClient{}}, nil
+	}
+	var logs bytes.Buffer
+	logOutput = &logs
+	t.Cleanup(func() { newTaggingFactory, logOutput = orig, origOutput })
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("FILE_CACHE_ENABLED", "false")
+	t.Setenv("LOG_LEVEL_CACHE", "verbose")
+	t.Setenv("LOG_LEVEL_ENRICH", "verbose")
+
+	var records []events.KinesisFirehoseEventRecord
+	for _, id := range []string{"i-1234567890abcdef0", "i-0fedcba0987654321"} {
+		data, err := requestsIntoRawData([]*metricsservicepb.ExportMetricsServiceRequest{
+			makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10(id)),
+		})
+		if err != nil {
+			t.Fatalf("requestsIntoRawData failed: %v", err)
+		}
+		records = append(records, events.KinesisFirehoseEventRecord{RecordID: id, Data: data})
+	}
+	if _, err := lambdaHandler(context.Background(), events.KinesisFirehoseEvent{Records: records}); err != nil {
+		t.Fatalf("lambdaHandler failed: %v", err)
+	}
+	if got := strings.Count(logs.String(), "Invalid log level"); got != 2 {
+		t.Errorf("expected one invalid log level warning per subsystem and invocation, got %d", got)
+	}
+}
+
+func TestLambdaHandlerLogsRequestID(t *testing.T) {
+	orig, origOutput := newTaggingFactory, logOutput
+	newTaggingFactory = func(*slog.Logger, string) (taggingClientFactory, error) {
+		return brokenTaggingFactory{}, nil
+	}
+	var logs bytes.Buffer
+	logOutput = &logs
+	t.Cleanup(func() { newTaggingFactory, logOutput = orig, origOutput })
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "8476a536-e9f4-11e8-9739-2dfe598c3fcd"})
+	_, err := lambdaHandler(ctx, events.KinesisFirehoseEvent{
+		Records: []events.KinesisFirehoseEventRecord{{RecordID: "rec-1", Data: []byte("not OTLP")}},
+	})
+	if err != nil {
+		t.Fatalf("lambdaHandler failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) == 0 || lines[0] == "" {
+		t.Fatal("expected the handler to log")
+	}
+	for _, line := range lines {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %s", line)
+		}
+		if entry["aws_request_id"] != "8476a536-e9f4-11e8-9739-2dfe598c3fcd" {
+			t.Errorf("expected the request ID on every log line, got %s", line)
+		}
+	}
+}
+
+func TestLambdaHandlerPassesThroughOtherSignals(t *testing.T) {
+	orig := newTaggingFactory
+	newTaggingFactory = func(*slog.Logger, string) (taggingClientFactory, error) {
+		return brokenTaggingFactory{}, nil
+	}
+	t.Cleanup(func() { newTaggingFactory = orig })
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("FIREHOSE_OUTPUT_MODE", outputModeEnhanced)
+	t.Setenv("CONTINUE_ON_EXPORT_FAILURE", "false")
+
+	traces := &tracepb.ExportTraceServiceRequest{ResourceSpans: []*tracev1.ResourceSpans{{
+		ScopeSpans: []*tracev1.ScopeSpans{{Spans: []*tracev1.Span{{
+			TraceId:           []byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+			SpanId:            []byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+			Name:              "GET /",
+			Kind:              tracev1.Span_SPAN_KIND_SERVER,
+			StartTimeUnixNano: 1700000000000000000,
+		}}}},
+	}}}
+	logs := &logspb.ExportLogsServiceRequest{ResourceLogs: []*logsv1.ResourceLogs{{
+		ScopeLogs: []*logsv1.ScopeLogs{{LogRecords: []*logsv1.LogRecord{{
+			TimeUnixNano: 1700000000000000000,
+			Body:         &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "hello"}},
+		}}}},
+	}}}
+
+	var records []events.KinesisFirehoseEventRecord
+	for id, m := range map[string]proto.Message{"traces": traces, "logs": logs} {
+		var b bytes.Buffer
+		if _, err := pbutil.WriteDelimited(&b, m); err != nil {
+			t.Fatalf("WriteDelimited failed: %v", err)
+		}
+		if _, err := rawDataIntoRequests(b.Bytes()); !errors.Is(err, errNotMetrics) {
+			t.Errorf("%s: expected errNotMetrics, got %v", id, err)
+		}
+		records = append(records, events.KinesisFirehoseEventRecord{RecordID: id, Data: b.Bytes()})
+	}
+	out, err := lambdaHandler(context.Background(), events.KinesisFirehoseEvent{Records: records})
+	if err != nil {
+		t.Fatalf("lambdaHandler failed: %v", err)
+	}
+
+	resp := out.(events.KinesisFirehoseResponse)
+	if len(resp.Records) != len(records) {
+		t.Fatalf("expected %d response records, got %d", len(records), len(resp.Records))
+	}
+	for i, r := range resp.Records {
+		decoded, err := base64.StdEncoding.DecodeString(string(r.Data))
+		if err != nil {
+			t.Fatalf("response data is not base64: %v", err)
+		}
+		if r.RecordID != records[i].RecordID || r.Result != events.KinesisFirehoseTransformedStateOk || !bytes.Equal(decoded, records[i].Data) {
+			t.Errorf("%s: expected the record to be passed through untouched, got %+v", records[i].RecordID, r)
+		}
+	}
+}
+
+func TestLambdaHandlerEmitEnricherVersion(t *testing.T) {
+	origFactory, origVersion := newTaggingFactory, version
+	newTaggingFactory = func(*slog.Logger, string) (taggingClientFactory, error) {
+		return brokenTaggingFactory{}, nil
+	}
+	version = "1.2.3-test"
+	t.Cleanup(func() { newTaggingFactory, version = origFactory, origVersion })
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("FIREHOSE_OUTPUT_MODE", outputModeEnhanced)
+	t.Setenv("EMIT_ENRICHER_VERSION", "true")
+
+	// A version left by an earlier enrichment is replaced, not duplicated.
+	req := makeExportRequestOTLP10WithResource("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1234567890abcdef0"), "123456789012", "us-east-1")
+	setEnricherVersion([]*metricsservicepb.ExportMetricsServiceRequest{req}, "0.0.1")
+	data, err := requestsIntoRawData([]*metricsservicepb.ExportMetricsServiceRequest{req})
+	if err != nil {
+		t.Fatalf("requestsIntoRawData failed: %v", err)
+	}
+	out, err := lambdaHandler(context.Background(), events.KinesisFirehoseEvent{
+		Records: []events.KinesisFirehoseEventRecord{{RecordID: "rec-1", Data: data}},
+	})
+	if err != nil {
+		t.Fatalf("lambdaHandler failed: %v", err)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(string(out.(events.KinesisFirehoseResponse).Records[0].Data))
+	if err != nil {
+		t.Fatalf("response data is not base64: %v", err)
+	}
+	got, err := rawDataIntoRequests(decoded)
+	if err != nil {
+		t.Fatalf("rawDataIntoRequests failed: %v", err)
+	}
+	var versions []string
+	for _, kv := range got[0].GetResourceMetrics()[0].GetResource().GetAttributes() {
+		if kv.GetKey() == "enricher_version" {
+			versions = append(versions, kv.GetValue().GetStringValue())
+		}
+	}
+	if len(versions) != 1 || versions[0] != "1.2.3-test" {
+		t.Errorf("enricher_version resource attribute: got %v, want [1.2.3-test]", versions)
+	}
+	if attrs := keyValueToMap(got[0].GetResourceMetrics()[0].GetResource().GetAttributes()); attrs["cloud.account.id"] != "123456789012" {
+		t.Errorf("existing resource attributes should be kept, got %v", attrs)
 	}
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/W0n9/cw-otlp-tag-enricher-otel-grpc/internal/prompb"
+	"github.com/golang/snappy"
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// flatSample is a single value of an enriched metric together with its labels. It is the common
+// representation used by the remote-write and S3 archive outputs.
+type flatSample struct {
+	Name        string            `json:"name"`
+	Labels      map[string]string `json:"labels"`
+	Value       float64           `json:"value"`
+	TimestampMs int64             `json:"timestamp_ms"`
+}
+
+// reservedSampleLabels are the labels flattenSamples and requestsToWriteRequest set themselves.
+var reservedSampleLabels = map[string]bool{"__name__": true, "quantile": true, "le": true}
+
+// flattenSamples converts enriched OTLP metrics into flat samples. Data point attributes (the YACE labels)
+// become labels; attributes with empty string values are dropped, as Prometheus treats an empty label as absent,
+// and so are attributes named __name__, quantile or le, which would clash with the labels set here.
+// Gauges and Sums produce one sample per data point; Summaries produce _sum, _count and quantile-labeled
+// samples, and Histograms and ExponentialHistograms _sum, _count and cumulative le-labeled _bucket samples,
+// like the Prometheus client. Number data points without a value are skipped.
+func flattenSamples(reqs []*metricsservicepb.ExportMetricsServiceRequest) []flatSample {
+	var out []flatSample
+	add := func(name string, attrs []*commonpb.KeyValue, labelKey, labelValue string, value float64, timeUnixNano uint64) {
+		labels := make(map[string]string, len(attrs)+1)
+		for _, a := range attrs {
+			if reservedSampleLabels[a.GetKey()] {
+				continue
+			}
+			if v := anyValueToString(a.GetValue()); v != "" {
+				labels[a.GetKey()] = v
+			}
+		}
+		if labelKey != "" {
+			labels[labelKey] = labelValue
+		}
+		out = append(out, flatSample{
+			Name:        name,
+			Labels:      labels,
+			Value:       value,
+			TimestampMs: int64(timeUnixNano / uint64(time.Millisecond)),
+		})
+	}
+	addHistogram := func(name string, attrs []*commonpb.KeyValue, buckets histogramBuckets, count uint64, sum float64, ts uint64) {
+		var cumulative uint64
+		for i, bound := range buckets.bounds {
+			if i < len(buckets.counts) {
+				cumulative += buckets.counts[i]
+			}
+			add(name+"_bucket", attrs, "le", strconv.FormatFloat(bound, 'g', -1, 64), float64(cumulative), ts)
+		}
+		add(name+"_bucket", attrs, "le", "+Inf", float64(count), ts)
+		add(name+"_sum", attrs, "", "", sum, ts)
+		add(name+"_count", attrs, "", "", float64(count), ts)
+	}
+
+	for _, req := range reqs {
+		for _, rm := range req.GetResourceMetrics() {
+			for _, sm := range rm.GetScopeMetrics() {
+				for _, metric := range sm.GetMetrics() {
+					name := metric.GetName()
+					switch t := metric.Data.(type) {
+					case *metricspb.Metric_Gauge:
+						for _, dp := range t.Gauge.GetDataPoints() {
+							if v, ok := numberValue(dp); ok {
+								add(name, dp.GetAttributes(), "", "", v, dp.GetTimeUnixNano())
+							}
+						}
+					case *metricspb.Metric_Sum:
+						for _, dp := range t.Sum.GetDataPoints() {
+							if v, ok := numberValue(dp); ok {
+								add(name, dp.GetAttributes(), "", "", v, dp.GetTimeUnixNano())
+							}
+						}
+					case *metricspb.Metric_Summary:
+						for _, dp := range t.Summary.GetDataPoints() {
+							ts := dp.GetTimeUnixNano()
+							add(name+"_sum", dp.GetAttributes(), "", "", dp.GetSum(), ts)
+							add(name+"_count", dp.GetAttributes(), "", "", float64(dp.GetCount()), ts)
+							for _, qv := range dp.GetQuantileValues() {
+								add(name, dp.GetAttributes(), "quantile", strconv.FormatFloat(qv.GetQuantile(), 'f', -1, 64), qv.GetValue(), ts)
+							}
+						}
+					case *metricspb.Metric_Histogram:
+						for _, dp := range t.Histogram.GetDataPoints() {
+							buckets := histogramBuckets{bounds: dp.GetExplicitBounds(), counts: dp.GetBucketCounts()}
+							addHistogram(name, dp.GetAttributes(), buckets, dp.GetCount(), dp.GetSum(), dp.GetTimeUnixNano())
+						}
+					case *metricspb.Metric_ExponentialHistogram:
+						for _, dp := range t.ExponentialHistogram.GetDataPoints() {
+							buckets := exponentialHistogramBuckets(dp)
+							addHistogram(name, dp.GetAttributes(), buckets, dp.GetCount(), dp.GetSum(), dp.GetTimeUnixNano())
+						}
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+func numberValue(dp *metricspb.NumberDataPoint) (float64, bool) {
+	switch v := dp.GetValue().(type) {
+	case *metricspb.NumberDataPoint_AsDouble:
+		return v.AsDouble, true
+	case *metricspb.NumberDataPoint_AsInt:
+		return float64(v.AsInt), true
+	default:
+		return 0, false
+	}
+}
+
+// requestsToWriteRequest converts enriched OTLP metrics into a Prometheus remote-write request.
+func requestsToWriteRequest(reqs []*metricsservicepb.ExportMetricsServiceRequest) *prompb.WriteRequest {
+	samples := flattenSamples(reqs)
+	wr := &prompb.WriteRequest{Timeseries: make([]prompb.TimeSeries, 0, len(samples))}
+	for _, fs := range samples {
+		labels := make([]prompb.Label, 0, len(fs.Labels)+1)
+		labels = append(labels, prompb.Label{Name: "__name__", Value: fs.Name})
+		for k, v := range fs.Labels {
+			labels = append(labels, prompb.Label{Name: k, Value: v})
+		}
+		sort.Slice(labels, func(i, j int) bool {
+			return labels[i].Name < labels[j].Name
+		})
+		wr.Timeseries = append(wr.Timeseries, prompb.TimeSeries{
+			Labels:  labels,
+			Samples: []prompb.Sample{{Value: fs.Value, Timestamp: fs.TimestampMs}},
+		})
+	}
+	return wr
+}
+
+// remoteWrite POSTs the snappy-compressed write request to url.
+func remoteWrite(ctx context.Context, client *http.Client, url string, wr *prompb.WriteRequest, timeout time.Duration) error {
+	if len(wr.Timeseries) == 0 {
+		return nil
+	}
+	b, err := wr.Marshal()
+	if err != nil {
+		return err
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(reqCtx, http.MethodPost, url, bytes.NewReader(snappy.Encode(nil, b)))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write to %s failed: %s: %s", url, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/W0n9/cw-otlp-tag-enricher-otel-grpc/internal/prompb"
+	"github.com/golang/snappy"
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// labelsToMap converts Prometheus labels to a map for assertions.
+func labelsToMap(labels []prompb.Label) map[string]string {
+	m := make(map[string]string, len(labels))
+	for _, l := range labels {
+		m[l.Name] = l.Value
+	}
+	return m
+}
+
+func TestRemoteWriteEnrichedGauges(t *testing.T) {
+	attrs := []*commonpb.KeyValue{
+		{Key: "region", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "us-east-1"}}},
+		{Key: "name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "arn:aws:ec2:us-east-1:123456789012:instance/i-1"}}},
+		{Key: "tag_name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "my-instance"}}},
+	}
+	req := &metricsservicepb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Metrics: []*metricspb.Metric{
+					newGauge("aws_ec2_cpuutilization_maximum", 10.0, 2_000_000_000, 0, attrs),
+					newGauge("aws_ec2_cpuutilization_minimum", 2.0, 2_000_000_000, 0, attrs),
+				},
+			}},
+		}},
+	}
+
+	var received prompb.WriteRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Errorf("expected snappy Content-Encoding, got %q", r.Header.Get("Content-Encoding"))
+		}
+		compressed, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read body: %v", err)
+		}
+		b, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("failed to decode snappy body: %v", err)
+		}
+		if err := received.Unmarshal(b); err != nil {
+			t.Errorf("failed to unmarshal write request: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	wr := requestsToWriteRequest([]*metricsservicepb.ExportMetricsServiceRequest{req})
+	if err := remoteWrite(context.Background(), srv.Client(), srv.URL, wr, 5*time.Second); err != nil {
+		t.Fatalf("remoteWrite failed: %v", err)
+	}
+
+	if len(received.Timeseries) != 2 {
+		t.Fatalf("expected 2 time series, got %d", len(received.Timeseries))
+	}
+	expected := map[string]float64{
+		"aws_ec2_cpuutilization_maximum": 10.0,
+		"aws_ec2_cpuutilization_minimum": 2.0,
+	}
+	for _, ts := range received.Timeseries {
+		labels := labelsToMap(ts.Labels)
+		want, ok := expected[labels["__name__"]]
+		if !ok {
+			t.Errorf("unexpected series %v", labels)
+			continue
+		}
+		if labels["region"] != "us-east-1" || labels["tag_name"] != "my-instance" {
+			t.Errorf("series %s: YACE labels not carried over: %v", labels["__name__"], labels)
+		}
+		if len(ts.Samples) != 1 || ts.Samples[0].Value != want || ts.Samples[0].Timestamp != 2000 {
+			t.Errorf("series %s: unexpected samples %+v", labels["__name__"], ts.Samples)
+		}
+		for i := 1; i < len(ts.Labels); i++ {
+			if ts.Labels[i-1].Name >= ts.Labels[i].Name {
+				t.Errorf("series %s: labels are not sorted: %v", labels["__name__"], ts.Labels)
+			}
+		}
+	}
+}
+
+func TestRequestsToWriteRequestSummary(t *testing.T) {
+	req := makeExportRequestWithSummaryData("aws_ec2_cpuutilization", nil, 10, 50.0, map[float64]float64{0.95: 8.0})
+	wr := requestsToWriteRequest([]*metricsservicepb.ExportMetricsServiceRequest{req})
+
+	got := make(map[string]float64)
+	for _, ts := range wr.Timeseries {
+		labels := labelsToMap(ts.Labels)
+		key := labels["__name__"]
+		if q, ok := labels["quantile"]; ok {
+			key += "{quantile=" + q + "}"
+		}
+		got[key] = ts.Samples[0].Value
+	}
+	expected := map[string]float64{
+		"aws_ec2_cpuutilization_sum":            50.0,
+		"aws_ec2_cpuutilization_count":          10.0,
+		"aws_ec2_cpuutilization{quantile=0.95}": 8.0,
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d series, got %v", len(expected), got)
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			t.Errorf("%s: got %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestRequestsToWriteRequestHistogram(t *testing.T) {
+	req := &metricsservicepb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Metrics: []*metricspb.Metric{{
+					Name: "request_duration_seconds",
+					Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+						DataPoints: []*metricspb.HistogramDataPoint{{
+							TimeUnixNano:   uint64(time.Second),
+							Count:          10,
+							Sum:            proto.Float64(42),
+							ExplicitBounds: []float64{1, 5},
+							BucketCounts:   []uint64{2, 3, 5},
+						}},
+					}},
+				}, {
+					Name: "payload_bytes",
+					Data: &metricspb.Metric_ExponentialHistogram{ExponentialHistogram: &metricspb.ExponentialHistogram{
+						DataPoints: []*metricspb.ExponentialHistogramDataPoint{{
+							TimeUnixNano: uint64(time.Second),
+							Count:        3,
+							Sum:          proto.Float64(7),
+							Scale:        0,
+							ZeroCount:    1,
+							Positive:     &metricspb.ExponentialHistogramDataPoint_Buckets{Offset: 0, BucketCounts: []uint64{2}},
+						}},
+					}},
+				}},
+			}},
+		}},
+	}
+	wr := requestsToWriteRequest([]*metricsservicepb.ExportMetricsServiceRequest{req})
+
+	got := make(map[string]float64)
+	for _, ts := range wr.Timeseries {
+		labels := labelsToMap(ts.Labels)
+		key := labels["__name__"]
+		if le, ok := labels["le"]; ok {
+			key += "{le=" + le + "}"
+		}
+		got[key] = ts.Samples[0].Value
+	}
+	expected := map[string]float64{
+		"request_duration_seconds_bucket{le=1}":    2,
+		"request_duration_seconds_bucket{le=5}":    5,
+		"request_duration_seconds_bucket{le=+Inf}": 10,
+		"request_duration_seconds_sum":             42,
+		"request_duration_seconds_count":           10,
+		"payload_bytes_bucket{le=0}":               1,
+		"payload_bytes_bucket{le=2}":               3,
+		"payload_bytes_bucket{le=+Inf}":            3,
+		"payload_bytes_sum":                        7,
+		"payload_bytes_count":                      3,
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d series, got %v", len(expected), got)
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			t.Errorf("%s: got %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestRequestsToWriteRequestReservedAttributes(t *testing.T) {
+	attrs := []*commonpb.KeyValue{
+		{Key: "__name__", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "other"}}},
+		{Key: "quantile", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "0.5"}}},
+		{Key: "region", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "us-east-1"}}},
+	}
+	req := makeExportRequestWithSummaryData("aws_ec2_cpuutilization", attrs, 10, 50.0, map[float64]float64{0.95: 8.0})
+	wr := requestsToWriteRequest([]*metricsservicepb.ExportMetricsServiceRequest{req})
+
+	if len(wr.Timeseries) != 3 {
+		t.Fatalf("expected 3 series, got %d", len(wr.Timeseries))
+	}
+	for _, ts := range wr.Timeseries {
+		seen := make(map[string]bool)
+		for _, l := range ts.Labels {
+			if seen[l.Name] {
+				t.Errorf("duplicate label %q in %v", l.Name, ts.Labels)
+			}
+			seen[l.Name] = true
+		}
+		labels := labelsToMap(ts.Labels)
+		if labels["__name__"] == "other" || labels["quantile"] == "0.5" || labels["region"] != "us-east-1" {
+			t.Errorf("reserved attributes should be dropped and others kept: %v", labels)
+		}
+	}
+}
+
+func TestRemoteWriteErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	wr := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+	}}}
+	if err := remoteWrite(context.Background(), srv.Client(), srv.URL, wr, 5*time.Second); err == nil {
+		t.Fatal("expected error for non-2xx response")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/promutil"
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// resourceInfoMetricName is the name of the EMIT_RESOURCE_INFO info metric.
+const resourceInfoMetricName = "aws_resource_info"
+
+// matchedResources collects the resources associated with a metric during one invocation, per namespace
+// and ARN, for EMIT_RESOURCE_INFO. A nil *matchedResources collects nothing.
+type matchedResources struct {
+	mu          sync.Mutex
+	byNamespace map[string]map[string]*model.TaggedResource
+}
+
+func newMatchedResources() *matchedResources {
+	return &matchedResources{byNamespace: make(map[string]map[string]*model.TaggedResource)}
+}
+
+func (m *matchedResources) add(namespace string, r *model.TaggedResource) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.byNamespace[namespace] == nil {
+		m.byNamespace[namespace] = make(map[string]*model.TaggedResource)
+	}
+	m.byNamespace[namespace][r.ARN] = r
+}
+
+// resourceInfoRequest returns an aws_resource_info gauge of value 1 per matched resource, labeled with its
+// namespace, name and all its tags as tag_* labels, or nil when no resource was matched. Tags are named and
+// normalized as on the enriched metrics, so the info series can be joined on name.
+func resourceInfoRequest(logger *slog.Logger, cfg enhanceConfig, m *matchedResources, now time.Time) *metricsservicepb.ExportMetricsServiceRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ts := uint64(now.UnixNano())
+	strVal := func(s string) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+	}
+	var metrics []*metricspb.Metric
+	for _, ns := range sortedKeys(m.byNamespace) {
+		namespace := ns
+		if cfg.shortNamespace {
+			namespace = strings.TrimPrefix(namespace, "AWS/")
+		}
+		resources := m.byNamespace[ns]
+		for _, arn := range sortedKeys(resources) {
+			r := resources[arn]
+			labels := []*commonpb.KeyValue{
+				{Key: "namespace", Value: strVal(namespace)},
+				{Key: "name", Value: strVal(resourceName(r, cfg.nameFromARN))},
+			}
+			for _, tag := range r.Tags {
+				ok, promTag := promutil.PromStringTag(tag.Key, cfg.labelsSnakeCase)
+				if !ok {
+					logger.Warn("resource tag name is an invalid prometheus label name", "tag", tag.Key)
+					continue
+				}
+				labels = append(labels, &commonpb.KeyValue{Key: "tag_" + promTag, Value: strVal(cfg.tagValues.normalize(tag.Value))})
+			}
+			metrics = append(metrics, newGauge(resourceInfoMetricName, 1, ts, 0, labels))
+		}
+	}
+
+	if len(metrics) == 0 {
+		return nil
+	}
+	return &metricsservicepb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}},
+		}},
+	}
+}
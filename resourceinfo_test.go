@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/job/maxdimassociator"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+)
+
+func TestResourceInfoRequest(t *testing.T) {
+	resources := []*model.TaggedResource{
+		{
+			ARN:       "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0",
+			Namespace: "AWS/EC2",
+			Tags:      []model.Tag{{Key: "Team", Value: "web"}, {Key: "CostCenter", Value: "42"}},
+		},
+		{
+			ARN:       "arn:aws:ec2:us-east-1:123456789012:instance/i-0fedcba0987654321",
+			Namespace: "AWS/EC2",
+			Tags:      []model.Tag{{Key: "Team", Value: "db"}},
+		},
+	}
+	// Two metrics per instance, so each resource is matched twice.
+	var reqs []*metricsservicepb.ExportMetricsServiceRequest
+	for _, id := range []string{"i-1234567890abcdef0", "i-0fedcba0987654321"} {
+		for range 2 {
+			reqs = append(reqs, makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10(id)))
+		}
+	}
+	cfg := enhanceConfig{continueOnResourceFailure: true, labelsSnakeCase: true, matchedResources: newMatchedResources()}
+	err := enhanceRequests(slog.Default(), cfg, reqs, map[string][]*model.TaggedResource{"AWS/EC2": resources},
+		map[string]maxdimassociator.Associator{}, aws.String("us-east-1"), mockTaggingClient{})
+	if err != nil {
+		t.Fatalf("enhanceRequests failed: %v", err)
+	}
+
+	req := resourceInfoRequest(slog.Default(), cfg, cfg.matchedResources, time.Unix(1700000000, 0))
+	if req == nil {
+		t.Fatal("expected a resource info request")
+	}
+	metrics := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()
+	if len(metrics) != len(resources) {
+		t.Fatalf("expected one info series per resource, got %d", len(metrics))
+	}
+	want := map[string]map[string]string{
+		resources[0].ARN: {"namespace": "AWS/EC2", "name": resources[0].ARN, "tag_team": "web", "tag_cost_center": "42"},
+		resources[1].ARN: {"namespace": "AWS/EC2", "name": resources[1].ARN, "tag_team": "db"},
+	}
+	for _, m := range metrics {
+		dp := m.GetGauge().GetDataPoints()[0]
+		labels := keyValueToMap(dp.GetAttributes())
+		if m.GetName() != resourceInfoMetricName || dp.GetAsDouble() != 1 {
+			t.Errorf("expected %s with value 1, got %s = %v", resourceInfoMetricName, m.GetName(), dp.GetAsDouble())
+		}
+		expected := want[labels["name"]]
+		if len(labels) != len(expected) {
+			t.Errorf("%s: got labels %v, want %v", labels["name"], labels, expected)
+			continue
+		}
+		for k, v := range expected {
+			if labels[k] != v {
+				t.Errorf("%s: label %s = %q, want %q", labels["name"], k, labels[k], v)
+			}
+		}
+	}
+
+	if req := resourceInfoRequest(slog.Default(), cfg, newMatchedResources(), time.Now()); req != nil {
+		t.Errorf("expected no request without matched resources, got %v", req)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+)
+
+// defaultRoutingAttribute is the attribute OTEL_ROUTING_RULES values are matched against by default, the
+// account label of enriched data points.
+const defaultRoutingAttribute = "account_id"
+
+// parseRoutingRules parses OTEL_ROUTING_RULES, a JSON object of attribute values to collector addresses,
+// e.g. {"111122223333":"collector-a:4317","444455556666":"collector-b:4317"}. Addresses are normalized
+// like OTEL_EXPORTER_OTLP_ENDPOINT.
+func parseRoutingRules(env string) (map[string]string, error) {
+	if env == "" {
+		return nil, nil
+	}
+	var rules map[string]string
+	if err := json.Unmarshal([]byte(env), &rules); err != nil {
+		return nil, err
+	}
+	for value, endpoint := range rules {
+		if rules[value] = otlpEndpoint("", endpoint); rules[value] == "" {
+			return nil, fmt.Errorf("value %q: empty endpoint", value)
+		}
+	}
+	return rules, nil
+}
+
+// routingClient exports each metric to the client routed from the value of attribute, taken from the
+// resource attributes, then from the metric's first data point carrying it. Metrics whose value has no
+// route, or whose route could not be dialed, go to fallback; when it is nil they are dropped with a debug
+// log, so only failed route exports are errors.
+type routingClient struct {
+	logger    *slog.Logger
+	attribute string
+	routes    map[string]metricsservicepb.MetricsServiceClient
+	fallback  metricsservicepb.MetricsServiceClient
+}
+
+func (c *routingClient) Export(ctx context.Context, in *metricsservicepb.ExportMetricsServiceRequest, opts ...grpc.CallOption) (*metricsservicepb.ExportMetricsServiceResponse, error) {
+	routed := splitByRoute(in, c.attribute, func(value string) bool { return c.routes[value] != nil })
+	var errs []error
+	for _, value := range sortedKeys(routed) {
+		client := c.routes[value]
+		if client == nil {
+			client = c.fallback
+		}
+		if client == nil {
+			c.logger.Debug("Dropping metrics without a route or default OTLP endpoint", "metrics", metricCount(routed[value]))
+			continue
+		}
+		if _, err := client.Export(ctx, routed[value], opts...); err != nil {
+			errs = append(errs, fmt.Errorf("route %q: %w", value, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &metricsservicepb.ExportMetricsServiceResponse{}, nil
+}
+
+// splitByRoute splits in into one request per routed attribute value, keyed "" for the metrics without
+// one. Each request keeps the resources and scopes of its metrics.
+func splitByRoute(in *metricsservicepb.ExportMetricsServiceRequest, attribute string, routed func(string) bool) map[string]*metricsservicepb.ExportMetricsServiceRequest {
+	out := make(map[string]*metricsservicepb.ExportMetricsServiceRequest)
+	for _, rm := range in.GetResourceMetrics() {
+		resourceValue := attrValue(rm.GetResource().GetAttributes(), attribute)
+		resources := make(map[string]*metricspb.ResourceMetrics)
+		for _, sm := range rm.GetScopeMetrics() {
+			scopes := make(map[string]*metricspb.ScopeMetrics)
+			for _, m := range sm.GetMetrics() {
+				value := resourceValue
+				if value == "" {
+					value = metricAttrValue(m, attribute)
+				}
+				if !routed(value) {
+					value = ""
+				}
+				scope := scopes[value]
+				if scope == nil {
+					resource := resources[value]
+					if resource == nil {
+						if out[value] == nil {
+							out[value] = &metricsservicepb.ExportMetricsServiceRequest{}
+						}
+						resource = &metricspb.ResourceMetrics{Resource: rm.Resource, SchemaUrl: rm.SchemaUrl}
+						out[value].ResourceMetrics = append(out[value].ResourceMetrics, resource)
+						resources[value] = resource
+					}
+					scope = &metricspb.ScopeMetrics{Scope: sm.Scope, SchemaUrl: sm.SchemaUrl}
+					resource.ScopeMetrics = append(resource.ScopeMetrics, scope)
+					scopes[value] = scope
+				}
+				scope.Metrics = append(scope.Metrics, m)
+			}
+		}
+	}
+	return out
+}
+
+func metricCount(req *metricsservicepb.ExportMetricsServiceRequest) int {
+	n := 0
+	for _, rm := range req.GetResourceMetrics() {
+		for _, sm := range rm.GetScopeMetrics() {
+			n += len(sm.GetMetrics())
+		}
+	}
+	return n
+}
+
+// metricAttrValue returns the value of key on the first data point of m carrying it.
+func metricAttrValue(m *metricspb.Metric, key string) string {
+	var attrs [][]*commonpb.KeyValue
+	switch t := m.Data.(type) {
+	case *metricspb.Metric_Gauge:
+		for _, dp := range t.Gauge.GetDataPoints() {
+			attrs = append(attrs, dp.GetAttributes())
+		}
+	case *metricspb.Metric_Sum:
+		for _, dp := range t.Sum.GetDataPoints() {
+			attrs = append(attrs, dp.GetAttributes())
+		}
+	case *metricspb.Metric_Summary:
+		for _, dp := range t.Summary.GetDataPoints() {
+			attrs = append(attrs, dp.GetAttributes())
+		}
+	case *metricspb.Metric_Histogram:
+		for _, dp := range t.Histogram.GetDataPoints() {
+			attrs = append(attrs, dp.GetAttributes())
+		}
+	case *metricspb.Metric_ExponentialHistogram:
+		for _, dp := range t.ExponentialHistogram.GetDataPoints() {
+			attrs = append(attrs, dp.GetAttributes())
+		}
+	}
+	for _, a := range attrs {
+		if v := attrValue(a, key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// routedGRPCClient returns a client routing by rules over connections dialed with cfg, and sending the
+// other metrics to fallback. A route that cannot be dialed is logged and falls back for this invocation.
+func routedGRPCClient(logger *slog.Logger, cfg grpcConnConfig, attribute string, rules map[string]string, fallback metricsservicepb.MetricsServiceClient) metricsservicepb.MetricsServiceClient {
+	weightedMu.Lock()
+	defer weightedMu.Unlock()
+
+	client := &routingClient{logger: logger, attribute: attribute, routes: make(map[string]metricsservicepb.MetricsServiceClient, len(rules)), fallback: fallback}
+	for _, value := range sortedKeys(rules) {
+		conn, err := pooledConn(cfg, rules[value])
+		if err != nil {
+			logger.Warn("Failed to connect to routed OTLP endpoint", "value", value, "endpoint", rules[value], "error", err)
+			continue
+		}
+		client.routes[value] = metricsservicepb.NewMetricsServiceClient(conn)
+	}
+	return client
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+)
+
+// requestRecorder records the requests it receives.
+type requestRecorder struct {
+	received []*metricsservicepb.ExportMetricsServiceRequest
+}
+
+func (c *requestRecorder) Export(ctx context.Context, in *metricsservicepb.ExportMetricsServiceRequest, opts ...grpc.CallOption) (*metricsservicepb.ExportMetricsServiceResponse, error) {
+	c.received = append(c.received, in)
+	return &metricsservicepb.ExportMetricsServiceResponse{}, nil
+}
+
+// metricNames returns the names of the metrics received, in order.
+func (c *requestRecorder) metricNames() []string {
+	var names []string
+	for _, req := range c.received {
+		for _, rm := range req.GetResourceMetrics() {
+			for _, sm := range rm.GetScopeMetrics() {
+				for _, m := range sm.GetMetrics() {
+					names = append(names, m.GetName())
+				}
+			}
+		}
+	}
+	return names
+}
+
+func accountGauge(name, account string) *metricspb.Metric {
+	return newGauge(name, 1, 1, 0, []*commonpb.KeyValue{
+		{Key: "account_id", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: account}}},
+	})
+}
+
+func TestRoutingClientRoutesAccounts(t *testing.T) {
+	rules, err := parseRoutingRules(`{"111122223333":"http://team-a:4317","444455556666":"team-b:4317"}`)
+	if err != nil {
+		t.Fatalf("parseRoutingRules failed: %v", err)
+	}
+	if rules["111122223333"] != "team-a:4317" {
+		t.Errorf("expected normalized endpoints, got %v", rules)
+	}
+
+	teamA, teamB, fallback := &requestRecorder{}, &requestRecorder{}, &requestRecorder{}
+	client := &routingClient{
+		logger:    slog.Default(),
+		attribute: defaultRoutingAttribute,
+		routes:    map[string]metricsservicepb.MetricsServiceClient{"111122223333": teamA, "444455556666": teamB},
+		fallback:  fallback,
+	}
+	scope := &commonpb.InstrumentationScope{Name: "enricher"}
+	req := &metricsservicepb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{
+		{ScopeMetrics: []*metricspb.ScopeMetrics{{Scope: scope, Metrics: []*metricspb.Metric{
+			accountGauge("a_cpu", "111122223333"),
+			accountGauge("b_cpu", "444455556666"),
+			accountGauge("other_cpu", "777788889999"),
+			accountGauge("a_network", "111122223333"),
+		}}}},
+		{
+			// The resource attribute routes every metric of the resource.
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				{Key: "account_id", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "444455556666"}}},
+			}},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: []*metricspb.Metric{accountGauge("b_disk", "")}}},
+		},
+	}}
+	if _, err := client.Export(context.Background(), req); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		client *requestRecorder
+		want   []string
+	}{
+		"team-a":   {teamA, []string{"a_cpu", "a_network"}},
+		"team-b":   {teamB, []string{"b_cpu", "b_disk"}},
+		"fallback": {fallback, []string{"other_cpu"}},
+	} {
+		if len(tc.client.received) != 1 {
+			t.Fatalf("%s: expected one request, got %d", name, len(tc.client.received))
+		}
+		if got := tc.client.metricNames(); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: expected %v, got %v", name, tc.want, got)
+		}
+	}
+	if got := teamA.received[0].GetResourceMetrics()[0].GetScopeMetrics()[0].GetScope(); got != scope {
+		t.Errorf("expected the routed metrics to keep their scope, got %v", got)
+	}
+	if got := len(teamB.received[0].GetResourceMetrics()); got != 2 {
+		t.Errorf("expected team-b's metrics to keep their two resources, got %d", got)
+	}
+
+	client.fallback = nil
+	if _, err := client.Export(context.Background(), req); err != nil {
+		t.Errorf("expected unrouted metrics to be dropped without a default endpoint, got %v", err)
+	}
+	if len(teamA.received) != 2 {
+		t.Errorf("expected the routed metrics to be exported anyway, got %d requests", len(teamA.received))
+	}
+
+	for _, env := range []string{`{"111122223333":""}`, `["team-a:4317"]`} {
+		if _, err := parseRoutingRules(env); err == nil {
+			t.Errorf("%s: expected a parse error", env)
+		}
+	}
+}
+
+func TestLambdaHandlerRoutedExportFailure(t *testing.T) {
+	orig := newTaggingFactory
+	newTaggingFactory = func(*slog.Logger, string) (taggingClientFactory, error) {
+		return brokenTaggingFactory{}, nil
+	}
+	t.Cleanup(func() {
+		newTaggingFactory = orig
+		closeWeightedConns(slog.Default())
+	})
+	// The test server implements no service, so every export to it fails.
+	t.Setenv("OTEL_ROUTING_RULES", `{"111122223333":"`+startTestGRPCServer(t)+`"}`)
+	t.Setenv("OTEL_ROUTING_ATTRIBUTE", "cloud.account.id")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("CONTINUE_ON_EXPORT_FAILURE", "false")
+
+	var records []events.KinesisFirehoseEventRecord
+	for i, account := range []string{"444455556666", "111122223333"} {
+		req := makeExportRequestOTLP10WithResource("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1234567890abcdef0"), account, "us-east-1")
+		data, err := requestsIntoRawData([]*metricsservicepb.ExportMetricsServiceRequest{req})
+		if err != nil {
+			t.Fatalf("requestsIntoRawData failed: %v", err)
+		}
+		records = append(records, events.KinesisFirehoseEventRecord{RecordID: account, Data: data})
+		if i == 0 {
+			// A record with only unrouted metrics is dropped from the export without failing.
+			if _, err := lambdaHandler(context.Background(), events.KinesisFirehoseEvent{Records: records}); err != nil {
+				t.Fatalf("expected unrouted metrics to be dropped, got %v", err)
+			}
+		}
+	}
+	if _, err := lambdaHandler(context.Background(), events.KinesisFirehoseEvent{Records: records}); err == nil {
+		t.Error("expected the routed export failure to fail the invocation")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/clients/tagging"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// selfTestNamespace is discovered by the tagging check. Every account running this function has at
+// least the function itself, and an empty result still proves the API is reachable.
+const selfTestNamespace = "AWS/Lambda"
+
+// Check statuses reported by a self-test.
+const (
+	checkOK      = "ok"
+	checkFailed  = "failed"
+	checkSkipped = "skipped"
+)
+
+// selfTestResult is returned instead of a Firehose response when SELF_TEST is set and the event has
+// no records, so a scheduled invocation can back a synthetic alarm on the OK field.
+type selfTestResult struct {
+	OK        bool        `json:"ok"`
+	Tagging   checkResult `json:"tagging"`
+	Collector checkResult `json:"collector"`
+}
+
+type checkResult struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latency_ms"`
+}
+
+func newCheckResult(start time.Time, err error) checkResult {
+	res := checkResult{Status: checkOK, LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		res.Status, res.Error = checkFailed, err.Error()
+	}
+	return res
+}
+
+// runSelfTest checks the tagging API and, when an OTLP endpoint is configured, the collector. A nil
+// tagging client fails the tagging check; without an endpoint the collector check is skipped.
+func runSelfTest(ctx context.Context, logger *slog.Logger, client tagging.Client, region string, connCfg grpcConnConfig) selfTestResult {
+	res := selfTestResult{
+		Tagging:   checkTagging(ctx, client, region, connCfg.timeout),
+		Collector: checkResult{Status: checkSkipped},
+	}
+	if connCfg.endpoint != "" {
+		start := time.Now()
+		conn, err := sharedGRPCConn(connCfg)
+		if err != nil {
+			res.Collector = newCheckResult(start, err)
+		} else {
+			res.Collector = checkCollector(ctx, conn, connCfg.timeout)
+		}
+	}
+	res.OK = res.Tagging.Status == checkOK && res.Collector.Status != checkFailed
+	logger.Info("Self-test finished", "ok", res.OK, "tagging", res.Tagging.Status, "collector", res.Collector.Status)
+	return res
+}
+
+func checkTagging(ctx context.Context, client tagging.Client, region string, timeout time.Duration) checkResult {
+	start := time.Now()
+	if client == nil {
+		return newCheckResult(start, errors.New("tagging client unavailable"))
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_, err := client.GetResources(ctx, model.DiscoveryJob{Namespace: selfTestNamespace}, region)
+	if errors.Is(err, tagging.ErrExpectedToFindResources) {
+		err = nil
+	}
+	return newCheckResult(start, err)
+}
+
+// checkCollector calls the standard gRPC health service. Collectors that do not register it answer
+// Unimplemented, which still proves the endpoint is reachable and speaks gRPC.
+func checkCollector(ctx context.Context, conn grpc.ClientConnInterface, timeout time.Duration) checkResult {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+	switch {
+	case status.Code(err) == codes.Unimplemented:
+		err = nil
+	case err == nil && resp.GetStatus() != healthpb.HealthCheckResponse_SERVING:
+		err = errors.New("collector reported " + resp.GetStatus().String())
+	}
+	return newCheckResult(start, err)
+}
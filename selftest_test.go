@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/clients/tagging"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// stubTaggingClient returns err from every GetResources call.
+type stubTaggingClient struct {
+	err error
+}
+
+func (c stubTaggingClient) GetResources(ctx context.Context, job model.DiscoveryJob, region string) ([]*model.TaggedResource, error) {
+	return nil, c.err
+}
+
+func startHealthServer(t *testing.T, status healthpb.HealthCheckResponse_ServingStatus) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	hs := health.NewServer()
+	hs.SetServingStatus("", status)
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func TestRunSelfTest(t *testing.T) {
+	tests := []struct {
+		name          string
+		client        tagging.Client
+		endpoint      string
+		wantOK        bool
+		wantTagging   string
+		wantCollector string
+	}{
+		{
+			name:          "healthy",
+			client:        stubTaggingClient{err: tagging.ErrExpectedToFindResources},
+			endpoint:      startHealthServer(t, healthpb.HealthCheckResponse_SERVING),
+			wantOK:        true,
+			wantTagging:   checkOK,
+			wantCollector: checkOK,
+		},
+		{
+			name:          "collector without health service",
+			client:        stubTaggingClient{},
+			endpoint:      startTestGRPCServer(t),
+			wantOK:        true,
+			wantTagging:   checkOK,
+			wantCollector: checkOK,
+		},
+		{
+			name:          "collector not serving",
+			client:        stubTaggingClient{},
+			endpoint:      startHealthServer(t, healthpb.HealthCheckResponse_NOT_SERVING),
+			wantTagging:   checkOK,
+			wantCollector: checkFailed,
+		},
+		{
+			name:          "tagging API error without endpoint",
+			client:        stubTaggingClient{err: errors.New("AccessDenied")},
+			wantTagging:   checkFailed,
+			wantCollector: checkSkipped,
+		},
+		{
+			name:          "no tagging client",
+			wantTagging:   checkFailed,
+			wantCollector: checkSkipped,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := grpcConnConfig{endpoint: tt.endpoint, insecure: true, timeout: 2 * time.Second}
+			res := runSelfTest(context.Background(), slog.Default(), tt.client, "us-east-1", cfg)
+			if res.OK != tt.wantOK || res.Tagging.Status != tt.wantTagging || res.Collector.Status != tt.wantCollector {
+				t.Errorf("got %+v, want ok=%v tagging=%s collector=%s", res, tt.wantOK, tt.wantTagging, tt.wantCollector)
+			}
+			if res.Tagging.Status == checkFailed && res.Tagging.Error == "" {
+				t.Errorf("failed tagging check should carry an error")
+			}
+		})
+	}
+}
+
+func TestLambdaHandlerSelfTest(t *testing.T) {
+	orig := newTaggingFactory
+	newTaggingFactory = func(*slog.Logger, string) (taggingClientFactory, error) {
+		return brokenTaggingFactory{}, nil
+	}
+	t.Cleanup(func() { newTaggingFactory = orig })
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("SELF_TEST", "true")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", startHealthServer(t, healthpb.HealthCheckResponse_SERVING))
+
+	out, err := lambdaHandler(context.Background(), events.KinesisFirehoseEvent{})
+	if err != nil {
+		t.Fatalf("lambdaHandler failed: %v", err)
+	}
+	res, ok := out.(selfTestResult)
+	if !ok {
+		t.Fatalf("expected a selfTestResult, got %T", out)
+	}
+	if res.OK || res.Tagging.Status != checkFailed || res.Collector.Status != checkOK {
+		t.Errorf("unexpected self-test result: %+v", res)
+	}
+}
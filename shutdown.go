@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// shutdownFlushTimeout bounds the flush on shutdown, within the time Lambda leaves an execution environment
+// after sending SIGTERM.
+const shutdownFlushTimeout = 400 * time.Millisecond
+
+// shutdown drains the async exports of an invocation still in flight, then closes the shared OTLP
+// connection and the OTEL_ENDPOINT_WEIGHTS and OTEL_ROUTING_RULES ones. Exports not done within timeout
+// are dropped. It runs on SIGTERM, which the Lambda runtime sends before shutting the execution
+// environment down once main enables it.
+func shutdown(logger *slog.Logger, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := flushPendingExports(ctx); err != nil {
+		logger.Error("Failed to flush OTLP exports on shutdown", "error", err)
+	}
+
+	sharedConnMu.Lock()
+	defer sharedConnMu.Unlock()
+	if sharedConn != nil {
+		if err := sharedConn.Close(); err != nil {
+			logger.Warn("Failed to close OTLP connection on shutdown", "error", err)
+		}
+		sharedConn, sharedClient, sharedConnCfg = nil, nil, grpcConnConfig{}
+	}
+	closeWeightedConns(logger)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+)
+
+func TestShutdownFlushesPendingExports(t *testing.T) {
+	var exported atomic.Int32
+	exp := startAsyncExporter(context.Background(), 4, func(ctx context.Context, reqs []*metricsservicepb.ExportMetricsServiceRequest) error {
+		time.Sleep(10 * time.Millisecond)
+		exported.Add(1)
+		return nil
+	})
+	defer exp.stop()
+	for _, id := range []string{"rec-1", "rec-2", "rec-3"} {
+		if err := exp.enqueue(context.Background(), id, nil); err != nil {
+			t.Fatalf("enqueue %s failed: %v", id, err)
+		}
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := grpc.NewServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := sharedGRPCConn(grpcConnConfig{endpoint: lis.Addr().String(), insecure: true, timeout: time.Second})
+	if err != nil {
+		t.Fatalf("sharedGRPCConn failed: %v", err)
+	}
+
+	// Deliver a real SIGTERM and run the shutdown callback on it, as the Lambda runtime does.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("failed to send SIGTERM: %v", err)
+	}
+	select {
+	case <-sig:
+		shutdown(slog.Default(), time.Second)
+	case <-time.After(time.Second):
+		t.Fatal("SIGTERM was not delivered")
+	}
+
+	if got := exported.Load(); got != 3 {
+		t.Errorf("expected the 3 queued exports to be flushed, got %d", got)
+	}
+	if err := exp.enqueue(context.Background(), "rec-4", nil); !errors.Is(err, errExporterStopped) {
+		t.Errorf("expected enqueue after shutdown to fail with errExporterStopped, got %v", err)
+	}
+	if sharedConn != nil || conn.GetState().String() != "SHUTDOWN" {
+		t.Errorf("expected the shared connection to be closed, state %s", conn.GetState())
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+// sigv4Transport signs each request with AWS SigV4 before sending it with next. It is used for
+// collectors and remote-write endpoints (e.g. AMP or API Gateway) that require IAM authentication.
+type sigv4Transport struct {
+	next        http.RoundTripper
+	credentials aws.CredentialsProvider
+	signer      *v4.Signer
+	service     string
+	region      string
+	now         func() time.Time
+}
+
+func newSigV4HTTPClient(ctx context.Context, service, region string) (*http.Client, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: &sigv4Transport{
+		next:        http.DefaultTransport,
+		credentials: cfg.Credentials,
+		signer:      v4.NewSigner(),
+		service:     service,
+		region:      region,
+		now:         time.Now,
+	}}, nil
+}
+
+func (t *sigv4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sum := sha256.Sum256(body)
+
+	creds, err := t.credentials.Retrieve(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	signed := req.Clone(req.Context())
+	signed.Body = io.NopCloser(bytes.NewReader(body))
+	if err := t.signer.SignHTTP(req.Context(), creds, signed, hex.EncodeToString(sum[:]), t.service, t.region, t.now()); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(signed)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/W0n9/cw-otlp-tag-enricher-otel-grpc/internal/prompb"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+func TestSigV4TransportSignsRequest(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	creds := aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+	})
+	client := &http.Client{Transport: &sigv4Transport{
+		next:        http.DefaultTransport,
+		credentials: creds,
+		signer:      v4.NewSigner(),
+		service:     "aps",
+		region:      "us-east-1",
+		now:         func() time.Time { return time.Date(2026, 3, 7, 12, 0, 0, 0, time.UTC) },
+	}}
+
+	wr := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}}}
+	if err := remoteWrite(context.Background(), client, srv.URL, wr, time.Second); err != nil {
+		t.Fatalf("remoteWrite failed: %v", err)
+	}
+
+	auth := got.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20260307/us-east-1/aps/aws4_request") {
+		t.Errorf("unexpected Authorization header: %q", auth)
+	}
+	if got.Get("X-Amz-Date") != "20260307T120000Z" {
+		t.Errorf("unexpected X-Amz-Date header: %q", got.Get("X-Amz-Date"))
+	}
+	if got.Get("Content-Encoding") != "snappy" {
+		t.Errorf("original headers should be preserved, got Content-Encoding %q", got.Get("Content-Encoding"))
+	}
+}
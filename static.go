@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
+)
+
+// staticTaggingClient serves resource discovery from a static inventory instead of the Tagging API, for
+// environments that cannot call it.
+type staticTaggingClient struct {
+	resources []*model.TaggedResource
+}
+
+// GetResources returns the resources of the job's namespace in region. Resources without a region match
+// every region.
+func (c staticTaggingClient) GetResources(_ context.Context, job model.DiscoveryJob, region string) ([]*model.TaggedResource, error) {
+	var out []*model.TaggedResource
+	for _, r := range c.resources {
+		if r.Namespace == job.Namespace && (r.Region == "" || r.Region == region) {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+// The STATIC_RESOURCE_FILE inventory is read once per execution environment and reused by warm invocations.
+var (
+	staticResourcesMu   sync.Mutex
+	staticResourcesPath string
+	staticResources     staticTaggingClient
+)
+
+// loadStaticResources returns the client for the inventory at path, a JSON array of model.TaggedResource
+// objects such as {"ARN":"arn:aws:ec2:...","Namespace":"AWS/EC2","Region":"us-east-1","Tags":[{"Key":"team","Value":"web"}]}.
+// The file is read on first use, then again only when the path changes.
+func loadStaticResources(path string) (staticTaggingClient, error) {
+	staticResourcesMu.Lock()
+	defer staticResourcesMu.Unlock()
+	if staticResourcesPath == path {
+		return staticResources, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return staticTaggingClient{}, err
+	}
+	var resources []*model.TaggedResource
+	if err := json.Unmarshal(data, &resources); err != nil {
+		return staticTaggingClient{}, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	for i, r := range resources {
+		if r == nil || r.ARN == "" || r.Namespace == "" {
+			return staticTaggingClient{}, fmt.Errorf("%s: resource %d has no ARN or Namespace", path, i)
+		}
+	}
+	staticResourcesPath, staticResources = path, staticTaggingClient{resources: resources}
+	return staticResources, nil
+}
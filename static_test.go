@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+)
+
+const staticResourcesJSON = `[
+	{"ARN":"arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0","Namespace":"AWS/EC2","Region":"us-east-1","Tags":[{"Key":"team","Value":"web"}]},
+	{"ARN":"arn:aws:ec2:eu-west-1:123456789012:instance/i-0fedcba0987654321","Namespace":"AWS/EC2","Region":"eu-west-1","Tags":[{"Key":"team","Value":"api"}]}
+]`
+
+func TestLambdaHandlerStaticResourceFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resources.json")
+	if err := os.WriteFile(path, []byte(staticResourcesJSON), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	orig := newTaggingFactory
+	newTaggingFactory = func(*slog.Logger, string) (taggingClientFactory, error) {
+		t.Error("expected the Tagging API not to be used with STATIC_RESOURCE_FILE")
+		return brokenTaggingFactory{}, nil
+	}
+	t.Cleanup(func() {
+		newTaggingFactory = orig
+		staticResourcesPath, staticResources = "", staticTaggingClient{}
+	})
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("FIREHOSE_OUTPUT_MODE", outputModeEnhanced)
+	t.Setenv("FILE_CACHE_ENABLED", "false")
+	t.Setenv("LABELS_SNAKE_CASE", "true")
+	t.Setenv("STATIC_RESOURCE_FILE", path)
+
+	req := makeExportRequestOTLP10("amazonaws.com/AWS/EC2/CPUUtilization", ec2InputAttrsOTLP10("i-1234567890abcdef0"))
+	data, err := requestsIntoRawData([]*metricsservicepb.ExportMetricsServiceRequest{req})
+	if err != nil {
+		t.Fatalf("requestsIntoRawData failed: %v", err)
+	}
+	out, err := lambdaHandler(context.Background(), events.KinesisFirehoseEvent{
+		Records: []events.KinesisFirehoseEventRecord{{RecordID: "rec-1", Data: data}},
+	})
+	if err != nil {
+		t.Fatalf("lambdaHandler failed: %v", err)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(string(out.(events.KinesisFirehoseResponse).Records[0].Data))
+	if err != nil {
+		t.Fatalf("response data is not base64: %v", err)
+	}
+	got, err := rawDataIntoRequests(decoded)
+	if err != nil {
+		t.Fatalf("rawDataIntoRequests failed: %v", err)
+	}
+	labels := keyValueToMap(got[0].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetSummary().GetDataPoints()[0].GetAttributes())
+	if labels["tag_team"] != "web" || labels["name"] != "arn:aws:ec2:us-east-1:123456789012:instance/i-1234567890abcdef0" {
+		t.Errorf("expected the metric to be enriched from the static file, got %v", labels)
+	}
+}
+
+func TestStaticTaggingClient(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resources.json")
+	if err := os.WriteFile(path, []byte(staticResourcesJSON), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	t.Cleanup(func() { staticResourcesPath, staticResources = "", staticTaggingClient{} })
+
+	client, err := loadStaticResources(path)
+	if err != nil {
+		t.Fatalf("loadStaticResources failed: %v", err)
+	}
+	resources, _ := client.GetResources(context.Background(), model.DiscoveryJob{Namespace: "AWS/EC2"}, "eu-west-1")
+	if len(resources) != 1 || resources[0].Tags[0].Value != "api" {
+		t.Errorf("expected the eu-west-1 instance only, got %v", resources)
+	}
+	if resources, _ := client.GetResources(context.Background(), model.DiscoveryJob{Namespace: "AWS/RDS"}, "us-east-1"); len(resources) != 0 {
+		t.Errorf("expected no resources of another namespace, got %v", resources)
+	}
+
+	// The inventory is kept once loaded.
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := loadStaticResources(path); err != nil {
+		t.Errorf("expected the loaded inventory to be reused, got %v", err)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.json")
+	if err := os.WriteFile(bad, []byte(`[{"Namespace":"AWS/EC2"}]`), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := loadStaticResources(bad); err == nil {
+		t.Error("expected an error for a resource without an ARN")
+	}
+}
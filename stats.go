@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/clients/tagging"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// taggingStats accumulates Tagging API latency per namespace over one invocation.
+// It is safe for concurrent use, as namespaces may be prewarmed in parallel.
+type taggingStats struct {
+	mu       sync.Mutex
+	duration map[string]time.Duration
+}
+
+func newTaggingStats() *taggingStats {
+	return &taggingStats{duration: make(map[string]time.Duration)}
+}
+
+func (s *taggingStats) record(namespace string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.duration[namespace] += d
+}
+
+// durations returns a copy of the accumulated latency per namespace.
+func (s *taggingStats) durations() map[string]time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]time.Duration, len(s.duration))
+	for ns, d := range s.duration {
+		out[ns] = d
+	}
+	return out
+}
+
+// enricherStatsRequest returns the invocation's enricher stats, or nil when there are none:
+//   - tagging_api_duration_seconds: Tagging API latency per namespace
+//   - enricher_cached_resources: number of resources cached per namespace at the end of the invocation
+//   - enricher_invocation_duration_seconds: time from started to now, labeled with the function name and
+//     region, the push equivalent of scrape_duration_seconds; omitted when started is zero
+func enricherStatsRequest(stats *taggingStats, resourceCache map[string][]*model.TaggedResource, started, now time.Time, region string) *metricsservicepb.ExportMetricsServiceRequest {
+	ts := uint64(now.UnixNano())
+	var metrics []*metricspb.Metric
+
+	if !started.IsZero() {
+		strVal := func(s string) *commonpb.AnyValue {
+			return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+		}
+		labels := []*commonpb.KeyValue{
+			{Key: "function_name", Value: strVal(lambdacontext.FunctionName)},
+			{Key: "region", Value: strVal(region)},
+		}
+		metrics = append(metrics, newGauge("enricher_invocation_duration_seconds", now.Sub(started).Seconds(), ts, 0, labels))
+	}
+
+	durations := stats.durations()
+	for _, ns := range sortedKeys(durations) {
+		metrics = append(metrics, newGauge("tagging_api_duration_seconds", durations[ns].Seconds(), ts, 0, namespaceLabel(ns)))
+	}
+	for _, key := range sortedKeys(resourceCache) {
+		metrics = append(metrics, newGauge("enricher_cached_resources", float64(len(resourceCache[key])), ts, 0, cacheKeyLabels(key)))
+	}
+
+	if len(metrics) == 0 {
+		return nil
+	}
+	return &metricsservicepb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}},
+		}},
+	}
+}
+
+func namespaceLabel(ns string) []*commonpb.KeyValue {
+	return []*commonpb.KeyValue{
+		{Key: "namespace", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: ns}}},
+	}
+}
+
+// cacheKeyLabels labels a resourceCacheKey with its namespace, plus its region for cross-region keys.
+func cacheKeyLabels(key string) []*commonpb.KeyValue {
+	ns, region, ok := strings.Cut(key, "@")
+	labels := namespaceLabel(ns)
+	if ok {
+		labels = append(labels, &commonpb.KeyValue{Key: "region", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: region}}})
+	}
+	return labels
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// timedTaggingClient records the latency of every GetResources call in stats.
+type timedTaggingClient struct {
+	client tagging.Client
+	stats  *taggingStats
+}
+
+func (c timedTaggingClient) GetResources(ctx context.Context, job model.DiscoveryJob, region string) ([]*model.TaggedResource, error) {
+	start := time.Now()
+	defer func() {
+		c.stats.record(job.Namespace, time.Since(start))
+	}()
+	return c.client.GetResources(ctx, job, region)
+}
+
+// logTaggingStats logs the Tagging API latency of each namespace discovered during the invocation.
+func logTaggingStats(logger *slog.Logger, stats *taggingStats) {
+	for ns, d := range stats.durations() {
+		logger.Info("Tagging API latency", "namespace", ns, "duration_seconds", d.Seconds())
+	}
+}
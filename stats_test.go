@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
+)
+
+// slowTaggingClient sleeps before returning no resources.
+type slowTaggingClient struct {
+	delay time.Duration
+}
+
+func (c slowTaggingClient) GetResources(ctx context.Context, job model.DiscoveryJob, region string) ([]*model.TaggedResource, error) {
+	time.Sleep(c.delay)
+	return nil, nil
+}
+
+func TestTimedTaggingClientRecordsLatency(t *testing.T) {
+	stats := newTaggingStats()
+	client := timedTaggingClient{client: slowTaggingClient{delay: 20 * time.Millisecond}, stats: stats}
+
+	if _, err := retrieveResources("AWS/EC2", aws.String("us-east-1"), nil, client, false); err != nil {
+		t.Fatalf("retrieveResources failed: %v", err)
+	}
+	if _, err := retrieveResources("AWS/RDS", aws.String("us-east-1"), nil, client, false); err != nil {
+		t.Fatalf("retrieveResources failed: %v", err)
+	}
+
+	durations := stats.durations()
+	for _, ns := range []string{"AWS/EC2", "AWS/RDS"} {
+		if durations[ns] < 20*time.Millisecond {
+			t.Errorf("%s: expected at least 20ms, got %s", ns, durations[ns])
+		}
+	}
+
+	req := enricherStatsRequest(stats, nil, time.Time{}, time.Unix(1, 0), "us-east-1")
+	metrics := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 gauges, got %d", len(metrics))
+	}
+	dp := metrics[0].GetGauge().GetDataPoints()[0]
+	if metrics[0].GetName() != "tagging_api_duration_seconds" {
+		t.Errorf("metric name: got %q", metrics[0].GetName())
+	}
+	if got := keyValueToMap(dp.GetAttributes())["namespace"]; got != "AWS/EC2" {
+		t.Errorf("namespace label: got %q, want AWS/EC2", got)
+	}
+	if dp.GetAsDouble() < 0.02 {
+		t.Errorf("expected at least 0.02s, got %v", dp.GetAsDouble())
+	}
+}
+
+func TestEnricherStatsEmpty(t *testing.T) {
+	if req := enricherStatsRequest(newTaggingStats(), map[string][]*model.TaggedResource{}, time.Time{}, time.Now(), "us-east-1"); req != nil {
+		t.Errorf("expected no stats request when nothing was recorded, got %v", req)
+	}
+}
+
+func TestEnricherStatsCachedResources(t *testing.T) {
+	resourceCache := map[string][]*model.TaggedResource{
+		"AWS/EC2": {{ARN: "arn:aws:ec2:us-east-1:123456789012:instance/i-1"}, {ARN: "arn:aws:ec2:us-east-1:123456789012:instance/i-2"}},
+		"AWS/RDS": {},
+	}
+	req := enricherStatsRequest(newTaggingStats(), resourceCache, time.Time{}, time.Unix(1, 0), "us-east-1")
+	got := make(map[string]float64)
+	for _, m := range req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics() {
+		if m.GetName() != "enricher_cached_resources" {
+			t.Errorf("unexpected metric %q", m.GetName())
+			continue
+		}
+		dp := m.GetGauge().GetDataPoints()[0]
+		got[keyValueToMap(dp.GetAttributes())["namespace"]] = dp.GetAsDouble()
+	}
+	if len(got) != 2 || got["AWS/EC2"] != 2 || got["AWS/RDS"] != 0 {
+		t.Errorf("enricher_cached_resources: got %v, want AWS/EC2=2 AWS/RDS=0", got)
+	}
+}
+
+func TestEnricherStatsInvocationDuration(t *testing.T) {
+	origName := lambdacontext.FunctionName
+	lambdacontext.FunctionName = "cw-otlp-tag-enricher"
+	t.Cleanup(func() { lambdacontext.FunctionName = origName })
+
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	started := clock.Now()
+	clock.now = clock.now.Add(1500 * time.Millisecond)
+
+	req := enricherStatsRequest(newTaggingStats(), nil, started, clock.Now(), "us-east-1")
+	metrics := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()
+	if len(metrics) != 1 || metrics[0].GetName() != "enricher_invocation_duration_seconds" {
+		t.Fatalf("expected only the invocation duration gauge, got %v", metrics)
+	}
+	dp := metrics[0].GetGauge().GetDataPoints()[0]
+	if dp.GetAsDouble() != 1.5 {
+		t.Errorf("expected 1.5s, got %v", dp.GetAsDouble())
+	}
+	if dp.GetTimeUnixNano() != uint64(clock.Now().UnixNano()) {
+		t.Errorf("expected the gauge at the end of the invocation, got %d", dp.GetTimeUnixNano())
+	}
+	labels := keyValueToMap(dp.GetAttributes())
+	if labels["function_name"] != "cw-otlp-tag-enricher" || labels["region"] != "us-east-1" {
+		t.Errorf("expected function_name and region labels, got %v", labels)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// lastValueState holds the last exported value of each gauge series for DELTA_SUPPRESSION. Like sumState it
+// lives at package level so warm invocations compare against the previous one; a cold start or a different
+// container starts empty, so suppression is a heuristic on Lambda and some unchanged values are still exported.
+type lastValueState struct {
+	mu   sync.Mutex
+	last map[uint64]float64
+}
+
+func newLastValueState() *lastValueState {
+	return &lastValueState{last: make(map[uint64]float64)}
+}
+
+var deltaSuppressionState = newLastValueState()
+
+// suppressRequests removes, in place, gauge data points whose value is unchanged since the last one seen
+// for their series, and returns how many were dropped. Series are identified as for Sum temporality, by
+// resource, metric name and attributes. Gauges left without data points are removed.
+func (s *lastValueState) suppressRequests(reqs []*metricsservicepb.ExportMetricsServiceRequest) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dropped := 0
+	for _, req := range reqs {
+		for _, rm := range req.GetResourceMetrics() {
+			var resourceKey []byte
+			if res := rm.GetResource(); res != nil {
+				resourceKey, _ = attributeKey(res)
+			}
+			for _, sm := range rm.GetScopeMetrics() {
+				kept := sm.Metrics[:0]
+				for _, metric := range sm.GetMetrics() {
+					if gauge := metric.GetGauge(); gauge != nil {
+						dropped += s.suppressGauge(resourceKey, metric.GetName(), gauge)
+						if len(gauge.DataPoints) == 0 {
+							continue
+						}
+					}
+					kept = append(kept, metric)
+				}
+				sm.Metrics = kept
+			}
+		}
+	}
+	return dropped
+}
+
+func (s *lastValueState) suppressGauge(resourceKey []byte, name string, gauge *metricspb.Gauge) int {
+	dropped := 0
+	kept := gauge.DataPoints[:0]
+	for _, dp := range gauge.GetDataPoints() {
+		v, ok := numberValue(dp)
+		if !ok {
+			kept = append(kept, dp)
+			continue
+		}
+		key := seriesKey(resourceKey, name, dp.Attributes)
+		if prev, seen := s.last[key]; seen && prev == v {
+			dropped++
+			continue
+		}
+		s.last[key] = v
+		kept = append(kept, dp)
+	}
+	gauge.DataPoints = kept
+	return dropped
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+func makeGaugeRequest(value float64, ts uint64) *metricsservicepb.ExportMetricsServiceRequest {
+	attrs := []*commonpb.KeyValue{
+		{Key: "name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "arn:aws:ec2:us-east-1:123456789012:instance/i-1"}}},
+	}
+	return &metricsservicepb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Metrics: []*metricspb.Metric{newGauge("aws_ec2_cpuutilization_average", value, ts, 0, attrs)},
+			}},
+		}},
+	}
+}
+
+func TestDeltaSuppression(t *testing.T) {
+	s := newLastValueState()
+	for i, tc := range []struct {
+		value    float64
+		exported bool
+	}{
+		{value: 10, exported: true},
+		{value: 10, exported: false},
+		{value: 12, exported: true},
+		{value: 10, exported: true},
+	} {
+		req := makeGaugeRequest(tc.value, uint64(i+1))
+		dropped := s.suppressRequests([]*metricsservicepb.ExportMetricsServiceRequest{req})
+		metrics := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()
+		if exported := len(metrics) == 1; exported != tc.exported {
+			t.Errorf("point %d (value %v): exported = %v, want %v", i, tc.value, exported, tc.exported)
+		}
+		if wantDropped := map[bool]int{true: 0, false: 1}[tc.exported]; dropped != wantDropped {
+			t.Errorf("point %d: dropped = %d, want %d", i, dropped, wantDropped)
+		}
+	}
+}
+
+func TestDeltaSuppressionIgnoresOtherMetricTypes(t *testing.T) {
+	s := newLastValueState()
+	for i := 0; i < 2; i++ {
+		req := makeSumRequest(metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA, 5, 0, uint64(i+1))
+		if dropped := s.suppressRequests([]*metricsservicepb.ExportMetricsServiceRequest{req}); dropped != 0 || sumOf(req) == nil {
+			t.Fatalf("invocation %d: Sum metrics should not be suppressed, dropped %d", i, dropped)
+		}
+	}
+}
+
+func TestDeltaSuppressionKeepsResourceAttributeOrder(t *testing.T) {
+	strKV := func(k, v string) *commonpb.KeyValue {
+		return &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}}
+	}
+	s := newLastValueState()
+	first := makeGaugeRequest(10, 1)
+	first.ResourceMetrics[0].Resource = &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+		strKV("cloud.region", "us-east-1"), strKV("cloud.account.id", "123456789012"),
+	}}
+	s.suppressRequests([]*metricsservicepb.ExportMetricsServiceRequest{first})
+	if got := first.GetResourceMetrics()[0].GetResource().GetAttributes()[0].GetKey(); got != "cloud.region" {
+		t.Errorf("expected the resource attribute order to be preserved, first key is %q", got)
+	}
+
+	// The same resource with its attributes in another order is the same series.
+	second := makeGaugeRequest(10, 2)
+	second.ResourceMetrics[0].Resource = &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+		strKV("cloud.account.id", "123456789012"), strKV("cloud.region", "us-east-1"),
+	}}
+	if dropped := s.suppressRequests([]*metricsservicepb.ExportMetricsServiceRequest{second}); dropped != 1 {
+		t.Errorf("expected the unchanged point to be suppressed, dropped %d", dropped)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strings"
+	"sync"
+
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// parseSumTemporality parses SUM_TEMPORALITY. It returns false for passthrough (or unset), meaning
+// Sum metrics are left untouched.
+func parseSumTemporality(env string) (metricspb.AggregationTemporality, bool, error) {
+	switch strings.ToLower(env) {
+	case "", "passthrough":
+		return metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED, false, nil
+	case "delta":
+		return metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA, true, nil
+	case "cumulative":
+		return metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, true, nil
+	default:
+		return metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED, false, fmt.Errorf("unknown SUM_TEMPORALITY %q", env)
+	}
+}
+
+// sumPoint is the last value seen for a Sum series.
+type sumPoint struct {
+	value     float64
+	startTime uint64
+	time      uint64
+}
+
+// sumState holds the per-series state needed to convert Sum temporality. It lives at package level so warm
+// invocations continue from the previous one; a cold start loses it, so conversion is best-effort on Lambda.
+type sumState struct {
+	mu   sync.Mutex
+	last map[uint64]sumPoint
+}
+
+func newSumState() *sumState {
+	return &sumState{last: make(map[uint64]sumPoint)}
+}
+
+var sumTemporalityState = newSumState()
+
+// convertRequests rewrites Sum metrics to the target temporality in place and returns how many data points
+// were dropped. Sums with unspecified temporality are only relabeled. Cumulative to delta diffs each point
+// against the previous one of the same series; the first point of a series, and points after a counter reset,
+// have no previous value and are dropped. Delta to cumulative keeps a running total per series. In both
+// directions, points not newer than the last one of their series are dropped.
+func (s *sumState) convertRequests(reqs []*metricsservicepb.ExportMetricsServiceRequest, target metricspb.AggregationTemporality) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dropped := 0
+	for _, req := range reqs {
+		for _, rm := range req.GetResourceMetrics() {
+			var resourceKey []byte
+			if res := rm.GetResource(); res != nil {
+				resourceKey, _ = attributeKey(res)
+			}
+			for _, sm := range rm.GetScopeMetrics() {
+				kept := sm.Metrics[:0]
+				for _, metric := range sm.GetMetrics() {
+					if sum := metric.GetSum(); sum != nil {
+						dropped += s.convertSum(resourceKey, metric.GetName(), sum, target)
+						if len(sum.DataPoints) == 0 {
+							continue
+						}
+					}
+					kept = append(kept, metric)
+				}
+				sm.Metrics = kept
+			}
+		}
+	}
+	return dropped
+}
+
+func (s *sumState) convertSum(resourceKey []byte, name string, sum *metricspb.Sum, target metricspb.AggregationTemporality) int {
+	from := sum.GetAggregationTemporality()
+	if from == target {
+		return 0
+	}
+	sum.AggregationTemporality = target
+	if from == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED {
+		return 0
+	}
+
+	dropped := 0
+	kept := sum.DataPoints[:0]
+	for _, dp := range sum.GetDataPoints() {
+		v, ok := numberValue(dp)
+		if !ok {
+			dropped++
+			continue
+		}
+		key := seriesKey(resourceKey, name, dp.Attributes)
+		prev, seen := s.last[key]
+		cur := sumPoint{value: v, startTime: dp.GetStartTimeUnixNano(), time: dp.GetTimeUnixNano()}
+
+		if target == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA {
+			s.last[key] = cur
+			if !seen || v < prev.value || cur.startTime != prev.startTime || cur.time <= prev.time {
+				dropped++
+				continue
+			}
+			setNumberValue(dp, v-prev.value)
+			dp.StartTimeUnixNano = prev.time
+		} else {
+			if seen {
+				if cur.time <= prev.time {
+					dropped++
+					continue
+				}
+				cur = sumPoint{value: prev.value + v, startTime: prev.startTime, time: cur.time}
+			}
+			s.last[key] = cur
+			setNumberValue(dp, cur.value)
+			dp.StartTimeUnixNano = cur.startTime
+		}
+		kept = append(kept, dp)
+	}
+	sum.DataPoints = kept
+	return dropped
+}
+
+// seriesKey identifies a series by resource, metric name and attributes (order-normalized on a copy, so
+// the data point keeps its label order).
+func seriesKey(resourceKey []byte, name string, attrs []*commonpb.KeyValue) uint64 {
+	attrs = slices.Clone(attrs)
+	sortAttributes(attrs)
+	h := fnv.New64a()
+	h.Write(resourceKey)
+	h.Write([]byte{0})
+	h.Write([]byte(name))
+	for _, a := range attrs {
+		b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(a)
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	return h.Sum64()
+}
+
+// setNumberValue sets v on dp, keeping integer data points integer.
+func setNumberValue(dp *metricspb.NumberDataPoint, v float64) {
+	if _, ok := dp.GetValue().(*metricspb.NumberDataPoint_AsInt); ok {
+		dp.Value = &metricspb.NumberDataPoint_AsInt{AsInt: int64(v)}
+		return
+	}
+	dp.Value = &metricspb.NumberDataPoint_AsDouble{AsDouble: v}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	metricsservicepb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+func makeSumRequest(temporality metricspb.AggregationTemporality, value float64, start, ts uint64) *metricsservicepb.ExportMetricsServiceRequest {
+	return &metricsservicepb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Metrics: []*metricspb.Metric{{
+					Name: "requests_total",
+					Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+						AggregationTemporality: temporality,
+						IsMonotonic:            true,
+						DataPoints: []*metricspb.NumberDataPoint{{
+							Attributes: []*commonpb.KeyValue{
+								{Key: "name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "arn:aws:ec2:us-east-1:123456789012:instance/i-1"}}},
+							},
+							StartTimeUnixNano: start,
+							TimeUnixNano:      ts,
+							Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+						}},
+					}},
+				}},
+			}},
+		}},
+	}
+}
+
+func sumOf(req *metricsservicepb.ExportMetricsServiceRequest) *metricspb.Sum {
+	metrics := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()
+	if len(metrics) == 0 {
+		return nil
+	}
+	return metrics[0].GetSum()
+}
+
+func TestParseSumTemporality(t *testing.T) {
+	for _, env := range []string{"", "passthrough", "PassThrough"} {
+		if _, convert, err := parseSumTemporality(env); convert || err != nil {
+			t.Errorf("%q: expected passthrough, got convert=%v err=%v", env, convert, err)
+		}
+	}
+	if target, convert, _ := parseSumTemporality("delta"); !convert || target != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA {
+		t.Errorf("delta: got %v, %v", target, convert)
+	}
+	if _, _, err := parseSumTemporality("rate"); err == nil {
+		t.Error("expected an error for an unknown temporality")
+	}
+}
+
+func TestSumTemporalityRelabelOnly(t *testing.T) {
+	delta := metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	for _, from := range []metricspb.AggregationTemporality{
+		metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED,
+		delta,
+	} {
+		req := makeSumRequest(from, 5, 100, 200)
+		if dropped := newSumState().convertRequests([]*metricsservicepb.ExportMetricsServiceRequest{req}, delta); dropped != 0 {
+			t.Errorf("%v: expected no dropped points, got %d", from, dropped)
+		}
+		sum := sumOf(req)
+		if sum.GetAggregationTemporality() != delta {
+			t.Errorf("%v: temporality got %v, want delta", from, sum.GetAggregationTemporality())
+		}
+		dp := sum.GetDataPoints()[0]
+		if dp.GetAsDouble() != 5 || dp.GetStartTimeUnixNano() != 100 {
+			t.Errorf("%v: relabeling should not change values, got %v from %d", from, dp.GetAsDouble(), dp.GetStartTimeUnixNano())
+		}
+	}
+}
+
+func TestSumTemporalityCumulativeToDelta(t *testing.T) {
+	cumulative := metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	delta := metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	state := newSumState()
+
+	// The first point has no previous value to diff against.
+	first := makeSumRequest(cumulative, 10, 100, 200)
+	if dropped := state.convertRequests([]*metricsservicepb.ExportMetricsServiceRequest{first}, delta); dropped != 1 {
+		t.Errorf("expected the first point to be dropped, got %d", dropped)
+	}
+	if sumOf(first) != nil {
+		t.Error("expected the Sum metric without data points to be removed")
+	}
+
+	// A later invocation with warm state produces the increase since the previous point.
+	second := makeSumRequest(cumulative, 25, 100, 300)
+	state.convertRequests([]*metricsservicepb.ExportMetricsServiceRequest{second}, delta)
+	dp := sumOf(second).GetDataPoints()[0]
+	if dp.GetAsDouble() != 15 || dp.GetStartTimeUnixNano() != 200 || dp.GetTimeUnixNano() != 300 {
+		t.Errorf("unexpected delta point: value=%v start=%d time=%d", dp.GetAsDouble(), dp.GetStartTimeUnixNano(), dp.GetTimeUnixNano())
+	}
+
+	// A counter reset restarts the series.
+	reset := makeSumRequest(cumulative, 3, 350, 400)
+	if dropped := state.convertRequests([]*metricsservicepb.ExportMetricsServiceRequest{reset}, delta); dropped != 1 {
+		t.Errorf("expected the point after a reset to be dropped, got %d", dropped)
+	}
+}
+
+func TestSumTemporalityDeltaToCumulative(t *testing.T) {
+	delta := metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	cumulative := metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	state := newSumState()
+
+	var got []float64
+	for i, v := range []float64{4, 6, 5} {
+		req := makeSumRequest(delta, v, uint64(100*(i+1)), uint64(100*(i+2)))
+		state.convertRequests([]*metricsservicepb.ExportMetricsServiceRequest{req}, cumulative)
+		dp := sumOf(req).GetDataPoints()[0]
+		if dp.GetStartTimeUnixNano() != 100 {
+			t.Errorf("point %d: start time got %d, want the first point's 100", i, dp.GetStartTimeUnixNano())
+		}
+		got = append(got, dp.GetAsDouble())
+	}
+	want := []float64{4, 10, 15}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("running totals: got %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestSumTemporalityKeepsAttributeOrder(t *testing.T) {
+	cumulative := metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	delta := metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	strKV := func(k, v string) *commonpb.KeyValue {
+		return &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}}
+	}
+	request := func(value float64, ts uint64, attrs ...*commonpb.KeyValue) *metricsservicepb.ExportMetricsServiceRequest {
+		req := makeSumRequest(cumulative, value, 100, ts)
+		req.ResourceMetrics[0].Resource = &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+			strKV("cloud.region", "us-east-1"), strKV("cloud.account.id", "123456789012"),
+		}}
+		sumOf(req).DataPoints[0].Attributes = attrs
+		return req
+	}
+	keys := func(attrs []*commonpb.KeyValue) []string {
+		var out []string
+		for _, a := range attrs {
+			out = append(out, a.GetKey())
+		}
+		return out
+	}
+
+	state := newSumState()
+	state.convertRequests([]*metricsservicepb.ExportMetricsServiceRequest{request(10, 200, strKV("name", "i-1"), strKV("dimension_instance_id", "i-1"))}, delta)
+	// The same series with its attributes in another order is diffed against the first point.
+	second := request(25, 300, strKV("dimension_instance_id", "i-1"), strKV("name", "i-1"))
+	state.convertRequests([]*metricsservicepb.ExportMetricsServiceRequest{second}, delta)
+
+	dp := sumOf(second).GetDataPoints()[0]
+	if dp.GetAsDouble() != 15 {
+		t.Errorf("expected the reordered series to be diffed, got %v", dp.GetAsDouble())
+	}
+	if got := keys(dp.GetAttributes()); !slices.Equal(got, []string{"dimension_instance_id", "name"}) {
+		t.Errorf("expected the data point attribute order to be preserved, got %v", got)
+	}
+	if got := keys(second.GetResourceMetrics()[0].GetResource().GetAttributes()); !slices.Equal(got, []string{"cloud.region", "cloud.account.id"}) {
+		t.Errorf("expected the resource attribute order to be preserved, got %v", got)
+	}
+}